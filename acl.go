@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Parses a comma-separated list of addresses and prefixes like 203.0.113.0/24,2001:db8::1
+func parseClientPrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("'%s' is not an address or prefix", entry)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Parses per tunnel client lists like 22=203.0.113.0/24,2001:db8::/32;443=198.51.100.7 keyed by source port
+func parseTunnelClients(variable, value string, srcPorts []string) (map[string][]netip.Prefix, error) {
+	clients := make(map[string][]netip.Prefix)
+	err := parsePortValues(variable, value, srcPorts, func(port, value string) error {
+		prefixes, err := parseClientPrefixes(value)
+		if err != nil {
+			return err
+		}
+		if len(prefixes) == 0 {
+			return fmt.Errorf("source port %s has no addresses", port)
+		}
+		clients[port] = prefixes
+		return nil
+	})
+	return clients, err
+}
+
+// Formats prefixes like they are configured, single addresses without their prefix length
+func formatClientPrefixes(prefixes []netip.Prefix) []string {
+	formatted := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			formatted = append(formatted, prefix.Addr().String())
+		} else {
+			formatted = append(formatted, prefix.String())
+		}
+	}
+	return formatted
+}
+
+// Reports whether a client may connect to a tunnel. Denied prefixes win, an empty allow list admits everybody else.
+// Clients of unix sockets don't have an IP, they only pass tunnels without an allow list.
+func admitsClient(allowed, denied []netip.Prefix, clientIP string) bool {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return len(allowed) == 0
+	}
+
+	addr = addr.Unmap()
+	contains := func(prefix netip.Prefix) bool { return prefix.Contains(addr) }
+	if slices.ContainsFunc(denied, contains) {
+		return false
+	}
+	return len(allowed) == 0 || slices.ContainsFunc(allowed, contains)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAdmitsClient(t *testing.T) {
+	mustPrefixes := func(list string) []netip.Prefix {
+		prefixes, err := parseClientPrefixes(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+	allowed := mustPrefixes("203.0.113.0/24, 198.51.100.7, 2001:db8::/32")
+	denied := mustPrefixes("203.0.113.128/25")
+
+	tests := []struct {
+		name            string
+		allowed, denied []netip.Prefix
+		client          string
+		want            bool
+	}{
+		{"no acl", nil, nil, "192.0.2.1", true},
+		{"allowed prefix", allowed, nil, "203.0.113.5", true},
+		{"allowed address", allowed, nil, "198.51.100.7", true},
+		{"mapped address", allowed, nil, "::ffff:198.51.100.7", true},
+		{"allowed ipv6", allowed, nil, "2001:db8::1", true},
+		{"not allowed", allowed, nil, "198.51.100.8", false},
+		{"denied wins", allowed, denied, "203.0.113.200", false},
+		{"allowed next to denied", allowed, denied, "203.0.113.5", true},
+		{"only denied", nil, denied, "192.0.2.1", true},
+		{"only denied match", nil, denied, "203.0.113.200", false},
+		{"unix client with allow list", allowed, nil, "", false},
+		{"unix client with deny list", nil, denied, "", true},
+	}
+	for _, test := range tests {
+		if got := admitsClient(test.allowed, test.denied, test.client); got != test.want {
+			t.Errorf("%s: admitsClient(%q) = %v, want %v", test.name, test.client, got, test.want)
+		}
+	}
+}
+
+func TestParseTunnelClients(t *testing.T) {
+	clients, err := parseTunnelClients("TUNNEL_ALLOWED_CLIENTS", "22=203.0.113.0/24,198.51.100.7", []string{"22", "443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatClientPrefixes(clients["22"]); len(got) != 2 || got[0] != "203.0.113.0/24" || got[1] != "198.51.100.7" {
+		t.Errorf("clients = %v", got)
+	}
+	for _, value := range []string{"22=example.com", "22=", "80=192.0.2.1"} {
+		if _, err := parseTunnelClients("TUNNEL_ALLOWED_CLIENTS", value, []string{"22"}); err == nil {
+			t.Errorf("%q was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Anything in an update body that might be an IPv6 address, optionally with a zone.
+// Candidates are validated with netip, so this only needs to find them.
+var addressCandidate = regexp.MustCompile(`[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*(%[0-9A-Za-z_.-]+)?`)
+
+// Limits the candidates searched in a body, so a body full of colons can't make an update slow
+const maxAddressCandidates = 64
+
+// Parses an address the way updates send it, with optional brackets and zone identifier
+func parseIPv6Candidate(candidate string) (netip.Addr, bool) {
+	candidate = strings.TrimSuffix(strings.TrimPrefix(candidate, "["), "]")
+	candidate = strings.TrimRight(candidate, ".")
+
+	addr, err := netip.ParseAddr(candidate)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone(""), true
+}
+
+// Returns why the address can't be a relay target, or nil if it can
+func (config *Config) checkAddressScope(addr netip.Addr) error {
+	if config.WebhookAllowLocalAddresses {
+		return nil
+	}
+
+	switch {
+	case addr.IsUnspecified():
+		return fmt.Errorf("%s is the unspecified address", addr)
+	case addr.IsLoopback():
+		return fmt.Errorf("%s is a loopback address", addr)
+	case addr.IsLinkLocalUnicast():
+		return fmt.Errorf("%s is a link-local address", addr)
+	case addr.IsMulticast():
+		return fmt.Errorf("%s is a multicast address", addr)
+	}
+	return nil
+}
+
+// Finds the IPv6 address in an unstructured update body. Local addresses are skipped,
+// and several different addresses are rejected or resolved depending on WEBHOOK_MULTIPLE_ADDRESSES.
+func (config *Config) findIPv6Address(body string) (netip.Addr, error) {
+	var addresses []netip.Addr
+	var skipped error
+	for _, candidate := range addressCandidate.FindAllString(body, maxAddressCandidates) {
+		addr, ok := parseIPv6Candidate(candidate)
+		if !ok {
+			continue
+		}
+		if err := config.checkAddressScope(addr); err != nil {
+			skipped = err
+			continue
+		}
+		if !containsAddr(addresses, addr) {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	switch {
+	case len(addresses) == 0 && skipped != nil:
+		return netip.Addr{}, fmt.Errorf("the body only contained unusable IPv6 addresses: %v", skipped)
+	case len(addresses) == 0:
+		return netip.Addr{}, errors.New("the body did not contain an IPv6 address")
+	case len(addresses) == 1:
+		return addresses[0], nil
+	case config.WebhookMultipleAddresses == "reject":
+		return netip.Addr{}, fmt.Errorf("the body contained %d different IPv6 addresses", len(addresses))
+	}
+
+	// Prefer a global unicast address over unique local and, if allowed, local ones
+	for _, addr := range addresses {
+		if addr.IsGlobalUnicast() && !addr.IsPrivate() {
+			return addr, nil
+		}
+	}
+	return addresses[0], nil
+}
+
+func containsAddr(addresses []netip.Addr, addr netip.Addr) bool {
+	for _, existing := range addresses {
+		if existing == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Dials the WEBHOOK_VERIFY_PORTS on a new address in parallel. It passes as soon as one of them
+// accepts a connection, so a single service being down doesn't block address changes.
+func (config *Config) verifyAddress(ipv6Address string) error {
+	results := make(chan error, len(config.WebhookVerifyPorts))
+	for _, port := range config.WebhookVerifyPorts {
+		go func() {
+			_, err := checkTunnel(ipv6Address, port, config.HealthTimeout)
+			results <- err
+		}()
+	}
+
+	var errs []error
+	for range config.WebhookVerifyPorts {
+		err := <-results
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Parses WEBHOOK_VERIFY_PORTS, every port has to be a destination port
+func parseVerifyPorts(value string, destPorts []string) ([]string, error) {
+	var ports []string
+	for _, port := range strings.Split(value, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		if _, err := parsePort(port); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(destPorts, port) {
+			return nil, fmt.Errorf("port %s is not a destination port", port)
+		}
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// Parses WEBHOOK_MULTIPLE_ADDRESSES
+func parseMultipleAddresses(mode string) (string, error) {
+	switch mode {
+	case "prefer-global", "reject":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode '%s', expected prefer-global or reject", mode)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Heartbeat is sent periodically by the home-side agent to the relay
+type Heartbeat struct {
+	Hostname        string        `json:"hostname"`
+	Interface       string        `json:"interface,omitempty"`
+	Kernel          string        `json:"kernel"`
+	Addresses       []AddressInfo `json:"addresses"`
+	IntervalSeconds int           `json:"interval_seconds"`
+	SentAt          time.Time     `json:"sent_at"`
+}
+
+// AddressInfo describes a global IPv6 address of the agent host.
+// Lifetimes are in seconds, -1 means forever and a missing value means the platform doesn't expose them.
+type AddressInfo struct {
+	Address           string `json:"address"`
+	Interface         string `json:"interface"`
+	PreferredLifetime *int64 `json:"preferred_lifetime,omitempty"`
+	ValidLifetime     *int64 `json:"valid_lifetime,omitempty"`
+}
+
+// AgentConfig holds the configuration of the home-side agent
+type AgentConfig struct {
+	RelayURL string
+	Token    string
+	// Signs the requests for relays with an hmac step
+	HMACSecret string
+	Interface  string
+	Interval   time.Duration
+	DataDir    string
+
+	// Control channel to the relay, used instead of RelayURL when set
+	ControlAddr   string
+	ControlKey    string
+	ReportAddress bool
+}
+
+func newAgentConfigFromEnv() (*AgentConfig, error) {
+	relayURL := os.Getenv("RELAY_URL")
+	token := os.Getenv("WEBHOOK_TOKEN")
+	controlAddr := os.Getenv("RELAY_CONTROL_ADDR")
+	controlKey := os.Getenv("RELAY_CONTROL_KEY")
+
+	if controlAddr != "" {
+		if controlKey == "" {
+			return nil, fmt.Errorf("RELAY_CONTROL_KEY environment variable not set")
+		}
+	} else {
+		if relayURL == "" {
+			return nil, fmt.Errorf("RELAY_URL environment variable not set")
+		}
+		if token == "" && os.Getenv("WEBHOOK_HMAC_SECRET") == "" {
+			return nil, fmt.Errorf("WEBHOOK_TOKEN environment variable not set")
+		}
+	}
+
+	interval, err := time.ParseDuration(parseConfigEnv("HEARTBEAT_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid HEARTBEAT_INTERVAL: %v", err)
+	}
+
+	return &AgentConfig{
+		RelayURL:      strings.TrimSuffix(relayURL, "/"),
+		Token:         token,
+		HMACSecret:    os.Getenv("WEBHOOK_HMAC_SECRET"),
+		Interface:     os.Getenv("AGENT_INTERFACE"),
+		Interval:      interval,
+		DataDir:       parseConfigEnv("AGENT_DATA_DIR", "data"),
+		ControlAddr:   controlAddr,
+		ControlKey:    controlKey,
+		ReportAddress: parseConfigEnv("AGENT_REPORT_ADDRESS", "false") == "true",
+	}, nil
+}
+
+// Collects the metadata of the local host for a heartbeat
+func collectHeartbeat(agent *AgentConfig) (*Heartbeat, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := interfaceAddresses(agent.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Heartbeat{
+		Hostname:        hostname,
+		Interface:       agent.Interface,
+		Kernel:          kernelVersion(),
+		Addresses:       addresses,
+		IntervalSeconds: int(agent.Interval.Seconds()),
+		SentAt:          time.Now().UTC(),
+	}, nil
+}
+
+func sendHeartbeat(client *http.Client, agent *AgentConfig, heartbeat *Heartbeat) error {
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, agent.RelayURL+"/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if agent.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", agent.Token))
+	}
+	signRequest(req, agent.HMACSecret, body)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Picks the address the relay should forward to. Unique local addresses are skipped
+// and the address that stays preferred the longest wins.
+func preferredAddress(addresses []AddressInfo) string {
+	var best *AddressInfo
+	for i, addr := range addresses {
+		ip := net.ParseIP(addr.Address)
+		if ip == nil || ip.IsPrivate() {
+			continue
+		}
+		if best == nil || lifetimeLonger(addr.PreferredLifetime, best.PreferredLifetime) {
+			best = &addresses[i]
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.Address
+}
+
+// Compares two lifetimes where nil means unknown and -1 means forever
+func lifetimeLonger(a, b *int64) bool {
+	switch {
+	case a == nil:
+		return false
+	case b == nil:
+		return true
+	case *b == -1:
+		return false
+	case *a == -1:
+		return true
+	default:
+		return *a > *b
+	}
+}
+
+// Sets up the sender for the heartbeats, either the control channel or the HTTP endpoint
+func newHeartbeatSender(agent *AgentConfig, logger *slog.Logger) (func(heartbeat *Heartbeat) error, error) {
+	if agent.ControlAddr == "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		return func(heartbeat *Heartbeat) error {
+			return sendHeartbeat(client, agent, heartbeat)
+		}, nil
+	}
+
+	key, err := loadOrCreateControlKey(agent.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Using the control channel, pin this key on the relay", slog.String("fingerprint", keyFingerprint(key.Public().(ed25519.PublicKey))))
+
+	tlsConfig, err := pinnedTLSConfig(key, []string{agent.ControlKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(heartbeat *Heartbeat) error {
+		msg := &controlMessage{Heartbeat: heartbeat}
+		if agent.ReportAddress {
+			msg.IPv6Address = preferredAddress(heartbeat.Addresses)
+		}
+		return sendControlMessage(agent.ControlAddr, tlsConfig, msg)
+	}, nil
+}
+
+// Runs the home-side agent which sends heartbeats to the relay until the process is stopped
+func runAgent() error {
+	agent, err := newAgentConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	relay := agent.RelayURL
+	if agent.ControlAddr != "" {
+		relay = agent.ControlAddr
+	}
+	logger := slog.Default().With(slog.String("relay", relay))
+
+	send, err := newHeartbeatSender(agent, logger)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Starting agent", slog.Duration("interval", agent.Interval))
+	for {
+		heartbeat, err := collectHeartbeat(agent)
+		if err != nil {
+			logger.Error("Failed to collect heartbeat", slog.Any("error", err))
+		} else if err := send(heartbeat); err != nil {
+			logger.Warn("Failed to send heartbeat", slog.Any("error", err))
+		} else {
+			logger.Debug("Sent heartbeat", slog.Int("addresses", len(heartbeat.Addresses)))
+		}
+
+		time.Sleep(agent.Interval)
+	}
+}
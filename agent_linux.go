@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The kernel reports infinite lifetimes as 0xffffffff
+const infiniteLifetime = ^uint32(0)
+
+func kernelVersion() string {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "linux"
+	}
+	return "linux " + strings.TrimSpace(string(release))
+}
+
+// Lists the global IPv6 addresses including their lifetimes using netlink
+func interfaceAddresses(ifName string) ([]AddressInfo, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []AddressInfo{}
+	for _, msg := range msgs {
+		if msg.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		// struct ifaddrmsg: family, prefixlen, flags, scope (1 byte each), index (4 bytes)
+		if msg.Header.Type != syscall.RTM_NEWADDR || len(msg.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		if msg.Data[3] != syscall.RT_SCOPE_UNIVERSE {
+			continue
+		}
+
+		iface, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(msg.Data[4:8])))
+		if err != nil || (ifName != "" && iface.Name != ifName) {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, err
+		}
+
+		info := AddressInfo{Interface: iface.Name}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				info.Address = net.IP(attr.Value).String()
+			case syscall.IFA_CACHEINFO:
+				// struct ifa_cacheinfo: preferred, valid, cstamp, tstamp (4 bytes each)
+				if len(attr.Value) >= 8 {
+					info.PreferredLifetime = lifetimeSeconds(binary.NativeEndian.Uint32(attr.Value[0:4]))
+					info.ValidLifetime = lifetimeSeconds(binary.NativeEndian.Uint32(attr.Value[4:8]))
+				}
+			}
+		}
+
+		if info.Address != "" {
+			addresses = append(addresses, info)
+		}
+	}
+
+	return addresses, nil
+}
+
+func lifetimeSeconds(value uint32) *int64 {
+	seconds := int64(value)
+	if value == infiniteLifetime {
+		seconds = -1
+	}
+	return &seconds
+}
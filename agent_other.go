@@ -0,0 +1,42 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"runtime"
+)
+
+func kernelVersion() string {
+	return runtime.GOOS
+}
+
+// Lists the global IPv6 addresses. Lifetimes are not available on this platform.
+func interfaceAddresses(ifName string) ([]AddressInfo, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []AddressInfo{}
+	for _, iface := range ifaces {
+		if ifName != "" && iface.Name != ifName {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			addresses = append(addresses, AddressInfo{Address: ipNet.IP.String(), Interface: iface.Name})
+		}
+	}
+
+	return addresses, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Alert is a condition found by the /alerts endpoint
+type Alert struct {
+	// tunnel_down, update_stale, pool_exhausted or latency_slo
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Tunnel   string `json:"tunnel,omitempty"`
+	Pool     string `json:"pool,omitempty"`
+	// When the condition started, not known for every alert
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// AlertsResponse is the response of the /alerts endpoint
+type AlertsResponse struct {
+	Firing      []Alert   `json:"firing"`
+	EvaluatedAt time.Time `json:"evaluated_at"`
+}
+
+// Ports of a pool that are in use, named after the variable that configures the pool
+type portPoolUsage struct {
+	name       string
+	used, size int
+}
+
+// Checks the built-in alert conditions against the ALERT_* thresholds
+func (config *Config) evaluateAlerts(now time.Time) []Alert {
+	alerts := []Alert{}
+
+	if config.AlertTunnelDownAfter > 0 {
+		statuses, _ := config.health.snapshot()
+		for _, status := range statuses {
+			if status.IPv6Alive {
+				continue
+			}
+			name := tunnelName(status.IPv4Port, status.IPv6Port)
+			health, ok := config.health.tunnelHealth(name)
+			if !ok || now.Sub(health.Since) < config.AlertTunnelDownAfter {
+				continue
+			}
+			alerts = append(alerts, Alert{
+				Name:     "tunnel_down",
+				Severity: "critical",
+				Tunnel:   name,
+				Message:  config.maskText(fmt.Sprintf("Tunnel %s is down for %s: %s", name, now.Sub(health.Since).Round(time.Second), health.LastError)),
+				Since:    &health.Since,
+			})
+		}
+	}
+
+	if config.AlertUpdateStaleAfter > 0 {
+		// Without an update since the start, the age counts from the start
+		last := config.startedAt.UTC()
+		if updates := config.history.list(); len(updates) > 0 && updates[0].Time.After(last) {
+			last = updates[0].Time
+		}
+		if now.Sub(last) >= config.AlertUpdateStaleAfter {
+			alerts = append(alerts, Alert{
+				Name:     "update_stale",
+				Severity: "warning",
+				Message:  fmt.Sprintf("No address update for %s", now.Sub(last).Round(time.Second)),
+				Since:    &last,
+			})
+		}
+	}
+
+	if config.AlertPoolUsage > 0 {
+		var pools []portPoolUsage
+		if config.ephemeral != nil {
+			pools = append(pools, config.ephemeral.usage())
+		}
+		if config.ftp != nil {
+			pools = append(pools, config.ftp.usage())
+		}
+		if config.sip != nil {
+			pools = append(pools, config.sip.usage())
+		}
+		for _, pool := range pools {
+			if pool.used*100 < config.AlertPoolUsage*pool.size {
+				continue
+			}
+			alerts = append(alerts, Alert{
+				Name:     "pool_exhausted",
+				Severity: "warning",
+				Pool:     pool.name,
+				Message:  fmt.Sprintf("%d of %d ports of %s are in use", pool.used, pool.size, pool.name),
+			})
+		}
+	}
+
+	for i, ipv4Port := range config.IPv4Ports {
+		latency := config.latencySLOs[ipv4Port].status()
+		if latency == nil || !latency.Degraded {
+			continue
+		}
+		name := tunnelName(ipv4Port, config.IPv6Ports[i])
+		message := fmt.Sprintf("Tunnel %s exceeds its latency SLO of %s", name, latency.SLO)
+		if latency.P90Milliseconds != nil {
+			message += fmt.Sprintf(", the 90th percentile is %dms", *latency.P90Milliseconds)
+		}
+		alerts = append(alerts, Alert{Name: "latency_slo", Severity: "warning", Tunnel: name, Message: message})
+	}
+
+	return alerts
+}
+
+// Provides the alerts that are currently firing, an empty list if everything is fine
+func alertsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AlertsResponse{Firing: config.evaluateAlerts(now), EvaluatedAt: now})
+	}
+}
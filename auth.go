@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Groups of HTTP endpoints that are protected by the same chain, configured with AUTH_<GROUP>
+const (
+	// /update and /heartbeat, called by the router or the agent
+	authGroupUpdate = "update"
+	// /tunnels/..., changes the tunnels
+	authGroupAdmin = "admin"
+	// /status, /history, /dns, /stats, /alerts, /debug/tuning and the dashboard
+	authGroupStatus = "status"
+	// /health and its sub paths, called by uptime monitors and orchestrators
+	authGroupHealth = "health"
+)
+
+// Chains of the groups unless configured otherwise, which is how the endpoints were always protected
+var defaultAuthChains = map[string]string{
+	authGroupUpdate: "token",
+	authGroupAdmin:  "token",
+	authGroupStatus: "none",
+	authGroupHealth: "none",
+}
+
+// Header with the HMAC-SHA256 signature of the request body, like GitHub's webhooks
+const signatureHeader = "X-Signature-256"
+
+// Upper bound of remembered clients per rate limit, the ones with a full bucket are dropped first
+const maxAuthRateLimitClients = 4096
+
+// A step of a chain, it writes the error response and returns false if the request must not pass
+type authStep func(w http.ResponseWriter, r *http.Request) bool
+
+// The steps a request of an endpoint group has to pass, in order
+type authChain struct {
+	steps []authStep
+	// Whether a step checks the bearer token, WEBHOOK_TOKEN must be set then
+	token bool
+}
+
+// Chains keyed by endpoint group
+type authChains map[string]*authChain
+
+// Parses AUTH_UPDATE, AUTH_ADMIN, AUTH_STATUS and AUTH_HEALTH and the settings of the steps they use
+func parseAuthChains(config *Config, env configEnv) (authChains, error) {
+	var hmacSecret []byte
+	if secret := env("WEBHOOK_HMAC_SECRET"); secret != "" {
+		hmacSecret = []byte(secret)
+	}
+
+	allowed, err := parseClientPrefixes(env("AUTH_ALLOWED_IPS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTH_ALLOWED_IPS: %v", err)
+	}
+
+	requests, per, err := parseRequestRate(env.parse("AUTH_RATE_LIMIT", "60/1m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTH_RATE_LIMIT: %v", err)
+	}
+
+	allowUnauthenticatedUpdates := env.parse("AUTH_ALLOW_UNAUTHENTICATED_UPDATES", "false") == "true"
+	allowUnauthenticatedAdmin := env.parse("AUTH_ALLOW_UNAUTHENTICATED_ADMIN", "false") == "true"
+
+	chains := make(authChains)
+	for _, group := range []string{authGroupUpdate, authGroupAdmin, authGroupStatus, authGroupHealth} {
+		variable := "AUTH_" + strings.ToUpper(group)
+		chain := &authChain{}
+		authenticated := false
+		for _, name := range strings.Split(env.parse(variable, defaultAuthChains[group]), ",") {
+			switch name = strings.TrimSpace(name); name {
+			case "none", "":
+			case "token":
+				chain.steps = append(chain.steps, tokenAuthStep(config))
+				chain.token, authenticated = true, true
+			case "hmac":
+				if hmacSecret == nil {
+					return nil, fmt.Errorf("invalid %s: hmac needs WEBHOOK_HMAC_SECRET", variable)
+				}
+				chain.steps = append(chain.steps, hmacAuthStep(hmacSecret))
+				authenticated = true
+			case "mtls":
+				if config.webhookTLS == nil || config.webhookTLS.ClientCAs == nil {
+					return nil, fmt.Errorf("invalid %s: mtls needs WEBHOOK_TLS_CERT, WEBHOOK_TLS_KEY and WEBHOOK_TLS_CLIENT_CA", variable)
+				}
+				chain.steps = append(chain.steps, mtlsAuthStep())
+				authenticated = true
+			case "allowlist":
+				if len(allowed) == 0 {
+					return nil, fmt.Errorf("invalid %s: allowlist needs AUTH_ALLOWED_IPS", variable)
+				}
+				chain.steps = append(chain.steps, allowlistAuthStep(allowed))
+				authenticated = true
+			case "ratelimit":
+				chain.steps = append(chain.steps, newAuthRateLimit(requests, per).step)
+			default:
+				return nil, fmt.Errorf("invalid %s: unknown step '%s', must be token, hmac, mtls, allowlist, ratelimit or none", variable, name)
+			}
+		}
+		// Whoever can send updates decides where the tunnels go, a forgotten token must not open that to everyone
+		if group == authGroupUpdate && !authenticated && !allowUnauthenticatedUpdates {
+			return nil, fmt.Errorf("invalid %s: anyone could change the target address, add a token, hmac, mtls or allowlist step or set AUTH_ALLOW_UNAUTHENTICATED_UPDATES=true", variable)
+		}
+		// The admin endpoints open new public ports and change the client ACLs, that's no less dangerous
+		if group == authGroupAdmin && !authenticated && !allowUnauthenticatedAdmin {
+			return nil, fmt.Errorf("invalid %s: anyone could use the admin endpoints, add a token, hmac, mtls or allowlist step or set AUTH_ALLOW_UNAUTHENTICATED_ADMIN=true", variable)
+		}
+		chains[group] = chain
+	}
+	return chains, nil
+}
+
+// Reports if a chain checks the bearer token
+func (chains authChains) usesToken() bool {
+	for _, chain := range chains {
+		if chain.token {
+			return true
+		}
+	}
+	return false
+}
+
+// Protects the handler with the chain of the group
+func (chains authChains) wrap(group string, next http.HandlerFunc) http.Handler {
+	chain := chains[group]
+	if chain == nil || len(chain.steps) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, step := range chain.steps {
+			if !step(w, r) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Checks the bearer token of a request
+func (config *Config) isAuthorized(r *http.Request) bool {
+	expected := "Bearer " + config.WebhookToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// Requires the webhook token
+func tokenAuthStep(config *Config) authStep {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if config.isAuthorized(r) {
+			return true
+		}
+		loggerFromContext(r.Context()).Warn("Rejected request with an invalid token", slog.String("path", r.URL.Path))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+}
+
+// Requires an HMAC-SHA256 signature of the body made with the secret, as sha256=<hex> in the signature header
+func hmacAuthStep(secret []byte) authStep {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		logger := loggerFromContext(r.Context())
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpdateBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Invalid request: the body is too large.", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return false
+		}
+		// The handler reads the body again
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte(bodySignature(secret, body))) {
+			return true
+		}
+		logger.Warn("Rejected request with an invalid signature", slog.String("path", r.URL.Path))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+}
+
+// Returns the value of the signature header for the body
+func bodySignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds the signature header for relays with an hmac step, nothing happens without a secret
+func signRequest(req *http.Request, secret string, body []byte) {
+	if secret != "" {
+		req.Header.Set(signatureHeader, bodySignature([]byte(secret), body))
+	}
+}
+
+// Requires a client certificate signed by WEBHOOK_TLS_CLIENT_CA
+func mtlsAuthStep() authStep {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			return true
+		}
+		loggerFromContext(r.Context()).Warn("Rejected request without a valid client certificate", slog.String("path", r.URL.Path))
+		http.Error(w, "Unauthorized: a client certificate is required", http.StatusUnauthorized)
+		return false
+	}
+}
+
+// Requires a client address in one of the prefixes
+func allowlistAuthStep(allowed []netip.Prefix) authStep {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if addr, ok := remoteAddr(r); ok {
+			for _, prefix := range allowed {
+				if prefix.Contains(addr) {
+					return true
+				}
+			}
+		}
+		loggerFromContext(r.Context()).Warn("Rejected request from an address that is not allowed", slog.String("path", r.URL.Path))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+}
+
+// Returns the unmapped address of the client
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// Parses a request rate like 60/1m
+func parseRequestRate(value string) (int, time.Duration, error) {
+	count, period, ok := strings.Cut(value, "/")
+	requests, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || err != nil || requests <= 0 {
+		return 0, 0, fmt.Errorf("'%s' is not a rate like 60/1m", value)
+	}
+	per, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("'%s' is not a rate like 60/1m", value)
+	}
+	return requests, per, nil
+}
+
+// Token buckets of the clients of an endpoint group, the bucket holds up to a period worth of requests
+type authRateLimit struct {
+	requests float64
+	per      time.Duration
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*requestBucket
+}
+
+type requestBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAuthRateLimit(requests int, per time.Duration) *authRateLimit {
+	return &authRateLimit{requests: float64(requests), per: per, clients: make(map[netip.Addr]*requestBucket)}
+}
+
+// Takes a request from the bucket of the client, returns how long to wait if it's empty
+func (limit *authRateLimit) take(addr netip.Addr) (time.Duration, bool) {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	now := time.Now()
+	rate := limit.requests / limit.per.Seconds()
+	if len(limit.clients) >= maxAuthRateLimitClients {
+		for client, bucket := range limit.clients {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= limit.requests {
+				delete(limit.clients, client)
+			}
+		}
+	}
+
+	bucket, ok := limit.clients[addr]
+	if !ok {
+		bucket = &requestBucket{tokens: limit.requests, last: now}
+		limit.clients[addr] = bucket
+	}
+	bucket.tokens = min(bucket.tokens+now.Sub(bucket.last).Seconds()*rate, limit.requests)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+func (limit *authRateLimit) step(w http.ResponseWriter, r *http.Request) bool {
+	addr, _ := remoteAddr(r)
+	wait, ok := limit.take(addr)
+	if ok {
+		return true
+	}
+	loggerFromContext(r.Context()).Warn("Rejected request over the rate limit", slog.String("path", r.URL.Path))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// Loads the certificate of the webhook server and the CA of the client certificates, returns nil if TLS is disabled
+func loadWebhookTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("WEBHOOK_TLS_CLIENT_CA needs WEBHOOK_TLS_CERT and WEBHOOK_TLS_KEY")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadClientCAs("WEBHOOK_TLS_CLIENT_CA", clientCAFile); err != nil {
+			return nil, err
+		}
+		// Only the groups with an mtls step require a certificate
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// Loads the CA certificates the client certificates must be signed by
+func loadClientCAs(variable, file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s %s contains no certificate", variable, file)
+	}
+	return pool, nil
+}
+
+// Wraps the webhook listener with TLS if it's enabled
+func (config *Config) webhookListener(listener net.Listener) net.Listener {
+	if config.webhookTLS == nil {
+		return listener
+	}
+	return tls.NewListener(listener, config.webhookTLS)
+}
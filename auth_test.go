@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns a configEnv that reads from the map instead of the environment
+func mapEnv(values map[string]string) configEnv {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestParseAuthChainsUpdateGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+		token   bool
+	}{
+		{name: "defaults", env: map[string]string{}, token: true},
+		{name: "none", env: map[string]string{"AUTH_UPDATE": "none"}, wantErr: "AUTH_ALLOW_UNAUTHENTICATED_UPDATES"},
+		{name: "only ratelimit", env: map[string]string{"AUTH_UPDATE": "ratelimit"}, wantErr: "anyone could change the target address"},
+		{name: "none allowed", env: map[string]string{"AUTH_UPDATE": "none", "AUTH_ALLOW_UNAUTHENTICATED_UPDATES": "true", "AUTH_ADMIN": "none", "AUTH_ALLOW_UNAUTHENTICATED_ADMIN": "true"}},
+		{name: "admin none", env: map[string]string{"AUTH_ADMIN": "none"}, wantErr: "AUTH_ALLOW_UNAUTHENTICATED_ADMIN"},
+		{name: "admin only ratelimit", env: map[string]string{"AUTH_ADMIN": "ratelimit"}, wantErr: "anyone could use the admin endpoints"},
+		{name: "admin allowed updates not", env: map[string]string{"AUTH_UPDATE": "none", "AUTH_ALLOW_UNAUTHENTICATED_ADMIN": "true"}, wantErr: "AUTH_ALLOW_UNAUTHENTICATED_UPDATES"},
+		{name: "hmac without token", env: map[string]string{"AUTH_UPDATE": "ratelimit,hmac", "WEBHOOK_HMAC_SECRET": "s", "AUTH_ADMIN": "allowlist", "AUTH_ALLOWED_IPS": "127.0.0.1"}},
+		{name: "token for admin only", env: map[string]string{"AUTH_UPDATE": "allowlist", "AUTH_ALLOWED_IPS": "2001:db8::/56"}, token: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chains, err := parseAuthChains(&Config{}, mapEnv(test.env))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want it to mention %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chains.usesToken() != test.token {
+				t.Errorf("usesToken() = %v, want %v", chains.usesToken(), test.token)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Shared address space of carrier-grade NAT (RFC 6598)
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// Explains why the IPv4 address of the home network can't be reached from the internet, empty if nothing
+// points to NAT. The client is the address the update came from, wan the IPv4 address the router reported
+// for its uplink, if any.
+func detectCGNAT(client, wan netip.Addr) string {
+	switch {
+	case client.Is4() && cgnatPrefix.Contains(client):
+		return fmt.Sprintf("the update came from %s, an address of the carrier-grade NAT range %s", client, cgnatPrefix)
+	case !wan.IsValid():
+		return ""
+	case cgnatPrefix.Contains(wan):
+		return fmt.Sprintf("the router's IPv4 address %s is in the carrier-grade NAT range %s", wan, cgnatPrefix)
+	case wan.IsPrivate():
+		return fmt.Sprintf("the router's IPv4 address %s is private, another NAT sits between it and the internet", wan)
+	// Clients in the local network or behind a reverse proxy don't tell anything about the uplink
+	case client.Is4() && client.IsGlobalUnicast() && !client.IsPrivate() && client != wan:
+		return fmt.Sprintf("the router reports %s but the update came from %s, the provider translates the IPv4 connection", wan, client)
+	}
+	return ""
+}
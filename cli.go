@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands of the binary, serve is the default
+const cliUsage = `Usage: four2six [flags] [command]
+
+Commands:
+  serve                 Run the relay (default)
+  check-config          Validate the configuration and print the tunnels
+  update-ip <address>   Store a new target address, or send it to RELAY_URL if set
+  export <format>       Print the tunnels as haproxy or nginx configuration
+  replay <recording>... Send recorded webhook requests to RELAY_URL again
+  agent                 Run the home-side agent
+  knock <host:port>     Send an SPA packet that opens the gated tunnels of a relay for this host, or the IP given after it
+
+Every flag mirrors the environment variable of the same name, e.g. --webhook-token sets WEBHOOK_TOKEN.
+Flags take precedence over the environment and can be given before or after the command.
+
+Flags:
+`
+
+// configVariable is an environment variable that can also be set with a flag
+type configVariable struct {
+	name        string
+	boolean     bool
+	description string
+}
+
+// All environment variables of the relay and the agent, in the order of the README
+var configVariables = []configVariable{
+	{"WEBHOOK_TOKEN", false, "Authentication token for the /update endpoint"},
+	{"RELAYS", false, "Comma-separated names of several relays run by one process, configured with RELAY_<NAME>_<VARIABLE>"},
+	{"RELAY_NAME", false, "Relay of RELAYS the export and update-ip commands work on"},
+	{"DEST_PORTS", false, "Comma-separated list of destination ports and port ranges"},
+	{"SRC_PORTS", false, "Comma-separated list of source ports and port ranges"},
+	{"PORT_MAPPINGS", false, "Semicolon-separated mapping expressions, replaces SRC_PORTS and DEST_PORTS if set"},
+	{"SRC_LISTEN_ADDR", false, "Interface address for incoming traffic"},
+	{"TUNNEL_LISTEN_ADDRS", false, "Semicolon-separated per-tunnel listen addresses keyed by source port"},
+	{"UNIX_SOCKET_MODE", false, "File permissions of unix socket listeners"},
+	{"WEBHOOK_LISTEN_ADDR", false, "Interface address for HTTP endpoints"},
+	{"WEBHOOK_LISTEN_PORT", false, "Port for HTTP endpoints"},
+	{"WEBHOOK_IPV6_LISTEN_ADDR", false, "IPv6 address of an additional IPv6 only listener for the HTTP endpoints, e.g. ::"},
+	{"WEBHOOK_IPV6_LISTEN_PORT", false, "Port of the IPv6 listener, defaults to WEBHOOK_LISTEN_PORT"},
+	{"WEBHOOK_REGEX_FALLBACK", true, "Search unstructured update bodies for an IPv6 address. Set to false to only accept JSON updates"},
+	{"WEBHOOK_ALLOW_LOCAL_ADDRESSES", true, "Accept loopback, link-local and multicast addresses in updates"},
+	{"WEBHOOK_MULTIPLE_ADDRESSES", false, "What to do if a text update contains several addresses: prefer-global or reject"},
+	{"WEBHOOK_VERIFY_PORTS", false, "Comma-separated destination ports dialed on a new address before it's stored, updates are refused if none of them is reachable"},
+	{"WEBHOOK_TLS_CERT", false, "Certificate file of the HTTP endpoints, enables HTTPS"},
+	{"WEBHOOK_TLS_KEY", false, "Private key file of WEBHOOK_TLS_CERT"},
+	{"WEBHOOK_TLS_CLIENT_CA", false, "CA file that signs the client certificates of the mtls step"},
+	{"WEBHOOK_HMAC_SECRET", false, "Secret of the hmac step, the agent and update-ip sign their requests with it"},
+	{"AUTH_UPDATE", false, "Authentication steps of /update and /heartbeat, e.g. allowlist,token"},
+	{"AUTH_ADMIN", false, "Authentication steps of the /tunnels endpoints"},
+	{"AUTH_STATUS", false, "Authentication steps of /status, /history, /dns, /stats, /alerts and the dashboard"},
+	{"AUTH_HEALTH", false, "Authentication steps of the /health endpoints"},
+	{"AUTH_ALLOW_UNAUTHENTICATED_UPDATES", true, "Allow AUTH_UPDATE chains without a token, hmac, mtls or allowlist step"},
+	{"AUTH_ALLOW_UNAUTHENTICATED_ADMIN", true, "Allow AUTH_ADMIN chains without a token, hmac, mtls or allowlist step"},
+	{"AUTH_ALLOWED_IPS", false, "Comma-separated addresses and prefixes the allowlist step accepts"},
+	{"AUTH_RATE_LIMIT", false, "Requests per client of the ratelimit step, e.g. 60/1m"},
+	{"LOG_LEVEL", false, "Minimum log level (debug, info, warn, error)"},
+	{"LOG_FORMAT", false, "Log output format (text or json)"},
+	{"TARGET_HOST", false, "Hostname whose AAAA record is used as the target instead of the stored IPv6 address"},
+	{"RESOLVER_ADDR", false, "DNS server used to resolve hostname targets, e.g. 10.0.0.53 or 10.0.0.53:5353"},
+	{"DNS_NEGATIVE_TTL", false, "Maximum time a missing record is cached"},
+	{"DNS64_PREFIX", false, "NAT64 prefix (e.g. 64:ff9b::/96) used to synthesize addresses for names with only A records"},
+	{"HAPPY_EYEBALLS", true, "Race the IPv6 and IPv4 addresses of hostname targets and fall back to IPv4"},
+	{"HAPPY_EYEBALLS_DELAY", false, "Delay between the connection attempts of Happy Eyeballs"},
+	{"SNI_LISTEN_PORT", false, "Port of the SNI routing listener, disabled if not set"},
+	{"SNI_ROUTES", false, "Comma-separated server-name=host:port routes"},
+	{"SNI_DEFAULT_TARGET", false, "host:port for connections that match no route or don't send a server name"},
+	{"PROXY_LISTEN_PORT", false, "Port of the SOCKS5 and HTTP CONNECT proxy, disabled if not set"},
+	{"PROXY_LISTEN_ADDR", false, "Interface address of the proxy"},
+	{"PROXY_USERNAME", false, "Username required by the proxy"},
+	{"PROXY_PASSWORD", false, "Password required by the proxy"},
+	{"PROTOCOL_STATS", true, "Collect TLS statistics of the tunnels"},
+	{"FAILOVER_TARGETS", false, "Comma-separated IPv6 addresses or hostnames tried after the primary target"},
+	{"TUNNEL_TARGETS", false, "Semicolon-separated per-tunnel target lists keyed by source port, e.g. 443=2001:db8::1,2001:db8::2"},
+	{"STATE_BACKEND", false, "Where the IPv6 address is stored: file, redis, etcd or consul"},
+	{"STATE_URL", false, "Address of the state backend, e.g. redis://:password@redis:6379/0 or http://consul:8500"},
+	{"STATE_KEY", false, "Key of the IPv6 address in the state backend"},
+	{"STATE_TOKEN", false, "Consul ACL token or etcd auth token"},
+	{"ACTIVE_LEASE_TTL", false, "Enables the active lease for instances sharing a state backend, e.g. 30s"},
+	{"INSTANCE_ID", false, "Name of this instance in the active lease, must be unique"},
+	{"READ_ONLY", true, "Run the tunnels but refuse address updates and tunnel changes, e.g. for a recovered instance"},
+	{"DIAL_TIMEOUT", false, "Timeout for connecting to a target, applies to every failover target separately"},
+	{"DIAL_RETRY_WINDOW", false, "Keep retrying to connect to the targets with exponential backoff for this long before dropping the client, 0 disables it"},
+	{"DIAL_RETRY_BACKOFF", false, "Wait before the first retry, doubled after every attempt up to 5s"},
+	{"CIRCUIT_BREAKER", true, "Don't connect to targets that failed the last healthcheck"},
+	{"SESSION_PINNING_WINDOW", false, "Keep sending clients to the previous IPv6 address for this long after it changed, 0 disables it"},
+	{"IDLE_TIMEOUT", false, "Close tunnel connections that transferred nothing in either direction for this long, 0 disables it"},
+	{"STALL_TIMEOUT", false, "Log tunnel writes that block for this long because the peer stopped reading, 0 disables it"},
+	{"STALL_ABORT", true, "Close tunnel connections once a write stalled for STALL_TIMEOUT"},
+	{"KEEPALIVE_INTERVAL", false, "TCP keep-alive interval on both sides of a tunnel, 0 disables keep-alive probes"},
+	{"COPY_BUFFER_SIZE", false, "Size of the relay copy buffers, e.g. 64KiB. auto adapts the buffers to the throughput of each connection"},
+	{"TUNNEL_RATE_LIMITS", false, "Semicolon-separated bandwidth limits keyed by source port, e.g. 873=50Mbit;22=1MB"},
+	{"TUNNEL_TRAFFIC_CLASSES", false, "Semicolon-separated IPv6 traffic classes of the backend connections keyed by source port, e.g. 22=ef;873=cs1"},
+	{"TUNNEL_FLOW_LABELS", false, "Semicolon-separated IPv6 flow labels of the backend connections keyed by source port, e.g. 22=0x1234"},
+	{"TUNNEL_PROXY_PROTOCOL", false, "Semicolon-separated PROXY protocol versions sent to the backends keyed by source port, e.g. 443=v2;25=v1"},
+	{"TUNNEL_TLS_PORTS", false, "Comma-separated source ports of tunnels that terminate TLS and forward the plain text"},
+	{"TUNNEL_TLS_CERT", false, "Certificate file of the terminating tunnels"},
+	{"TUNNEL_TLS_KEY", false, "Private key file of TUNNEL_TLS_CERT"},
+	{"TUNNEL_TLS_CLIENT_CA", false, "CA file that must sign the client certificates of the terminating tunnels"},
+	{"TUNNEL_ALLOWED_CLIENTS", false, "Semicolon-separated client addresses and prefixes the tunnels accept keyed by source port, e.g. 22=203.0.113.0/24,198.51.100.7"},
+	{"TUNNEL_DENIED_CLIENTS", false, "Semicolon-separated client addresses and prefixes the tunnels refuse keyed by source port, e.g. 443=192.0.2.0/24"},
+	{"TUNNEL_LATENCY_SLOS", false, "Semicolon-separated connection-open latency SLOs keyed by source port, e.g. 22=200ms;443=1s"},
+	{"LATENCY_SLO_WINDOW", false, "How far back the connections are considered for the latency SLOs"},
+	{"LATENCY_SHED_PERCENT", false, "Percentage of new connections that are closed while a tunnel exceeds its latency SLO, 0 only reports it"},
+	{"FTP_PORTS", false, "Comma-separated source ports of tunnels to FTP servers, their passive mode replies are rewritten"},
+	{"FTP_PASSIVE_PORTS", false, "IPv4 ports and port ranges the relay forwards the passive data connections on, e.g. 30000-30099"},
+	{"FTP_PASSIVE_ADDRESS", false, "IPv4 address announced in PASV replies"},
+	{"SIP_PORTS", false, "Comma-separated source ports of SIP over TCP tunnels, their SDP bodies are rewritten and the media is relayed"},
+	{"SIP_RTP_PORTS", false, "UDP ports and port ranges for the RTP and RTCP of the calls, e.g. 40000-40099"},
+	{"SIP_MEDIA_ADDRESS", false, "IPv4 address announced to SIP clients for the media"},
+	{"SPA_PORTS", false, "Comma-separated source ports of tunnels that only accept clients after a valid SPA packet"},
+	{"SPA_SECRET", false, "Shared secret the SPA packets are signed with"},
+	{"SPA_LISTEN_PORT", false, "UDP port the SPA packets are received on"},
+	{"SPA_LISTEN_ADDR", false, "Interface address for the SPA packets"},
+	{"SPA_TTL", false, "How long a client may open new connections after its SPA packet"},
+	{"REUSE_PORT", true, "Bind listeners with SO_REUSEPORT so several instances can share a port"},
+	{"LAZY_LISTENERS", true, "Only open the listener of a tunnel once its backend passed a healthcheck"},
+	{"LAZY_LISTENER_UNBIND_AFTER", false, "Close the listener of a lazy tunnel again after its backend failed the healthchecks for this long, 0 keeps it open"},
+	{"EPHEMERAL_PORTS", false, "Source ports and port ranges temporary tunnels are allocated from via POST /tunnels/ephemeral"},
+	{"EPHEMERAL_DEST_PORTS", false, "Destination ports temporary tunnels may forward to, empty allows every port"},
+	{"EPHEMERAL_MAX_TTL", false, "Longest lifetime of a temporary tunnel"},
+	{"HEALTHCHECK_INTERVAL", false, "How often the tunnels are checked in the background"},
+	{"HEALTHCHECK_TIMEOUT", false, "Dial timeout for a single tunnel check"},
+	{"ADDRESS_MASK", false, "Hide target addresses in /health and /update responses: off, prefix or redact"},
+	{"HEALTH_POLICY", false, "When /health and /health/ready report healthy: all, any, quorum or weighted"},
+	{"HEALTH_WEIGHTS", false, "Comma-separated tunnel weights for the weighted policy keyed by source port, e.g. 443=3,22=1"},
+	{"HEALTH_WEIGHT_THRESHOLD", false, "Share of the total weight that has to be up for the weighted policy"},
+	{"CONTROL_LISTEN_PORT", false, "Port of the agent control channel, disabled if not set"},
+	{"CONTROL_LISTEN_ADDR", false, "Interface address for the agent control channel"},
+	{"CONTROL_AGENT_KEYS", false, "Comma-separated list of pinned agent key fingerprints"},
+	{"REVERSE_DNS", true, "Resolve the reverse DNS name of clients for the access logs and /status"},
+	{"REVERSE_DNS_CACHE_SIZE", false, "Maximum number of cached client names"},
+	{"REVERSE_DNS_TTL", false, "How long a resolved client name is cached"},
+	{"NOTIFY_URLS", false, "Comma-separated list of URLs to notify about events"},
+	{"NOTIFY_ROUTES", false, "Semicolon-separated rules that send event types to specific notifiers, e.g. tunnel_down=ops;*=chat"},
+	{"DIGEST_SCHEDULE", false, "Send a summary via the notifiers: off, daily or weekly"},
+	{"DIGEST_TIME", false, "Local time the digest is sent at, weekly digests are sent on Mondays"},
+	{"PING_URLS", false, "Comma-separated dead man's switch URLs, e.g. of healthchecks.io or Uptime Kuma push monitors"},
+	{"PING_INTERVAL", false, "How often the ping URLs are requested"},
+	{"PING_REQUIRE_HEALTHY", true, "Only ping while the tunnels satisfy the health policy"},
+	{"PUBLIC_IPV4_SOURCE", false, "URL that responds with the public IPv4 address of the host, or interface:<name>, enables following it"},
+	{"PUBLIC_IPV4_INTERVAL", false, "How often the public IPv4 address is checked"},
+	{"PUBLIC_IPV4_DNS_URLS", false, "Comma-separated DNS records to point at the public IPv4 address, cloudflare:// or http(s) URLs with {ip}"},
+	{"NOTIFY_DEBOUNCE", false, "How long a tunnel has to stay down or up before a notification is sent"},
+	{"EVENT_LOG", true, "Write all events as JSON lines to events.jsonl in the data dir"},
+	{"EVENT_LOG_MAX_SIZE", false, "Size after which the event log is rotated, e.g. 10MiB"},
+	{"EVENT_LOG_BACKUPS", false, "Number of rotated event log files that are kept"},
+	{"WEBHOOK_RECORD", true, "Write every update request with redacted credentials to webhook-recordings in the data dir"},
+	{"WEBHOOK_RECORD_MAX", false, "Number of recorded update requests that are kept"},
+	{"ALERT_TUNNEL_DOWN_AFTER", false, "Report a tunnel_down alert on /alerts once a tunnel is down for this long, 0 disables it"},
+	{"ALERT_UPDATE_STALE_AFTER", false, "Report an update_stale alert on /alerts once the address wasn't updated for this long, 0 disables it"},
+	{"ALERT_POOL_USAGE", false, "Report a pool_exhausted alert on /alerts once this percentage of a port pool is in use, 0 disables it"},
+	{"RELAY_URL", false, "Base URL of the relay's HTTP endpoints"},
+	{"AGENT_INTERFACE", false, "Only report addresses of this interface"},
+	{"HEARTBEAT_INTERVAL", false, "How often a heartbeat is sent"},
+	{"RELAY_CONTROL_ADDR", false, "host:port of the relay's control channel, replaces RELAY_URL and WEBHOOK_TOKEN"},
+	{"RELAY_CONTROL_KEY", false, "Pinned key fingerprint of the relay"},
+	{"AGENT_REPORT_ADDRESS", true, "Let the agent update the relay's target address with its own global IPv6 address"},
+	{"AGENT_DATA_DIR", false, "Directory where the agent stores its key"}}
+
+// Sets an environment variable from a flag
+type envFlag struct {
+	name    string
+	boolean bool
+}
+
+// Shows the value from the environment as default in the usage
+func (f *envFlag) String() string {
+	if f == nil || f.name == "" {
+		return ""
+	}
+	return os.Getenv(f.name)
+}
+
+func (f *envFlag) Set(value string) error {
+	if f.boolean {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		value = strconv.FormatBool(enabled)
+	}
+	return os.Setenv(f.name, value)
+}
+
+func (f *envFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// Converts WEBHOOK_TOKEN to webhook-token
+func flagName(variable string) string {
+	return strings.ReplaceAll(strings.ToLower(variable), "_", "-")
+}
+
+func newFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("four2six", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), cliUsage)
+		flags.PrintDefaults()
+	}
+
+	for _, variable := range configVariables {
+		flags.Var(&envFlag{name: variable.name, boolean: variable.boolean}, flagName(variable.name), variable.description)
+	}
+	for _, eventType := range eventTypes {
+		name := strings.ToUpper(string(eventType))
+		flags.Var(&envFlag{name: "NOTIFY_TEMPLATE_" + name}, flagName("NOTIFY_TEMPLATE_"+name), fmt.Sprintf("Go template that replaces the message of %s notifications", eventType))
+		flags.Var(&envFlag{name: "NOTIFY_TITLE_" + name}, flagName("NOTIFY_TITLE_"+name), fmt.Sprintf("Go template that replaces the title of %s notifications", eventType))
+	}
+	return flags
+}
+
+// Applies the flags to the environment and returns the command and its arguments
+func parseCommandLine(args []string) (string, []string, error) {
+	flags := newFlagSet()
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+
+	command := "serve"
+	args = flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	// Flags may also follow the command
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	return command, flags.Args(), nil
+}
+
+// Handles the `check-config` command, the configuration was already validated when it was loaded
+func runCheckConfig(configs []*Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: four2six check-config")
+	}
+
+	for i, config := range configs {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := checkRelayConfig(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints the summary and tunnels of a relay
+func checkRelayConfig(config *Config) error {
+	if config.WebhookToken == "" && config.auth.usesToken() {
+		if config.Relay != "" {
+			return fmt.Errorf("WEBHOOK_TOKEN is not set for relay %s", config.Relay)
+		}
+		return errors.New("WEBHOOK_TOKEN is not set")
+	}
+
+	// Show the persisted address if there is one, just like the relay would use it
+	targetSource := "stored"
+	if config.TargetHost != "" {
+		targetSource = "TARGET_HOST"
+	} else if err := config.loadIPv6Address(); err != nil {
+		targetSource = "default, " + err.Error()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if config.Relay != "" {
+		fmt.Fprintf(w, "Relay:\t%s\n", config.Relay)
+	}
+	fmt.Fprintf(w, "Target:\t%s (%s)\n", config.primaryTarget(), targetSource)
+	fmt.Fprintf(w, "Webhook:\t%s\n", joinListenAddr(config.WebhookListenAddr, config.WebhookListenPort))
+	if config.WebhookIPv6ListenAddr != "" {
+		fmt.Fprintf(w, "Webhook (IPv6):\t%s\n", joinListenAddr(config.WebhookIPv6ListenAddr, config.WebhookIPv6ListenPort))
+	}
+	if config.ControlListenPort != "" {
+		fmt.Fprintf(w, "Control channel:\t%s\n", joinListenAddr(config.ControlListenAddr, config.ControlListenPort))
+	}
+	if config.SNIListenPort != "" {
+		fmt.Fprintf(w, "SNI routing:\t%s\n", joinListenAddr(config.TunnelListenAddr, config.SNIListenPort))
+	}
+	if config.ProxyListenPort != "" {
+		fmt.Fprintf(w, "Proxy:\t%s\n", joinListenAddr(config.ProxyListenAddr, config.ProxyListenPort))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TUNNEL\tLISTEN\tTARGETS\tRATE LIMIT")
+	for i, ipv4Port := range config.IPv4Ports {
+		rateLimit := "-"
+		if limit, ok := config.rateLimits[ipv4Port]; ok {
+			rateLimit = limit.limit
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			tunnelName(ipv4Port, config.IPv6Ports[i]),
+			joinListenAddr(config.tunnelListenAddr(ipv4Port), ipv4Port),
+			strings.Join(config.tunnelTargets(ipv4Port), ", "),
+			rateLimit,
+		)
+	}
+	return w.Flush()
+}
+
+// Formats a listen address, unix sockets don't have a port
+func joinListenAddr(addr, port string) string {
+	if strings.HasPrefix(addr, "unix://") {
+		return addr
+	}
+	if strings.Contains(addr, ":") {
+		addr = "[" + addr + "]"
+	}
+	return addr + ":" + port
+}
+
+// Handles the `update-ip <address>` command. With RELAY_URL the address is sent to a running relay,
+// otherwise it's written to the state backend where running relays pick it up. Read-only instances
+// and standby instances of an active lease refuse to write it.
+func runUpdateIP(config *Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: four2six update-ip <address>")
+	}
+
+	addr, ok := parseIPv6Candidate(args[0])
+	if !ok {
+		return fmt.Errorf("'%s' is not a valid IPv6 address", args[0])
+	}
+	if err := config.checkAddressScope(addr); err != nil {
+		return err
+	}
+	ipv6Address := addr.String()
+
+	if relayURL := os.Getenv("RELAY_URL"); relayURL != "" {
+		return sendUpdate(relayURL, config.WebhookToken, os.Getenv("WEBHOOK_HMAC_SECRET"), ipv6Address)
+	}
+
+	// The command writes like a running instance would, so it follows the same rules
+	if config.ReadOnly {
+		return errReadOnly
+	}
+	var err error
+	if config.history, err = loadAddressHistory(config.DataDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the address history: %v\n", err)
+	}
+	if config.LeaseTTL > 0 {
+		config.lease = newActiveLease(config, config.InstanceID, config.LeaseTTL)
+	}
+
+	err = config.setIPv6Address(AddressUpdate{IPv6Address: ipv6Address, Source: "cli"})
+	if errors.Is(err, errNotActive) {
+		return fmt.Errorf("%v, run the command on the active instance or send the update to it with RELAY_URL", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store the address: %v", err)
+	}
+
+	fmt.Printf("IPv6 address updated to %s\n", ipv6Address)
+	return nil
+}
+
+// Sends the address to the /update endpoint of a running relay
+func sendUpdate(relayURL, token, hmacSecret, ipv6Address string) error {
+	if token == "" && hmacSecret == "" {
+		return errors.New("WEBHOOK_TOKEN or WEBHOOK_HMAC_SECRET must be set to send the update to RELAY_URL")
+	}
+
+	body, err := json.Marshal(map[string]string{"ipv6_address": ipv6Address, "source": "cli"})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(relayURL, "/")+"/update", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	signRequest(req, hmacSecret, body)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	fmt.Println(strings.TrimSpace(string(message)))
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the file in the data dir that holds the control channel key
+const controlKeyFile = "control_key.pem"
+
+// Messages on the control channel are small, anything bigger is refused
+const maxControlMessageSize = 64 * 1024
+
+// controlMessage is sent by the agent over the control channel
+type controlMessage struct {
+	Heartbeat   *Heartbeat `json:"heartbeat,omitempty"`
+	IPv6Address string     `json:"ipv6_address,omitempty"`
+}
+
+// controlResponse is the answer of the relay to a control message
+type controlResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Loads the ed25519 key from the data dir or generates a new one if it doesn't exist yet
+func loadOrCreateControlKey(dataDir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dataDir, controlKeyFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s does not contain an ed25519 key", path)
+		}
+		return edKey, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Generated a new control channel key", slog.String("path", path))
+	return key, nil
+}
+
+// Returns the fingerprint of a public key in the same notation as SSH
+func keyFingerprint(publicKey ed25519.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Wraps the key into a self-signed certificate. The certificate itself is never validated, only the pinned key is.
+func controlCertificate(key ed25519.PrivateKey) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(100, 0, 0),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Verifies that the peer presented one of the pinned keys
+func verifyPinnedKey(pinned []string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer did not present a certificate")
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		publicKey, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("peer did not present an ed25519 key")
+		}
+
+		fingerprint := keyFingerprint(publicKey)
+		for _, pin := range pinned {
+			if fingerprint == pin {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer key %s is not pinned", fingerprint)
+	}
+}
+
+// Builds a TLS config that authenticates both sides with pinned keys only
+func pinnedTLSConfig(key ed25519.PrivateKey, pinned []string) (*tls.Config, error) {
+	cert, err := controlCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true, // The certificate chain is replaced by the key pinning below
+		VerifyPeerCertificate: verifyPinnedKey(pinned),
+	}, nil
+}
+
+func parseKeyList(keys string) []string {
+	var pinned []string
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			pinned = append(pinned, key)
+		}
+	}
+	return pinned
+}
+
+// Accepts agent connections on the control channel until the process is stopped
+func runControlServer(config *Config, tcpListener net.Listener) error {
+	defer tcpListener.Close()
+
+	key, err := loadOrCreateControlKey(config.DataDir)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := pinnedTLSConfig(key, config.ControlAgentKeys)
+	if err != nil {
+		return err
+	}
+
+	listener := tls.NewListener(tcpListener, tlsConfig)
+	config.logger().Info("Starting control channel server", slog.String("addr", listener.Addr().String()), slog.String("fingerprint", keyFingerprint(key.Public().(ed25519.PublicKey))))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			config.logger().Error("Error accepting control connection", slog.Any("error", err))
+			continue
+		}
+
+		go handleControlConn(config, conn.(*tls.Conn))
+	}
+}
+
+func handleControlConn(config *Config, conn *tls.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	logger := config.logger().With(slog.String("client", conn.RemoteAddr().String()))
+	if err := conn.Handshake(); err != nil {
+		logger.Warn("Control channel handshake failed", slog.Any("error", err))
+		return
+	}
+	peerKey := conn.ConnectionState().PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	logger = logger.With(slog.String("agent_key", keyFingerprint(peerKey)))
+
+	reader := bufio.NewReader(io.LimitReader(conn, maxControlMessageSize))
+	encoder := json.NewEncoder(conn)
+
+	var msg controlMessage
+	if err := json.NewDecoder(reader).Decode(&msg); err != nil {
+		logger.Warn("Failed to decode control message", slog.Any("error", err))
+		encoder.Encode(controlResponse{Error: "invalid message"})
+		return
+	}
+
+	if msg.Heartbeat != nil {
+		config.heartbeats.record(&HeartbeatRecord{
+			Heartbeat:  *msg.Heartbeat,
+			ReceivedAt: time.Now().UTC(),
+			RemoteAddr: conn.RemoteAddr().String(),
+		})
+		logger.Debug("Received heartbeat over the control channel", slog.String("hostname", msg.Heartbeat.Hostname))
+	}
+
+	if msg.IPv6Address != "" {
+		// Same rules as the webhook, a leaked agent key must not point the tunnels anywhere the webhook couldn't
+		addr, ok := parseIPv6Candidate(msg.IPv6Address)
+		if !ok {
+			logger.Warn("Agent sent an invalid IPv6 address", slog.String("ipv6_address", msg.IPv6Address))
+			encoder.Encode(controlResponse{Error: "invalid IPv6 address"})
+			return
+		}
+		if err := config.checkAddressScope(addr); err != nil {
+			logger.Warn("Agent sent an IPv6 address that can't be a target", slog.String("ipv6_address", msg.IPv6Address), slog.Any("error", err))
+			encoder.Encode(controlResponse{Error: err.Error()})
+			return
+		}
+		ip := addr.String()
+
+		if config.ipv6Address() != ip {
+			var client netip.Addr
+			if addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+				client = addrPort.Addr().Unmap()
+			}
+			err := config.acceptAddressUpdate(logger, AddressUpdate{IPv6Address: ip, Source: "agent " + keyFingerprint(peerKey), Client: conn.RemoteAddr().String()}, client, netip.Addr{}, false)
+			var unreachable *unreachableAddressError
+			if errors.As(err, &unreachable) {
+				logger.Warn("Rejected an unreachable IPv6 address from the agent", slog.String("ipv6_address", ip), slog.Any("error", err))
+				encoder.Encode(controlResponse{Error: "IPv6 address is not reachable on WEBHOOK_VERIFY_PORTS"})
+				return
+			}
+			if errors.Is(err, errNotActive) {
+				logger.Warn("Refused address update on a standby instance", slog.String("ipv6_address", ip))
+				encoder.Encode(controlResponse{Error: "relay is on standby"})
+				return
+			}
+			if errors.Is(err, errReadOnly) {
+				logger.Warn("Refused address update in read-only mode", slog.String("ipv6_address", ip))
+				encoder.Encode(controlResponse{Error: "relay is read-only"})
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to save IPv6 address", slog.Any("error", err))
+				encoder.Encode(controlResponse{Error: "failed to save IPv6 address"})
+				return
+			}
+			logger.Info("IPv6 address updated by the agent", slog.String("ipv6_address", ip))
+		}
+	}
+
+	encoder.Encode(controlResponse{})
+}
+
+// Sends a message to the relay over the control channel and waits for the response
+func sendControlMessage(addr string, tlsConfig *tls.Config, msg *controlMessage) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return err
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("relay rejected the message: %s", resp.Error)
+	}
+	return nil
+}
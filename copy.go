@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the adaptive copy buffers
+const (
+	minCopyBufferSize = 4 << 10
+	maxCopyBufferSize = 256 << 10
+)
+
+// Bounds of COPY_BUFFER_SIZE
+const (
+	minFixedCopyBufferSize = 1 << 10
+	maxFixedCopyBufferSize = 4 << 20
+)
+
+// The buffer grows after this many reads in a row filled it completely
+const growAfterFullReads = 4
+
+// The buffer shrinks after this many reads in a row used less than a quarter of it
+const shrinkAfterSmallReads = 16
+
+// A read that blocked for longer than this means the connection was idle and the buffer drops to the minimum
+const idleShrinkAfter = 5 * time.Second
+
+// Copies from src to dst like io.Copy, but sizes the buffer by the observed throughput.
+// Bulk transfers get large buffers while idle and interactive connections only keep a small one.
+func copyAdaptive(dst io.Writer, src io.Reader) (int64, error) {
+	bufPtr := getCopyBuffer(minCopyBufferSize)
+	defer func() { putCopyBuffer(bufPtr) }()
+	buf := *bufPtr
+	var written int64
+	var fullReads, smallReads int
+
+	for {
+		start := time.Now()
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			nw, writeErr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+
+		size := len(buf)
+		switch {
+		case time.Since(start) > idleShrinkAfter:
+			fullReads, smallReads = 0, 0
+			size = minCopyBufferSize
+		case nr == len(buf):
+			smallReads = 0
+			if fullReads++; fullReads >= growAfterFullReads {
+				fullReads = 0
+				size = min(size*2, maxCopyBufferSize)
+			}
+		case nr < len(buf)/4:
+			fullReads = 0
+			if smallReads++; smallReads >= shrinkAfterSmallReads {
+				smallReads = 0
+				size = max(size/2, minCopyBufferSize)
+			}
+		default:
+			fullReads, smallReads = 0, 0
+		}
+
+		if size != len(buf) {
+			putCopyBuffer(bufPtr)
+			bufPtr = getCopyBuffer(size)
+			buf = *bufPtr
+		}
+	}
+}
+
+// Pools of copy buffers keyed by their size, so relaying doesn't allocate for every connection
+var copyBufferPools sync.Map
+
+func getCopyBuffer(size int) *[]byte {
+	pool, ok := copyBufferPools.Load(size)
+	if !ok {
+		pool, _ = copyBufferPools.LoadOrStore(size, &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+func putCopyBuffer(buf *[]byte) {
+	if pool, ok := copyBufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
+
+// Copies from src to dst. Plain TCP connections are spliced in the kernel where supported,
+// everything else goes through a pooled buffer of the configured size or an adaptive one.
+func (config *Config) copyConn(dst, src net.Conn) (int64, error) {
+	if spliceSupported {
+		dstTCP, dstOK := dst.(*net.TCPConn)
+		_, srcOK := src.(*net.TCPConn)
+		if dstOK && srcOK {
+			return dstTCP.ReadFrom(src)
+		}
+	}
+
+	if config.CopyBufferSize == 0 {
+		return copyAdaptive(dst, src)
+	}
+
+	buf := getCopyBuffer(config.CopyBufferSize)
+	defer putCopyBuffer(buf)
+	// Hide the ReaderFrom and WriterTo implementations, otherwise io.CopyBuffer ignores the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// Disables Nagle's algorithm and configures keep-alive probes on TCP connections, wrapped ones included
+func (config *Config) tuneTCPConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetNoDelay(true)
+			c.SetKeepAlive(config.KeepAliveInterval > 0)
+			if config.KeepAliveInterval > 0 {
+				c.SetKeepAlivePeriod(config.KeepAliveInterval)
+			}
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
+
+// Tracks the last activity of both directions of a tunnel
+type idleTracker struct {
+	timeout      time.Duration
+	lastActivity atomic.Int64
+}
+
+// Closes a tunnel direction once neither direction transferred anything for the timeout
+type idleConn struct {
+	net.Conn
+	tracker *idleTracker
+}
+
+// Wraps both sides of a tunnel so reads fail once the whole tunnel was idle for the timeout
+func newIdleConns(src, dst net.Conn, timeout time.Duration) (net.Conn, net.Conn) {
+	tracker := &idleTracker{timeout: timeout}
+	tracker.lastActivity.Store(time.Now().UnixNano())
+	return &idleConn{Conn: src, tracker: tracker}, &idleConn{Conn: dst, tracker: tracker}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.tracker.timeout))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.tracker.lastActivity.Store(time.Now().UnixNano())
+		}
+
+		// A one-way transfer keeps the tunnel alive even though this direction is quiet
+		idleFor := time.Since(time.Unix(0, c.tracker.lastActivity.Load()))
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && idleFor < c.tracker.timeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Returns the wrapped connection
+func (c *idleConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Byte counts of both directions of a tunnel, shared by its stall watchers
+type stallTracker struct {
+	timeout time.Duration
+	abort   bool
+	logger  *slog.Logger
+
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+}
+
+// Notices writes that block because the peer stopped reading
+type stallConn struct {
+	net.Conn
+	tracker *stallTracker
+	// upload writes to the target, download to the client
+	direction string
+	written   *atomic.Int64
+}
+
+// Wraps both sides of a tunnel so writes that block for longer than the timeout are logged and optionally fail
+func (config *Config) newStallConns(src, dst net.Conn, timeout time.Duration) (net.Conn, net.Conn) {
+	tracker := &stallTracker{
+		timeout: timeout,
+		abort:   config.StallAbort,
+		logger:  config.logger().With(slog.String("client", src.RemoteAddr().String()), slog.String("target", dst.RemoteAddr().String())),
+	}
+	return &stallConn{Conn: src, tracker: tracker, direction: "download", written: &tracker.downloaded},
+		&stallConn{Conn: dst, tracker: tracker, direction: "upload", written: &tracker.uploaded}
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	var written int
+	var stalledAt time.Time
+	for {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.tracker.timeout))
+		n, err := c.Conn.Write(p[written:])
+		written += n
+		c.written.Add(int64(n))
+		if err == nil {
+			if !stalledAt.IsZero() {
+				c.tracker.logger.Info("Stalled write resumed", slog.String("direction", c.direction), slog.Duration("stalled_for", time.Since(stalledAt)))
+			}
+			return written, nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return written, err
+		}
+
+		// Log once per write, a peer that never reads again would flood the log otherwise
+		if stalledAt.IsZero() {
+			stalledAt = time.Now().Add(-c.tracker.timeout)
+			c.tracker.logger.Warn("Write stalled, the peer stopped reading",
+				slog.String("direction", c.direction),
+				slog.Duration("stalled_for", c.tracker.timeout),
+				slog.Int("pending_bytes", len(p)-written),
+				slog.Int64("uploaded", c.tracker.uploaded.Load()),
+				slog.Int64("downloaded", c.tracker.downloaded.Load()),
+				slog.Bool("abort", c.tracker.abort))
+		}
+		if c.tracker.abort {
+			return written, fmt.Errorf("%s stalled for %s: %w", c.direction, c.tracker.timeout, err)
+		}
+	}
+}
+
+// Returns the wrapped connection
+func (c *stallConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Parses COPY_BUFFER_SIZE. "auto" selects the adaptive buffers and is returned as 0.
+func parseCopyBufferSize(value string) (int, error) {
+	if strings.EqualFold(value, "auto") {
+		return 0, nil
+	}
+
+	size, err := parseByteSize(value)
+	if err != nil {
+		return 0, err
+	}
+	if size < minFixedCopyBufferSize || size > maxFixedCopyBufferSize {
+		return 0, fmt.Errorf("'%s' must be between 1KiB and 4MiB", value)
+	}
+	return size, nil
+}
+
+// Parses a size in bytes or with a K/KiB or M/MiB suffix
+func parseByteSize(value string) (int, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix string
+		factor int
+	}{{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"K", 1 << 10}, {"M", 1 << 20}} {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = trimmed, unit.factor
+			break
+		}
+	}
+
+	size, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a size", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of clients listed in a digest
+const digestTopClients = 5
+
+// Limits the number of distinct clients counted per period so scanners can't grow it forever
+const maxDigestClients = 4096
+
+// Digest summarizes a period, it's sent as part of the digest event
+type Digest struct {
+	Period         string         `json:"period"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	AddressChanges int            `json:"address_changes"`
+	Tunnels        []DigestTunnel `json:"tunnels"`
+	TopClients     []DigestClient `json:"top_clients"`
+}
+
+// DigestTunnel is the summary of a single tunnel
+type DigestTunnel struct {
+	Name string `json:"name"`
+	// Share of the health checks that found the tunnel up, nil if it wasn't checked
+	UptimePercent *float64 `json:"uptime_percent"`
+	Connections   uint64   `json:"connections"`
+	// Bytes from the clients to the target and back
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+}
+
+// DigestClient is a client and the number of connections it opened
+type DigestClient struct {
+	IP          string `json:"ip"`
+	Connections uint64 `json:"connections"`
+}
+
+type digestTunnelCounts struct {
+	checks, upChecks     int
+	connections          uint64
+	uploaded, downloaded int64
+}
+
+// Collects what happened since the last digest and sends it on a schedule
+type digestCollector struct {
+	config *Config
+	// daily or weekly
+	period string
+	// Local time of day the digest is sent at
+	hour, minute int
+
+	mu             sync.Mutex
+	from           time.Time
+	addressChanges int
+	tunnels        map[string]*digestTunnelCounts
+	clients        map[string]uint64
+}
+
+// Parses DIGEST_SCHEDULE and DIGEST_TIME, returns nil if digests are disabled
+func newDigestCollector(config *Config, schedule, at string) (*digestCollector, error) {
+	switch schedule {
+	case "off":
+		return nil, nil
+	case "daily", "weekly":
+	default:
+		return nil, fmt.Errorf("unknown schedule '%s', expected one of: off, daily, weekly", schedule)
+	}
+
+	sendAt, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a time like 08:00", at)
+	}
+
+	digest := &digestCollector{config: config, period: schedule, hour: sendAt.Hour(), minute: sendAt.Minute()}
+	digest.reset(time.Now())
+	return digest, nil
+}
+
+// Starts a new period, must be called with the lock held
+func (digest *digestCollector) reset(now time.Time) {
+	digest.from = now
+	digest.addressChanges = 0
+	digest.tunnels = make(map[string]*digestTunnelCounts)
+	digest.clients = make(map[string]uint64)
+}
+
+// Returns the counts of the tunnel, must be called with the lock held
+func (digest *digestCollector) tunnel(name string) *digestTunnelCounts {
+	counts, ok := digest.tunnels[name]
+	if !ok {
+		counts = &digestTunnelCounts{}
+		digest.tunnels[name] = counts
+	}
+	return counts
+}
+
+func (digest *digestCollector) recordCheck(tunnel string, alive bool) {
+	if digest == nil {
+		return
+	}
+	digest.mu.Lock()
+	defer digest.mu.Unlock()
+
+	counts := digest.tunnel(tunnel)
+	counts.checks++
+	if alive {
+		counts.upChecks++
+	}
+}
+
+func (digest *digestCollector) recordConnection(tunnel, clientIP string) {
+	if digest == nil {
+		return
+	}
+	digest.mu.Lock()
+	defer digest.mu.Unlock()
+
+	digest.tunnel(tunnel).connections++
+	if clientIP == "" {
+		return
+	}
+	if _, ok := digest.clients[clientIP]; ok || len(digest.clients) < maxDigestClients {
+		digest.clients[clientIP]++
+	}
+}
+
+func (digest *digestCollector) recordTraffic(tunnel string, uploaded, downloaded int64) {
+	if digest == nil {
+		return
+	}
+	digest.mu.Lock()
+	defer digest.mu.Unlock()
+
+	counts := digest.tunnel(tunnel)
+	counts.uploaded += uploaded
+	counts.downloaded += downloaded
+}
+
+func (digest *digestCollector) recordAddressChange() {
+	if digest == nil {
+		return
+	}
+	digest.mu.Lock()
+	digest.addressChanges++
+	digest.mu.Unlock()
+}
+
+// Builds the digest of the current period and starts the next one
+func (digest *digestCollector) collect(now time.Time) *Digest {
+	digest.mu.Lock()
+	defer digest.mu.Unlock()
+
+	summary := &Digest{
+		Period:         digest.period,
+		From:           digest.from.UTC(),
+		To:             now.UTC(),
+		AddressChanges: digest.addressChanges,
+		Tunnels:        []DigestTunnel{},
+		TopClients:     []DigestClient{},
+	}
+
+	// List every configured tunnel, including the ones without traffic
+	for i, ipv4Port := range digest.config.IPv4Ports {
+		name := tunnelName(ipv4Port, digest.config.IPv6Ports[i])
+		counts := digest.tunnel(name)
+		tunnel := DigestTunnel{
+			Name:            name,
+			Connections:     counts.connections,
+			BytesUploaded:   counts.uploaded,
+			BytesDownloaded: counts.downloaded,
+		}
+		if counts.checks > 0 {
+			uptime := float64(counts.upChecks) / float64(counts.checks) * 100
+			tunnel.UptimePercent = &uptime
+		}
+		summary.Tunnels = append(summary.Tunnels, tunnel)
+	}
+
+	for ip, connections := range digest.clients {
+		summary.TopClients = append(summary.TopClients, DigestClient{IP: ip, Connections: connections})
+	}
+	slices.SortFunc(summary.TopClients, func(a, b DigestClient) int {
+		return cmp.Or(cmp.Compare(b.Connections, a.Connections), strings.Compare(a.IP, b.IP))
+	})
+	if len(summary.TopClients) > digestTopClients {
+		summary.TopClients = summary.TopClients[:digestTopClients]
+	}
+
+	digest.reset(now)
+	return summary
+}
+
+// Human readable version of the digest for the notification message
+func (summary *Digest) message() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Four2Six %s digest from %s to %s\n", summary.Period, summary.From.Format(time.DateTime), summary.To.Format(time.DateTime))
+	fmt.Fprintf(&b, "Address changes: %d\n", summary.AddressChanges)
+
+	b.WriteString("\nTunnels:\n")
+	for _, tunnel := range summary.Tunnels {
+		uptime := "not checked"
+		if tunnel.UptimePercent != nil {
+			uptime = fmt.Sprintf("%.2f%% up", *tunnel.UptimePercent)
+		}
+		fmt.Fprintf(&b, "- %s: %s, %d connections, %s up, %s down\n", tunnel.Name, uptime, tunnel.Connections, formatBytes(tunnel.BytesUploaded), formatBytes(tunnel.BytesDownloaded))
+	}
+
+	if len(summary.TopClients) > 0 {
+		b.WriteString("\nTop clients:\n")
+		for _, client := range summary.TopClients {
+			fmt.Fprintf(&b, "- %s: %d connections\n", client.IP, client.Connections)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Returns when the next digest is due, weekly digests are sent on Mondays
+func (digest *digestCollector) next(now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), digest.hour, digest.minute, 0, 0, now.Location())
+	for !next.After(now) || (digest.period == "weekly" && next.Weekday() != time.Monday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Sends the digests until the process is stopped
+func (digest *digestCollector) run() {
+	for {
+		due := digest.next(time.Now())
+		digest.config.logger().Debug("Scheduled the next digest", slog.Time("at", due))
+		time.Sleep(time.Until(due))
+
+		summary := digest.collect(time.Now())
+		// Standby instances only relay, the active one reports
+		if !digest.config.lease.isActive() {
+			continue
+		}
+		digest.config.notifications.publish(Event{
+			Type:    EventDigest,
+			Message: summary.message(),
+			Digest:  summary,
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS record types used by the resolver
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeSOA  uint16 = 6
+	dnsTypeAAAA uint16 = 28
+)
+
+// Used when the system resolver is used since it doesn't expose record TTLs
+const defaultSystemResolverTTL = 60 * time.Second
+
+// errNoRecords is returned (and cached) when a name has no records of the requested type
+var errNoRecords = errors.New("no such host or no records of the requested type")
+
+type dnsCacheKey struct {
+	host  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// DNSCacheStats is the metrics view of the DNS cache
+type DNSCacheStats struct {
+	Resolver     string          `json:"resolver"`
+	Hits         uint64          `json:"hits"`
+	NegativeHits uint64          `json:"negative_hits"`
+	Misses       uint64          `json:"misses"`
+	Failures     uint64          `json:"failures"`
+	StaleServed  uint64          `json:"stale_served"`
+	Entries      []DNSCacheEntry `json:"entries"`
+}
+
+// DNSCacheEntry is a single cached record set
+type DNSCacheEntry struct {
+	Host      string    `json:"host"`
+	Type      string    `json:"type"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Caches DNS answers for hostname backends. TTLs of the records are respected and
+// missing names are cached as well (negative caching).
+type dnsCache struct {
+	// DNS server to query, the system resolver is used if empty
+	server      string
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+
+	hits, negativeHits, misses, failures, staleServed atomic.Uint64
+}
+
+func newDNSCache(server string, negativeTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		server:      server,
+		negativeTTL: negativeTTL,
+		entries:     make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+}
+
+// Returns the first nameserver of /etc/resolv.conf, or an empty string if there is none
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+// Resolves the host to addresses of the given record type, using the cache if possible
+func (cache *dnsCache) lookup(ctx context.Context, host string, qtype uint16) ([]netip.Addr, error) {
+	key := dnsCacheKey{host: strings.ToLower(strings.TrimSuffix(host, ".")), qtype: qtype}
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	cache.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		if entry.err != nil {
+			cache.negativeHits.Add(1)
+			return nil, entry.err
+		}
+		cache.hits.Add(1)
+		return entry.addrs, nil
+	}
+	cache.misses.Add(1)
+
+	addrs, ttl, err := cache.query(ctx, key.host, qtype)
+	if err != nil && !errors.Is(err, errNoRecords) {
+		cache.failures.Add(1)
+		// Rather use a stale answer than failing while the DNS server is unreachable
+		if ok && entry.err == nil {
+			cache.staleServed.Add(1)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	if errors.Is(err, errNoRecords) && (ttl <= 0 || ttl > cache.negativeTTL) {
+		ttl = cache.negativeTTL
+	}
+
+	cache.mu.Lock()
+	cache.entries[key] = &dnsCacheEntry{addrs: addrs, err: err, expires: time.Now().Add(ttl)}
+	cache.mu.Unlock()
+
+	return addrs, err
+}
+
+// Queries the configured server or falls back to the system resolver
+func (cache *dnsCache) query(ctx context.Context, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	if cache.server != "" {
+		return queryDNS(ctx, cache.server, host, qtype)
+	}
+
+	network := "ip6"
+	if qtype == dnsTypeA {
+		network = "ip4"
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, 0, errNoRecords
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, defaultSystemResolverTTL, nil
+}
+
+// Sends a single query to a DNS server. UDP is used first with a fallback to TCP for truncated answers.
+func queryDNS(ctx context.Context, server, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	id := uint16(rand.IntN(1 << 16))
+	query, err := buildDNSQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+	}
+
+	response, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addrs, ttl, truncated, err := parseDNSResponse(response, id, qtype)
+	if truncated {
+		if response, err = exchangeDNS(ctx, "tcp", server, query); err != nil {
+			return nil, 0, err
+		}
+		addrs, ttl, _, err = parseDNSResponse(response, id, qtype)
+	}
+	return addrs, ttl, err
+}
+
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		var length [2]byte
+		if _, err := readFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err := readFull(conn, response)
+		return response, err
+	}
+
+	response := make([]byte, 1232)
+	n, err := conn.Read(response)
+	return response[:n], err
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := conn.Read(buf[read:])
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func buildDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, 0x0100) // Recursion desired
+	msg = binary.BigEndian.AppendUint16(msg, 1)      // One question
+	msg = append(msg, 0, 0, 0, 0, 0, 0)              // No answer, authority or additional records
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname '%s'", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // Class IN
+
+	return msg, nil
+}
+
+// Returns the offset right after the (possibly compressed) name at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("truncated DNS name")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xC0 == 0xC0:
+			// A compression pointer always ends the name
+			return off + 2, nil
+		default:
+			off += length + 1
+		}
+	}
+}
+
+// Extracts the addresses and the lowest TTL from a response. For negative answers the TTL
+// is taken from the SOA record of the authority section.
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) ([]netip.Addr, time.Duration, bool, error) {
+	if len(msg) < 12 {
+		return nil, 0, false, errors.New("DNS response too short")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != id {
+		return nil, 0, false, errors.New("DNS response id mismatch")
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x0200 != 0 {
+		return nil, 0, true, nil
+	}
+
+	rcode := flags & 0x000F
+	if rcode != 0 && rcode != 3 {
+		return nil, 0, false, fmt.Errorf("DNS server responded with rcode %d", rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	answers := int(binary.BigEndian.Uint16(msg[6:8]))
+	authorities := int(binary.BigEndian.Uint16(msg[8:10]))
+
+	off := 12
+	for range questions {
+		var err error
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, false, err
+		}
+		off += 4
+	}
+
+	var addrs []netip.Addr
+	var ttl, negativeTTL time.Duration
+	for i := range answers + authorities {
+		var err error
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, false, errors.New("truncated DNS record")
+		}
+
+		rrType := binary.BigEndian.Uint16(msg[off : off+2])
+		rrTTL := time.Duration(binary.BigEndian.Uint32(msg[off+4:off+8])) * time.Second
+		rdLength := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdLength > len(msg) {
+			return nil, 0, false, errors.New("truncated DNS record data")
+		}
+		rdata := msg[off : off+rdLength]
+		off += rdLength
+
+		switch {
+		case i < answers && rrType == qtype && rrType == dnsTypeAAAA && rdLength == 16:
+			addrs = append(addrs, netip.AddrFrom16([16]byte(rdata)))
+		case i < answers && rrType == qtype && rrType == dnsTypeA && rdLength == 4:
+			addrs = append(addrs, netip.AddrFrom4([4]byte(rdata)))
+		case i >= answers && rrType == dnsTypeSOA && rdLength >= 4:
+			// The negative TTL is the lower one of the SOA TTL and its minimum field
+			negativeTTL = min(rrTTL, time.Duration(binary.BigEndian.Uint32(rdata[rdLength-4:]))*time.Second)
+			continue
+		default:
+			continue
+		}
+
+		if ttl == 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, negativeTTL, false, errNoRecords
+	}
+	return addrs, ttl, false, nil
+}
+
+// Parses a NAT64 prefix, only the prefix lengths of RFC 6052 are allowed
+func parseNAT64Prefix(prefix string) (netip.Prefix, error) {
+	parsed, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !parsed.Addr().Is6() || parsed.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	}
+
+	switch parsed.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+		return parsed.Masked(), nil
+	default:
+		return netip.Prefix{}, fmt.Errorf("prefix length must be one of 32, 40, 48, 56, 64 or 96, not %d", parsed.Bits())
+	}
+}
+
+// Embeds the IPv4 address into the NAT64 prefix as described in RFC 6052 section 2.2.
+// Bits 64 to 71 are reserved and always skipped.
+func synthesizeNAT64(prefix netip.Prefix, ipv4 netip.Addr) netip.Addr {
+	addr := prefix.Addr().As16()
+	v4 := ipv4.As4()
+
+	pos := prefix.Bits() / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		addr[pos] = b
+		pos++
+	}
+
+	return netip.AddrFrom16(addr)
+}
+
+// Resolves a hostname to an IPv6 address. IPv6 literals are returned as is. If DNS64 is enabled
+// and the name only has A records, an address within the NAT64 prefix is synthesized.
+func (config *Config) resolveHost(ctx context.Context, host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+
+	addrs, err := config.dnsCache.lookup(ctx, host, dnsTypeAAAA)
+	if errors.Is(err, errNoRecords) && config.DNS64Prefix.IsValid() {
+		var v4Addrs []netip.Addr
+		if v4Addrs, err = config.dnsCache.lookup(ctx, host, dnsTypeA); err == nil {
+			return synthesizeNAT64(config.DNS64Prefix, v4Addrs[0]), nil
+		}
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	return addrs[0], nil
+}
+
+// Returns the metrics view of the cache
+func (cache *dnsCache) stats() DNSCacheStats {
+	resolver := cache.server
+	if resolver == "" {
+		resolver = "system"
+	}
+
+	stats := DNSCacheStats{
+		Resolver:     resolver,
+		Hits:         cache.hits.Load(),
+		NegativeHits: cache.negativeHits.Load(),
+		Misses:       cache.misses.Load(),
+		Failures:     cache.failures.Load(),
+		StaleServed:  cache.staleServed.Load(),
+		Entries:      []DNSCacheEntry{},
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for key, entry := range cache.entries {
+		e := DNSCacheEntry{Host: key.host, Type: "AAAA", Expires: entry.expires.UTC()}
+		if key.qtype == dnsTypeA {
+			e.Type = "A"
+		}
+		for _, addr := range entry.addrs {
+			e.Addresses = append(e.Addresses, addr.String())
+		}
+		if entry.err != nil {
+			e.Error = entry.err.Error()
+		}
+		stats.Entries = append(stats.Entries, e)
+	}
+
+	return stats
+}
+
+// Provides the metrics view of the DNS cache
+func dnsCacheHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config.dnsCache.stats())
+	}
+}
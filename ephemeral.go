@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetime of an ephemeral tunnel that doesn't ask for one
+const defaultEphemeralTTL = time.Hour
+
+// EphemeralTunnel is a temporary tunnel allocated with POST /tunnels/ephemeral
+type EphemeralTunnel struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	IPv4Port    string    `json:"ipv4_port"`
+	IPv6Port    string    `json:"ipv6_port"`
+	ListenAddr  string    `json:"listen_addr"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Request body of POST /tunnels/ephemeral
+type ephemeralRequest struct {
+	// Destination port on the target
+	Port int `json:"port"`
+	// Go duration like 30m, defaults to an hour
+	TTL         string `json:"ttl"`
+	Description string `json:"description"`
+}
+
+// Allocates temporary tunnels from a pool of source ports
+type ephemeralTunnels struct {
+	config *Config
+	// Source ports the tunnels are allocated from
+	ports []string
+	// Destination ports that may be requested, empty allows every port
+	destPorts []string
+	maxTTL    time.Duration
+
+	mu      sync.Mutex
+	tunnels map[string]*ephemeralTunnel
+}
+
+type ephemeralTunnel struct {
+	EphemeralTunnel
+	timer *time.Timer
+}
+
+// Parses EPHEMERAL_PORTS and EPHEMERAL_DEST_PORTS, returns nil if ephemeral tunnels are disabled
+func newEphemeralTunnels(config *Config, ports, destPorts string, maxTTL time.Duration) (*ephemeralTunnels, error) {
+	if strings.TrimSpace(ports) == "" {
+		return nil, nil
+	}
+
+	pool, err := parsePortList(ports)
+	if err != nil {
+		return nil, err
+	}
+	for _, port := range pool {
+		if slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("port %s is also a source port", port)
+		}
+	}
+
+	ephemeral := &ephemeralTunnels{config: config, ports: pool, maxTTL: maxTTL, tunnels: make(map[string]*ephemeralTunnel)}
+	if strings.TrimSpace(destPorts) != "" {
+		if ephemeral.destPorts, err = parsePortList(destPorts); err != nil {
+			return nil, fmt.Errorf("EPHEMERAL_DEST_PORTS: %v", err)
+		}
+	}
+	return ephemeral, nil
+}
+
+// Opens a tunnel from a free port of the pool to the destination port
+func (ephemeral *ephemeralTunnels) allocate(req ephemeralRequest) (EphemeralTunnel, error) {
+	ipv6Port := strconv.Itoa(req.Port)
+	if _, err := parsePort(ipv6Port); err != nil {
+		return EphemeralTunnel{}, errors.New("port must be a port between 1 and 65535")
+	}
+	if len(ephemeral.destPorts) > 0 && !slices.Contains(ephemeral.destPorts, ipv6Port) {
+		return EphemeralTunnel{}, fmt.Errorf("port %s is not allowed, see EPHEMERAL_DEST_PORTS", ipv6Port)
+	}
+
+	ttl := defaultEphemeralTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return EphemeralTunnel{}, fmt.Errorf("ttl '%s' is not a positive duration like 30m", req.TTL)
+		}
+	}
+	if ttl > ephemeral.maxTTL {
+		return EphemeralTunnel{}, fmt.Errorf("ttl is longer than %s", ephemeral.maxTTL)
+	}
+
+	ephemeral.mu.Lock()
+	defer ephemeral.mu.Unlock()
+
+	config := ephemeral.config
+	addr := config.publicIPv4.translate(config.TunnelListenAddr)
+	for _, ipv4Port := range ephemeral.ports {
+		if ephemeral.inUse(ipv4Port) {
+			continue
+		}
+		// The tunnels aren't configured, so the tunnel manager doesn't move them to a new public IPv4 address
+		listener, err := config.listenFollowing(config.TunnelListenAddr, ipv4Port)
+		if err != nil {
+			// Something else uses the port, try the next one
+			continue
+		}
+
+		now := time.Now().UTC()
+		tunnel := &ephemeralTunnel{EphemeralTunnel: EphemeralTunnel{
+			ID:          newRequestID(),
+			Name:        tunnelName(ipv4Port, ipv6Port),
+			IPv4Port:    ipv4Port,
+			IPv6Port:    ipv6Port,
+			ListenAddr:  addr,
+			Description: req.Description,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}}
+		tunnel.timer = time.AfterFunc(ttl, func() {
+			if ephemeral.remove(tunnel.ID) {
+				config.logger().Info("Ephemeral tunnel expired", slog.String("tunnel", tunnel.Name), slog.String("id", tunnel.ID))
+			}
+		})
+		ephemeral.tunnels[tunnel.ID] = tunnel
+		config.tunnels.serve(listener, tunnel.Name, ipv4Port, ipv6Port)
+		return tunnel.EphemeralTunnel, nil
+	}
+	return EphemeralTunnel{}, errNoEphemeralPort
+}
+
+var errNoEphemeralPort = errors.New("no port of EPHEMERAL_PORTS is free")
+
+// Whether a tunnel uses the port, must be called with the lock held
+func (ephemeral *ephemeralTunnels) inUse(ipv4Port string) bool {
+	for _, tunnel := range ephemeral.tunnels {
+		if tunnel.IPv4Port == ipv4Port {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes the listener of a tunnel, its open connections keep running. Returns false if the tunnel doesn't exist.
+func (ephemeral *ephemeralTunnels) remove(id string) bool {
+	ephemeral.mu.Lock()
+	defer ephemeral.mu.Unlock()
+
+	tunnel, ok := ephemeral.tunnels[id]
+	if !ok {
+		return false
+	}
+	tunnel.timer.Stop()
+	ephemeral.config.tunnels.close(tunnel.IPv4Port)
+	delete(ephemeral.tunnels, id)
+	return true
+}
+
+// Returns how many ports of the pool are in use
+func (ephemeral *ephemeralTunnels) usage() portPoolUsage {
+	ephemeral.mu.Lock()
+	defer ephemeral.mu.Unlock()
+	return portPoolUsage{"EPHEMERAL_PORTS", len(ephemeral.tunnels), len(ephemeral.ports)}
+}
+
+// Returns the open tunnels, the ones expiring first first
+func (ephemeral *ephemeralTunnels) list() []EphemeralTunnel {
+	ephemeral.mu.Lock()
+	defer ephemeral.mu.Unlock()
+
+	tunnels := []EphemeralTunnel{}
+	for _, tunnel := range ephemeral.tunnels {
+		// The listener may have moved to a new public IPv4 address since
+		current := tunnel.EphemeralTunnel
+		if listener, ok := ephemeral.config.tunnels.listener(current.IPv4Port); ok {
+			if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+				current.ListenAddr = addr.IP.String()
+			}
+		}
+		tunnels = append(tunnels, current)
+	}
+	slices.SortFunc(tunnels, func(a, b EphemeralTunnel) int {
+		return a.ExpiresAt.Compare(b.ExpiresAt)
+	})
+	return tunnels
+}
+
+// Lists, allocates and removes ephemeral tunnels
+func ephemeralTunnelsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFromContext(r.Context())
+
+		if config.ephemeral == nil {
+			http.Error(w, "Ephemeral tunnels are disabled, set EPHEMERAL_PORTS", http.StatusNotFound)
+			return
+		}
+
+		if r.Method != http.MethodGet && config.ReadOnly {
+			logger.Warn("Refused ephemeral tunnel change in read-only mode")
+			http.Error(w, "This instance is read-only, tunnels can't be changed", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.PathValue("id") == "":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(config.ephemeral.list())
+
+		case r.Method == http.MethodPost && r.PathValue("id") == "":
+			var req ephemeralRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+				http.Error(w, `Invalid request: expected a JSON body like {"port": 22, "ttl": "1h"}.`, http.StatusBadRequest)
+				return
+			}
+
+			tunnel, err := config.ephemeral.allocate(req)
+			if errors.Is(err, errNoEphemeralPort) {
+				logger.Warn("Ran out of ephemeral tunnel ports")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request: %v.", err), http.StatusBadRequest)
+				return
+			}
+
+			logger.Info("Opened an ephemeral tunnel", slog.String("tunnel", tunnel.Name), slog.String("id", tunnel.ID), slog.Time("expires_at", tunnel.ExpiresAt), slog.String("description", tunnel.Description))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(tunnel)
+
+		case r.Method == http.MethodDelete && r.PathValue("id") != "":
+			if !config.ephemeral.remove(r.PathValue("id")) {
+				http.Error(w, "Ephemeral tunnel not found", http.StatusNotFound)
+				return
+			}
+			logger.Info("Closed an ephemeral tunnel", slog.String("id", r.PathValue("id")))
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEphemeralTunnelFollowsPublicIPv4(t *testing.T) {
+	destPort := startEchoBackend(t)
+	config := newTestConfig(t, map[string]string{"SRC_PORTS": freePort(t), "DEST_PORTS": "1", "EPHEMERAL_PORTS": freePort(t)})
+	config.publicIPv4 = &publicIPv4Watcher{config: config, rebound: make(map[string]string), followers: make(map[*followingListener]struct{})}
+	config.storeIPv6Address("::1")
+	t.Cleanup(config.tunnels.stop)
+
+	port, _ := parsePort(destPort)
+	tunnel, err := config.ephemeral.allocate(ephemeralRequest{Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, dialTunnel(t, "127.0.0.1", tunnel.IPv4Port), "before")
+
+	config.publicIPv4.mu.Lock()
+	config.publicIPv4.rebound["127.0.0.1"] = "127.0.0.2"
+	config.publicIPv4.mu.Unlock()
+	config.publicIPv4.moveFollowers()
+
+	if tunnels := config.ephemeral.list(); len(tunnels) != 1 || tunnels[0].ListenAddr != "127.0.0.2" {
+		t.Fatalf("tunnels = %+v, want one on 127.0.0.2", tunnels)
+	}
+	expectEcho(t, dialTunnel(t, "127.0.0.2", tunnel.IPv4Port), "after")
+	if conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", tunnel.IPv4Port)); err == nil {
+		conn.Close()
+		t.Error("the old address still accepts connections")
+	}
+}
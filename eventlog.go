@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Name of the file in the data dir that holds the event log
+const eventLogFile = "events.jsonl"
+
+// Events that are only written to the event log, they are never sent to notifiers
+const (
+	EventTunnelOpened EventType = "tunnel_opened"
+	EventTunnelClosed EventType = "tunnel_closed"
+)
+
+// Appends events as JSON lines to a file in the data dir and rotates it once it grows
+// past the maximum size. Nil if disabled.
+type eventLog struct {
+	path    string
+	maxSize int64
+	// Number of rotated files that are kept, events.jsonl.1 is the newest
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Returns nil if the event log is disabled
+func newEventLog(enabled bool, path string, maxSize int64, backups int) *eventLog {
+	if !enabled {
+		return nil
+	}
+	return &eventLog{path: path, maxSize: maxSize, backups: backups}
+}
+
+// Appends the event, errors are logged since events must never hold up the relay
+func (events *eventLog) write(logger *slog.Logger, event Event) {
+	if events == nil {
+		return
+	}
+
+	// Keep the arrows of tunnel names readable
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return
+	}
+	line := buf.Bytes()
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	if err := events.open(); err != nil {
+		logger.Warn("Failed to open the event log", slog.String("path", events.path), slog.Any("error", err))
+		return
+	}
+	if events.size > 0 && events.size+int64(len(line)) > events.maxSize {
+		if err := events.rotate(); err != nil {
+			logger.Warn("Failed to rotate the event log", slog.String("path", events.path), slog.Any("error", err))
+		}
+		if events.file == nil {
+			return
+		}
+	}
+
+	n, err := events.file.Write(line)
+	events.size += int64(n)
+	if err != nil {
+		logger.Warn("Failed to write to the event log", slog.String("path", events.path), slog.Any("error", err))
+	}
+}
+
+// Opens the file if it isn't open yet, must be called with the lock held
+func (events *eventLog) open() error {
+	if events.file != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(events.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(events.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	events.file, events.size = file, info.Size()
+	return nil
+}
+
+// Shifts the rotated files by one, dropping the oldest, and starts a new file.
+// Must be called with the lock held.
+func (events *eventLog) rotate() error {
+	events.file.Close()
+	events.file = nil
+
+	if events.backups == 0 {
+		os.Remove(events.path)
+	} else {
+		for i := events.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", events.path, i), fmt.Sprintf("%s.%d", events.path, i+1))
+		}
+		if err := os.Rename(events.path, events.path+".1"); err != nil {
+			// Keep appending to the current file
+			events.open()
+			return err
+		}
+	}
+	return events.open()
+}
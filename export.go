@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// Supported export formats
+var exportFormats = map[string]func(config *Config, w io.Writer) error{
+	"haproxy": exportHAProxy,
+	"nginx":   exportNginx,
+}
+
+// Handles the `export <format>` command and writes the rendered config to stdout
+func runExport(config *Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: four2six export <%s>", strings.Join(exportFormatNames(), "|"))
+	}
+
+	render, ok := exportFormats[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown export format '%s', expected one of: %s", args[0], strings.Join(exportFormatNames(), ", "))
+	}
+
+	// Use the persisted address if there is one, just like the relay would
+	if err := config.loadIPv6Address(); err != nil {
+		slog.Warn("Failed to load IPv6 address, using default", slog.Any("error", err), slog.String("ipv6_address", config.ipv6Address()))
+	}
+
+	return render(config, os.Stdout)
+}
+
+func exportFormatNames() []string {
+	return []string{"haproxy", "nginx"}
+}
+
+// Renders the tunnels as HAProxy TCP frontends and backends. Failover targets become backup servers.
+func exportHAProxy(config *Config, w io.Writer) error {
+	fmt.Fprintln(w, "# Generated by four2six export haproxy")
+	fmt.Fprintf(w, "# Target: %s\n", config.primaryTarget())
+	for i, ipv4Port := range config.IPv4Ports {
+		ipv6Port := config.IPv6Ports[i]
+		name := fmt.Sprintf("four2six_%s_%s", ipv4Port, ipv6Port)
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "frontend %s\n", name)
+		fmt.Fprintln(w, "    mode tcp")
+		bind := net.JoinHostPort(config.tunnelListenAddr(ipv4Port), ipv4Port)
+		if path, ok := strings.CutPrefix(config.tunnelListenAddr(ipv4Port), "unix://"); ok {
+			bind = path
+		}
+		fmt.Fprintf(w, "    bind %s\n", bind)
+		fmt.Fprintf(w, "    default_backend %s\n", name)
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "backend %s\n", name)
+		fmt.Fprintln(w, "    mode tcp")
+		for j, target := range config.tunnelTargets(ipv4Port) {
+			backup := ""
+			if j > 0 {
+				backup = " backup"
+			}
+			fmt.Fprintf(w, "    server target%d %s check%s\n", j+1, net.JoinHostPort(target, ipv6Port), backup)
+		}
+	}
+
+	return nil
+}
+
+// Renders the tunnels as an nginx stream {} block. Failover targets become backup servers of an upstream.
+func exportNginx(config *Config, w io.Writer) error {
+	fmt.Fprintln(w, "# Generated by four2six export nginx")
+	fmt.Fprintf(w, "# Target: %s\n", config.primaryTarget())
+	fmt.Fprintln(w, "stream {")
+	for i, ipv4Port := range config.IPv4Ports {
+		ipv6Port := config.IPv6Ports[i]
+		targets := config.tunnelTargets(ipv4Port)
+
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		proxyPass := net.JoinHostPort(targets[0], ipv6Port)
+		if len(targets) > 1 {
+			proxyPass = fmt.Sprintf("four2six_%s_%s", ipv4Port, ipv6Port)
+			fmt.Fprintf(w, "    upstream %s {\n", proxyPass)
+			for j, target := range targets {
+				backup := ""
+				if j > 0 {
+					backup = " backup"
+				}
+				fmt.Fprintf(w, "        server %s%s;\n", net.JoinHostPort(target, ipv6Port), backup)
+			}
+			fmt.Fprintln(w, "    }")
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintln(w, "    server {")
+		listen := net.JoinHostPort(config.tunnelListenAddr(ipv4Port), ipv4Port)
+		if path, ok := strings.CutPrefix(config.tunnelListenAddr(ipv4Port), "unix://"); ok {
+			listen = "unix:" + path
+		}
+		fmt.Fprintf(w, "        listen %s;\n", listen)
+		fmt.Fprintf(w, "        proxy_pass %s;\n", proxyPass)
+		fmt.Fprintln(w, "    }")
+	}
+	fmt.Fprintln(w, "}")
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// How long to wait for the AAAA answer once the A answer arrived, see RFC 8305 section 3
+const resolutionDelay = 50 * time.Millisecond
+
+type lookupResult struct {
+	addrs []netip.Addr
+	err   error
+}
+
+// Resolves the AAAA and A records of a hostname in parallel and returns the addresses in the
+// order they should be tried: IPv6 first, then alternating between the families.
+// Literals are returned as is.
+func (config *Config) resolveDualStack(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	v6Results := make(chan lookupResult, 1)
+	v4Results := make(chan lookupResult, 1)
+	go func() {
+		addrs, err := config.dnsCache.lookup(ctx, host, dnsTypeAAAA)
+		v6Results <- lookupResult{addrs, err}
+	}()
+	go func() {
+		addrs, err := config.dnsCache.lookup(ctx, host, dnsTypeA)
+		v4Results <- lookupResult{addrs, err}
+	}()
+
+	var v6, v4 lookupResult
+	select {
+	case v6 = <-v6Results:
+		v4 = <-v4Results
+	case v4 = <-v4Results:
+		// Don't hold back the IPv4 answer for long if the AAAA query is slow
+		if v4.err != nil {
+			v6 = <-v6Results
+			break
+		}
+		select {
+		case v6 = <-v6Results:
+		case <-time.After(resolutionDelay):
+			v6.err = errors.New("AAAA lookup did not finish within the resolution delay")
+		}
+	}
+
+	// Synthesized addresses reach IPv4-only names through NAT64 if the relay has no IPv4 route
+	if errors.Is(v6.err, errNoRecords) && v4.err == nil && config.DNS64Prefix.IsValid() {
+		v6 = lookupResult{addrs: []netip.Addr{synthesizeNAT64(config.DNS64Prefix, v4.addrs[0])}}
+	}
+
+	if v6.err != nil && v4.err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, errors.Join(v6.err, v4.err))
+	}
+	return interleaveAddrs(v6.addrs, v4.addrs), nil
+}
+
+// Alternates between the address families, starting with IPv6
+func interleaveAddrs(v6, v4 []netip.Addr) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(v6)+len(v4))
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i].Unmap())
+		}
+	}
+	return addrs
+}
+
+// Connects to a target with Happy Eyeballs (RFC 8305): the addresses are tried one after another,
+// each HAPPY_EYEBALLS_DELAY or as soon as the previous attempt failed, and the first connection wins.
+func (config *Config) dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, host, port string) (net.Conn, error) {
+	addrs, err := config.resolveDualStack(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(addrs))
+
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(config.HappyEyeballsDelay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close the connections of attempts that still succeed after cancelling them
+				go func(pending int) {
+					for range pending {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			errs = append(errs, result.err)
+			if next < len(addrs) {
+				start()
+				timer.Reset(config.HappyEyeballsDelay)
+			}
+
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(config.HappyEyeballsDelay)
+			}
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a passive data tunnel waits for the client to connect
+const ftpDataTimeout = 30 * time.Second
+
+// Longest command or reply line, anything longer isn't FTP
+const maxFTPLineLength = 4096
+
+// Port in a 229 Entering Extended Passive Mode (|||port|) reply
+var ftpExtendedPassivePort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// Makes passive FTP work through the relay. The backend is asked for an extended passive port,
+// which is forwarded from a port of FTP_PASSIVE_PORTS, and the client gets that port instead.
+type ftpHelper struct {
+	config *Config
+	// Source ports of the FTP control tunnels
+	ports []string
+	// Pool of IPv4 ports for the data tunnels
+	passivePorts []string
+	// IPv4 address announced in PASV replies, empty to detect it
+	passiveAddr string
+
+	mu sync.Mutex
+	// Passive ports with an open data tunnel
+	inUse map[string]bool
+	next  int
+}
+
+// Parses FTP_PORTS, FTP_PASSIVE_PORTS and FTP_PASSIVE_ADDRESS, returns nil if no tunnel speaks FTP
+func newFTPHelper(config *Config, ports, passivePorts, passiveAddr string) (*ftpHelper, error) {
+	if strings.TrimSpace(ports) == "" {
+		return nil, nil
+	}
+
+	helper := &ftpHelper{config: config, inUse: make(map[string]bool)}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if !slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if strings.HasPrefix(config.tunnelListenAddr(port), "unix://") {
+			return nil, fmt.Errorf("tunnel %s listens on a unix socket, FTP needs an IPv4 address for the data connections", port)
+		}
+		helper.ports = append(helper.ports, port)
+	}
+
+	if strings.TrimSpace(passivePorts) == "" {
+		return nil, errors.New("FTP_PASSIVE_PORTS must be set for FTP tunnels")
+	}
+	var err error
+	if helper.passivePorts, err = parsePortList(passivePorts); err != nil {
+		return nil, fmt.Errorf("FTP_PASSIVE_PORTS: %v", err)
+	}
+	for _, port := range helper.passivePorts {
+		if slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("passive port %s is also a source port", port)
+		}
+	}
+
+	if passiveAddr != "" {
+		addr, err := netip.ParseAddr(passiveAddr)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("FTP_PASSIVE_ADDRESS '%s' is not an IPv4 address", passiveAddr)
+		}
+		helper.passiveAddr = addr.String()
+	}
+
+	return helper, nil
+}
+
+// Whether the tunnel speaks FTP
+func (helper *ftpHelper) handles(ipv4Port string) bool {
+	return helper != nil && slices.Contains(helper.ports, ipv4Port)
+}
+
+// Opens a listener on a free passive port
+func (helper *ftpHelper) listenPassive(addr string) (net.Listener, string, error) {
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+
+	var lastErr error = errors.New("all passive ports are in use")
+	for range helper.passivePorts {
+		port := helper.passivePorts[helper.next]
+		helper.next = (helper.next + 1) % len(helper.passivePorts)
+		if helper.inUse[port] {
+			continue
+		}
+
+		// A client that didn't connect yet reaches the data tunnel on the new address after the public IPv4 changed
+		listener, err := helper.config.listenFollowing(addr, port)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		helper.inUse[port] = true
+		return listener, port, nil
+	}
+	return nil, "", lastErr
+}
+
+func (helper *ftpHelper) release(port string) {
+	helper.mu.Lock()
+	delete(helper.inUse, port)
+	helper.mu.Unlock()
+}
+
+// Returns how many passive ports are in use
+func (helper *ftpHelper) usage() portPoolUsage {
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+	return portPoolUsage{"FTP_PASSIVE_PORTS", len(helper.inUse), len(helper.passivePorts)}
+}
+
+// A control connection between a client and the backend
+type ftpSession struct {
+	helper   *ftpHelper
+	logger   *slog.Logger
+	tunnel   string
+	ipv4Port string
+	clientIP string
+	src, dst net.Conn
+
+	// Replies to the client come from both directions
+	writeMu sync.Mutex
+	// Passive commands sent to the backend as EPSV whose reply is outstanding
+	pending chan string
+}
+
+// Forwards an FTP control connection and rewrites the passive mode replies. Returns the bytes sent from src to dst and back.
+func (helper *ftpHelper) forward(tunnel, ipv4Port, clientIP string, src, dst net.Conn) (int64, int64) {
+	defer src.Close()
+	defer dst.Close()
+
+	src, dst = helper.config.wrapTunnelConns(ipv4Port, src, dst)
+	session := &ftpSession{
+		helper:   helper,
+		logger:   helper.config.logger().With(slog.String("tunnel", tunnel), slog.String("client", src.RemoteAddr().String())),
+		tunnel:   tunnel,
+		ipv4Port: ipv4Port,
+		clientIP: clientIP,
+		src:      src,
+		dst:      dst,
+		pending:  make(chan string, 16),
+	}
+
+	downloaded := make(chan int64, 1)
+	go func() {
+		downloaded <- session.relayReplies()
+	}()
+	uploaded := session.relayCommands()
+
+	// Stop the other direction before waiting for its count
+	src.Close()
+	dst.Close()
+	return uploaded, <-downloaded
+}
+
+// Answers the client directly
+func (session *ftpSession) reply(line string) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	_, err := io.WriteString(session.src, line+"\r\n")
+	return err
+}
+
+// Forwards the commands of the client, passive mode is always requested as EPSV because the
+// backend is usually reached over IPv6. Active mode can't work through the relay.
+func (session *ftpSession) relayCommands() int64 {
+	reader := bufio.NewReaderSize(session.src, maxFTPLineLength)
+	var written int64
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			session.logger.Warn("Closing FTP connection after an overlong command")
+			return written
+		}
+		if len(line) == 0 {
+			return written
+		}
+
+		verb, arg, _ := strings.Cut(strings.TrimSpace(string(line)), " ")
+		switch strings.ToUpper(verb) {
+		case "PASV", "EPSV":
+			if strings.EqualFold(arg, "ALL") {
+				break
+			}
+			select {
+			case session.pending <- strings.ToUpper(verb):
+			default:
+				session.logger.Warn("Closing FTP connection with too many outstanding passive commands")
+				return written
+			}
+			line = []byte("EPSV\r\n")
+		case "PORT", "EPRT":
+			if session.reply("502 Active mode is not supported through the relay, use passive mode.") != nil {
+				return written
+			}
+			continue
+		case "AUTH":
+			// The passive replies can't be rewritten once the connection is encrypted
+			if session.reply("502 TLS is not supported through the relay.") != nil {
+				return written
+			}
+			continue
+		}
+
+		n, werr := session.dst.Write(line)
+		written += int64(n)
+		if werr != nil || err != nil {
+			return written
+		}
+	}
+}
+
+// Forwards the replies of the backend and replaces the passive ports with forwarded ones
+func (session *ftpSession) relayReplies() int64 {
+	reader := bufio.NewReaderSize(session.dst, maxFTPLineLength)
+	var written int64
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			session.logger.Warn("Closing FTP connection after an overlong reply")
+			return written
+		}
+		if len(line) == 0 {
+			return written
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		if isFinalFTPReply(text) && (text[0] == '2' || text[0] == '4' || text[0] == '5') {
+			select {
+			case command := <-session.pending:
+				if strings.HasPrefix(text, "229 ") {
+					text = session.openDataTunnel(command, text)
+				}
+				line = []byte(text + "\r\n")
+			default:
+			}
+		}
+
+		session.writeMu.Lock()
+		n, werr := session.src.Write(line)
+		session.writeMu.Unlock()
+		written += int64(n)
+		if werr != nil || err != nil {
+			return written
+		}
+	}
+}
+
+// Whether the line is the last line of a reply, e.g. "229 Entering..." but not "229-..."
+func isFinalFTPReply(line string) bool {
+	if len(line) < 4 || line[3] != ' ' {
+		return false
+	}
+	_, err := strconv.Atoi(line[:3])
+	return err == nil
+}
+
+// Forwards a passive port to the port of the backend's 229 reply and returns the reply for the client
+func (session *ftpSession) openDataTunnel(command, reply string) string {
+	match := ftpExtendedPassivePort.FindStringSubmatch(reply)
+	if match == nil {
+		session.logger.Warn("Backend sent an unexpected passive mode reply", slog.String("reply", reply))
+		return "425 Can't open passive connection."
+	}
+	backend, ok := session.dst.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "425 Can't open passive connection."
+	}
+	backendAddr := net.JoinHostPort(backend.IP.String(), match[1])
+
+	announced, ok := session.helper.config.advertisedIPv4(session.helper.passiveAddr, session.src)
+	if !ok {
+		session.logger.Error("The relay doesn't know its IPv4 address, set FTP_PASSIVE_ADDRESS")
+		return "425 Can't open passive connection."
+	}
+
+	// The data tunnel listens on the address the control connection came in on
+	listenAddr := "0.0.0.0"
+	if local, ok := session.src.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() != nil {
+		listenAddr = local.IP.String()
+	}
+	listener, port, err := session.helper.listenPassive(listenAddr)
+	if err != nil {
+		session.logger.Error("Error opening a passive data tunnel", slog.Any("error", err))
+		return "425 Can't open passive connection."
+	}
+	go session.serveDataTunnel(listener, port, backendAddr)
+
+	if command == "EPSV" {
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%s|)", port)
+	}
+	n, _ := strconv.Atoi(port)
+	ip := announced.As4()
+	return fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], n/256, n%256)
+}
+
+// Forwards the first connection of the client to the backend's data port and closes the listener
+func (session *ftpSession) serveDataTunnel(listener net.Listener, port, backendAddr string) {
+	defer session.helper.release(port)
+	defer listener.Close()
+
+	logger := session.logger.With(slog.String("passive_port", port))
+	if deadlineListener, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+		deadlineListener.SetDeadline(time.Now().Add(ftpDataTimeout))
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Warn("Client didn't open the passive data connection", slog.Any("error", err))
+			return
+		}
+
+		// Only the client of the control connection may use the data tunnel
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if clientIP != session.clientIP {
+			logger.Warn("Rejected a data connection from another client", slog.String("data_client", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
+		listener.Close()
+
+		config := session.helper.config
+		dst, err := config.tunnelDialer(session.ipv4Port).Dial("tcp", backendAddr)
+		if err != nil {
+			logger.Error("Error dialing the passive data port", slog.String("target", backendAddr), slog.Any("error", err))
+			conn.Close()
+			return
+		}
+
+		// Data connections share the rate limit of the control tunnel
+		uploaded, downloaded := session.helper.forwardData(config.limitTunnel(session.ipv4Port, conn, dst))
+		config.digest.recordTraffic(session.tunnel, uploaded, downloaded)
+		logger.Debug("Passive data connection closed", slog.Int64("bytes_uploaded", uploaded), slog.Int64("bytes_downloaded", downloaded))
+		return
+	}
+}
+
+// Forwards a data connection. FTP marks the end of a transfer by closing it, so the first direction
+// that ends closes both instead of waiting for the other side like the tunnels do.
+func (helper *ftpHelper) forwardData(src, dst net.Conn) (int64, int64) {
+	config := helper.config
+	config.tuneTCPConn(src)
+	config.tuneTCPConn(dst)
+
+	uploaded := make(chan int64, 1)
+	downloaded := make(chan int64, 1)
+	go func() {
+		n, _ := config.copyConn(dst, src)
+		uploaded <- n
+	}()
+	go func() {
+		n, _ := config.copyConn(src, dst)
+		downloaded <- n
+	}()
+
+	var up, down int64
+	select {
+	case up = <-uploaded:
+		src.Close()
+		dst.Close()
+		down = <-downloaded
+	case down = <-downloaded:
+		src.Close()
+		dst.Close()
+		up = <-uploaded
+	}
+	return up, down
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts an FTP server on the IPv6 loopback address that answers EPSV with a data port sending "payload".
+// Returns its port and the commands it received.
+func startFTPBackend(t *testing.T) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := make(chan string, 64)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTPBackend(t, conn, commands)
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), commands
+}
+
+func serveFTPBackend(t *testing.T, conn net.Conn, commands chan string) {
+	defer conn.Close()
+	io.WriteString(conn, "220 Ready\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		commands <- command
+
+		switch command {
+		case "EPSV":
+			data, err := net.Listen("tcp6", "[::1]:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				defer data.Close()
+				conn, err := data.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, "payload")
+				conn.Close()
+			}()
+			fmt.Fprintf(conn, "229 Entering Extended Passive Mode (|||%d|)\r\n", data.Addr().(*net.TCPAddr).Port)
+		case "EPSV ALL":
+			io.WriteString(conn, "200 EPSV ALL ok\r\n")
+		default:
+			io.WriteString(conn, "200 Ok\r\n")
+		}
+	}
+}
+
+// Starts a relay with an FTP tunnel to the backend, returns the config and the source port
+func startFTPTunnel(t *testing.T, backendPort string, env map[string]string) (*Config, string) {
+	t.Helper()
+	srcPort := freePort(t)
+	values := map[string]string{"SRC_PORTS": srcPort, "DEST_PORTS": backendPort, "FTP_PORTS": srcPort, "FTP_PASSIVE_PORTS": freePort(t) + "," + freePort(t)}
+	maps.Copy(values, env)
+	config := newTestConfig(t, values)
+	config.storeIPv6Address("::1")
+	config.tunnels.start()
+	t.Cleanup(config.tunnels.stop)
+	return config, srcPort
+}
+
+// Opens a control connection and reads the greeting
+func dialFTP(t *testing.T, port string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn := dialTunnel(t, "127.0.0.1", port)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if greeting := ftpCommand(t, conn, reader, ""); !strings.HasPrefix(greeting, "220 ") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	return conn, reader
+}
+
+// Sends a command unless it's empty and returns the reply line
+func ftpCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) string {
+	t.Helper()
+	if command != "" {
+		if _, err := io.WriteString(conn, command+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Returns the next command the backend received
+func nextFTPCommand(t *testing.T, commands chan string) string {
+	t.Helper()
+	select {
+	case command := <-commands:
+		return command
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend received no command")
+		return ""
+	}
+}
+
+// Reads everything the data tunnel sends, optionally connecting from another local address
+func readFTPData(t *testing.T, port, localIP string) (string, error) {
+	t.Helper()
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	if localIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localIP)}
+	}
+	conn, err := dialer.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	return string(data), err
+}
+
+var ftpPassiveReply = regexp.MustCompile(`^227 Entering Passive Mode \(127,0,0,1,(\d+),(\d+)\)\.$`)
+
+func TestFTPPassiveReplies(t *testing.T) {
+	backendPort, commands := startFTPBackend(t)
+	config, srcPort := startFTPTunnel(t, backendPort, nil)
+
+	tests := []struct {
+		command string
+		port    func(reply string) string
+	}{
+		{"PASV", func(reply string) string {
+			match := ftpPassiveReply.FindStringSubmatch(reply)
+			if match == nil {
+				return ""
+			}
+			high, _ := strconv.Atoi(match[1])
+			low, _ := strconv.Atoi(match[2])
+			return strconv.Itoa(high*256 + low)
+		}},
+		{"EPSV", func(reply string) string {
+			if match := ftpExtendedPassivePort.FindStringSubmatch(reply); match != nil && strings.HasPrefix(reply, "229 ") {
+				return match[1]
+			}
+			return ""
+		}},
+	}
+	for _, test := range tests {
+		conn, reader := dialFTP(t, srcPort)
+		reply := ftpCommand(t, conn, reader, test.command)
+		// The backend is always asked for an extended passive port
+		if command := nextFTPCommand(t, commands); command != "EPSV" {
+			t.Errorf("%s: backend received %q, want EPSV", test.command, command)
+		}
+
+		port := test.port(reply)
+		if !slices.Contains(config.ftp.passivePorts, port) {
+			t.Errorf("%s: reply %q doesn't point to a passive port of the pool", test.command, reply)
+			continue
+		}
+		if data, err := readFTPData(t, port, ""); err != nil || data != "payload" {
+			t.Errorf("%s: data connection got %q, %v", test.command, data, err)
+		}
+	}
+}
+
+func TestFTPCommandsNotForwarded(t *testing.T) {
+	backendPort, commands := startFTPBackend(t)
+	_, srcPort := startFTPTunnel(t, backendPort, nil)
+
+	tests := []struct {
+		command, reply string
+		forwarded      bool
+	}{
+		{command: "PORT 127,0,0,1,4,1", reply: "502 Active mode"},
+		{command: "EPRT |1|127.0.0.1|1025|", reply: "502 Active mode"},
+		{command: "AUTH TLS", reply: "502 TLS"},
+		{command: "auth ssl", reply: "502 TLS"},
+		// EPSV ALL only tells the server that no PASV will follow, it opens no data tunnel
+		{command: "EPSV ALL", reply: "200 EPSV ALL ok", forwarded: true},
+	}
+	for _, test := range tests {
+		conn, reader := dialFTP(t, srcPort)
+		if reply := ftpCommand(t, conn, reader, test.command); !strings.HasPrefix(reply, test.reply) {
+			t.Errorf("%s: reply = %q, want %q", test.command, reply, test.reply)
+		}
+
+		// The next command shows whether the backend saw the first one
+		if reply := ftpCommand(t, conn, reader, "NOOP"); reply != "200 Ok" {
+			t.Errorf("%s: NOOP reply = %q", test.command, reply)
+		}
+		want := []string{"NOOP"}
+		if test.forwarded {
+			want = []string{test.command, "NOOP"}
+		}
+		for _, command := range want {
+			if got := nextFTPCommand(t, commands); got != command {
+				t.Errorf("%s: backend received %q, want %q", test.command, got, command)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestFTPPassivePoolExhausted(t *testing.T) {
+	backendPort, _ := startFTPBackend(t)
+	config, srcPort := startFTPTunnel(t, backendPort, map[string]string{"FTP_PASSIVE_PORTS": freePort(t)})
+
+	conn, reader := dialFTP(t, srcPort)
+	first := ftpCommand(t, conn, reader, "EPSV")
+	if !strings.HasPrefix(first, "229 ") {
+		t.Fatalf("first reply = %q", first)
+	}
+	if reply := ftpCommand(t, conn, reader, "EPSV"); !strings.HasPrefix(reply, "425 ") {
+		t.Errorf("reply with the only passive port in use = %q, want 425", reply)
+	}
+	if usage := config.ftp.usage(); usage.used != 1 {
+		t.Errorf("%d passive ports in use, want 1", usage.used)
+	}
+
+	// The port is free again once its data connection is done
+	if data, err := readFTPData(t, ftpExtendedPassivePort.FindStringSubmatch(first)[1], ""); err != nil || data != "payload" {
+		t.Fatalf("data connection got %q, %v", data, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for config.ftp.usage().used != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the passive port wasn't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := ftpCommand(t, conn, reader, "EPSV"); !strings.HasPrefix(reply, "229 ") {
+		t.Errorf("reply after the release = %q", reply)
+	}
+}
+
+func TestFTPDataConnectionFromOtherClient(t *testing.T) {
+	backendPort, _ := startFTPBackend(t)
+	_, srcPort := startFTPTunnel(t, backendPort, nil)
+
+	conn, reader := dialFTP(t, srcPort)
+	reply := ftpCommand(t, conn, reader, "EPSV")
+	match := ftpExtendedPassivePort.FindStringSubmatch(reply)
+	if match == nil {
+		t.Fatalf("reply = %q", reply)
+	}
+
+	// Linux routes all of 127.0.0.0/8 to the loopback interface, so 127.0.0.2 is another client
+	data, err := readFTPData(t, match[1], "127.0.0.2")
+	if err == nil && data != "" {
+		t.Errorf("another client got %q from the data tunnel", data)
+	}
+	if data, err := readFTPData(t, match[1], ""); err != nil || data != "payload" {
+		t.Errorf("the client got %q, %v after another client was rejected", data, err)
+	}
+}
+
+func TestFTPControlConnectionIdleTimeout(t *testing.T) {
+	backendPort, _ := startFTPBackend(t)
+	_, srcPort := startFTPTunnel(t, backendPort, map[string]string{"IDLE_TIMEOUT": "200ms"})
+
+	conn, reader := dialFTP(t, srcPort)
+	start := time.Now()
+	if _, err := reader.ReadString('\n'); err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("idle control connection still open after %s: %v", time.Since(start), err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,359 @@
+// Package harness runs four2six end to end for integration tests. Every Lab gets two Linux
+// network namespaces connected by a veth pair: the relay runs in one of them, a fake backend
+// in the other one, the "home network". Tests connect to the relay's IPv4 port, renumber the
+// home network and check where their connections end up:
+//
+//	func TestRenumbering(t *testing.T) {
+//		lab := harness.New(t, harness.Options{Env: []string{"SESSION_PINNING_WINDOW=1m"}})
+//		old := lab.HomeAddress()
+//		renumbered := lab.Renumber()
+//		if served := lab.ServedBy(); served != renumbered {
+//			t.Fatalf("served by %s instead of %s", served, renumbered)
+//		}
+//		lab.Retire(old)
+//	}
+//
+// The namespaces need root and the ip command. Tests are skipped on other platforms and
+// without root, so they can stay in a test suite that also runs on developer machines.
+// The relay binary is taken from Options.Binary, $FOUR2SIX_BINARY or four2six in $PATH.
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Home addresses are taken from this prefix, the n-th address lives in its own /64
+const homePrefix = "fd00:4206"
+
+// Token of the relay's webhook
+const token = "harness"
+
+// How long the relay may take to start
+const startTimeout = 10 * time.Second
+
+// Options configure a Lab
+type Options struct {
+	// Path of the four2six binary
+	Binary string
+	// Additional environment of the relay like DIAL_RETRY_WINDOW=5s
+	Env []string
+	// Port the backend listens on in the home network, 8080 by default
+	BackendPort int
+	// IPv4 port of the tunnel on the relay, 8080 by default
+	RelayPort int
+}
+
+// Lab is a relay and a backend in their own network namespaces
+type Lab struct {
+	t    testing.TB
+	opts Options
+
+	relayNS netns
+	homeNS  netns
+	homeIf  string
+
+	mu      sync.Mutex
+	address netip.Addr
+	next    int
+
+	backend net.Listener
+	relay   *exec.Cmd
+	logs    lockedBuffer
+}
+
+// Unique names of the namespaces of the labs of this process
+var labCount atomic.Int32
+
+// Starts a lab and stops it once the test is done. The home network starts with one address
+// that the relay already forwards to.
+func New(t testing.TB, opts Options) *Lab {
+	t.Helper()
+	if err := supported(); err != nil {
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+
+	binary, err := findBinary(opts.Binary)
+	if err != nil {
+		t.Fatalf("four2six binary not found, set Options.Binary or FOUR2SIX_BINARY: %v", err)
+	}
+	opts.Binary = binary
+	if opts.BackendPort == 0 {
+		opts.BackendPort = 8080
+	}
+	if opts.RelayPort == 0 {
+		opts.RelayPort = 8080
+	}
+
+	id := fmt.Sprintf("f2s%d%d", os.Getpid()%100000, labCount.Add(1))
+	lab := &Lab{t: t, opts: opts, homeIf: id + "h"}
+	t.Cleanup(lab.stop)
+
+	if lab.relayNS, err = createNetns(id + "r"); err != nil {
+		t.Fatalf("creating the relay namespace: %v", err)
+	}
+	if lab.homeNS, err = createNetns(id + "h"); err != nil {
+		t.Fatalf("creating the home namespace: %v", err)
+	}
+	relayIf := id + "r"
+	lab.run("link", "add", relayIf, "netns", lab.relayNS.name, "type", "veth", "peer", "name", lab.homeIf, "netns", lab.homeNS.name)
+	for _, side := range []struct {
+		ns    netns
+		iface string
+		addr  string
+	}{{lab.relayNS, relayIf, homePrefix + ":ffff::1/64"}, {lab.homeNS, lab.homeIf, homePrefix + ":fffe::1/64"}} {
+		lab.run("-n", side.ns.name, "link", "set", "lo", "up")
+		lab.run("-n", side.ns.name, "link", "set", side.iface, "up")
+		lab.run("-n", side.ns.name, "addr", "add", side.addr, "dev", side.iface, "nodad")
+		// Every home prefix is on the link, so renumbering doesn't need routers
+		lab.run("-n", side.ns.name, "-6", "route", "add", homePrefix+"::/32", "dev", side.iface)
+	}
+
+	lab.address = lab.addAddress()
+	lab.startBackend()
+	lab.startRelay()
+	if err := lab.Update(lab.address); err != nil {
+		t.Fatalf("sending the first address: %v", err)
+	}
+	return lab
+}
+
+// Returns the address the relay should currently forward to
+func (lab *Lab) HomeAddress() netip.Addr {
+	lab.mu.Lock()
+	defer lab.mu.Unlock()
+	return lab.address
+}
+
+// Adds an address from a new prefix to the home network and sends it to the relay.
+// The previous address keeps working until it's retired, like during make-before-break renumbering.
+func (lab *Lab) Renumber() netip.Addr {
+	lab.t.Helper()
+	addr := lab.addAddress()
+	if err := lab.Update(addr); err != nil {
+		lab.t.Fatalf("sending the new address: %v", err)
+	}
+	lab.mu.Lock()
+	lab.address = addr
+	lab.mu.Unlock()
+	return addr
+}
+
+// Removes an address from the home network. Its prefix becomes unreachable like after the ISP
+// withdrew it, so new connections to it fail right away instead of timing out.
+func (lab *Lab) Retire(addr netip.Addr) {
+	lab.t.Helper()
+	prefix := netip.PrefixFrom(addr, 64).Masked().String()
+	lab.run("-n", lab.homeNS.name, "addr", "del", addr.String()+"/64", "dev", lab.homeIf)
+	lab.run("-n", lab.relayNS.name, "-6", "route", "add", "unreachable", prefix)
+}
+
+// Sends an address to the relay's /update endpoint without changing the home network
+func (lab *Lab) Update(addr netip.Addr) error {
+	req, err := http.NewRequest(http.MethodPost, lab.webhookURL("/update"), strings.NewReader(addr.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := lab.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Connects to the tunnel like an IPv4 client of the relay
+func (lab *Lab) Dial() (net.Conn, error) {
+	return lab.DialFrom(netip.MustParseAddr("127.0.0.1"))
+}
+
+// Connects to the tunnel from a specific loopback address, to tell several clients apart
+func (lab *Lab) DialFrom(client netip.Addr) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, LocalAddr: &net.TCPAddr{IP: client.AsSlice()}}
+	return lab.relayNS.dial(context.Background(), dialer, "tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(lab.opts.RelayPort)))
+}
+
+// Connects to the tunnel and returns the home address that accepted the connection
+func (lab *Lab) ServedBy() netip.Addr {
+	lab.t.Helper()
+	conn, err := lab.Dial()
+	if err != nil {
+		lab.t.Fatalf("dialing the tunnel: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		lab.t.Fatalf("reading from the tunnel: %v", err)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(line))
+	if err != nil {
+		lab.t.Fatalf("unexpected greeting of the backend %q", line)
+	}
+	return addr
+}
+
+// Returns an HTTP client that reaches the relay's endpoints
+func (lab *Lab) HTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return lab.relayNS.dial(ctx, dialer, network, addr)
+		}},
+	}
+}
+
+// Returns the output of the relay so far
+func (lab *Lab) Logs() string {
+	return lab.logs.String()
+}
+
+func (lab *Lab) webhookURL(path string) string {
+	return "http://127.0.0.1:8081" + path
+}
+
+// Adds the next home address, must not be called with the lock held
+func (lab *Lab) addAddress() netip.Addr {
+	lab.mu.Lock()
+	lab.next++
+	addr := netip.MustParseAddr(fmt.Sprintf("%s:%x::2", homePrefix, lab.next))
+	lab.mu.Unlock()
+
+	lab.run("-n", lab.homeNS.name, "addr", "add", addr.String()+"/64", "dev", lab.homeIf, "nodad")
+	return addr
+}
+
+// Starts the backend, it greets every connection with the address it was reached on and echoes what it receives
+func (lab *Lab) startBackend() {
+	listener, err := lab.homeNS.listen("tcp6", net.JoinHostPort("::", strconv.Itoa(lab.opts.BackendPort)))
+	if err != nil {
+		lab.t.Fatalf("starting the backend: %v", err)
+	}
+	lab.backend = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				local := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+				fmt.Fprintf(conn, "%s\n", local)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// Starts the relay in its namespace and waits until it answers
+func (lab *Lab) startRelay() {
+	env := append(os.Environ(),
+		"WEBHOOK_TOKEN="+token,
+		"WEBHOOK_LISTEN_ADDR=127.0.0.1",
+		"WEBHOOK_LISTEN_PORT=8081",
+		"SRC_LISTEN_ADDR=127.0.0.1",
+		"SRC_PORTS="+strconv.Itoa(lab.opts.RelayPort),
+		"DEST_PORTS="+strconv.Itoa(lab.opts.BackendPort),
+		"HEALTHCHECK_INTERVAL=1s",
+	)
+	env = append(env, lab.opts.Env...)
+
+	lab.relay = exec.Command("ip", "netns", "exec", lab.relayNS.name, lab.opts.Binary)
+	lab.relay.Env = env
+	// The relay keeps its data dir in the working directory
+	lab.relay.Dir = lab.t.TempDir()
+	lab.relay.Stdout = &lab.logs
+	lab.relay.Stderr = &lab.logs
+	if err := lab.relay.Start(); err != nil {
+		lab.t.Fatalf("starting the relay: %v", err)
+	}
+
+	client := lab.HTTPClient()
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(lab.webhookURL("/health/live"))
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	lab.t.Fatalf("the relay didn't start within %s:\n%s", startTimeout, lab.Logs())
+}
+
+// Stops the relay and the backend and deletes the namespaces with their interfaces
+func (lab *Lab) stop() {
+	if lab.relay != nil && lab.relay.Process != nil {
+		lab.relay.Process.Kill()
+		lab.relay.Wait()
+	}
+	if lab.backend != nil {
+		lab.backend.Close()
+	}
+	if lab.t.Failed() {
+		lab.t.Logf("relay output:\n%s", lab.Logs())
+	}
+	for _, ns := range []netns{lab.relayNS, lab.homeNS} {
+		if ns.name != "" {
+			exec.Command("ip", "netns", "del", ns.name).Run()
+		}
+	}
+}
+
+// Runs the ip command and fails the test if it fails
+func (lab *Lab) run(args ...string) {
+	lab.t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		lab.t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+}
+
+func findBinary(binary string) (string, error) {
+	if binary == "" {
+		binary = os.Getenv("FOUR2SIX_BINARY")
+	}
+	if binary == "" {
+		binary = "four2six"
+	}
+	return exec.LookPath(binary)
+}
+
+// Collects the output of the relay, which is written from the goroutines of exec
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,96 @@
+package harness_test
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muckelba/four2six/harness"
+)
+
+// Builds the relay for the labs unless FOUR2SIX_BINARY points to one. Labs only run as root on Linux,
+// the build is skipped everywhere else.
+func TestMain(m *testing.M) {
+	if os.Getenv("FOUR2SIX_BINARY") != "" || runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		os.Exit(m.Run())
+	}
+
+	dir, err := os.MkdirTemp("", "four2six-harness")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary := filepath.Join(dir, "four2six")
+	if out, err := exec.Command("go", "build", "-o", binary, "..").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "building four2six: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	os.Setenv("FOUR2SIX_BINARY", binary)
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestUpdateAndForward(t *testing.T) {
+	lab := harness.New(t, harness.Options{})
+
+	// The first address was sent while the lab started, the backend greets with the address it was reached on
+	conn, err := lab.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(greeting) != lab.HomeAddress().String() {
+		t.Fatalf("served by %s instead of %s", strings.TrimSpace(greeting), lab.HomeAddress())
+	}
+	if _, err := fmt.Fprintln(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if echo, err := reader.ReadString('\n'); err != nil || echo != "ping\n" {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+
+	// New connections follow the update, the open one keeps its target
+	old := lab.HomeAddress()
+	renumbered := lab.Renumber()
+	if served := lab.ServedBy(); served != renumbered {
+		t.Fatalf("served by %s instead of %s after the update", served, renumbered)
+	}
+	if _, err := fmt.Fprintln(conn, "still there"); err != nil {
+		t.Fatal(err)
+	}
+	if echo, err := reader.ReadString('\n'); err != nil || echo != "still there\n" {
+		t.Fatalf("echo of the open connection = %q, %v", echo, err)
+	}
+
+	lab.Retire(old)
+	if served := lab.ServedBy(); served != renumbered {
+		t.Fatalf("served by %s instead of %s after the old prefix was withdrawn", served, renumbered)
+	}
+}
+
+func TestPinnedClientsSurviveRenumbering(t *testing.T) {
+	lab := harness.New(t, harness.Options{Env: []string{"SESSION_PINNING_WINDOW=1m"}})
+	old := lab.HomeAddress()
+	if served := lab.ServedBy(); served != old {
+		t.Fatalf("served by %s instead of %s", served, old)
+	}
+	lab.Renumber()
+	if served := lab.ServedBy(); served != old {
+		t.Fatalf("pinned client moved to %s", served)
+	}
+}
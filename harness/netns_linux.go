@@ -0,0 +1,106 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// A named network namespace below /var/run/netns, created with ip netns add
+type netns struct {
+	name string
+}
+
+// Reports why labs can't run here
+func supported() error {
+	if os.Geteuid() != 0 {
+		return errors.New("root is required")
+	}
+	if _, ok := setnsTrap[runtime.GOARCH]; !ok {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func createNetns(name string) (netns, error) {
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		return netns{}, fmt.Errorf("%v: %s", err, out)
+	}
+	return netns{name: name}, nil
+}
+
+// Runs fn on a thread that was moved into the namespace. Sockets keep the namespace they
+// were created in, so they can be used from any goroutine afterwards.
+func (ns netns) do(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	target, err := os.Open("/var/run/netns/" + ns.name)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if err := setns(target); err != nil {
+		return fmt.Errorf("entering namespace %s: %w", ns.name, err)
+	}
+	fnErr := fn()
+	if err := setns(origin); err != nil {
+		// The thread is stuck in the namespace, it exits with the locked goroutine
+		panic(fmt.Sprintf("leaving namespace %s: %v", ns.name, err))
+	}
+	return fnErr
+}
+
+func (ns netns) listen(network, addr string) (net.Listener, error) {
+	var listener net.Listener
+	err := ns.do(func() (err error) {
+		listener, err = net.Listen(network, addr)
+		return err
+	})
+	return listener, err
+}
+
+func (ns netns) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := ns.do(func() (err error) {
+		conn, err = dialer.DialContext(ctx, network, addr)
+		return err
+	})
+	return conn, err
+}
+
+// Number of the setns syscall, the syscall package doesn't export it on every architecture
+var setnsTrap = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64le": 350,
+	"riscv64": 268,
+	"s390x":   339,
+}
+
+func setns(file *os.File) error {
+	trap, ok := setnsTrap[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("setns is not supported on %s", runtime.GOARCH)
+	}
+	if _, _, errno := syscall.Syscall(trap, file.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package harness
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Network namespaces only exist on Linux, labs are skipped elsewhere
+type netns struct {
+	name string
+}
+
+func supported() error {
+	return errors.New("network namespaces require Linux")
+}
+
+func createNetns(name string) (netns, error) {
+	return netns{}, supported()
+}
+
+func (ns netns) listen(network, addr string) (net.Listener, error) {
+	return nil, supported()
+}
+
+func (ns netns) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	return nil, supported()
+}
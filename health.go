@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunnelStatus represents the status of a tunnel. Used for the healthcheck
+type TunnelStatus struct {
+	IPv4Port  string `json:"ipv4_port"`
+	IPv6Port  string `json:"ipv6_port"`
+	IPv6Alive bool   `json:"ipv6_alive"`
+	// Only set if the tunnel has failover targets
+	Targets []TargetStatus `json:"targets,omitempty"`
+}
+
+// TargetStatus represents the status of a single target of a tunnel
+type TargetStatus struct {
+	Target string `json:"target"`
+	Alive  bool   `json:"alive"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Number of check results kept per tunnel for /health/{tunnel}
+const healthHistorySize = 20
+
+// HealthCheckResult is a single healthcheck of a tunnel
+type HealthCheckResult struct {
+	Time  time.Time `json:"time"`
+	Alive bool      `json:"alive"`
+	Error string    `json:"error,omitempty"`
+}
+
+// TunnelHealth is the response of the /health/{tunnel} endpoint
+type TunnelHealth struct {
+	Tunnel string `json:"tunnel"`
+	TunnelStatus
+	CheckedAt time.Time `json:"checked_at"`
+	// When the tunnel last went up or down
+	Since       time.Time           `json:"since"`
+	LastError   string              `json:"last_error,omitempty"`
+	LastErrorAt *time.Time          `json:"last_error_at,omitempty"`
+	History     []HealthCheckResult `json:"history"`
+}
+
+// Past results of a single tunnel
+type tunnelHistory struct {
+	results     []HealthCheckResult
+	since       time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// Decides if the tunnels as a whole count as healthy
+type healthPolicy struct {
+	// One of all, any, quorum or weighted
+	mode string
+	// Weights by source port for the weighted mode, tunnels without a weight count as 1
+	weights map[string]float64
+	// Share of the total weight that has to be up in the weighted mode
+	threshold float64
+}
+
+// Parses HEALTH_POLICY, HEALTH_WEIGHTS like 443=3,22=0.5 and HEALTH_WEIGHT_THRESHOLD
+func parseHealthPolicy(mode, weights, threshold string, srcPorts []string) (healthPolicy, error) {
+	policy := healthPolicy{mode: mode, weights: make(map[string]float64)}
+	if !slices.Contains([]string{"all", "any", "quorum", "weighted"}, mode) {
+		return policy, fmt.Errorf("unknown policy '%s', expected one of: all, any, quorum, weighted", mode)
+	}
+
+	for _, entry := range strings.Split(weights, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		port, value, found := strings.Cut(entry, "=")
+		if !found {
+			return policy, fmt.Errorf("weight '%s' is missing the '=' between source port and weight", entry)
+		}
+		port = strings.TrimSpace(port)
+		if !slices.Contains(srcPorts, port) {
+			return policy, fmt.Errorf("source port %s is not configured", port)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return policy, fmt.Errorf("invalid weight '%s' for source port %s", value, port)
+		}
+		policy.weights[port] = weight
+	}
+
+	var err error
+	policy.threshold, err = strconv.ParseFloat(threshold, 64)
+	if err != nil || policy.threshold <= 0 || policy.threshold > 1 {
+		return policy, fmt.Errorf("invalid threshold '%s', must be a share between 0 and 1", threshold)
+	}
+
+	return policy, nil
+}
+
+// Applies the policy to the tunnel statuses. No tunnels at all count as healthy.
+func (policy healthPolicy) healthy(statuses []TunnelStatus) bool {
+	up := 0
+	var upWeight, totalWeight float64
+	for _, status := range statuses {
+		weight, ok := policy.weights[status.IPv4Port]
+		if !ok {
+			weight = 1
+		}
+		totalWeight += weight
+		if status.IPv6Alive {
+			up++
+			upWeight += weight
+		}
+	}
+
+	switch policy.mode {
+	case "any":
+		return up > 0 || len(statuses) == 0
+	case "quorum":
+		return up*2 > len(statuses) || len(statuses) == 0
+	case "weighted":
+		return upWeight >= totalWeight*policy.threshold
+	default:
+		return up == len(statuses)
+	}
+}
+
+// Periodically checks all tunnels in the background and caches the results
+type healthMonitor struct {
+	config *Config
+
+	mu        sync.RWMutex
+	statuses  []TunnelStatus
+	checkedAt time.Time
+
+	// Tunnels whose last healthcheck failed, used to avoid logging the same failure over and over
+	failingTunnels map[string]bool
+
+	// Targets per tunnel that failed the last healthcheck, new connections try them last
+	downTargets map[string]map[string]bool
+
+	// Recent results per tunnel
+	history map[string]*tunnelHistory
+
+	// Requests a check outside of the regular interval
+	trigger            chan struct{}
+	recheckRequestedAt time.Time
+
+	// Notified after every check
+	subscribers []chan struct{}
+}
+
+func newHealthMonitor(config *Config) *healthMonitor {
+	return &healthMonitor{
+		config:         config,
+		failingTunnels: make(map[string]bool),
+		downTargets:    make(map[string]map[string]bool),
+		history:        make(map[string]*tunnelHistory),
+		trigger:        make(chan struct{}, 1),
+	}
+}
+
+// Checks if a connection to the IPv6 address and port is possible
+func checkTunnel(ipv6Addr, port string, timeout time.Duration) (bool, error) {
+	conn, err := net.DialTimeout("tcp6", net.JoinHostPort(ipv6Addr, port), timeout)
+	if err != nil {
+		return false, err
+	}
+	conn.Close()
+	return true, nil
+}
+
+// Resolves the target and checks if the port is reachable
+func (monitor *healthMonitor) checkTarget(target, port string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), monitor.config.HealthTimeout)
+	defer cancel()
+
+	if monitor.config.HappyEyeballs {
+		conn, err := monitor.config.dialHappyEyeballs(ctx, monitor.config.dialer(), target, port)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	addr, err := monitor.config.resolveHost(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	_, err = checkTunnel(addr.String(), port, monitor.config.HealthTimeout)
+	return err
+}
+
+// Checks all targets of all tunnels in parallel and updates the cached statuses.
+// A tunnel is alive as long as at least one of its targets is reachable.
+func (monitor *healthMonitor) check() {
+	config := monitor.config
+
+	ipv4Ports := config.IPv4Ports
+	ipv6Ports := config.IPv6Ports
+
+	targets := make([][]TargetStatus, len(ipv4Ports))
+	var wg sync.WaitGroup
+	for i, ipv4Port := range ipv4Ports {
+		tunnelTargets := config.tunnelTargets(ipv4Port)
+		targets[i] = make([]TargetStatus, len(tunnelTargets))
+		for j, target := range tunnelTargets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				targets[i][j] = TargetStatus{Target: target, Alive: true}
+				if err := monitor.checkTarget(target, ipv6Ports[i]); err != nil {
+					targets[i][j] = TargetStatus{Target: target, Error: err.Error()}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	statuses := make([]TunnelStatus, len(ipv4Ports))
+	errs := make([]error, len(ipv4Ports))
+	downTargets := make(map[string]map[string]bool)
+	for i, ipv4Port := range ipv4Ports {
+		name := tunnelName(ipv4Port, ipv6Ports[i])
+		downTargets[name] = make(map[string]bool)
+
+		status := TunnelStatus{IPv4Port: ipv4Port, IPv6Port: ipv6Ports[i]}
+		var targetErrs []error
+		for _, target := range targets[i] {
+			if target.Alive {
+				status.IPv6Alive = true
+			} else {
+				downTargets[name][target.Target] = true
+				targetErrs = append(targetErrs, errors.New(target.Error))
+			}
+		}
+		if len(targets[i]) > 1 {
+			status.Targets = targets[i]
+		}
+		if !status.IPv6Alive {
+			errs[i] = errors.Join(targetErrs...)
+		}
+		statuses[i] = status
+	}
+
+	monitor.mu.Lock()
+	monitor.statuses = statuses
+	monitor.checkedAt = time.Now()
+	for name, down := range downTargets {
+		monitor.logTargetTransitions(name, monitor.downTargets[name], down)
+	}
+	monitor.downTargets = downTargets
+	for i, status := range statuses {
+		monitor.recordHistory(tunnelName(status.IPv4Port, status.IPv6Port), monitor.checkedAt, errs[i])
+		config.digest.recordCheck(tunnelName(status.IPv4Port, status.IPv6Port), status.IPv6Alive)
+		monitor.logTransition(status.IPv4Port, status.IPv6Port, errs[i])
+	}
+	subscribers := monitor.subscribers
+	monitor.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		notifyChecked(subscriber)
+	}
+}
+
+// Returns a channel that receives a value after every check. A subscriber that is still busy
+// with the last check only sees the next one once, and the first value arrives right away if
+// a check already finished.
+func (monitor *healthMonitor) subscribe() <-chan struct{} {
+	subscriber := make(chan struct{}, 1)
+
+	monitor.mu.Lock()
+	monitor.subscribers = append(monitor.subscribers, subscriber)
+	checked := !monitor.checkedAt.IsZero()
+	monitor.mu.Unlock()
+
+	if checked {
+		notifyChecked(subscriber)
+	}
+	return subscriber
+}
+
+func notifyChecked(subscriber chan struct{}) {
+	select {
+	case subscriber <- struct{}{}:
+	default: // The subscriber didn't pick up the last check yet
+	}
+}
+
+// Appends a result to the history of the tunnel. Must be called with the lock held.
+func (monitor *healthMonitor) recordHistory(name string, checkedAt time.Time, err error) {
+	history, ok := monitor.history[name]
+	if !ok {
+		history = &tunnelHistory{since: checkedAt}
+		monitor.history[name] = history
+	}
+
+	result := HealthCheckResult{Time: checkedAt.UTC(), Alive: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+		history.lastError = result.Error
+		history.lastErrorAt = result.Time
+	}
+	if len(history.results) > 0 && history.results[len(history.results)-1].Alive != result.Alive {
+		history.since = checkedAt
+	}
+
+	history.results = append(history.results, result)
+	if len(history.results) > healthHistorySize {
+		history.results = history.results[len(history.results)-healthHistorySize:]
+	}
+}
+
+// Logs when a failover target goes down or comes back. Must be called with the lock held.
+func (monitor *healthMonitor) logTargetTransitions(name string, wasDown, down map[string]bool) {
+	logger := monitor.config.logger().With(slog.String("tunnel", name))
+	for target := range down {
+		if !wasDown[target] {
+			logger.Warn("Target failed the healthcheck", slog.String("target", target))
+		}
+	}
+	for target := range wasDown {
+		if !down[target] {
+			logger.Info("Target passed the healthcheck again", slog.String("target", target))
+		}
+	}
+}
+
+// Orders the targets so the ones that passed the last health check come first, keeping the configured order otherwise
+func (monitor *healthMonitor) orderTargets(name string, targets []string) []string {
+	if monitor == nil || len(targets) < 2 {
+		return targets
+	}
+
+	monitor.mu.RLock()
+	down := monitor.downTargets[name]
+	monitor.mu.RUnlock()
+
+	ordered := make([]string, 0, len(targets))
+	var unhealthy []string
+	for _, target := range targets {
+		if down[target] {
+			unhealthy = append(unhealthy, target)
+		} else {
+			ordered = append(ordered, target)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
+
+// Returns the targets that passed the last health check, in the configured order
+func (monitor *healthMonitor) availableTargets(name string, targets []string) []string {
+	if monitor == nil {
+		return targets
+	}
+
+	monitor.mu.RLock()
+	down := monitor.downTargets[name]
+	monitor.mu.RUnlock()
+
+	var available []string
+	for _, target := range targets {
+		if !down[target] {
+			available = append(available, target)
+		}
+	}
+	return available
+}
+
+// Logs healthcheck failures once when a tunnel goes down and again when it recovers.
+// Repeated failures are only logged at debug level to avoid spamming the logs.
+func (monitor *healthMonitor) logTransition(ipv4Port, ipv6Port string, err error) {
+	name := tunnelName(ipv4Port, ipv6Port)
+	logger := monitor.config.logger().With(slog.String("tunnel", name))
+
+	wasFailing := monitor.failingTunnels[name]
+	switch {
+	case err != nil && wasFailing:
+		logger.Debug("Healthcheck still failing", slog.Any("error", err))
+	case err != nil:
+		logger.Warn("Healthcheck failed", slog.Any("error", err))
+	case wasFailing:
+		logger.Info("Healthcheck recovered")
+	}
+	monitor.failingTunnels[name] = err != nil
+
+	// Only the active instance notifies, the others see the same tunnels
+	if monitor.config.lease.isActive() {
+		monitor.config.notifications.tunnelStateChanged(name, err)
+	}
+}
+
+// Runs the health checks until the process is stopped
+func (monitor *healthMonitor) run() {
+	ticker := time.NewTicker(monitor.config.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		monitor.check()
+		select {
+		case <-ticker.C:
+		case <-monitor.trigger:
+		}
+	}
+}
+
+// Schedules a check as soon as possible, e.g. after the IPv6 address changed
+func (monitor *healthMonitor) recheck() {
+	if monitor == nil {
+		return
+	}
+
+	select {
+	case monitor.trigger <- struct{}{}:
+	default: // A check is already pending
+	}
+}
+
+// Schedules a check unless the last one finished less than the interval ago
+func (monitor *healthMonitor) recheckAfter(interval time.Duration) {
+	if monitor == nil {
+		return
+	}
+
+	// Requests made while a check is running would queue another one right after it otherwise
+	monitor.mu.Lock()
+	due := time.Since(monitor.checkedAt) >= interval && time.Since(monitor.recheckRequestedAt) >= interval
+	if due {
+		monitor.recheckRequestedAt = time.Now()
+	}
+	monitor.mu.Unlock()
+	if due {
+		monitor.recheck()
+	}
+}
+
+// Returns the cached statuses and whether they are healthy according to HEALTH_POLICY.
+// The result is never healthy before the first check finished.
+func (monitor *healthMonitor) snapshot() ([]TunnelStatus, bool) {
+	if monitor == nil {
+		return nil, false
+	}
+
+	monitor.mu.RLock()
+	defer monitor.mu.RUnlock()
+
+	healthy := !monitor.checkedAt.IsZero() && monitor.config.HealthPolicy.healthy(monitor.statuses)
+	return monitor.statuses, healthy
+}
+
+// Returns the cached health of the tunnel with the given name or source port
+func (monitor *healthMonitor) tunnelHealth(tunnel string) (*TunnelHealth, bool) {
+	monitor.mu.RLock()
+	defer monitor.mu.RUnlock()
+
+	for _, status := range monitor.statuses {
+		name := tunnelName(status.IPv4Port, status.IPv6Port)
+		if tunnel != name && tunnel != status.IPv4Port {
+			continue
+		}
+
+		history := monitor.history[name]
+		health := &TunnelHealth{
+			Tunnel:       name,
+			TunnelStatus: status,
+			CheckedAt:    monitor.checkedAt.UTC(),
+			Since:        history.since.UTC(),
+			LastError:    history.lastError,
+			History:      slices.Clone(history.results),
+		}
+		// The history keeps changing once the lock is released
+		if lastErrorAt := history.lastErrorAt; !lastErrorAt.IsZero() {
+			health.LastErrorAt = &lastErrorAt
+		}
+		return health, true
+	}
+	return nil, false
+}
+
+// Provides the cached health of all open tunnels
+func healthCheckHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, healthy := config.health.snapshot()
+		if statuses == nil {
+			statuses = []TunnelStatus{}
+		}
+		statuses = config.maskTunnelStatuses(statuses)
+
+		// Respond with JSON containing the tunnel statuses.
+		w.Header().Set("Content-Type", "application/json")
+		if healthy {
+			w.WriteHeader(http.StatusOK) // HTTP 200 if the tunnels satisfy the health policy
+		} else {
+			w.WriteHeader(http.StatusInternalServerError) // HTTP 500 if too many tunnels are down
+		}
+		json.NewEncoder(w).Encode(statuses)
+	}
+}
+
+// Provides the cached health and recent history of a single tunnel, addressed by its name or source port
+func tunnelHealthHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health, ok := config.health.tunnelHealth(r.PathValue("tunnel"))
+		if !ok {
+			http.Error(w, "Unknown tunnel", http.StatusNotFound)
+			return
+		}
+
+		health.TunnelStatus = config.maskTunnelStatus(health.TunnelStatus)
+		health.LastError = config.maskText(health.LastError)
+		for i := range health.History {
+			health.History[i].Error = config.maskText(health.History[i].Error)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if health.IPv6Alive {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(health)
+	}
+}
+
+// Reports that the process is up, regardless of the tunnel health
+func livenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// Reports whether the tunnels satisfied the health policy during the last check
+func readinessHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, healthy := config.health.snapshot()
+		if !healthy {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "OK")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name of the file in the data dir that holds the address history
+const historyFile = "address_history.jsonl"
+
+// Number of updates kept in the history
+const historySize = 100
+
+// AddressUpdate is an entry of the address history
+type AddressUpdate struct {
+	IPv6Address string `json:"ipv6_address"`
+	// Which client or router sent the update, as reported by itself
+	Source string `json:"source,omitempty"`
+	// Remote address of the request or agent connection
+	Client string `json:"client,omitempty"`
+	// IPv4 address of the router's uplink as reported by itself
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	// Why the home network seems to be behind carrier-grade NAT, empty if nothing points to it
+	CGNAT string    `json:"cgnat,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Keeps the latest address updates in a JSON lines file in the data dir
+type addressHistory struct {
+	path string
+
+	mu      sync.Mutex
+	updates []AddressUpdate
+}
+
+// Loads the history from the data dir, a missing file is an empty history
+func loadAddressHistory(dataDir string) (*addressHistory, error) {
+	history := &addressHistory{path: filepath.Join(dataDir, historyFile)}
+
+	data, err := os.ReadFile(history.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var update AddressUpdate
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			continue // Skip lines that were cut off
+		}
+		history.updates = append(history.updates, update)
+	}
+	return history, nil
+}
+
+// Appends the update and rewrites the file with the latest entries only
+func (history *addressHistory) record(update AddressUpdate) error {
+	if history == nil {
+		return nil
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	history.updates = append(history.updates, update)
+	if len(history.updates) > historySize {
+		history.updates = history.updates[len(history.updates)-historySize:]
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range history.updates {
+		encoder.Encode(entry)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(history.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(history.path, buf.Bytes(), 0o644)
+}
+
+// Returns the updates, newest first
+func (history *addressHistory) list() []AddressUpdate {
+	if history == nil {
+		return nil
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	updates := make([]AddressUpdate, len(history.updates))
+	for i, update := range history.updates {
+		updates[len(updates)-1-i] = update
+	}
+	return updates
+}
+
+// Provides the latest address updates and who sent them
+func historyHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updates := config.history.list()
+		if updates == nil {
+			updates = []AddressUpdate{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config.maskAddressUpdates(updates))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Binds the listener of a tunnel only while its backend is usable, so scanners hitting the public
+// address don't pile up dials against a dead target. The listener is opened once the tunnel passed
+// a healthcheck and closed again after the tunnel failed them for LAZY_LISTENER_UNBIND_AFTER.
+func (manager *tunnelManager) runLazy(name, ipv4Port, ipv6Port string) {
+	config := manager.config
+	logger := config.logger().With(slog.String("tunnel", name))
+	logger.Info("Waiting for the backend to pass a healthcheck before listening")
+
+	for range config.health.subscribe() {
+		health, ok := config.health.tunnelHealth(name)
+		if !ok {
+			continue
+		}
+
+		_, open := manager.listener(ipv4Port)
+		switch {
+		case !open && health.IPv6Alive:
+			if err := manager.open(name, ipv4Port, ipv6Port); err != nil {
+				logger.Error("Error opening the listener, retrying after the next healthcheck", slog.Any("error", err))
+			}
+
+		case open && !health.IPv6Alive && config.LazyListenerUnbindAfter > 0 && time.Since(health.Since) >= config.LazyListenerUnbindAfter:
+			// Connections that are already open keep running
+			logger.Warn("Backend failed the healthchecks for too long, closing the listener", slog.Duration("down_for", time.Since(health.Since).Round(time.Second)))
+			manager.close(ipv4Port)
+		}
+	}
+}
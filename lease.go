@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Name of the file next to the address file that records which instance is active, for the file backend
+const leaseFile = "active_lease.json"
+
+// Appended to STATE_KEY for the key that records which instance is active, for the other backends
+const leaseKeySuffix = "/lease"
+
+// Returned when another instance replaced the lease between our read and our write
+var errLeaseTaken = errors.New("another instance wrote the active lease first")
+
+// Returned when a write is attempted by an instance that doesn't hold the active lease
+var errNotActive = errors.New("this instance does not hold the active lease")
+
+// Returned when a write is attempted while READ_ONLY is set
+var errReadOnly = errors.New("this instance is read-only")
+
+// leaseRecord is the content of the lease
+type leaseRecord struct {
+	Holder string `json:"holder"`
+	// Incremented on every renewal. Other instances watch it change instead of comparing
+	// timestamps, so clock skew between the hosts doesn't matter.
+	Renewals  uint64    `json:"renewals"`
+	RenewedAt time.Time `json:"renewed_at"`
+}
+
+// LeaseStatus is the lease part of the /status response
+type LeaseStatus struct {
+	Instance string `json:"instance"`
+	Active   bool   `json:"active"`
+	Holder   string `json:"holder,omitempty"`
+	// Instance that claimed the lease while this one still held it
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Makes sure only one of several instances sharing a state backend writes the address and sends notifications
+type activeLease struct {
+	config   *Config
+	instance string
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	active   bool
+	conflict string
+	renewals uint64
+	// Local time of our last successful renewal
+	renewedAt time.Time
+	// Last record seen in the state backend and the local time it changed
+	seen          leaseRecord
+	seenChangedAt time.Time
+	// Encoded form of the last record seen, our next write only wins if the lease still has it
+	seenValue string
+}
+
+func newActiveLease(config *Config, instance string, ttl time.Duration) *activeLease {
+	return &activeLease{
+		config:   config,
+		instance: instance,
+		ttl:      ttl,
+	}
+}
+
+func (lease *activeLease) read() (leaseRecord, error) {
+	var record leaseRecord
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	data, err := lease.config.state.LoadLease(ctx)
+	if err != nil {
+		return record, err
+	}
+	lease.seenValue = data
+	if data == "" {
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return record, fmt.Errorf("the active lease is corrupt: %v", err)
+	}
+	return record, nil
+}
+
+// Writes the lease if no other instance changed it since our last read
+func (lease *activeLease) write() error {
+	record := leaseRecord{Holder: lease.instance, Renewals: lease.renewals + 1, RenewedAt: time.Now().UTC()}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	swapped, err := lease.config.state.SwapLease(ctx, lease.seenValue, string(data))
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return errLeaseTaken
+	}
+
+	lease.seenValue = string(data)
+	lease.renewals = record.Renewals
+	lease.renewedAt = time.Now()
+	lease.seen = record
+	lease.seenChangedAt = lease.renewedAt
+	return nil
+}
+
+// Renews, acquires or gives up the lease depending on what the other instances did
+func (lease *activeLease) update() {
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	now := time.Now()
+	record, err := lease.read()
+	if err != nil {
+		lease.config.logger().Warn("Failed to read the active lease", slog.Any("error", err))
+		if lease.active && now.Sub(lease.renewedAt) > lease.ttl {
+			lease.config.logger().Error("Could not renew the active lease in time, switching to standby")
+			lease.active = false
+		}
+		return
+	}
+	if record != lease.seen {
+		lease.seen = record
+		lease.seenChangedAt = now
+	}
+
+	switch {
+	case record.Holder == "" || record.Holder == lease.instance:
+		if !lease.active {
+			lease.config.logger().Info("Acquired the active lease", slog.String("instance", lease.instance))
+		}
+		lease.renew()
+
+	case lease.active && now.Sub(lease.renewedAt) < lease.ttl:
+		// Another instance wrote the lease although ours didn't expire. Both would publish
+		// their own address now, so step back and let a human sort it out.
+		lease.active = false
+		lease.conflict = record.Holder
+		lease.config.logger().Error("Another instance claimed the active lease while this one still held it, refusing writes", slog.String("instance", lease.instance), slog.String("other_instance", record.Holder))
+		lease.config.notifications.publish(Event{
+			Type:    EventLeaseConflict,
+			Message: fmt.Sprintf("Instances %s and %s both claimed the active role, %s switched to standby", lease.instance, record.Holder, lease.instance),
+		})
+
+	case lease.active:
+		lease.active = false
+		lease.config.logger().Warn("Lost the active lease to another instance, switching to standby", slog.String("other_instance", record.Holder))
+
+	case now.Sub(lease.seenChangedAt) > lease.ttl:
+		lease.config.logger().Warn("The active instance stopped renewing its lease, taking over", slog.String("other_instance", record.Holder))
+		lease.renew()
+	}
+}
+
+func (lease *activeLease) renew() {
+	err := lease.write()
+	if errors.Is(err, errLeaseTaken) {
+		// The next update reads the other record and reacts to it
+		lease.config.logger().Warn("Failed to write the active lease", slog.Any("error", err))
+		return
+	}
+	if err != nil {
+		lease.config.logger().Error("Failed to write the active lease", slog.Any("error", err))
+		return
+	}
+	lease.active = true
+	lease.conflict = ""
+}
+
+// Checks the lease right before a write and reports if this instance may do it
+func (lease *activeLease) confirm() bool {
+	if lease == nil {
+		return true
+	}
+	lease.update()
+	return lease.isActive()
+}
+
+// Reports if this instance holds the lease, instances without a lease are always active
+func (lease *activeLease) isActive() bool {
+	if lease == nil {
+		return true
+	}
+
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+	return lease.active
+}
+
+func (lease *activeLease) status() *LeaseStatus {
+	if lease == nil {
+		return nil
+	}
+
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+	return &LeaseStatus{
+		Instance: lease.instance,
+		Active:   lease.active,
+		Holder:   lease.seen.Holder,
+		Conflict: lease.conflict,
+	}
+}
+
+// Keeps the lease up to date until the process is stopped
+func (lease *activeLease) run() {
+	ticker := time.NewTicker(lease.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		lease.update()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestActiveLease(t *testing.T) {
+	config := newTestConfig(t, nil)
+	first := newActiveLease(config, "first", time.Minute)
+	second := newActiveLease(config, "second", time.Minute)
+
+	first.update()
+	second.update()
+	if !first.isActive() || second.isActive() {
+		t.Fatalf("first active = %v, second active = %v, want only the first", first.isActive(), second.isActive())
+	}
+	if holder := second.status().Holder; holder != "first" {
+		t.Errorf("second sees holder %q, want first", holder)
+	}
+
+	first.update()
+	if !first.isActive() || first.renewals != 2 {
+		t.Errorf("first active = %v after %d renewals, want a second renewal", first.isActive(), first.renewals)
+	}
+
+	// The first instance stopped renewing after the second saw its last renewal, the second one takes over
+	// and the first steps back without a conflict
+	second.update()
+	second.seenChangedAt = time.Now().Add(-2 * time.Minute)
+	first.renewedAt = time.Now().Add(-2 * time.Minute)
+	second.update()
+	first.update()
+	if first.isActive() || !second.isActive() {
+		t.Fatalf("first active = %v, second active = %v, want only the second", first.isActive(), second.isActive())
+	}
+	if status := first.status(); status.Holder != "second" || status.Conflict != "" {
+		t.Errorf("first status = %+v", status)
+	}
+}
+
+func TestActiveLeaseRace(t *testing.T) {
+	config := newTestConfig(t, nil)
+	first := newActiveLease(config, "first", time.Minute)
+	second := newActiveLease(config, "second", time.Minute)
+
+	// Both saw no lease, only the first write may win
+	for _, lease := range []*activeLease{first, second} {
+		if _, err := lease.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.write(); !errors.Is(err, errLeaseTaken) {
+		t.Fatalf("second write = %v, want %v", err, errLeaseTaken)
+	}
+
+	record, err := second.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Holder != "first" {
+		t.Errorf("holder = %q, want first", record.Holder)
+	}
+}
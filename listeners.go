@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFDsStart = 3
+
+// Listeners inherited from systemd socket activation, keyed by port
+type inheritedListeners struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// Picks up the sockets passed by systemd via LISTEN_FDS. The variables are removed
+// afterwards so child processes don't try to use the same sockets.
+func loadInheritedListeners() (*inheritedListeners, error) {
+	inherited := &inheritedListeners{listeners: make(map[string]net.Listener)}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return inherited, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return inherited, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := range count {
+		fd := listenFDsStart + i
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s is not a stream listener: %v", name, err)
+		}
+
+		// Unix sockets are keyed by their path instead of a port
+		port := listener.Addr().String()
+		if listener.Addr().Network() != "unix" {
+			if _, port, err = net.SplitHostPort(port); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := inherited.listeners[port]; ok {
+			return nil, fmt.Errorf("more than one inherited socket listens on %s", port)
+		}
+
+		inherited.listeners[port] = listener
+		slog.Info("Inherited socket from systemd", slog.String("name", name), slog.String("addr", listener.Addr().String()))
+	}
+
+	return inherited, nil
+}
+
+// Returns and removes the inherited listener of the port or unix socket path
+func (inherited *inheritedListeners) take(port string) (net.Listener, bool) {
+	if inherited == nil {
+		return nil, false
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	listener, ok := inherited.listeners[port]
+	delete(inherited.listeners, port)
+	return listener, ok
+}
+
+// Reports if a socket for the port or unix socket path was inherited and not taken yet
+func (inherited *inheritedListeners) has(port string) bool {
+	if inherited == nil {
+		return false
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	_, ok := inherited.listeners[port]
+	return ok
+}
+
+// Closes the inherited sockets that don't belong to any configured listener
+func (inherited *inheritedListeners) closeUnused() {
+	if inherited == nil {
+		return
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	for port, listener := range inherited.listeners {
+		slog.Warn("Inherited socket does not match any configured port, closing it", slog.String("port", port), slog.String("addr", listener.Addr().String()))
+		listener.Close()
+		delete(inherited.listeners, port)
+	}
+}
+
+// Opens a listener on the address and port. A socket inherited from systemd is used if one
+// listens on the same port, otherwise a new socket is bound (with SO_REUSEPORT if enabled).
+func (config *Config) listen(network, addr, port string) (net.Listener, error) {
+	if listener, ok := config.inherited.take(port); ok {
+		return listener, nil
+	}
+
+	listenConfig := net.ListenConfig{}
+	if config.ReusePort {
+		listenConfig.Control = setReusePort
+	}
+	return listenConfig.Listen(context.Background(), network, net.JoinHostPort(addr, port))
+}
+
+// Reports whether a listener is bound to the unspecified IPv6 address, which also accepts IPv4
+// connections unless the socket is IPv6 only
+func acceptsIPv6(listener net.Listener) bool {
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	return ok && addr.IP.To4() == nil && addr.IP.IsUnspecified()
+}
+
+// Parses per tunnel listen addresses like 22=127.0.0.1;8080=unix:///run/four2six/web.sock keyed by source port
+func parseTunnelListenAddrs(value string, srcPorts []string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, addr, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("entry '%s' is missing the '=' between source port and address", entry)
+		}
+		port, addr = strings.TrimSpace(port), strings.TrimSpace(addr)
+
+		if !slices.Contains(srcPorts, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+			if !filepath.IsAbs(path) {
+				return nil, fmt.Errorf("unix socket path '%s' must be absolute", path)
+			}
+		} else if ip, err := netip.ParseAddr(addr); err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("listen address '%s' is neither an IPv4 address nor a unix:// socket", addr)
+		}
+		addrs[port] = addr
+	}
+
+	return addrs, nil
+}
+
+// Returns the listen address of a tunnel, which is either its own or SRC_LISTEN_ADDR.
+// Addresses that were the public IPv4 address of the relay follow it when it changes.
+func (config *Config) tunnelListenAddr(ipv4Port string) string {
+	if addr, ok := config.TunnelListenAddrs[ipv4Port]; ok {
+		return config.publicIPv4.translate(addr)
+	}
+	return config.publicIPv4.translate(config.TunnelListenAddr)
+}
+
+// Opens the listener of a tunnel on its IPv4 address or unix socket and exits if that's not possible
+func (config *Config) mustListenTunnel(name, ipv4Port string) net.Listener {
+	addr := config.tunnelListenAddr(ipv4Port)
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return config.mustListenIPv4(name, addr, ipv4Port)
+	}
+
+	listener, err := config.listenUnix(path)
+	if err != nil {
+		fatal("Error listening on unix socket", slog.String("tunnel", name), slog.String("path", path), slog.Any("error", err))
+	}
+	return listener
+}
+
+// Opens the listener of a tunnel on its IPv4 address or unix socket
+func (config *Config) listenTunnel(ipv4Port string) (net.Listener, error) {
+	addr := config.tunnelListenAddr(ipv4Port)
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return config.listenUnix(path)
+	}
+	return config.listen("tcp4", addr, ipv4Port)
+}
+
+// Opens a unix socket with UNIX_SOCKET_MODE. A stale socket of a previous run is removed first,
+// the socket file is removed again when the listener is closed or the process is stopped.
+func (config *Config) listenUnix(path string) (net.Listener, error) {
+	if listener, ok := config.inherited.take(path); ok {
+		return listener, nil
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, config.UnixSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	removeOnExit(path)
+	return listener, nil
+}
+
+var (
+	socketsToRemove   []string
+	socketsToRemoveMu sync.Mutex
+	removeOnExitOnce  sync.Once
+)
+
+// Removes the file when the process is stopped by SIGINT or SIGTERM
+func removeOnExit(path string) {
+	socketsToRemoveMu.Lock()
+	socketsToRemove = append(socketsToRemove, path)
+	socketsToRemoveMu.Unlock()
+
+	removeOnExitOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			socketsToRemoveMu.Lock()
+			for _, path := range socketsToRemove {
+				os.Remove(path)
+			}
+			socketsToRemoveMu.Unlock()
+
+			slog.Info("Stopping", slog.String("signal", sig.String()))
+			os.Exit(0)
+		}()
+	})
+}
+
+// Opens an IPv4 listener for a tunnel and exits if that's not possible
+func (config *Config) mustListenIPv4(name, addr, port string) net.Listener {
+	listener, err := config.listen("tcp4", addr, port)
+	if err != nil {
+		fatal("Error listening on IPv4 address", slog.String("tunnel", name), slog.String("addr", addr), slog.String("port", port), slog.Any("error", err))
+	}
+	return listener
+}
@@ -1,22 +1,36 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 // Config holds the runtime configuration
 type Config struct {
-	IPv6Address       string
+	// Name of the relay in RELAYS, empty if the process runs a single relay
+	Relay             string
+	TargetHost        string
+	FailoverTargets   []string
+	TunnelTargets     map[string][]string
+	DNS64Prefix       netip.Prefix
 	IPv6Ports         []string
 	IPv4Ports         []string
 	FilePath          string
@@ -24,15 +38,154 @@ type Config struct {
 	WebhookToken      string
 	WebhookListenPort string
 	WebhookListenAddr string
-	TunnelListenAddr  string
-	mu                sync.RWMutex
-}
+	// Additional IPv6 only listener for the HTTP endpoints, empty if disabled
+	WebhookIPv6ListenAddr string
+	WebhookIPv6ListenPort string
+	// How addresses are shown in /health and webhook responses: off, prefix or redact
+	AddressMask string
+	// Search unstructured webhook bodies for anything that looks like an IPv6 address
+	WebhookRegexFallback bool
+	// Accept loopback, link-local and multicast addresses in updates
+	WebhookAllowLocalAddresses bool
+	// What to do with update bodies that contain several addresses: prefer-global or reject
+	WebhookMultipleAddresses string
+	// Destination ports dialed on a new address before it's stored, empty disables the check
+	WebhookVerifyPorts []string
+	TunnelListenAddr   string
+	TunnelListenAddrs  map[string]string
+	UnixSocketMode     os.FileMode
+	LogLevel           string
+	LogFormat          string
+	ControlListenAddr  string
+	ControlListenPort  string
+	ControlAgentKeys   []string
+	SNIListenPort      string
+	SNIRoutes          []sniRoute
+	SNIDefaultTarget   string
+	ProxyListenAddr    string
+	ProxyListenPort    string
+	ProxyUsername      string
+	ProxyPassword      string
+	HealthInterval     time.Duration
+	HealthTimeout      time.Duration
+	HealthPolicy       healthPolicy
+	ReusePort          bool
+	// Only listen while the backend of a tunnel is reachable
+	LazyListeners           bool
+	LazyListenerUnbindAfter time.Duration
+	CopyBufferSize          int
+	DialTimeout             time.Duration
+	// Keep retrying failed dials with backoff for this long, 0 disables retries
+	DialRetryWindow  time.Duration
+	DialRetryBackoff time.Duration
+	// Skip the targets that failed the last healthcheck instead of dialing them
+	CircuitBreaker bool
+	// Race the IPv6 and IPv4 addresses of hostname targets instead of only dialing IPv6
+	HappyEyeballs      bool
+	HappyEyeballsDelay time.Duration
+	IdleTimeout        time.Duration
+	StallTimeout       time.Duration
+	StallAbort         bool
+	KeepAliveInterval  time.Duration
+	InstanceID         string
+	LeaseTTL           time.Duration
+	// Tunnels run, but the address and the tunnels can't be changed
+	ReadOnly bool
+
+	// Thresholds of the /alerts endpoint, 0 disables the alert
+	AlertTunnelDownAfter  time.Duration
+	AlertUpdateStaleAfter time.Duration
+	AlertPoolUsage        int
+
+	// Swapped on every address update, see snapshot.go
+	current atomic.Pointer[configSnapshot]
+
+	health *healthMonitor
+
+	heartbeats heartbeatTracker
+
+	// Listeners and open connections of the tunnels
+	tunnels *tunnelManager
+
+	startedAt time.Time
+
+	notifications *notificationDispatcher
+
+	// Reverse DNS names of clients, nil if disabled
+	reverseDNS *reverseDNSCache
+
+	// Resolves TargetHost and other hostname targets
+	dnsCache *dnsCache
+
+	// TLS statistics of the tunnels, nil if disabled
+	protocolStats *protocolStats
+
+	// Bandwidth limits keyed by source port
+	rateLimits map[string]*tunnelRateLimit
+
+	// Tunnel settings changed at runtime, nil until the relay is served
+	settings *tunnelSettings
+
+	// Traffic class and flow label of the backend connections keyed by source port
+	markings map[string]*ipv6Marking
+
+	// PROXY protocol version sent to the backends keyed by source port
+	proxyProtocols map[string]string
+
+	// Clients the tunnels accept and refuse keyed by source port
+	allowedClients map[string][]netip.Prefix
+	deniedClients  map[string][]netip.Prefix
+
+	// Connection-open latency SLOs keyed by source port
+	latencySLOs map[string]*latencySLO
+
+	// Rewrites passive mode replies of FTP tunnels, nil if no tunnel speaks FTP
+	ftp *ftpHelper
+
+	// Rewrites the SDP bodies of SIP tunnels and relays their media, nil if no tunnel speaks SIP
+	sip *sipHelper
+
+	// Single packet authorization in front of gated tunnels, nil if no tunnel is gated
+	spa *spaGate
 
-// TunnelStatus represents the status of a tunnel. Used for the healthcheck
-type TunnelStatus struct {
-	IPv4Port  string `json:"ipv4_port"`
-	IPv6Port  string `json:"ipv6_port"`
-	IPv6Alive bool   `json:"ipv6_alive"`
+	// Terminates TLS in front of the backends, nil if no tunnel terminates TLS
+	tls *tlsTerminator
+
+	// Temporary tunnels allocated via the API, nil if disabled
+	ephemeral *ephemeralTunnels
+
+	// Targets clients were last forwarded to, nil if disabled
+	pins *sessionPins
+
+	// Writes the update requests to the data dir, nil if disabled
+	recorder *webhookRecorder
+
+	// Collects the periodic digest, nil if disabled
+	digest *digestCollector
+
+	// Pings the heartbeat URLs, nil if disabled
+	pinger *pinger
+
+	// Follows the public IPv4 address of the host, nil if disabled
+	publicIPv4 *publicIPv4Watcher
+
+	// Persists the IPv6 address and shares it with other instances
+	state State
+
+	// Latest address updates and who sent them
+	history *addressHistory
+
+	// Decides which instance writes the address when several share the data dir, nil if disabled
+	lease *activeLease
+
+	// Sockets passed by systemd socket activation
+	inherited *inheritedListeners
+
+	// TLS of the webhook server, nil to serve plain HTTP
+	webhookTLS *tls.Config
+
+	// Authentication chains of the HTTP endpoints keyed by endpoint group
+	auth authChains
 }
 
 func parseConfigEnv(envVar string, defaultValue string) string {
@@ -43,253 +196,890 @@ func parseConfigEnv(envVar string, defaultValue string) string {
 	return env
 }
 
-// Forwards traffic between the source and destination connections
-func forward(src, dst net.Conn) {
+// Forwards traffic between the source and destination connections with the timeouts of the tunnel and returns the number
+// of bytes sent from src to dst and back. Connections that don't belong to a tunnel pass an empty port.
+func (config *Config) forward(ipv4Port string, src, dst net.Conn) (int64, int64) {
 	defer src.Close()
 	defer dst.Close()
 
-	// Use io.Copy to forward data in both directions
-	go io.Copy(src, dst)
-	io.Copy(dst, src)
-}
+	src, dst = config.wrapTunnelConns(ipv4Port, src, dst)
 
-func (config *Config) saveIPv6Address() error {
-	config.mu.RLock()
-	defer config.mu.RUnlock()
+	// Forward data in both directions
+	downloaded := make(chan int64, 1)
+	go func() {
+		n, _ := config.copyConn(src, dst)
+		downloaded <- n
+	}()
+	uploaded, _ := config.copyConn(dst, src)
 
-	file, err := os.Create(config.FilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	// Stop the other direction before waiting for its count
+	src.Close()
+	dst.Close()
+	return uploaded, <-downloaded
+}
 
-	_, err = file.WriteString(config.IPv6Address)
-	if err != nil {
-		return err
+// Tunes both sides of a connection and applies the idle and stall timeouts of the tunnel
+func (config *Config) wrapTunnelConns(ipv4Port string, src, dst net.Conn) (net.Conn, net.Conn) {
+	setting := config.tunnelSetting(ipv4Port)
+	config.tuneTCPConn(src)
+	config.tuneTCPConn(dst)
+	if setting.idleTimeout > 0 {
+		src, dst = newIdleConns(src, dst, setting.idleTimeout)
+	}
+	if setting.stallTimeout > 0 {
+		src, dst = config.newStallConns(src, dst, setting.stallTimeout)
 	}
+	return src, dst
+}
 
-	return nil
+func (config *Config) saveIPv6Address() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+	return config.state.Store(ctx, config.ipv6Address())
 }
 
 func (config *Config) loadIPv6Address() error {
-	// Create a data/ dir if it's not existing to store the txt file
-	err := os.MkdirAll(config.DataDir, os.ModePerm)
-	if err != nil {
-		return err
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
 
-	file, err := os.Open(config.FilePath)
+	ipv6Address, err := config.state.Load(ctx)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	var ipv6Addr string
-	_, err = fmt.Fscanf(file, "%s", &ipv6Addr)
-	if err != nil {
-		return err
-	}
-
-	config.mu.Lock()
-	config.IPv6Address = ipv6Addr
-	config.mu.Unlock()
 
+	config.storeIPv6Address(ipv6Address)
 	return nil
 }
 
 // Handles the webhook to update the IPv6 address
 func updateIPv6Address(config *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check the token
-		token := r.Header.Get("Authorization")
-		if token != fmt.Sprintf("Bearer %s", config.WebhookToken) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logger := loggerFromContext(r.Context())
+
+		if config.ReadOnly {
+			logger.Warn("Refused update in read-only mode")
+			http.Error(w, "This instance is read-only, updates are disabled", http.StatusForbidden)
 			return
 		}
 
-		bodyBytes, err := io.ReadAll(r.Body)
+		bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpdateBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Warn("Rejected an oversized update", slog.Int64("limit", tooLarge.Limit))
+			http.Error(w, "Invalid request: the body is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
+			logger.Error("Failed to read request body", slog.Any("error", err))
 			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 			return
 		}
 
-		bodyString := string(bodyBytes)
-
-		// What a wonderful regex stolen from https://stackoverflow.com/a/17871737
-		ipv6RegEx := regexp.MustCompile(`(([0-9a-fA-F]{1,4}:){7,7}[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,7}:|([0-9a-fA-F]{1,4}:){1,6}:[0-9a-fA-F]{1,4}|([0-9a-fA-F]{1,4}:){1,5}(:[0-9a-fA-F]{1,4}){1,2}|([0-9a-fA-F]{1,4}:){1,4}(:[0-9a-fA-F]{1,4}){1,3}|([0-9a-fA-F]{1,4}:){1,3}(:[0-9a-fA-F]{1,4}){1,4}|([0-9a-fA-F]{1,4}:){1,2}(:[0-9a-fA-F]{1,4}){1,5}|[0-9a-fA-F]{1,4}:((:[0-9a-fA-F]{1,4}){1,6})|:((:[0-9a-fA-F]{1,4}){1,7}|:)|fe80:(:[0-9a-fA-F]{0,4}){0,4}%[0-9a-zA-Z]{1,}|::(ffff(:0{1,4}){0,1}:){0,1}((25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])|([0-9a-fA-F]{1,4}:){1,4}:((25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9])\.){3,3}(25[0-5]|(2[0-4]|1{0,1}[0-9]){0,1}[0-9]))`)
-		ipv6Addresses := ipv6RegEx.FindAllString(bodyString, -1)
+		update, err := config.parseUpdatePayload(r.Header.Get("Content-Type"), bodyBytes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v.", err), http.StatusBadRequest)
+			logger.Warn("Rejected the update body", slog.String("body", loggedBody(bodyBytes)), slog.Any("error", err))
+			return
+		}
+		ipv6Address := update.IPv6Address.String()
+		if update.Unstructured {
+			logger.Debug("Found an IP address in the request body", slog.String("ipv6_address", ipv6Address))
+		}
 
-		if len(ipv6Addresses) == 0 {
-			http.Error(w, "Invalid request: the body did not contain an IPv6 address.", http.StatusBadRequest)
-			log.Printf("Did not found a valid IPv6 address in the request body: '%s'", bodyString)
+		// Update the IPv6 address and save to disk, unless it's unreachable and the client doesn't insist
+		clientAddr, _ := remoteAddr(r)
+		err = config.acceptAddressUpdate(logger, AddressUpdate{IPv6Address: ipv6Address, Source: update.Source, Client: r.RemoteAddr}, clientAddr, update.IPv4Address, r.URL.Query().Get("force") == "true")
+		var unreachable *unreachableAddressError
+		if errors.As(err, &unreachable) {
+			logger.Warn("Rejected an unreachable IPv6 address", slog.String("ipv6_address", ipv6Address), slog.String("source", update.Source), slog.Any("error", err))
+			http.Error(w, config.maskText(fmt.Sprintf("IPv6 address %s is not reachable on port %s, keeping the current address. Add ?force=true to store it anyway: %v", ipv6Address, strings.Join(config.WebhookVerifyPorts, ", "), err)), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, errNotActive) {
+			logger.Warn("Refused update on a standby instance", slog.String("ipv6_address", ipv6Address))
+			http.Error(w, "This instance is on standby, send the update to the active instance", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to save IPv6 address", slog.Any("error", err))
+			http.Error(w, "Failed to save IPv6 address", http.StatusInternalServerError)
 			return
 		}
 
-		// Always use the first matched address
-		ipv6Address := ipv6Addresses[0]
-		log.Printf("Found an IP address in the request body: %v", ipv6Address)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "IPv6 address updated to %s", config.maskText(ipv6Address))
+		logger.Info("IPv6 address updated", slog.String("ipv6_address", ipv6Address), slog.String("source", update.Source))
+	}
+}
 
-		// Disabled the proper JSON payload way for now because favonia/cloudflare-ddns only sends raw strings (even when they are sending a JSON content-type header)
-		// // Parse the request jsonBody.
-		// var jsonBody struct {
-		// 	IPv6Address string `json:"ipv6_address"`
-		// }
+// Returned for new addresses that failed the check of WEBHOOK_VERIFY_PORTS
+type unreachableAddressError struct {
+	err error
+}
 
-		// err = json.NewDecoder(r.Body).Decode(&jsonBody)
-		// if err != nil {
-		// log.Print("Request body does not match the expected JSON format")
-		// }
+func (e *unreachableAddressError) Error() string {
+	return e.err.Error()
+}
 
-		// Update the IPv6 address and save to disk
-		config.mu.Lock()
-		config.IPv6Address = ipv6Address
-		config.mu.Unlock()
+func (e *unreachableAddressError) Unwrap() error {
+	return e.err
+}
+
+// Verifies, records and stores an address update from the webhook or the agent. The client is the address the update
+// came from and wan the IPv4 address the router reported for its uplink, if any, both are checked for carrier-grade NAT.
+func (config *Config) acceptAddressUpdate(logger *slog.Logger, update AddressUpdate, client, wan netip.Addr, force bool) error {
+	// Make sure the new address works before the tunnels switch to it
+	if err := config.checkNewAddress(update.IPv6Address, force); err != nil {
+		return &unreachableAddressError{err}
+	}
+
+	// Users often wonder why the relay is needed at all, NAT in front of the router is the usual answer
+	if update.CGNAT = detectCGNAT(client, wan); update.CGNAT != "" {
+		logger.Warn("The IPv4 connection of the home network seems to be behind carrier-grade NAT", slog.String("reason", update.CGNAT))
+	}
+	if wan.IsValid() {
+		update.IPv4Address = wan.String()
+	}
+
+	return config.setIPv6Address(update)
+}
+
+// Verifies a new address from the webhook or the agent if WEBHOOK_VERIFY_PORTS is set. Forced updates and the current address are not checked.
+func (config *Config) checkNewAddress(ipv6Address string, force bool) error {
+	if len(config.WebhookVerifyPorts) == 0 || force {
+		return nil
+	}
 
-		err = config.saveIPv6Address()
+	if ipv6Address == config.ipv6Address() {
+		return nil
+	}
+
+	return config.verifyAddress(ipv6Address)
+}
+
+// Updates the IPv6 address, saves it to disk and lets everyone interested know about it
+func (config *Config) setIPv6Address(update AddressUpdate) error {
+	if config.ReadOnly {
+		return errReadOnly
+	}
+	if !config.lease.confirm() {
+		return errNotActive
+	}
+	ipv6Address := update.IPv6Address
+
+	config.pins.retire(config.storeIPv6Address(ipv6Address), ipv6Address)
+
+	if err := config.saveIPv6Address(); err != nil {
+		return err
+	}
+
+	if update.Time.IsZero() {
+		update.Time = time.Now().UTC()
+	}
+	if err := config.history.record(update); err != nil {
+		config.logger().Warn("Failed to record the address update in the history", slog.Any("error", err))
+	}
+
+	config.health.recheck()
+	config.digest.recordAddressChange()
+	config.pinger.ping("address update")
+	config.notifications.publish(Event{
+		Type:        EventAddressUpdated,
+		IPv6Address: ipv6Address,
+		Source:      update.Source,
+		Message:     fmt.Sprintf("IPv6 address updated to %s", ipv6Address),
+	})
+
+	return nil
+}
+
+// Builds the runtime configuration of a relay from the environment, the relay is empty if the process runs a single one
+func newConfigFromEnv(relay string, env configEnv) (*Config, error) {
+	var srcPorts, destPorts []string
+	var err error
+	if mappings := env("PORT_MAPPINGS"); mappings != "" {
+		srcPorts, destPorts, err = parsePortMappings(mappings)
 		if err != nil {
-			http.Error(w, "Failed to save IPv6 address", http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("invalid PORT_MAPPINGS: %v", err)
 		}
+	} else {
+		srcPortsEnv := env.parse("SRC_PORTS", "8080")
+		destPortsEnv := env.parse("DEST_PORTS", "8080")
 
-		logLine := fmt.Sprintf("IPv6 address updated to %s", ipv6Address)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, logLine)
-		log.Print(logLine)
+		srcPorts, destPorts, err = expandPortMapping(srcPortsEnv, destPortsEnv)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SRC_PORTS/DEST_PORTS: %v", err)
+		}
 	}
-}
 
-// Checks if a connection to the IPv6 address and port is possible
-func checkTunnel(ipv6Addr, port string) (bool, error) {
-	conn, err := net.DialTimeout("tcp6", fmt.Sprintf("[%s]:%s", ipv6Addr, port), 2*1e9) // 2 seconds timeout
+	if err := validateSourcePorts(srcPorts); err != nil {
+		return nil, err
+	}
+
+	sourceListenAddr := env.parse("SRC_LISTEN_ADDR", "0.0.0.0")
+
+	tunnelListenAddrs, err := parseTunnelListenAddrs(env("TUNNEL_LISTEN_ADDRS"), srcPorts)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("invalid TUNNEL_LISTEN_ADDRS: %v", err)
 	}
-	conn.Close()
-	return true, nil
-}
 
-// Provides a health check for all open tunnels
-func healthCheckHandler(config *Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		config.mu.RLock()
-		defer config.mu.RUnlock()
-
-		var statuses []TunnelStatus
-		allHealthy := true
-
-		for i, ipv4Port := range config.IPv4Ports {
-			ipv6Port := config.IPv6Ports[i]
-			ipv6Alive, err := checkTunnel(config.IPv6Address, ipv6Port)
-			status := TunnelStatus{
-				IPv4Port:  ipv4Port,
-				IPv6Port:  ipv6Port,
-				IPv6Alive: ipv6Alive,
-			}
-			statuses = append(statuses, status)
+	unixSocketMode, err := strconv.ParseUint(env.parse("UNIX_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || unixSocketMode > 0o777 {
+		return nil, fmt.Errorf("invalid UNIX_SOCKET_MODE: must be an octal file mode like 0660")
+	}
 
-			if !ipv6Alive {
-				allHealthy = false
-				log.Printf("Healthcheck failed for port %v! %v", ipv6Port, err)
-			}
+	// Logging is set up once for the whole process, so relays can't override it
+	logLevel := parseConfigEnv("LOG_LEVEL", "info")
+	logFormat := parseConfigEnv("LOG_FORMAT", "text")
+
+	webhookPort := env.parse("WEBHOOK_LISTEN_PORT", "8081")
+	webhookAddr := env.parse("WEBHOOK_LISTEN_ADDR", "0.0.0.0")
+	webhookIPv6Addr := env("WEBHOOK_IPV6_LISTEN_ADDR")
+	webhookIPv6Port := env.parse("WEBHOOK_IPV6_LISTEN_PORT", webhookPort)
+	if webhookIPv6Addr != "" {
+		if addr, err := netip.ParseAddr(webhookIPv6Addr); err != nil || !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("invalid WEBHOOK_IPV6_LISTEN_ADDR: '%s' is not an IPv6 address", webhookIPv6Addr)
+		}
+		if _, err := parsePort(webhookIPv6Port); err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_IPV6_LISTEN_PORT: %v", err)
 		}
+	}
 
-		if allHealthy {
-			w.WriteHeader(http.StatusOK) // HTTP 200 if all tunnels are healthy
-		} else {
-			w.WriteHeader(http.StatusInternalServerError) // HTTP 500 if at least one tunnel is down
+	notifiers, err := parseNotifiers(env("NOTIFY_URLS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_URLS: %v", err)
+	}
+
+	notifyRoutes, err := parseNotificationRoutes(env("NOTIFY_ROUTES"), notifiers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_ROUTES: %v", err)
+	}
+
+	notifyTemplates, err := parseNotificationTemplates(env)
+	if err != nil {
+		return nil, err
+	}
+
+	notifyDebounce, err := time.ParseDuration(env.parse("NOTIFY_DEBOUNCE", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_DEBOUNCE: %v", err)
+	}
+
+	healthInterval, err := time.ParseDuration(env.parse("HEALTHCHECK_INTERVAL", "30s"))
+	if err != nil || healthInterval <= 0 {
+		return nil, fmt.Errorf("invalid HEALTHCHECK_INTERVAL: %v", err)
+	}
+
+	healthTimeout, err := time.ParseDuration(env.parse("HEALTHCHECK_TIMEOUT", "2s"))
+	if err != nil || healthTimeout <= 0 {
+		return nil, fmt.Errorf("invalid HEALTHCHECK_TIMEOUT: %v", err)
+	}
+
+	healthPolicy, err := parseHealthPolicy(env.parse("HEALTH_POLICY", "all"), env("HEALTH_WEIGHTS"), env.parse("HEALTH_WEIGHT_THRESHOLD", "0.5"), srcPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_POLICY: %v", err)
+	}
+
+	addressMask, err := parseAddressMask(env.parse("ADDRESS_MASK", "off"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADDRESS_MASK: %v", err)
+	}
+
+	multipleAddresses, err := parseMultipleAddresses(env.parse("WEBHOOK_MULTIPLE_ADDRESSES", "prefer-global"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_MULTIPLE_ADDRESSES: %v", err)
+	}
+
+	verifyPorts, err := parseVerifyPorts(env("WEBHOOK_VERIFY_PORTS"), destPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_VERIFY_PORTS: %v", err)
+	}
+
+	var leaseTTL time.Duration
+	if ttl := env("ACTIVE_LEASE_TTL"); ttl != "" {
+		leaseTTL, err = time.ParseDuration(ttl)
+		if err != nil || leaseTTL < time.Second {
+			return nil, fmt.Errorf("invalid ACTIVE_LEASE_TTL: must be a duration of at least 1s")
 		}
+	}
 
-		// Respond with JSON containing the tunnel statuses.
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(statuses)
+	instanceID := env("INSTANCE_ID")
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
 	}
-}
 
-func main() {
-	token := os.Getenv("WEBHOOK_TOKEN")
-	if token == "" {
-		log.Fatal("WEBHOOK_TOKEN environment variable not set")
+	dialTimeout, err := time.ParseDuration(env.parse("DIAL_TIMEOUT", "10s"))
+	if err != nil || dialTimeout <= 0 {
+		return nil, fmt.Errorf("invalid DIAL_TIMEOUT: must be a positive duration")
+	}
+
+	// Zero disables the retries
+	dialRetryWindow, err := time.ParseDuration(env.parse("DIAL_RETRY_WINDOW", "0s"))
+	if err != nil || dialRetryWindow < 0 {
+		return nil, fmt.Errorf("invalid DIAL_RETRY_WINDOW: must be a duration, 0 disables it")
+	}
+	dialRetryBackoff, err := time.ParseDuration(env.parse("DIAL_RETRY_BACKOFF", "250ms"))
+	if err != nil || dialRetryBackoff <= 0 {
+		return nil, fmt.Errorf("invalid DIAL_RETRY_BACKOFF: must be a positive duration")
+	}
+
+	// Zero keeps lazy listeners open once they were bound
+	lazyUnbindAfter, err := time.ParseDuration(env.parse("LAZY_LISTENER_UNBIND_AFTER", "10m"))
+	if err != nil || lazyUnbindAfter < 0 {
+		return nil, fmt.Errorf("invalid LAZY_LISTENER_UNBIND_AFTER: must be a duration, 0 disables it")
+	}
+
+	happyEyeballsDelay, err := time.ParseDuration(env.parse("HAPPY_EYEBALLS_DELAY", "250ms"))
+	if err != nil || happyEyeballsDelay <= 0 {
+		return nil, fmt.Errorf("invalid HAPPY_EYEBALLS_DELAY: must be a positive duration")
+	}
+
+	// Zero disables the idle timeout and the keep-alive probes
+	idleTimeout, err := time.ParseDuration(env.parse("IDLE_TIMEOUT", "0s"))
+	if err != nil || idleTimeout < 0 {
+		return nil, fmt.Errorf("invalid IDLE_TIMEOUT: must be a duration, 0 disables it")
+	}
+
+	stallTimeout, err := time.ParseDuration(env.parse("STALL_TIMEOUT", "0s"))
+	if err != nil || stallTimeout < 0 {
+		return nil, fmt.Errorf("invalid STALL_TIMEOUT: must be a duration, 0 disables it")
+	}
+	keepAliveInterval, err := time.ParseDuration(env.parse("KEEPALIVE_INTERVAL", "30s"))
+	if err != nil || keepAliveInterval < 0 {
+		return nil, fmt.Errorf("invalid KEEPALIVE_INTERVAL: must be a duration, 0 disables it")
+	}
+
+	controlListenPort := env("CONTROL_LISTEN_PORT")
+	controlAgentKeys := parseKeyList(env("CONTROL_AGENT_KEYS"))
+	if controlListenPort != "" && len(controlAgentKeys) == 0 {
+		return nil, fmt.Errorf("CONTROL_AGENT_KEYS must contain at least one agent key fingerprint when the control channel is enabled")
+	}
+
+	var reverseDNS *reverseDNSCache
+	if env.parse("REVERSE_DNS", "false") == "true" {
+		size, err := strconv.Atoi(env.parse("REVERSE_DNS_CACHE_SIZE", "1024"))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid REVERSE_DNS_CACHE_SIZE: %v", err)
+		}
+
+		ttl, err := time.ParseDuration(env.parse("REVERSE_DNS_TTL", "1h"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid REVERSE_DNS_TTL: %v", err)
+		}
+
+		reverseDNS = newReverseDNSCache(size, ttl)
+	}
+
+	resolverAddr := env("RESOLVER_ADDR")
+	if resolverAddr == "" {
+		resolverAddr = systemNameserver()
+	} else if _, _, err := net.SplitHostPort(resolverAddr); err != nil {
+		resolverAddr = net.JoinHostPort(resolverAddr, "53")
+	}
+
+	negativeTTL, err := time.ParseDuration(env.parse("DNS_NEGATIVE_TTL", "30s"))
+	if err != nil || negativeTTL <= 0 {
+		return nil, fmt.Errorf("invalid DNS_NEGATIVE_TTL: %v", err)
+	}
+
+	var dns64Prefix netip.Prefix
+	if prefix := env("DNS64_PREFIX"); prefix != "" {
+		if dns64Prefix, err = parseNAT64Prefix(prefix); err != nil {
+			return nil, fmt.Errorf("invalid DNS64_PREFIX: %v", err)
+		}
+	}
+
+	sniListenPort := env("SNI_LISTEN_PORT")
+	sniRoutes, err := parseSNIRoutes(env("SNI_ROUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNI_ROUTES: %v", err)
+	}
+	sniDefaultTarget := env("SNI_DEFAULT_TARGET")
+	if sniDefaultTarget != "" {
+		if err := validateSNITarget(sniDefaultTarget); err != nil {
+			return nil, fmt.Errorf("invalid SNI_DEFAULT_TARGET: %v", err)
+		}
+	}
+	if sniListenPort != "" {
+		if _, err := parsePort(sniListenPort); err != nil {
+			return nil, fmt.Errorf("invalid SNI_LISTEN_PORT: %v", err)
+		}
+		if len(sniRoutes) == 0 && sniDefaultTarget == "" {
+			return nil, fmt.Errorf("SNI_ROUTES or SNI_DEFAULT_TARGET must be set when SNI_LISTEN_PORT is enabled")
+		}
+		if slices.Contains(srcPorts, sniListenPort) {
+			return nil, fmt.Errorf("SNI_LISTEN_PORT %s is also used as a source port", sniListenPort)
+		}
 	}
 
-	srcPortsEnv := parseConfigEnv("SRC_PORTS", "8080")
-	srcPorts := strings.Split(srcPortsEnv, ",")
+	proxyListenPort := env("PROXY_LISTEN_PORT")
+	if proxyListenPort != "" {
+		if _, err := parsePort(proxyListenPort); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_LISTEN_PORT: %v", err)
+		}
+		if slices.Contains(srcPorts, proxyListenPort) || proxyListenPort == sniListenPort {
+			return nil, fmt.Errorf("PROXY_LISTEN_PORT %s is already used by another listener", proxyListenPort)
+		}
+	}
 
-	destPortsEnv := parseConfigEnv("DEST_PORTS", "8080")
-	destPorts := strings.Split(destPortsEnv, ",")
+	copyBufferSize, err := parseCopyBufferSize(env.parse("COPY_BUFFER_SIZE", "auto"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COPY_BUFFER_SIZE: %v", err)
+	}
 
-	if len(srcPorts) != len(destPorts) {
-		log.Fatalf("SRC_PORTS has a different length (%v) than DEST_PORTS (%v). Please make sure that both variables have the same amount of ports", len(srcPorts), len(destPorts))
+	var stats *protocolStats
+	if env.parse("PROTOCOL_STATS", "false") == "true" {
+		stats = newProtocolStats()
+	}
+
+	failoverTargets, err := parseTargetList(env("FAILOVER_TARGETS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FAILOVER_TARGETS: %v", err)
+	}
+
+	rateLimits, err := parseTunnelRateLimits(env("TUNNEL_RATE_LIMITS"), srcPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUNNEL_RATE_LIMITS: %v", err)
+	}
+
+	markings, err := parseIPv6Markings(env("TUNNEL_TRAFFIC_CLASSES"), env("TUNNEL_FLOW_LABELS"), srcPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyProtocols, err := parseTunnelProxyProtocols(env("TUNNEL_PROXY_PROTOCOL"), srcPorts)
+	if err != nil {
+		return nil, err
+	}
+	allowedClients, err := parseTunnelClients("TUNNEL_ALLOWED_CLIENTS", env("TUNNEL_ALLOWED_CLIENTS"), srcPorts)
+	if err != nil {
+		return nil, err
+	}
+	deniedClients, err := parseTunnelClients("TUNNEL_DENIED_CLIENTS", env("TUNNEL_DENIED_CLIENTS"), srcPorts)
+	if err != nil {
+		return nil, err
 	}
 
-	sourceListenAddr := parseConfigEnv("SRC_LISTEN_ADDR", "0.0.0.0")
+	latencySLOWindow, err := time.ParseDuration(env.parse("LATENCY_SLO_WINDOW", "1m"))
+	if err != nil || latencySLOWindow <= 0 {
+		return nil, fmt.Errorf("invalid LATENCY_SLO_WINDOW: must be a positive duration")
+	}
+	latencyShedPercent, err := strconv.Atoi(strings.TrimSuffix(env.parse("LATENCY_SHED_PERCENT", "0"), "%"))
+	if err != nil || latencyShedPercent < 0 || latencyShedPercent > 100 {
+		return nil, fmt.Errorf("invalid LATENCY_SHED_PERCENT: must be a percentage between 0 and 100")
+	}
+	latencySLOs, err := parseTunnelLatencySLOs(env("TUNNEL_LATENCY_SLOS"), srcPorts, latencySLOWindow, latencyShedPercent)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUNNEL_LATENCY_SLOS: %v", err)
+	}
 
-	webhookPort := parseConfigEnv("WEBHOOK_LISTEN_PORT", "8081")
-	webhookAddr := parseConfigEnv("WEBHOOK_LISTEN_ADDR", "0.0.0.0")
+	tunnelTargets, err := parseTunnelTargets(env("TUNNEL_TARGETS"), srcPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUNNEL_TARGETS: %v", err)
+	}
 
 	dataPath := "data" // Name of the data directory
+	stateKey := "four2six/ipv6_address"
+	// Relays of one process keep their state apart
+	if relay != "" {
+		dataPath = filepath.Join(dataPath, relay)
+		stateKey = "four2six/" + relay + "/ipv6_address"
+	}
+	filePath := filepath.Join(dataPath, "ipv6_address.txt")
+
+	state, err := newState(env.parse("STATE_BACKEND", "file"), env("STATE_URL"), env.parse("STATE_KEY", stateKey), env("STATE_TOKEN"), filePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state backend: %v", err)
+	}
+
+	alertTunnelDownAfter, err := time.ParseDuration(env.parse("ALERT_TUNNEL_DOWN_AFTER", "5m"))
+	if err != nil || alertTunnelDownAfter < 0 {
+		return nil, fmt.Errorf("invalid ALERT_TUNNEL_DOWN_AFTER: must be a duration, 0 disables it")
+	}
+	alertUpdateStaleAfter, err := time.ParseDuration(env.parse("ALERT_UPDATE_STALE_AFTER", "0s"))
+	if err != nil || alertUpdateStaleAfter < 0 {
+		return nil, fmt.Errorf("invalid ALERT_UPDATE_STALE_AFTER: must be a duration, 0 disables it")
+	}
+	alertPoolUsage, err := strconv.Atoi(strings.TrimSuffix(env.parse("ALERT_POOL_USAGE", "80"), "%"))
+	if err != nil || alertPoolUsage < 0 || alertPoolUsage > 100 {
+		return nil, fmt.Errorf("invalid ALERT_POOL_USAGE: must be a percentage between 0 and 100, 0 disables it")
+	}
+
+	eventLogMaxSize, err := parseByteSize(env.parse("EVENT_LOG_MAX_SIZE", "10MiB"))
+	if err != nil || eventLogMaxSize <= 0 {
+		return nil, fmt.Errorf("invalid EVENT_LOG_MAX_SIZE: must be a size like 10MiB")
+	}
+	eventLogBackups, err := strconv.Atoi(env.parse("EVENT_LOG_BACKUPS", "3"))
+	if err != nil || eventLogBackups < 0 {
+		return nil, fmt.Errorf("invalid EVENT_LOG_BACKUPS: must be a number of files")
+	}
+	webhookRecordMax, err := strconv.Atoi(env.parse("WEBHOOK_RECORD_MAX", "100"))
+	if err != nil || webhookRecordMax <= 0 {
+		return nil, fmt.Errorf("invalid WEBHOOK_RECORD_MAX: must be a positive number of requests")
+	}
+
+	events := newEventLog(env.parse("EVENT_LOG", "false") == "true", filepath.Join(dataPath, eventLogFile), int64(eventLogMaxSize), eventLogBackups)
 
 	// Initial configuration
 	config := &Config{
-		IPv6Address:       "2001:db8::1", // Default IPv6 address
-		IPv4Ports:         srcPorts,
-		IPv6Ports:         destPorts,
-		WebhookToken:      token,
-		DataDir:           filepath.Join(".", dataPath),
-		FilePath:          filepath.Join(dataPath, "ipv6_address.txt"),
-		WebhookListenPort: webhookPort,
-		WebhookListenAddr: webhookAddr,
-		TunnelListenAddr:  sourceListenAddr,
-	}
-
-	// Load IPv6 address from the file if it exists
-	if err := config.loadIPv6Address(); err != nil {
-		log.Printf("Failed to load IPv6 address from file: %v. Using default (%s).", err, config.IPv6Address)
+		Relay:                      relay,
+		TargetHost:                 env("TARGET_HOST"),
+		DNS64Prefix:                dns64Prefix,
+		FailoverTargets:            failoverTargets,
+		TunnelTargets:              tunnelTargets,
+		IPv4Ports:                  srcPorts,
+		IPv6Ports:                  destPorts,
+		WebhookToken:               env("WEBHOOK_TOKEN"),
+		DataDir:                    filepath.Join(".", dataPath),
+		FilePath:                   filePath,
+		WebhookListenPort:          webhookPort,
+		WebhookListenAddr:          webhookAddr,
+		WebhookIPv6ListenAddr:      webhookIPv6Addr,
+		WebhookIPv6ListenPort:      webhookIPv6Port,
+		AddressMask:                addressMask,
+		WebhookRegexFallback:       env.parse("WEBHOOK_REGEX_FALLBACK", "true") == "true",
+		WebhookAllowLocalAddresses: env.parse("WEBHOOK_ALLOW_LOCAL_ADDRESSES", "false") == "true",
+		WebhookMultipleAddresses:   multipleAddresses,
+		WebhookVerifyPorts:         verifyPorts,
+		TunnelListenAddr:           sourceListenAddr,
+		TunnelListenAddrs:          tunnelListenAddrs,
+		UnixSocketMode:             os.FileMode(unixSocketMode),
+		LogLevel:                   logLevel,
+		LogFormat:                  logFormat,
+		ControlListenAddr:          env.parse("CONTROL_LISTEN_ADDR", "0.0.0.0"),
+		ControlListenPort:          controlListenPort,
+		ControlAgentKeys:           controlAgentKeys,
+		SNIListenPort:              sniListenPort,
+		SNIRoutes:                  sniRoutes,
+		SNIDefaultTarget:           sniDefaultTarget,
+		ProxyListenAddr:            env.parse("PROXY_LISTEN_ADDR", "127.0.0.1"),
+		ProxyListenPort:            proxyListenPort,
+		ProxyUsername:              env("PROXY_USERNAME"),
+		ProxyPassword:              env("PROXY_PASSWORD"),
+		HealthInterval:             healthInterval,
+		HealthTimeout:              healthTimeout,
+		HealthPolicy:               healthPolicy,
+		ReusePort:                  env.parse("REUSE_PORT", "false") == "true",
+		LazyListeners:              env.parse("LAZY_LISTENERS", "false") == "true",
+		LazyListenerUnbindAfter:    lazyUnbindAfter,
+		CopyBufferSize:             copyBufferSize,
+		DialTimeout:                dialTimeout,
+		DialRetryWindow:            dialRetryWindow,
+		DialRetryBackoff:           dialRetryBackoff,
+		CircuitBreaker:             env.parse("CIRCUIT_BREAKER", "false") == "true",
+		HappyEyeballs:              env.parse("HAPPY_EYEBALLS", "false") == "true",
+		HappyEyeballsDelay:         happyEyeballsDelay,
+		IdleTimeout:                idleTimeout,
+		StallTimeout:               stallTimeout,
+		StallAbort:                 env.parse("STALL_ABORT", "false") == "true",
+		KeepAliveInterval:          keepAliveInterval,
+		InstanceID:                 instanceID,
+		LeaseTTL:                   leaseTTL,
+		ReadOnly:                   env.parse("READ_ONLY", "false") == "true",
+		AlertTunnelDownAfter:       alertTunnelDownAfter,
+		AlertUpdateStaleAfter:      alertUpdateStaleAfter,
+		AlertPoolUsage:             alertPoolUsage,
+		notifications:              newNotificationDispatcher(relay, notifiers, notifyRoutes, notifyTemplates, notifyDebounce, events),
+		reverseDNS:                 reverseDNS,
+		dnsCache:                   newDNSCache(resolverAddr, negativeTTL),
+		rateLimits:                 rateLimits,
+		latencySLOs:                latencySLOs,
+		markings:                   markings,
+		proxyProtocols:             proxyProtocols,
+		allowedClients:             allowedClients,
+		deniedClients:              deniedClients,
+		recorder:                   newWebhookRecorder(env.parse("WEBHOOK_RECORD", "false") == "true", filepath.Join(dataPath, webhookRecordingsDir), webhookRecordMax),
+		protocolStats:              stats,
+		state:                      state,
+	}
+	config.current.Store(&configSnapshot{
+		IPv6Address: "2001:db8::1", // Default IPv6 address
+	})
+
+	if config.digest, err = newDigestCollector(config, env.parse("DIGEST_SCHEDULE", "off"), env.parse("DIGEST_TIME", "08:00")); err != nil {
+		return nil, fmt.Errorf("invalid DIGEST_SCHEDULE or DIGEST_TIME: %v", err)
+	}
+
+	if config.ftp, err = newFTPHelper(config, env("FTP_PORTS"), env("FTP_PASSIVE_PORTS"), env("FTP_PASSIVE_ADDRESS")); err != nil {
+		return nil, fmt.Errorf("invalid FTP_PORTS: %v", err)
 	}
 
-	// Start the HTTP server to listen for webhook updates and health check
-	http.HandleFunc("/update", updateIPv6Address(config))
-	http.HandleFunc("/health", healthCheckHandler(config))
+	if config.sip, err = newSIPHelper(config, env("SIP_PORTS"), env("SIP_RTP_PORTS"), env("SIP_MEDIA_ADDRESS")); err != nil {
+		return nil, fmt.Errorf("invalid SIP_PORTS: %v", err)
+	}
+
+	if config.spa, err = newSPAGate(config, env("SPA_PORTS"), env("SPA_SECRET"), env.parse("SPA_LISTEN_ADDR", "0.0.0.0"), env("SPA_LISTEN_PORT"), env.parse("SPA_TTL", "30s")); err != nil {
+		return nil, fmt.Errorf("invalid SPA_PORTS: %v", err)
+	}
+
+	if config.tls, err = newTLSTerminator(config, env("TUNNEL_TLS_PORTS"), env("TUNNEL_TLS_CERT"), env("TUNNEL_TLS_KEY"), env("TUNNEL_TLS_CLIENT_CA")); err != nil {
+		return nil, fmt.Errorf("invalid TUNNEL_TLS_PORTS: %v", err)
+	}
+
+	ephemeralMaxTTL, err := time.ParseDuration(env.parse("EPHEMERAL_MAX_TTL", "24h"))
+	if err != nil || ephemeralMaxTTL <= 0 {
+		return nil, fmt.Errorf("invalid EPHEMERAL_MAX_TTL: must be a positive duration")
+	}
+	if config.ephemeral, err = newEphemeralTunnels(config, env("EPHEMERAL_PORTS"), env("EPHEMERAL_DEST_PORTS"), ephemeralMaxTTL); err != nil {
+		return nil, fmt.Errorf("invalid EPHEMERAL_PORTS: %v", err)
+	}
+
+	if config.webhookTLS, err = loadWebhookTLS(env("WEBHOOK_TLS_CERT"), env("WEBHOOK_TLS_KEY"), env("WEBHOOK_TLS_CLIENT_CA")); err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_TLS_CERT: %v", err)
+	}
+	if config.auth, err = parseAuthChains(config, env); err != nil {
+		return nil, err
+	}
+
+	sessionPinningWindow, err := time.ParseDuration(env.parse("SESSION_PINNING_WINDOW", "0s"))
+	if err != nil || sessionPinningWindow < 0 {
+		return nil, fmt.Errorf("invalid SESSION_PINNING_WINDOW: must be a duration, 0 disables it")
+	}
+	config.pins = newSessionPins(sessionPinningWindow)
+
+	pingInterval, err := time.ParseDuration(env.parse("PING_INTERVAL", "1m"))
+	if err != nil || pingInterval <= 0 {
+		return nil, fmt.Errorf("invalid PING_INTERVAL: must be a positive duration")
+	}
+
+	config.pinger, err = newPinger(config, env("PING_URLS"), pingInterval, env.parse("PING_REQUIRE_HEALTHY", "false") == "true")
+	if err != nil {
+		return nil, fmt.Errorf("invalid PING_URLS: %v", err)
+	}
+
+	publicIPv4Interval, err := time.ParseDuration(env.parse("PUBLIC_IPV4_INTERVAL", "1m"))
+	if err != nil || publicIPv4Interval <= 0 {
+		return nil, fmt.Errorf("invalid PUBLIC_IPV4_INTERVAL: must be a positive duration")
+	}
+
+	config.publicIPv4, err = newPublicIPv4Watcher(config, env("PUBLIC_IPV4_SOURCE"), publicIPv4Interval, env("PUBLIC_IPV4_DNS_URLS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PUBLIC_IPV4_SOURCE or PUBLIC_IPV4_DNS_URLS: %v", err)
+	}
+
+	return config, nil
+}
+
+func main() {
+	command, args, err := parseCommandLine(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2) // The flag package already printed the error and the usage
+	}
+
+	configs, err := loadRelayConfigs(os.Getenv("RELAYS"))
+	if err != nil {
+		fatal("Invalid configuration", slog.Any("error", err))
+	}
+
+	// Logging is the same for every relay
+	if err := setupLogger(configs[0].LogLevel, configs[0].LogFormat); err != nil {
+		fatal("Invalid logging configuration", slog.Any("error", err))
+	}
+
+	switch command {
+	case "serve":
+	case "check-config":
+		if err := runCheckConfig(configs, args); err != nil {
+			fatal("Check failed", slog.Any("error", err))
+		}
+		return
+	case "agent":
+		if err := runAgent(); err != nil {
+			fatal("Agent failed", slog.Any("error", err))
+		}
+		return
+	case "knock":
+		if err := runKnock(args); err != nil {
+			fatal("Knock failed", slog.Any("error", err))
+		}
+		return
+	case "export", "update-ip", "replay":
+		config, err := findRelay(configs, os.Getenv("RELAY_NAME"))
+		if err != nil {
+			fatal("Invalid configuration", slog.Any("error", err))
+		}
+		switch command {
+		case "export":
+			err = runExport(config, args)
+		case "replay":
+			err = runReplay(config, args)
+		default:
+			err = runUpdateIP(config, args)
+		}
+		if err != nil {
+			fatal("Command failed", slog.String("command", command), slog.Any("error", err))
+		}
+		return
+	default:
+		fatal("Unknown command, see four2six -help", slog.String("command", command))
+	}
+
+	// Pick up the sockets passed by systemd socket activation
+	inherited, err := loadInheritedListeners()
+	if err != nil {
+		fatal("Failed to load inherited sockets", slog.Any("error", err))
+	}
+
+	for _, config := range configs {
+		switch {
+		case config.WebhookToken != "" || !config.auth.usesToken():
+		case config.Relay == "":
+			fatal("WEBHOOK_TOKEN environment variable not set")
+		default:
+			fatal("WEBHOOK_TOKEN is not set for the relay", slog.String("relay", config.Relay))
+		}
+	}
+
+	for _, config := range configs {
+		config.inherited = inherited
+		config.serve()
+	}
+
+	// Every listener is open now, inherited sockets nobody claimed are not needed
+	inherited.closeUnused()
+
+	// Keep the main goroutine running
+	select {}
+}
+
+// Serves the HTTP endpoints on a listener in the background
+func (config *Config) serveWebhook(listener net.Listener, handler http.Handler) {
+	listener = config.webhookListener(listener)
 	go func() {
-		fullAddr := fmt.Sprintf("%s:%s", config.WebhookListenAddr, config.WebhookListenPort)
-		log.Printf("Starting webhook server on %s\n", fullAddr)
-		log.Fatal(http.ListenAndServe(fullAddr, nil))
+		config.logger().Info("Starting webhook server", slog.String("addr", listener.Addr().String()))
+		fatal("Webhook server stopped", slog.String("addr", listener.Addr().String()), slog.Any("error", http.Serve(listener, handler)))
 	}()
+}
 
-	for i, port := range config.IPv4Ports {
-		go func(port string) {
-			listener, err := net.Listen("tcp4", fmt.Sprintf("%s:%s", config.TunnelListenAddr, port))
+// Starts the webhook server, the tunnels and the background tasks of a relay
+func (config *Config) serve() {
+	var err error
+
+	if config.history, err = loadAddressHistory(config.DataDir); err != nil {
+		config.logger().Warn("Failed to load the address history", slog.Any("error", err))
+	}
+
+	config.settings = newTunnelSettings(config)
+	if err := config.settings.load(); err != nil {
+		config.logger().Warn("Failed to load the tunnel settings, using the environment", slog.Any("error", err))
+	}
+
+	config.startedAt = time.Now()
+
+	// Load the IPv6 address from the state backend if one was stored
+	if err := config.loadIPv6Address(); err != nil {
+		config.logger().Warn("Failed to load IPv6 address, using default", slog.Any("error", err), slog.String("ipv6_address", config.ipv6Address()))
+	}
+
+	config.tunnels = newTunnelManager(config)
+
+	// Check the health of all tunnels in the background
+	config.health = newHealthMonitor(config)
+	go config.health.run()
+
+	// Pick up addresses stored by other instances
+	go config.watchState()
+
+	// Compete for the active lease with the other instances sharing the state backend, read-only instances stay out of it
+	if config.ReadOnly {
+		config.logger().Warn("Running in read-only mode, updates and tunnel changes are disabled")
+	} else if config.LeaseTTL > 0 {
+		config.lease = newActiveLease(config, config.InstanceID, config.LeaseTTL)
+		go config.lease.run()
+	}
+
+	// Send the periodic digest
+	if config.digest != nil {
+		go config.digest.run()
+	}
+
+	// Follow the public IPv4 address of the host
+	if config.publicIPv4 != nil {
+		go config.publicIPv4.run()
+	}
+
+	// Let the external monitors know that the relay is alive
+	if config.pinger != nil {
+		go config.pinger.run()
+	}
+
+	// Start the HTTP server to listen for webhook updates and health check, every relay has its own
+	mux := http.NewServeMux()
+	// Every endpoint is protected by the authentication chain of its group
+	mux.Handle("/update", config.auth.wrap(authGroupUpdate, config.recorder.wrap(updateIPv6Address(config))))
+	mux.Handle("/heartbeat", config.auth.wrap(authGroupUpdate, heartbeatHandler(config)))
+	mux.Handle("/health", config.auth.wrap(authGroupHealth, healthCheckHandler(config)))
+	mux.Handle("/health/live", config.auth.wrap(authGroupHealth, livenessHandler()))
+	mux.Handle("/health/ready", config.auth.wrap(authGroupHealth, readinessHandler(config)))
+	mux.Handle("/health/{tunnel}", config.auth.wrap(authGroupHealth, tunnelHealthHandler(config)))
+	mux.Handle("/status", config.auth.wrap(authGroupStatus, statusHandler(config)))
+	mux.Handle("/history", config.auth.wrap(authGroupStatus, historyHandler(config)))
+	mux.Handle("GET /{$}", config.auth.wrap(authGroupStatus, dashboardHandler()))
+	mux.Handle("/dns", config.auth.wrap(authGroupStatus, dnsCacheHandler(config)))
+	mux.Handle("/stats", config.auth.wrap(authGroupStatus, statsHandler(config)))
+	mux.Handle("GET /alerts", config.auth.wrap(authGroupStatus, alertsHandler(config)))
+	mux.Handle("GET /debug/tuning", config.auth.wrap(authGroupStatus, tuningHandler()))
+	mux.Handle("/tunnels/ephemeral", config.auth.wrap(authGroupAdmin, ephemeralTunnelsHandler(config)))
+	mux.Handle("/tunnels/ephemeral/{id}", config.auth.wrap(authGroupAdmin, ephemeralTunnelsHandler(config)))
+	mux.Handle("/tunnels/{name}", config.auth.wrap(authGroupAdmin, tunnelSettingsHandler(config)))
+	handler := withRequestLogger(config.logger(), withRelayHeader(config.Relay, mux))
+	webhookListener, err := config.listen("tcp", config.WebhookListenAddr, config.WebhookListenPort)
+	if err != nil {
+		fatal("Error starting webhook server", slog.String("addr", config.WebhookListenAddr), slog.String("port", config.WebhookListenPort), slog.Any("error", err))
+	}
+	config.serveWebhook(webhookListener, handler)
+
+	// Routers behind CGNAT may only reach the relay over IPv6
+	if config.WebhookIPv6ListenAddr != "" {
+		if _, port, _ := net.SplitHostPort(webhookListener.Addr().String()); port == config.WebhookIPv6ListenPort && acceptsIPv6(webhookListener) {
+			config.logger().Info("The webhook server accepts IPv6 connections already, not opening another listener", slog.String("addr", webhookListener.Addr().String()))
+		} else {
+			listener, err := config.listen("tcp6", config.WebhookIPv6ListenAddr, config.WebhookIPv6ListenPort)
 			if err != nil {
-				log.Fatalf("Error listening on IPv4 address %s port %s: %v", config.TunnelListenAddr, port, err)
+				fatal("Error starting IPv6 webhook server", slog.String("addr", config.WebhookIPv6ListenAddr), slog.String("port", config.WebhookIPv6ListenPort), slog.Any("error", err))
 			}
+			config.serveWebhook(listener, handler)
+		}
+	}
 
-			defer listener.Close()
-			log.Printf("Listening on %s:%s for IPv4 connections...\n", config.TunnelListenAddr, port)
-
-			for {
-				srcConn, err := listener.Accept()
-				if err != nil {
-					log.Printf("Error accepting connection: %v", err)
-					continue
-				}
-
-				config.mu.RLock()
-				ipv6Addr := config.IPv6Address
-				// Use the destination port that is at the same index as the source port
-				ipv6Port := config.IPv6Ports[i]
-				config.mu.RUnlock()
-
-				destConn, err := net.Dial("tcp6", fmt.Sprintf("[%s]:%s", ipv6Addr, ipv6Port))
-				if err != nil {
-					log.Printf("Error dialing IPv6 address %s port %s: %v", ipv6Addr, ipv6Port, err)
-					srcConn.Close()
-					continue
-				}
-
-				go forward(srcConn, destConn)
-			}
-		}(port)
+	// Start the control channel for the agent if it's enabled
+	if config.ControlListenPort != "" {
+		listener, err := config.listen("tcp", config.ControlListenAddr, config.ControlListenPort)
+		if err != nil {
+			fatal("Error starting control channel server", slog.String("addr", config.ControlListenAddr), slog.String("port", config.ControlListenPort), slog.Any("error", err))
+		}
+		go func() {
+			fatal("Control channel server stopped", slog.Any("error", runControlServer(config, listener)))
+		}()
 	}
 
-	// Keep the main goroutine running
-	select {}
+	// Wait for the packets that open the gated tunnels
+	if config.spa != nil {
+		conn, err := listenUDP("udp", net.JoinHostPort(config.spa.listenAddr, config.spa.listenPort))
+		if err != nil {
+			fatal("Error starting SPA listener", slog.String("addr", config.spa.listenAddr), slog.String("port", config.spa.listenPort), slog.Any("error", err))
+		}
+		go func() {
+			fatal("SPA listener stopped", slog.Any("error", config.spa.run(config.logger(), conn)))
+		}()
+	}
+
+	// Start the SNI routing listener if it's enabled
+	if config.SNIListenPort != "" {
+		listener, err := config.listenFollowing(config.TunnelListenAddr, config.SNIListenPort)
+		if err != nil {
+			fatal("Error listening on IPv4 address", slog.String("tunnel", "sni:"+config.SNIListenPort), slog.String("addr", config.TunnelListenAddr), slog.String("port", config.SNIListenPort), slog.Any("error", err))
+		}
+		go runSNIListener(config, listener)
+	}
+
+	// Start the SOCKS5 and HTTP CONNECT proxy if it's enabled
+	if config.ProxyListenPort != "" {
+		go runProxyListener(config, config.mustListenIPv4("proxy:"+config.ProxyListenPort, config.ProxyListenAddr, config.ProxyListenPort))
+	}
+
+	config.tunnels.start()
 }
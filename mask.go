@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+)
+
+// Prefix length that is kept when masking addresses, the interface identifier is hidden
+const maskedPrefixLength = 64
+
+// Anything that might be an IPv6 address, candidates are verified with netip. A candidate ends with a group or with ::,
+// so the colon of "2001:db8::1: connection refused" isn't taken for part of the address.
+var ipv6Candidate = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{0,4}:){1,7}:`)
+
+// Parses ADDRESS_MASK
+func parseAddressMask(mode string) (string, error) {
+	switch mode {
+	case "off", "prefix", "redact":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode '%s', expected one of: off, prefix, redact", mode)
+	}
+}
+
+// Masks a single address according to ADDRESS_MASK
+func (config *Config) maskAddress(addr netip.Addr) string {
+	switch config.AddressMask {
+	case "prefix":
+		prefix, _ := addr.Prefix(maskedPrefixLength)
+		return prefix.String()
+	case "redact":
+		return "redacted"
+	default:
+		return addr.String()
+	}
+}
+
+// Masks every IPv6 address in a text, e.g. in a dial error
+func (config *Config) maskText(text string) string {
+	if config.AddressMask == "off" {
+		return text
+	}
+
+	return ipv6Candidate.ReplaceAllStringFunc(text, func(candidate string) string {
+		addr, err := netip.ParseAddr(candidate)
+		if err != nil || !addr.Is6() {
+			return candidate
+		}
+		return config.maskAddress(addr)
+	})
+}
+
+// Returns a copy of the tunnel statuses with masked targets and errors
+func (config *Config) maskTunnelStatuses(statuses []TunnelStatus) []TunnelStatus {
+	if config.AddressMask == "off" {
+		return statuses
+	}
+
+	masked := make([]TunnelStatus, len(statuses))
+	for i, status := range statuses {
+		masked[i] = config.maskTunnelStatus(status)
+	}
+	return masked
+}
+
+func (config *Config) maskTunnelStatus(status TunnelStatus) TunnelStatus {
+	if config.AddressMask == "off" || status.Targets == nil {
+		return status
+	}
+
+	targets := make([]TargetStatus, len(status.Targets))
+	for i, target := range status.Targets {
+		targets[i] = TargetStatus{Target: config.maskText(target.Target), Alive: target.Alive, Error: config.maskText(target.Error)}
+	}
+	status.Targets = targets
+	return status
+}
+
+// Returns a copy of the status with masked addresses of the home network
+func (config *Config) maskStatus(status Status) Status {
+	if config.AddressMask == "off" {
+		return status
+	}
+
+	status.IPv6Address = config.maskText(status.IPv6Address)
+
+	tunnels := make([]TunnelOverview, len(status.Tunnels))
+	for i, tunnel := range status.Tunnels {
+		targets := make([]string, len(tunnel.Targets))
+		for j, target := range tunnel.Targets {
+			targets[j] = config.maskText(target)
+		}
+		tunnel.Targets = targets
+		tunnel.LastError = config.maskText(tunnel.LastError)
+		tunnels[i] = tunnel
+	}
+	status.Tunnels = tunnels
+
+	// The agent runs in the home network, so do its addresses
+	if heartbeat := status.Agent.LastHeartbeat; heartbeat != nil {
+		masked := *heartbeat
+		masked.RemoteAddr = config.maskText(masked.RemoteAddr)
+		masked.Addresses = make([]AddressInfo, len(heartbeat.Addresses))
+		for i, address := range heartbeat.Addresses {
+			address.Address = config.maskText(address.Address)
+			masked.Addresses[i] = address
+		}
+		status.Agent.LastHeartbeat = &masked
+	}
+	return status
+}
+
+// Returns a copy of the address history with masked addresses
+func (config *Config) maskAddressUpdates(updates []AddressUpdate) []AddressUpdate {
+	if config.AddressMask == "off" {
+		return updates
+	}
+
+	masked := make([]AddressUpdate, len(updates))
+	for i, update := range updates {
+		update.IPv6Address = config.maskText(update.IPv6Address)
+		update.Client = config.maskText(update.Client)
+		masked[i] = update
+	}
+	return masked
+}
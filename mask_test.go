@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestMaskText(t *testing.T) {
+	tests := []struct {
+		mode, text, want string
+	}{
+		{"off", "dial tcp6 [2001:db8:1:2::5]:443: i/o timeout", "dial tcp6 [2001:db8:1:2::5]:443: i/o timeout"},
+		{"prefix", "dial tcp6 [2001:db8:1:2::5]:443: i/o timeout", "dial tcp6 [2001:db8:1:2::/64]:443: i/o timeout"},
+		{"prefix", "2001:db8:1:2::5: connection refused", "2001:db8:1:2::/64: connection refused"},
+		{"prefix", "2001:db8:1:2:3:4:5:6: no route to host", "2001:db8:1:2::/64: no route to host"},
+		{"prefix", "target 2001:db8:1:2:: is down", "target 2001:db8:1:2::/64 is down"},
+		{"redact", "::1 and 2001:db8::1: refused", "redacted and redacted: refused"},
+		{"redact", "at 12:30:45 from 192.0.2.1:443", "at 12:30:45 from 192.0.2.1:443"},
+	}
+	for _, test := range tests {
+		config := &Config{AddressMask: test.mode}
+		if got := config.maskText(test.text); got != test.want {
+			t.Errorf("maskText(%q) with %s = %q, want %q", test.text, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestMaskStatus(t *testing.T) {
+	config := &Config{AddressMask: "prefix"}
+	heartbeat := &HeartbeatRecord{
+		Heartbeat:  Heartbeat{Addresses: []AddressInfo{{Address: "2001:db8:1:2::5"}}},
+		RemoteAddr: "[2001:db8:1:2::5]:40000",
+	}
+	status := Status{
+		IPv6Address: "2001:db8:1:2::5",
+		Tunnels:     []TunnelOverview{{Targets: []string{"2001:db8:1:2::5"}, LastError: "dial tcp6 [2001:db8:1:2::5]:443: i/o timeout"}},
+		Agent:       AgentStatus{LastHeartbeat: heartbeat},
+	}
+
+	masked := config.maskStatus(status)
+	if masked.IPv6Address != "2001:db8:1:2::/64" {
+		t.Errorf("ipv6_address = %q", masked.IPv6Address)
+	}
+	if tunnel := masked.Tunnels[0]; tunnel.Targets[0] != "2001:db8:1:2::/64" || tunnel.LastError != "dial tcp6 [2001:db8:1:2::/64]:443: i/o timeout" {
+		t.Errorf("tunnel = %+v", tunnel)
+	}
+	if agent := masked.Agent.LastHeartbeat; agent.Addresses[0].Address != "2001:db8:1:2::/64" || agent.RemoteAddr != "[2001:db8:1:2::/64]:40000" {
+		t.Errorf("agent = %+v", agent)
+	}
+
+	// The tracker and the health monitor keep using the originals
+	if status.Tunnels[0].Targets[0] != "2001:db8:1:2::5" || heartbeat.Addresses[0].Address != "2001:db8:1:2::5" || heartbeat.RemoteAddr != "[2001:db8:1:2::5]:40000" {
+		t.Error("masking changed the original status")
+	}
+}
+
+func TestMaskAddressUpdates(t *testing.T) {
+	config := &Config{AddressMask: "redact"}
+	updates := []AddressUpdate{{IPv6Address: "2001:db8::1", Client: "[2001:db8::2]:1234", Source: "router"}}
+
+	masked := config.maskAddressUpdates(updates)
+	if masked[0].IPv6Address != "redacted" || masked[0].Client != "[redacted]:1234" || masked[0].Source != "router" {
+		t.Errorf("masked = %+v", masked[0])
+	}
+	if updates[0].IPv6Address != "2001:db8::1" {
+		t.Error("masking changed the history")
+	}
+}
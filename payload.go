@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/netip"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Largest update body that is read, updates are a few hundred bytes at most
+const maxUpdateBodySize = 64 << 10
+
+// Longest source name that is stored in the history and sent with notifications
+const maxUpdateSourceLength = 128
+
+// Part of an update body that ends up in the logs
+const maxLoggedBodyLength = 256
+
+var errUnstructuredUpdate = errors.New(`expected a JSON body like {"ipv6_address": "2001:db8::1", "source": "router"}`)
+
+// An update as parsed from the webhook body
+type updatePayload struct {
+	IPv6Address netip.Addr
+	Source      string
+	// IPv4 address of the router's uplink, if it reported one
+	IPv4Address netip.Addr
+	// Whether the address was searched in an unstructured body
+	Unstructured bool
+}
+
+// Parses an update body, which is either JSON, a form with the same fields, or anything containing an address
+// if WEBHOOK_REGEX_FALLBACK is enabled. JSON objects and forms with an address are never searched, so a
+// broken structured update can't be mistaken for another address in its body.
+func (config *Config) parseUpdatePayload(contentType string, body []byte) (updatePayload, error) {
+	if !utf8.Valid(body) {
+		return updatePayload{}, errors.New("the body is not valid UTF-8")
+	}
+
+	var fields struct {
+		IPv6Address string `json:"ipv6_address"`
+		Source      string `json:"source"`
+		IPv4Address string `json:"ipv4_address"`
+	}
+	structured := false
+	if trimmed := bytes.TrimSpace(body); bytes.HasPrefix(trimmed, []byte("{")) {
+		if err := json.Unmarshal(trimmed, &fields); err != nil {
+			return updatePayload{}, fmt.Errorf("the body is not valid JSON: %v", err)
+		}
+		if fields.IPv6Address == "" {
+			return updatePayload{}, errors.New("ipv6_address is missing")
+		}
+		structured = true
+	} else if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		// curl -d sends raw addresses as forms too, those are handled like any other unstructured body
+		if values, err := url.ParseQuery(string(body)); err == nil && values.Has("ipv6_address") {
+			fields.IPv6Address, fields.Source, fields.IPv4Address = values.Get("ipv6_address"), values.Get("source"), values.Get("ipv4_address")
+			structured = true
+		}
+	}
+
+	if structured {
+		source, err := parseUpdateSource(fields.Source)
+		if err != nil {
+			return updatePayload{}, err
+		}
+		addr, ok := parseIPv6Candidate(fields.IPv6Address)
+		if !ok {
+			return updatePayload{}, errors.New("ipv6_address is not a valid IPv6 address")
+		}
+		if err := config.checkAddressScope(addr); err != nil {
+			return updatePayload{}, err
+		}
+		var ipv4Addr netip.Addr
+		if fields.IPv4Address != "" {
+			if ipv4Addr, err = netip.ParseAddr(fields.IPv4Address); err != nil || !ipv4Addr.Is4() {
+				return updatePayload{}, errors.New("ipv4_address is not a valid IPv4 address")
+			}
+		}
+		return updatePayload{IPv6Address: addr, Source: source, IPv4Address: ipv4Addr}, nil
+	}
+
+	if !config.WebhookRegexFallback {
+		return updatePayload{}, errUnstructuredUpdate
+	}
+
+	// favonia/cloudflare-ddns only sends raw strings (even when they are sending a JSON content-type header),
+	// so the body is searched for anything that looks like an IPv6 address.
+	addr, err := config.findIPv6Address(string(body))
+	if err != nil {
+		return updatePayload{}, err
+	}
+	return updatePayload{IPv6Address: addr, Unstructured: true}, nil
+}
+
+// Checks the source name of an update, which is shown in the history, logs and notifications
+func parseUpdateSource(source string) (string, error) {
+	source = strings.TrimSpace(source)
+	if utf8.RuneCountInString(source) > maxUpdateSourceLength {
+		return "", fmt.Errorf("source is longer than %d characters", maxUpdateSourceLength)
+	}
+	if strings.ContainsFunc(source, unicode.IsControl) {
+		return "", errors.New("source contains control characters")
+	}
+	return source, nil
+}
+
+// Shortens an update body for the logs
+func loggedBody(body []byte) string {
+	if len(body) <= maxLoggedBodyLength {
+		return string(body)
+	}
+	return strings.ToValidUTF8(string(body[:maxLoggedBodyLength]), "") + "..."
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestParseUpdatePayload(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		fallback    bool
+		multiple    string
+		want        updatePayload
+		wantErr     string
+	}{
+		{name: "json", contentType: "application/json", body: `{"ipv6_address": "2001:db8::1", "source": " router "}`,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Source: "router"}},
+		{name: "json with ipv4", body: ` {"ipv6_address": "[2001:db8::1]", "ipv4_address": "198.51.100.7"}`,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), IPv4Address: netip.MustParseAddr("198.51.100.7")}},
+		{name: "json with zone", body: `{"ipv6_address": "2001:db8::1%eth0"}`, want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1")}},
+		{name: "json without address", body: `{"source": "router"}`, fallback: true, wantErr: "ipv6_address is missing"},
+		{name: "broken json is not searched", body: `{"ipv6_address": "2001:db8::1"`, fallback: true, wantErr: "not valid JSON"},
+		{name: "json ipv4 target", body: `{"ipv6_address": "198.51.100.7"}`, wantErr: "not a valid IPv6 address"},
+		{name: "json mapped ipv4", body: `{"ipv6_address": "::ffff:198.51.100.7"}`, wantErr: "not a valid IPv6 address"},
+		{name: "json loopback", body: `{"ipv6_address": "::1"}`, wantErr: "loopback"},
+		{name: "json invalid ipv4", body: `{"ipv6_address": "2001:db8::1", "ipv4_address": "2001:db8::2"}`, wantErr: "ipv4_address"},
+		{name: "json long source", body: `{"ipv6_address": "2001:db8::1", "source": "` + strings.Repeat("x", maxUpdateSourceLength+1) + `"}`, wantErr: "source is longer"},
+		{name: "json control characters", body: `{"ipv6_address": "2001:db8::1", "source": "a\nb"}`, wantErr: "control characters"},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "ipv6_address=2001%3Adb8%3A%3A1&source=router&ipv4_address=198.51.100.7",
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Source: "router", IPv4Address: netip.MustParseAddr("198.51.100.7")}},
+		{name: "form link-local", contentType: "application/x-www-form-urlencoded", body: "ipv6_address=fe80::1", fallback: true, wantErr: "link-local"},
+		{name: "raw address sent as form", contentType: "application/x-www-form-urlencoded", body: "2001:db8::1", fallback: true,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Unstructured: true}},
+		{name: "text", contentType: "text/plain", body: "new address: 2001:db8::1.", fallback: true,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Unstructured: true}},
+		{name: "text json content type", contentType: "application/json", body: "2001:db8::1", fallback: true,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Unstructured: true}},
+		{name: "text without fallback", contentType: "text/plain", body: "2001:db8::1", wantErr: "expected a JSON body"},
+		{name: "text prefers global", body: "fd00::1 fe80::1 2001:db8::1", fallback: true,
+			want: updatePayload{IPv6Address: netip.MustParseAddr("2001:db8::1"), Unstructured: true}},
+		{name: "text rejects multiple", body: "fd00::1 2001:db8::1", fallback: true, multiple: "reject", wantErr: "2 different IPv6 addresses"},
+		{name: "text only local", body: "from ::1 at 12:30", fallback: true, wantErr: "only contained unusable"},
+		{name: "text without address", body: "nothing here", fallback: true, wantErr: "did not contain an IPv6 address"},
+		{name: "invalid utf-8", body: "2001:db8::1\xff", fallback: true, wantErr: "not valid UTF-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{WebhookRegexFallback: test.fallback, WebhookMultipleAddresses: test.multiple}
+			if config.WebhookMultipleAddresses == "" {
+				config.WebhookMultipleAddresses = "prefer-global"
+			}
+			got, err := config.parseUpdatePayload(test.contentType, []byte(test.body))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want it to mention %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpdateBodySizeLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{name: "at the limit", size: maxUpdateBodySize, want: http.StatusBadRequest},
+		{name: "over the limit", size: maxUpdateBodySize + 1, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The body is read completely before it is parsed, so a body within the limit fails as invalid JSON
+			body := "{" + strings.Repeat(" ", test.size-1)
+			recorder := httptest.NewRecorder()
+			updateIPv6Address(&Config{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(body)))
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.want, recorder.Body)
+			}
+		})
+	}
+}
+
+func FuzzParseUpdatePayload(f *testing.F) {
+	f.Add("application/json", `{"ipv6_address": "2001:db8::1", "source": "router", "ipv4_address": "198.51.100.7"}`, false)
+	f.Add("application/x-www-form-urlencoded", "ipv6_address=2001:db8::1&source=router", false)
+	f.Add("application/x-www-form-urlencoded", "2001:db8::1", true)
+	f.Add("text/plain", "address [fe80::1%eth0] and 2001:db8::1.", true)
+	f.Add("text/plain", "::ffff:198.51.100.7", true)
+
+	f.Fuzz(func(t *testing.T, contentType, body string, fallback bool) {
+		config := &Config{WebhookRegexFallback: fallback, WebhookMultipleAddresses: "prefer-global"}
+		update, err := config.parseUpdatePayload(contentType, []byte(body))
+		if err != nil {
+			return
+		}
+		if !update.IPv6Address.Is6() || update.IPv6Address.Is4In6() || update.IPv6Address.Zone() != "" {
+			t.Errorf("accepted %q as target", update.IPv6Address)
+		}
+		if err := config.checkAddressScope(update.IPv6Address); err != nil {
+			t.Errorf("accepted an out of scope target: %v", err)
+		}
+		if update.IPv4Address.IsValid() && !update.IPv4Address.Is4() {
+			t.Errorf("accepted %q as IPv4 address", update.IPv4Address)
+		}
+		if utf8.RuneCountInString(update.Source) > maxUpdateSourceLength || strings.ContainsFunc(update.Source, unicode.IsControl) {
+			t.Errorf("accepted source %q", update.Source)
+		}
+		if update.Unstructured && !fallback {
+			t.Error("searched an unstructured body without WEBHOOK_REGEX_FALLBACK")
+		}
+	})
+}
+
+func FuzzFindIPv6Address(f *testing.F) {
+	f.Add("2001:db8::1", false)
+	f.Add("fd00::1 fe80::1%eth0 2001:db8::1", false)
+	f.Add("[::1]:443 at 12:30:45", true)
+	f.Add("::ffff:198.51.100.7 1:2:3:4:5:6:7:8:9", false)
+	f.Add(strings.Repeat("a:", 200), false)
+
+	f.Fuzz(func(t *testing.T, body string, allowLocal bool) {
+		config := &Config{WebhookAllowLocalAddresses: allowLocal, WebhookMultipleAddresses: "prefer-global"}
+		addr, err := config.findIPv6Address(body)
+		if err != nil {
+			return
+		}
+		if !addr.Is6() || addr.Is4In6() || addr.Zone() != "" {
+			t.Errorf("found %q in %q", addr, body)
+		}
+		if err := config.checkAddressScope(addr); err != nil {
+			t.Errorf("found an out of scope address: %v", err)
+		}
+	})
+}
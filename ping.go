@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pings dead man's switch URLs like healthchecks.io or Uptime Kuma push monitors,
+// so an external monitor notices when the relay itself stops
+type pinger struct {
+	config         *Config
+	urls           []string
+	interval       time.Duration
+	requireHealthy bool
+	client         *http.Client
+}
+
+// Parses PING_URLS, returns nil if no URL is configured
+func newPinger(config *Config, urls string, interval time.Duration, requireHealthy bool) (*pinger, error) {
+	p := &pinger{config: config, interval: interval, requireHealthy: requireHealthy, client: &http.Client{Timeout: 10 * time.Second}}
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("ping URL '%s' must start with http:// or https://", url)
+		}
+		p.urls = append(p.urls, url)
+	}
+
+	if len(p.urls) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Pings all URLs in the background
+func (p *pinger) ping(reason string) {
+	if p == nil {
+		return
+	}
+	if p.requireHealthy {
+		if _, healthy := p.config.health.snapshot(); !healthy {
+			p.config.logger().Debug("Skipped the ping because the relay is unhealthy", slog.String("reason", reason))
+			return
+		}
+	}
+
+	for _, url := range p.urls {
+		go func() {
+			if err := p.send(url); err != nil {
+				p.config.logger().Warn("Failed to ping the heartbeat URL", slog.String("reason", reason), slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+func (p *pinger) send(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// Pings on the schedule until the process is stopped
+func (p *pinger) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.ping("schedule")
+		<-ticker.C
+	}
+}
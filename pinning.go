@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Upper bound of remembered clients, stale ones are dropped first
+const maxSessionPins = 4096
+
+// Remembers the target each client was last forwarded to, so clients keep reaching the
+// previous address for a while after the address changed. Nil if disabled.
+type sessionPins struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// Last target and connection time keyed by tunnel and client IP
+	pins map[sessionPinKey]sessionPin
+	// Previous addresses and when they were replaced
+	retired map[string]time.Time
+}
+
+type sessionPinKey struct {
+	tunnel   string
+	clientIP string
+}
+
+type sessionPin struct {
+	target   string
+	lastSeen time.Time
+}
+
+// Returns nil if the window is zero
+func newSessionPins(window time.Duration) *sessionPins {
+	if window == 0 {
+		return nil
+	}
+	return &sessionPins{window: window, pins: make(map[sessionPinKey]sessionPin), retired: make(map[string]time.Time)}
+}
+
+// Remembers the target a client was forwarded to
+func (pins *sessionPins) record(tunnel, clientIP, target string) {
+	if pins == nil || clientIP == "" {
+		return
+	}
+
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+
+	now := time.Now()
+	if len(pins.pins) >= maxSessionPins {
+		for key, pin := range pins.pins {
+			if now.Sub(pin.lastSeen) > pins.window {
+				delete(pins.pins, key)
+			}
+		}
+	}
+	if len(pins.pins) >= maxSessionPins {
+		return
+	}
+	pins.pins[sessionPinKey{tunnel, clientIP}] = sessionPin{target: target, lastSeen: now}
+}
+
+// Starts the window of an address that was replaced by the current one
+func (pins *sessionPins) retire(previous, current string) {
+	if pins == nil || previous == current {
+		return
+	}
+
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+
+	now := time.Now()
+	for addr, retiredAt := range pins.retired {
+		if now.Sub(retiredAt) > pins.window {
+			delete(pins.retired, addr)
+		}
+	}
+	// An address that comes back is the current one again
+	delete(pins.retired, current)
+	pins.retired[previous] = now
+}
+
+// Returns the previous address the client should keep using, if its window is still open
+// and the client was connected recently
+func (pins *sessionPins) pinned(tunnel, clientIP string) (string, bool) {
+	if pins == nil || clientIP == "" {
+		return "", false
+	}
+
+	pins.mu.Lock()
+	defer pins.mu.Unlock()
+
+	key := sessionPinKey{tunnel, clientIP}
+	pin, ok := pins.pins[key]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if now.Sub(pin.lastSeen) > pins.window {
+		delete(pins.pins, key)
+		return "", false
+	}
+	retiredAt, ok := pins.retired[pin.target]
+	if !ok || now.Sub(retiredAt) > pins.window {
+		return "", false
+	}
+	return pin.target, true
+}
+
+// Dials a tunnel for a client. With SESSION_PINNING_WINDOW a client that was recently forwarded to
+// an address that has since been replaced is sent there again, as long as it's still reachable.
+func (config *Config) dialClient(ctx context.Context, name, ipv4Port, ipv6Port, clientIP string) (net.Conn, string, error) {
+	if target, ok := config.pins.pinned(name, clientIP); ok {
+		conn, err := config.tunnelDialer(ipv4Port).DialContext(ctx, "tcp6", net.JoinHostPort(target, ipv6Port))
+		if err == nil {
+			config.pins.record(name, clientIP, target)
+			return conn, target, nil
+		}
+		config.logger().Debug("Pinned target is unreachable, using the current one", slog.String("tunnel", name), slog.String("client", clientIP), slog.String("target", target), slog.Any("error", err))
+	}
+
+	conn, target, err := config.dialTunnel(ctx, ipv4Port, ipv6Port)
+	if err == nil {
+		config.pins.record(name, clientIP, target)
+	}
+	return conn, target, err
+}
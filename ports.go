@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func parsePort(port string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port '%s'", port)
+	}
+	return n, nil
+}
+
+// Expands a comma separated list of ports and port ranges, e.g. 80,443,8000-8050
+func parsePortList(list string) ([]string, error) {
+	var ports []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, fmt.Errorf("empty port in '%s'", list)
+		}
+
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+
+		end := start
+		if isRange {
+			if end, err = parsePort(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid port range '%s': end is lower than start", item)
+			}
+		}
+
+		for port := start; port <= end; port++ {
+			ports = append(ports, strconv.Itoa(port))
+		}
+	}
+
+	return ports, nil
+}
+
+// Expands source and destination port lists into pairs of the same length.
+// A single destination port is used for all source ports (many-to-one).
+func expandPortMapping(src, dest string) ([]string, []string, error) {
+	srcPorts, err := parsePortList(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	destPorts, err := parsePortList(dest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(destPorts) == 1 && len(srcPorts) > 1 {
+		for len(destPorts) < len(srcPorts) {
+			destPorts = append(destPorts, destPorts[0])
+		}
+	}
+
+	if len(srcPorts) != len(destPorts) {
+		return nil, nil, fmt.Errorf("'%s' expands to %v source ports but '%s' expands to %v destination ports. Please make sure that both sides have the same amount of ports or only a single destination port", src, len(srcPorts), dest, len(destPorts))
+	}
+
+	return srcPorts, destPorts, nil
+}
+
+// Parses semicolon separated mapping expressions like 2000-2010:3000-3010;80,443:80,443
+func parsePortMappings(mappings string) ([]string, []string, error) {
+	var srcPorts, destPorts []string
+	for _, mapping := range strings.Split(mappings, ";") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+
+		src, dest, found := strings.Cut(mapping, ":")
+		if !found {
+			return nil, nil, fmt.Errorf("mapping '%s' is missing the ':' between source and destination ports", mapping)
+		}
+
+		mappedSrc, mappedDest, err := expandPortMapping(src, dest)
+		if err != nil {
+			return nil, nil, err
+		}
+		srcPorts = append(srcPorts, mappedSrc...)
+		destPorts = append(destPorts, mappedDest...)
+	}
+
+	return srcPorts, destPorts, nil
+}
+
+// Makes sure that no source port is used by more than one tunnel
+func validateSourcePorts(srcPorts []string) error {
+	seen := make(map[string]bool, len(srcPorts))
+	for _, port := range srcPorts {
+		if seen[port] {
+			return fmt.Errorf("source port %s is mapped more than once", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
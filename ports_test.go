@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandPortMapping(t *testing.T) {
+	tests := []struct {
+		src, dest         string
+		wantSrc, wantDest []string
+		wantErr           string
+	}{
+		{src: "80", dest: "8080", wantSrc: []string{"80"}, wantDest: []string{"8080"}},
+		{src: "80, 443", dest: "8080,8443", wantSrc: []string{"80", "443"}, wantDest: []string{"8080", "8443"}},
+		{src: "2000-2002", dest: "3000-3002", wantSrc: []string{"2000", "2001", "2002"}, wantDest: []string{"3000", "3001", "3002"}},
+		{src: "2000-2001,22", dest: "3000,3001-3002", wantSrc: []string{"2000", "2001", "22"}, wantDest: []string{"3000", "3001", "3002"}},
+		// A single destination port is shared, a single source port is not
+		{src: "2000-2002", dest: "22", wantSrc: []string{"2000", "2001", "2002"}, wantDest: []string{"22", "22", "22"}},
+		{src: "22", dest: "3000-3001", wantErr: "1 source ports but '3000-3001' expands to 2"},
+		{src: "2000-2002", dest: "3000-3001", wantErr: "3 source ports but '3000-3001' expands to 2"},
+		{src: "5000-5000", dest: "6000", wantSrc: []string{"5000"}, wantDest: []string{"6000"}},
+		{src: "2002-2000", dest: "3000-3002", wantErr: "end is lower than start"},
+		{src: "2000-2002", dest: "3002-3000", wantErr: "end is lower than start"},
+		{src: "0", dest: "80", wantErr: "invalid port '0'"},
+		{src: "65535", dest: "65536", wantErr: "invalid port '65536'"},
+		{src: "65534-65536", dest: "1", wantErr: "invalid port '65536'"},
+		{src: "-80", dest: "80", wantErr: "invalid port ''"},
+		{src: "80-", dest: "80", wantErr: "invalid port ''"},
+		{src: "80,,443", dest: "80", wantErr: "empty port"},
+		{src: "http", dest: "80", wantErr: "invalid port 'http'"},
+	}
+	for _, test := range tests {
+		src, dest, err := expandPortMapping(test.src, test.dest)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expandPortMapping(%q, %q) err = %v, want it to mention %q", test.src, test.dest, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(src, test.wantSrc) || !slices.Equal(dest, test.wantDest) {
+			t.Errorf("expandPortMapping(%q, %q) = %v, %v, %v, want %v, %v", test.src, test.dest, src, dest, err, test.wantSrc, test.wantDest)
+		}
+	}
+}
+
+func TestParsePortMappings(t *testing.T) {
+	tests := []struct {
+		mappings          string
+		wantSrc, wantDest []string
+		wantErr           string
+		// Whether validateSourcePorts rejects the result
+		overlaps bool
+	}{
+		{mappings: "2000-2001:3000-3001;80,443:8080,8443", wantSrc: []string{"2000", "2001", "80", "443"}, wantDest: []string{"3000", "3001", "8080", "8443"}},
+		{mappings: " 22:2222 ; ; 2000-2002:22 ;", wantSrc: []string{"22", "2000", "2001", "2002"}, wantDest: []string{"2222", "22", "22", "22"}},
+		{mappings: "80:80;8000-8001:9000-9002", wantErr: "2 source ports but '9000-9002' expands to 3"},
+		{mappings: "80:80;3001-3000:3000", wantErr: "end is lower than start"},
+		{mappings: "80:80;443", wantErr: "missing the ':'"},
+		{mappings: "70000:80", wantErr: "invalid port '70000'"},
+		{mappings: "80:0", wantErr: "invalid port '0'"},
+		// Overlapping source ports are parsed, the config refuses them afterwards
+		{mappings: "2000-2005:3000-3005;2005:22", wantSrc: []string{"2000", "2001", "2002", "2003", "2004", "2005", "2005"}, wantDest: []string{"3000", "3001", "3002", "3003", "3004", "3005", "22"}, overlaps: true},
+		{mappings: "80:80;80:8080", wantSrc: []string{"80", "80"}, wantDest: []string{"80", "8080"}, overlaps: true},
+		// Several sources may share a destination port
+		{mappings: "80:8080;81:8080", wantSrc: []string{"80", "81"}, wantDest: []string{"8080", "8080"}},
+	}
+	for _, test := range tests {
+		src, dest, err := parsePortMappings(test.mappings)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parsePortMappings(%q) err = %v, want it to mention %q", test.mappings, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(src, test.wantSrc) || !slices.Equal(dest, test.wantDest) {
+			t.Errorf("parsePortMappings(%q) = %v, %v, %v, want %v, %v", test.mappings, src, dest, err, test.wantSrc, test.wantDest)
+		}
+		if err := validateSourcePorts(src); (err != nil) != test.overlaps {
+			t.Errorf("validateSourcePorts(%v) = %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long a client may take to finish the proxy handshake
+const proxyHandshakeTimeout = 30 * time.Second
+
+// SOCKS5 constants from RFC 1928 and RFC 1929
+const (
+	socksVersion          = 0x05
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xFF
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNetworkUnreachable  = 0x03
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddrNotSupported    = 0x08
+)
+
+// Checks the proxy credentials, everyone is allowed if no credentials are configured
+func (config *Config) proxyCredentialsValid(username, password string) bool {
+	if config.ProxyUsername == "" && config.ProxyPassword == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(config.ProxyUsername)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(config.ProxyPassword)) == 1
+	return userOK && passOK
+}
+
+// Resolves the requested destination to an IPv6 address. IPv4 destinations are only
+// reachable if a NAT64 prefix is configured.
+func (config *Config) resolveProxyDestination(ctx context.Context, host string) (netip.Addr, error) {
+	addr, err := config.resolveHost(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr = addr.Unmap()
+	if addr.Is4() {
+		if !config.DNS64Prefix.IsValid() {
+			return netip.Addr{}, fmt.Errorf("%s is an IPv4 address and DNS64_PREFIX is not set", host)
+		}
+		addr = synthesizeNAT64(config.DNS64Prefix, addr)
+	}
+	return addr, nil
+}
+
+// Accepts SOCKS5 and HTTP CONNECT clients on the same port and dials the requested destinations over IPv6
+func runProxyListener(config *Config, listener net.Listener) {
+	name := "proxy:" + config.ProxyListenPort
+	logger := config.logger().With(slog.String("tunnel", name))
+
+	defer listener.Close()
+	logger.Info("Listening for SOCKS5 and HTTP CONNECT clients", slog.String("addr", listener.Addr().String()))
+
+	for {
+		srcConn, err := listener.Accept()
+		if err != nil {
+			logger.Error("Error accepting connection", slog.Any("error", err))
+			continue
+		}
+
+		go handleProxyConn(config, name, logger.With(slog.String("client", srcConn.RemoteAddr().String())), srcConn)
+	}
+}
+
+func handleProxyConn(config *Config, name string, logger *slog.Logger, srcConn net.Conn) {
+	srcConn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	reader := bufio.NewReader(srcConn)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		srcConn.Close()
+		return
+	}
+
+	var destConn net.Conn
+	var destination string
+	if first[0] == socksVersion {
+		destConn, destination, err = socksHandshake(config, reader, srcConn)
+	} else {
+		destConn, destination, err = httpConnectHandshake(config, reader, srcConn)
+	}
+	if err != nil {
+		logger.Warn("Proxy handshake failed", slog.String("destination", destination), slog.Any("error", err))
+		srcConn.Close()
+		return
+	}
+	srcConn.SetDeadline(time.Time{})
+	logger = logger.With(slog.String("destination", destination))
+
+	// The client might have sent data right after the handshake which is still buffered
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		if _, err := destConn.Write(data); err != nil {
+			logger.Error("Error forwarding buffered data", slog.Any("error", err))
+			srcConn.Close()
+			destConn.Close()
+			return
+		}
+	}
+
+	logger.Debug("Forwarding connection")
+	config.protocolStats.recordConnection(name)
+	start := time.Now()
+	src, dst := config.protocolStats.sniff(name, srcConn, destConn)
+	config.forward("", src, dst)
+	logger.Info("Connection closed", slog.Duration("duration", time.Since(start)))
+}
+
+// Dials the destination over IPv6 only
+func (config *Config) dialProxyDestination(host, port string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyHandshakeTimeout)
+	defer cancel()
+
+	addr, err := config.resolveProxyDestination(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.dialer().DialContext(ctx, "tcp6", net.JoinHostPort(addr.String(), port))
+}
+
+// Implements the server side of a SOCKS5 handshake with optional username/password authentication
+func socksHandshake(config *Config, reader *bufio.Reader, conn net.Conn) (net.Conn, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, "", err
+	}
+
+	method := byte(socksAuthNone)
+	if config.ProxyUsername != "" || config.ProxyPassword != "" {
+		method = socksAuthPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return nil, "", errors.New("client does not support the required authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, "", err
+	}
+
+	if method == socksAuthPassword {
+		username, password, err := readSocksCredentials(reader)
+		if err != nil {
+			return nil, "", err
+		}
+		if !config.proxyCredentialsValid(username, password) {
+			conn.Write([]byte{0x01, 0x01})
+			return nil, "", errors.New("invalid credentials")
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return nil, "", err
+	}
+	if request[0] != socksVersion {
+		return nil, "", errors.New("invalid SOCKS version")
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return nil, "", err
+		}
+		host = netip.AddrFrom4([4]byte(addr)).String()
+	case socksAtypIPv6:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return nil, "", err
+		}
+		host = netip.AddrFrom16([16]byte(addr)).String()
+	case socksAtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return nil, "", err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return nil, "", err
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksReplyAddrNotSupported)
+		return nil, "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return nil, "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))
+	destination := net.JoinHostPort(host, port)
+
+	if request[1] != socksCmdConnect {
+		writeSocksReply(conn, socksReplyCommandNotSupported)
+		return nil, destination, fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	destConn, err := config.dialProxyDestination(host, port)
+	if err != nil {
+		writeSocksReply(conn, socksReplyFor(err))
+		return nil, destination, err
+	}
+
+	if err := writeSocksReply(conn, socksReplySucceeded); err != nil {
+		destConn.Close()
+		return nil, destination, err
+	}
+	return destConn, destination, nil
+}
+
+// Reads the username/password sub-negotiation of RFC 1929
+func readSocksCredentials(reader *bufio.Reader) (string, string, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if version != 0x01 {
+		return "", "", errors.New("invalid authentication version")
+	}
+
+	fields := make([]string, 2)
+	for i := range fields {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(field)
+	}
+
+	return fields[0], fields[1], nil
+}
+
+// Sends a SOCKS5 reply. The bound address is always reported as unspecified.
+func writeSocksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Maps a dial error to the closest SOCKS5 reply code
+func socksReplyFor(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, errNoRecords):
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyGeneralFailure
+	}
+}
+
+// Implements the server side of an HTTP CONNECT request with optional basic authentication
+func httpConnectHandshake(config *Config, reader *bufio.Reader, conn net.Conn) (net.Conn, string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		return nil, req.Host, fmt.Errorf("unsupported method %s", req.Method)
+	}
+
+	if !config.proxyCredentialsValid(proxyBasicAuth(req)) {
+		fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"four2six\"\r\nContent-Length: 0\r\n\r\n")
+		return nil, req.Host, errors.New("invalid credentials")
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return nil, req.Host, err
+	}
+
+	destConn, err := config.dialProxyDestination(host, port)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return nil, req.Host, err
+	}
+
+	if _, err := fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		destConn.Close()
+		return nil, req.Host, err
+	}
+	return destConn, req.Host, nil
+}
+
+// Extracts the credentials of the Proxy-Authorization header
+func proxyBasicAuth(req *http.Request) (string, string) {
+	encoded, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ""
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	return username, password
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// PROXY protocol versions a tunnel can announce its clients to the backend with
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// Starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Parses a PROXY protocol version, an empty string disables the header
+func parseProxyProtocol(value string) (string, error) {
+	switch version := strings.ToLower(strings.TrimSpace(value)); version {
+	case "", proxyProtocolV1, proxyProtocolV2:
+		return version, nil
+	}
+	return "", fmt.Errorf("'%s' is not a PROXY protocol version, must be v1 or v2", value)
+}
+
+// Parses per tunnel PROXY protocol versions from TUNNEL_PROXY_PROTOCOL like 443=v2;25=v1 keyed by source port
+func parseTunnelProxyProtocols(value string, srcPorts []string) (map[string]string, error) {
+	versions := make(map[string]string)
+	err := parsePortValues("TUNNEL_PROXY_PROTOCOL", value, srcPorts, func(port, value string) error {
+		version, err := parseProxyProtocol(value)
+		if err != nil {
+			return err
+		}
+		if version == "" {
+			return fmt.Errorf("source port %s has no PROXY protocol version", port)
+		}
+		versions[port] = version
+		return nil
+	})
+	return versions, err
+}
+
+// Builds the header that tells the backend about the client and the address it connected to. Connections without
+// TCP addresses of the same family on both ends, like the ones of unix sockets, are sent as unknown (v1) or local (v2).
+// The TLVs are only sent with v2, v1 has no place for them.
+func proxyHeader(version string, client, local net.Addr, tlvs []byte) []byte {
+	src, dst := tcpAddrPort(client), tcpAddrPort(local)
+	known := src.IsValid() && dst.IsValid() && src.Addr().Is4() == dst.Addr().Is4()
+
+	if version == proxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// Version 2 with the LOCAL command and no addresses
+		header = append(header, 0x20, 0x00)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(tlvs)))
+		return append(header, tlvs...)
+	}
+	// Version 2 with the PROXY command, then TCP over IPv4 or IPv6 and the length of the addresses
+	family, size := byte(0x21), uint16(36)
+	if src.Addr().Is4() {
+		family, size = 0x11, 12
+	}
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, size+uint16(len(tlvs)))
+	header = append(header, src.Addr().AsSlice()...)
+	header = append(header, dst.Addr().AsSlice()...)
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	header = binary.BigEndian.AppendUint16(header, dst.Port())
+	return append(header, tlvs...)
+}
+
+// Appends a type-length-value field of a PROXY protocol v2 header
+func appendProxyTLV(tlvs []byte, kind byte, value []byte) []byte {
+	tlvs = append(tlvs, kind)
+	tlvs = binary.BigEndian.AppendUint16(tlvs, uint16(len(value)))
+	return append(tlvs, value...)
+}
+
+// Returns the unmapped address and port of a TCP connection end, or the zero value for other networks
+func tcpAddrPort(addr net.Addr) netip.AddrPort {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	addrPort := tcpAddr.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
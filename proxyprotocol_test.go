@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	client4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	local4 := &net.TCPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 443}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	local6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	unix := &net.UnixAddr{Name: "/run/four2six/web.sock", Net: "unix"}
+
+	v2 := func(rest ...byte) []byte {
+		return append(append([]byte(nil), proxyV2Signature...), rest...)
+	}
+	tests := []struct {
+		name          string
+		version       string
+		client, local net.Addr
+		want          []byte
+	}{
+		{"v1 ipv4", proxyProtocolV1, client4, local4, []byte("PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n")},
+		{"v1 ipv6", proxyProtocolV1, client6, local6, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 443\r\n")},
+		{"v1 mixed", proxyProtocolV1, client6, local4, []byte("PROXY UNKNOWN\r\n")},
+		{"v1 unix", proxyProtocolV1, unix, unix, []byte("PROXY UNKNOWN\r\n")},
+		{"v2 ipv4", proxyProtocolV2, client4, local4, v2(0x21, 0x11, 0, 12, 203, 0, 113, 7, 198, 51, 100, 1, 0x9c, 0x40, 0x01, 0xbb)},
+		{"v2 ipv6", proxyProtocolV2, client6, local6, v2(append(append([]byte{0x21, 0x21, 0, 36}, append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)...), 0x9c, 0x40, 0x01, 0xbb)...)},
+		{"v2 unix", proxyProtocolV2, unix, unix, v2(0x20, 0x00, 0, 0)},
+	}
+	for _, test := range tests {
+		if got := proxyHeader(test.version, test.client, test.local, nil); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: header = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// TLVs follow the addresses and count toward the length, v1 drops them
+	tlvs := appendProxyTLV(nil, pp2TypeAuthority, []byte("a"))
+	if got, want := proxyHeader(proxyProtocolV2, client4, local4, tlvs), v2(0x21, 0x11, 0, 16, 203, 0, 113, 7, 198, 51, 100, 1, 0x9c, 0x40, 0x01, 0xbb, 0x02, 0, 1, 'a'); !bytes.Equal(got, want) {
+		t.Errorf("v2 with TLVs: header = %q, want %q", got, want)
+	}
+	if got, want := proxyHeader(proxyProtocolV2, unix, unix, tlvs), v2(0x20, 0x00, 0, 4, 0x02, 0, 1, 'a'); !bytes.Equal(got, want) {
+		t.Errorf("v2 unix with TLVs: header = %q, want %q", got, want)
+	}
+	if got := proxyHeader(proxyProtocolV1, client4, local4, tlvs); !bytes.Equal(got, []byte("PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n")) {
+		t.Errorf("v1 with TLVs: header = %q", got)
+	}
+}
+
+func TestParseTunnelProxyProtocols(t *testing.T) {
+	versions, err := parseTunnelProxyProtocols("443=v2; 25=V1", []string{"25", "443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions["443"] != proxyProtocolV2 || versions["25"] != proxyProtocolV1 {
+		t.Errorf("versions = %v", versions)
+	}
+	for _, value := range []string{"443=v3", "443=", "80=v1"} {
+		if _, err := parseTunnelProxyProtocols(value, []string{"443"}); err == nil {
+			t.Errorf("%q was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Base URL of the Cloudflare API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// Watches the public IPv4 address of the relay host. When it changes, the listeners bound to the old
+// address are moved to the new one, the DNS records are updated and a public_ipv4_changed event is sent.
+type publicIPv4Watcher struct {
+	config *Config
+	// URL that responds with the address, or interface:<name>
+	source     string
+	interval   time.Duration
+	dnsRecords []dnsRecordUpdater
+	client     *http.Client
+
+	mu      sync.Mutex
+	current netip.Addr
+	// Configured listen addresses that were moved, mapped to the address they are bound to now
+	rebound map[string]string
+	// Open listeners outside the tunnels that move along with them
+	followers map[*followingListener]struct{}
+}
+
+// Updates a DNS A record to the public IPv4 address
+type dnsRecordUpdater interface {
+	UpdateA(ctx context.Context, addr netip.Addr) error
+}
+
+// Parses PUBLIC_IPV4_SOURCE and PUBLIC_IPV4_DNS_URLS, returns nil if the watcher is disabled
+func newPublicIPv4Watcher(config *Config, source string, interval time.Duration, dnsURLs string) (*publicIPv4Watcher, error) {
+	if source == "" {
+		if strings.TrimSpace(dnsURLs) != "" {
+			return nil, errors.New("PUBLIC_IPV4_DNS_URLS needs PUBLIC_IPV4_SOURCE")
+		}
+		return nil, nil
+	}
+
+	watcher := &publicIPv4Watcher{
+		config:    config,
+		source:    source,
+		interval:  interval,
+		rebound:   make(map[string]string),
+		followers: make(map[*followingListener]struct{}),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Services like icanhazip.com return the IPv6 address to dual-stack clients
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "tcp4", addr)
+				},
+			},
+		},
+	}
+
+	if name, ok := strings.CutPrefix(source, "interface:"); ok {
+		if name == "" {
+			return nil, errors.New("interface:<name> is missing the interface name")
+		}
+	} else if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return nil, fmt.Errorf("'%s' is neither an http(s):// URL nor interface:<name>", source)
+	}
+
+	for _, rawURL := range strings.Split(dnsURLs, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+		updater, err := parseDNSRecordUpdater(rawURL, watcher.client)
+		if err != nil {
+			return nil, err
+		}
+		watcher.dnsRecords = append(watcher.dnsRecords, updater)
+	}
+
+	return watcher, nil
+}
+
+// Parses cloudflare://api-token@zone-id/record.example.com or an http(s) URL with an {ip} placeholder
+func parseDNSRecordUpdater(rawURL string, client *http.Client) (dnsRecordUpdater, error) {
+	if strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://") {
+		if !strings.Contains(rawURL, "{ip}") {
+			return nil, fmt.Errorf("DNS update URL %s is missing the {ip} placeholder", redactURL(rawURL))
+		}
+		return &urlRecordUpdater{url: rawURL, client: client}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS update URL: %v", err)
+	}
+	if u.Scheme != "cloudflare" {
+		return nil, fmt.Errorf("unknown DNS update scheme '%s', expected cloudflare, http or https", u.Scheme)
+	}
+
+	updater := &cloudflareRecordUpdater{zoneID: u.Host, name: strings.Trim(u.Path, "/"), client: client}
+	if u.User != nil {
+		updater.token = u.User.Username()
+	}
+	if updater.token == "" || updater.zoneID == "" || updater.name == "" {
+		return nil, errors.New("cloudflare URL must look like cloudflare://api-token@zone-id/record.example.com")
+	}
+	return updater, nil
+}
+
+// Hides the credentials of a URL that isn't parsed yet
+func redactURL(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Redacted()
+	}
+	return "(unparsable URL)"
+}
+
+// Returns the current public IPv4 address from the source
+func (watcher *publicIPv4Watcher) detect(ctx context.Context) (netip.Addr, error) {
+	if name, ok := strings.CutPrefix(watcher.source, "interface:"); ok {
+		return interfaceIPv4(name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, watcher.source, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := watcher.client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return netip.Addr{}, fmt.Errorf("%s responded with %s", req.URL.Redacted(), resp.Status)
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil || !addr.Unmap().Is4() {
+		return netip.Addr{}, fmt.Errorf("%s did not respond with an IPv4 address", req.URL.Redacted())
+	}
+	return addr.Unmap(), nil
+}
+
+// Returns the public IPv4 address of the interface
+func interfaceIPv4(name string) (netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if ip = ip.Unmap(); ok && ip.Is4() && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("interface %s has no public IPv4 address", name)
+}
+
+// Returns the last detected address, empty before the first detection
+func (watcher *publicIPv4Watcher) address() string {
+	if watcher == nil {
+		return ""
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if !watcher.current.IsValid() {
+		return ""
+	}
+	return watcher.current.String()
+}
+
+// Returns the IPv4 address clients reach the relay at for protocols that announce it, which is the configured one,
+// the followed public IPv4 address, or the address the client connected to if there's no NAT in between
+func (config *Config) advertisedIPv4(configured string, conn net.Conn) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(configured); err == nil {
+		return addr, true
+	}
+	if addr, err := netip.ParseAddr(config.publicIPv4.address()); err == nil {
+		return addr, true
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		if addr := local.AddrPort().Addr().Unmap(); addr.Is4() && !addr.IsUnspecified() {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Returns the address a configured listen address is bound to now
+func (watcher *publicIPv4Watcher) translate(addr string) string {
+	if watcher == nil {
+		return addr
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if current, ok := watcher.rebound[addr]; ok {
+		return current
+	}
+	return addr
+}
+
+// A listener outside the tunnels, like the SNI listener, that moves along with them when the public IPv4
+// address changes. Accept keeps waiting on the new socket, so its accept loop doesn't notice.
+type followingListener struct {
+	watcher *publicIPv4Watcher
+	// Configured listen address, translated like the ones of the tunnels
+	addr string
+	port string
+
+	mu       sync.Mutex
+	current  net.Listener
+	deadline time.Time
+	closed   bool
+}
+
+// Opens an IPv4 listener that follows the public IPv4 address if the watcher is enabled
+func (config *Config) listenFollowing(addr, port string) (net.Listener, error) {
+	listener, err := config.listen("tcp4", config.publicIPv4.translate(addr), port)
+	if err != nil || config.publicIPv4 == nil {
+		return listener, err
+	}
+
+	following := &followingListener{watcher: config.publicIPv4, addr: addr, port: port, current: listener}
+	config.publicIPv4.mu.Lock()
+	config.publicIPv4.followers[following] = struct{}{}
+	config.publicIPv4.mu.Unlock()
+	return following, nil
+}
+
+func (listener *followingListener) Accept() (net.Conn, error) {
+	for {
+		listener.mu.Lock()
+		current := listener.current
+		listener.mu.Unlock()
+
+		conn, err := current.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		// The socket was replaced while we waited on it
+		listener.mu.Lock()
+		moved := !listener.closed && listener.current != current
+		listener.mu.Unlock()
+		if !moved {
+			return nil, err
+		}
+	}
+}
+
+func (listener *followingListener) Close() error {
+	listener.watcher.mu.Lock()
+	delete(listener.watcher.followers, listener)
+	listener.watcher.mu.Unlock()
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	listener.closed = true
+	return listener.current.Close()
+}
+
+func (listener *followingListener) Addr() net.Addr {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	return listener.current.Addr()
+}
+
+// Sets the deadline of Accept, it carries over to the new socket when the listener moves
+func (listener *followingListener) SetDeadline(t time.Time) error {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	listener.deadline = t
+	if tcpListener, ok := listener.current.(*net.TCPListener); ok {
+		return tcpListener.SetDeadline(t)
+	}
+	return nil
+}
+
+// Binds the listener to its translated address again if that changed
+func (listener *followingListener) move() error {
+	addr := listener.watcher.translate(listener.addr)
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	bound, ok := listener.current.Addr().(*net.TCPAddr)
+	if listener.closed || !ok || bound.AddrPort().Addr().Unmap().String() == addr {
+		return nil
+	}
+	replacement, err := listener.watcher.config.listen("tcp4", addr, listener.port)
+	if err != nil {
+		return err
+	}
+	if tcpListener, ok := replacement.(*net.TCPListener); ok && !listener.deadline.IsZero() {
+		tcpListener.SetDeadline(listener.deadline)
+	}
+	previous := listener.current
+	listener.current = replacement
+	previous.Close()
+	return nil
+}
+
+// Moves the listeners outside the tunnels whose address changed
+func (watcher *publicIPv4Watcher) moveFollowers() {
+	watcher.mu.Lock()
+	followers := make([]*followingListener, 0, len(watcher.followers))
+	for listener := range watcher.followers {
+		followers = append(followers, listener)
+	}
+	watcher.mu.Unlock()
+
+	for _, listener := range followers {
+		if err := listener.move(); err != nil {
+			watcher.config.logger().Error("Error moving the listener to its new address", slog.String("port", listener.port), slog.Any("error", err))
+		}
+	}
+}
+
+// Detects the address and reacts to changes
+func (watcher *publicIPv4Watcher) check() {
+	logger := watcher.config.logger()
+
+	ctx, cancel := context.WithTimeout(context.Background(), watcher.client.Timeout)
+	defer cancel()
+
+	addr, err := watcher.detect(ctx)
+	if err != nil {
+		logger.Warn("Failed to detect the public IPv4 address", slog.Any("error", err))
+		return
+	}
+
+	watcher.mu.Lock()
+	previous := watcher.current
+	watcher.current = addr
+	if previous.IsValid() && previous != addr {
+		// Listeners that followed the old address follow the new one as well
+		for configured, current := range watcher.rebound {
+			if current == previous.String() {
+				watcher.rebound[configured] = addr.String()
+			}
+		}
+		if _, ok := watcher.rebound[previous.String()]; !ok {
+			watcher.rebound[previous.String()] = addr.String()
+		}
+	}
+	watcher.mu.Unlock()
+
+	if previous == addr {
+		return
+	}
+
+	// Standby and read-only instances keep following the address, the active one owns the DNS records and notifies
+	active := watcher.config.lease.isActive() && !watcher.config.ReadOnly
+	if !previous.IsValid() {
+		logger.Info("Detected the public IPv4 address", slog.String("ipv4_address", addr.String()))
+		if active {
+			watcher.updateDNSRecords(addr)
+		}
+		return
+	}
+
+	logger.Warn("The public IPv4 address changed", slog.String("previous", previous.String()), slog.String("ipv4_address", addr.String()))
+	watcher.config.tunnels.reload()
+	watcher.moveFollowers()
+	if !active {
+		return
+	}
+	watcher.updateDNSRecords(addr)
+	watcher.config.notifications.publish(Event{
+		Type:        EventPublicIPv4,
+		IPv4Address: addr.String(),
+		Message:     fmt.Sprintf("Public IPv4 address changed from %s to %s", previous, addr),
+	})
+}
+
+// Points the DNS records at the address in the background
+func (watcher *publicIPv4Watcher) updateDNSRecords(addr netip.Addr) {
+	for _, record := range watcher.dnsRecords {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if err := record.UpdateA(ctx, addr); err != nil {
+				watcher.config.logger().Warn("Failed to update the DNS record", slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+// Checks the address on the interval until the process is stopped
+func (watcher *publicIPv4Watcher) run() {
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+
+	for {
+		watcher.check()
+		<-ticker.C
+	}
+}
+
+// Sends a GET request to a URL with the address in place of {ip}, the way most dynamic DNS providers work
+type urlRecordUpdater struct {
+	url    string
+	client *http.Client
+}
+
+func (u *urlRecordUpdater) UpdateA(ctx context.Context, addr netip.Addr) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(u.url, "{ip}", addr.String()), nil)
+	if err != nil {
+		return err
+	}
+	return sendNotification(u.client, req)
+}
+
+// Updates an existing A record with the Cloudflare API, see https://developers.cloudflare.com/api/resources/dns/
+type cloudflareRecordUpdater struct {
+	token  string
+	zoneID string
+	name   string
+	client *http.Client
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (c *cloudflareRecordUpdater) UpdateA(ctx context.Context, addr netip.Addr) error {
+	var records []struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	}
+	query := url.Values{"type": {"A"}, "name": {c.name}}
+	if err := c.call(ctx, http.MethodGet, "/zones/"+c.zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("cloudflare zone %s has no A record named %s", c.zoneID, c.name)
+	}
+
+	for _, record := range records {
+		if record.Content == addr.String() {
+			continue
+		}
+		body := map[string]string{"content": addr.String()}
+		if err := c.call(ctx, http.MethodPatch, "/zones/"+c.zoneID+"/dns_records/"+record.ID, body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls the Cloudflare API and decodes the result
+func (c *cloudflareRecordUpdater) call(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var decoded cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decoded); err != nil {
+		return fmt.Errorf("cloudflare responded with %s", resp.Status)
+	}
+	if !decoded.Success {
+		var messages []string
+		for _, e := range decoded.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare responded with %s: %s", resp.Status, strings.Join(messages, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(decoded.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFollowingListenerMoves(t *testing.T) {
+	config := &Config{}
+	config.publicIPv4 = &publicIPv4Watcher{config: config, rebound: make(map[string]string), followers: make(map[*followingListener]struct{})}
+	listener, err := config.listenFollowing("127.0.0.1", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// Port 0 picks a new port on the new address as well, real listeners keep theirs
+	previous := listener.Addr().String()
+	config.publicIPv4.mu.Lock()
+	config.publicIPv4.rebound["127.0.0.1"] = "127.0.0.2"
+	config.publicIPv4.mu.Unlock()
+	config.publicIPv4.moveFollowers()
+
+	if addr := listener.Addr().(*net.TCPAddr); addr.IP.String() != "127.0.0.2" {
+		t.Fatalf("listener is bound to %s, want 127.0.0.2", addr)
+	}
+	if conn, err := net.DialTimeout("tcp4", previous, time.Second); err == nil {
+		conn.Close()
+		t.Error("the old address still accepts connections")
+	}
+
+	// The accept loop keeps running on the new socket
+	conn, err := net.DialTimeout("tcp4", listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection to the new address wasn't accepted")
+	}
+
+	listener.Close()
+	if _, ok := <-accepted; ok {
+		t.Error("Accept returned a connection after Close")
+	}
+	if len(config.publicIPv4.followers) != 0 {
+		t.Error("the closed listener is still followed")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Flow labels from the upper half are reserved for the labels the kernel picks itself
+const maxFlowLabel = 0x7ffff
+
+// Traffic class values of the DSCP names, the two ECN bits stay zero
+var dscpTrafficClasses = map[string]int{
+	"cs0": 0, "cs1": 8 << 2, "cs2": 16 << 2, "cs3": 24 << 2, "cs4": 32 << 2, "cs5": 40 << 2, "cs6": 48 << 2, "cs7": 56 << 2,
+	"af11": 10 << 2, "af12": 12 << 2, "af13": 14 << 2,
+	"af21": 18 << 2, "af22": 20 << 2, "af23": 22 << 2,
+	"af31": 26 << 2, "af32": 28 << 2, "af33": 30 << 2,
+	"af41": 34 << 2, "af42": 36 << 2, "af43": 38 << 2,
+	"ef": 46 << 2, "le": 1 << 2,
+}
+
+// How the IPv6 packets of a tunnel's backend connections are marked
+type ipv6Marking struct {
+	// Traffic class byte, -1 if it's left alone
+	trafficClass int
+	// Flow label, 0 if it's left to the kernel
+	flowLabel uint32
+}
+
+// Parses per tunnel markings from TUNNEL_TRAFFIC_CLASSES like 22=ef;873=cs1 and
+// TUNNEL_FLOW_LABELS like 22=0x1234, both keyed by source port
+func parseIPv6Markings(trafficClasses, flowLabels string, srcPorts []string) (map[string]*ipv6Marking, error) {
+	markings := make(map[string]*ipv6Marking)
+	marking := func(port string) *ipv6Marking {
+		if _, ok := markings[port]; !ok {
+			markings[port] = &ipv6Marking{trafficClass: -1}
+		}
+		return markings[port]
+	}
+
+	err := parsePortValues("TUNNEL_TRAFFIC_CLASSES", trafficClasses, srcPorts, func(port, value string) error {
+		class, ok := dscpTrafficClasses[strings.ToLower(value)]
+		if !ok {
+			number, err := strconv.ParseUint(value, 0, 8)
+			if err != nil {
+				return fmt.Errorf("'%s' is neither a DSCP name like ef or af41 nor a traffic class between 0 and 255", value)
+			}
+			class = int(number)
+		}
+		marking(port).trafficClass = class
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = parsePortValues("TUNNEL_FLOW_LABELS", flowLabels, srcPorts, func(port, value string) error {
+		label, err := strconv.ParseUint(value, 0, 32)
+		if err != nil || label == 0 || label > maxFlowLabel {
+			return fmt.Errorf("'%s' is not a flow label between 1 and 0x%x", value, maxFlowLabel)
+		}
+		marking(port).flowLabel = uint32(label)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(markings) > 0 && !ipv6MarkingSupported {
+		return nil, fmt.Errorf("traffic classes and flow labels are only supported on Linux")
+	}
+	return markings, nil
+}
+
+// Calls set for every entry of a list like 22=ef;873=cs1 keyed by source port
+func parsePortValues(variable, value string, srcPorts []string, set func(port, value string) error) error {
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, value, found := strings.Cut(entry, "=")
+		if !found {
+			return fmt.Errorf("invalid %s: entry '%s' is missing the '=' between source port and value", variable, entry)
+		}
+		port, value = strings.TrimSpace(port), strings.TrimSpace(value)
+
+		if !slices.Contains(srcPorts, port) {
+			return fmt.Errorf("invalid %s: source port %s is not configured", variable, port)
+		}
+		if seen[port] {
+			return fmt.Errorf("invalid %s: source port %s is listed more than once", variable, port)
+		}
+		seen[port] = true
+
+		if err := set(port, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", variable, err)
+		}
+	}
+	return nil
+}
+
+// Returns the dialer for the backend connections of a tunnel, it marks their IPv6 packets if configured
+func (config *Config) tunnelDialer(ipv4Port string) *net.Dialer {
+	dialer := config.dialer()
+	if marking, ok := config.markings[ipv4Port]; ok {
+		dialer.Control = marking.control
+	}
+	return dialer
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+const ipv6MarkingSupported = true
+
+// Flow label options of linux/in6.h that are missing from the syscall package
+const (
+	ipv6FlowLabelMgr    = 0x20
+	ipv6FlowInfoSend    = 0x21
+	ipv6FlowLabelGet    = 0
+	ipv6FlowLabelShared = 0xff
+	ipv6FlowLabelCreate = 1
+)
+
+// struct in6_flowlabel_req
+type in6FlowLabelReq struct {
+	dst     [16]byte
+	label   uint32
+	action  uint8
+	share   uint8
+	flags   uint16
+	expires uint16
+	linger  uint16
+	_       uint32
+}
+
+// Sets the traffic class and flow label on a backend socket before it connects
+func (marking *ipv6Marking) control(network, address string, conn syscall.RawConn) error {
+	// Happy Eyeballs also dials IPv4 addresses, they have neither
+	if network != "tcp6" {
+		return nil
+	}
+
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		if marking.trafficClass >= 0 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, marking.trafficClass); sockErr != nil {
+				return
+			}
+		}
+		if marking.flowLabel != 0 {
+			sockErr = connectWithFlowLabel(int(fd), address, marking.flowLabel)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// The kernel only takes a flow label from the address passed to connect, which Go always sets to zero.
+// The connection is started here instead, Go's own connect then waits for it to complete.
+func connectWithFlowLabel(fd int, address string, label uint32) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	req := in6FlowLabelReq{dst: addrPort.Addr().As16(), action: ipv6FlowLabelGet, share: ipv6FlowLabelShared, flags: ipv6FlowLabelCreate}
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&req.label))[:], label)
+	if err := setsockopt(fd, ipv6FlowLabelMgr, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6FlowInfoSend, 1); err != nil {
+		return err
+	}
+
+	sa := syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Addr: addrPort.Addr().As16()}
+	if zone := addrPort.Addr().Zone(); zone != "" {
+		iface, err := net.InterfaceByName(zone)
+		if err != nil {
+			return err
+		}
+		sa.Scope_id = uint32(iface.Index)
+	}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], addrPort.Port())
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&sa.Flowinfo))[:], label)
+	_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 && errno != syscall.EINPROGRESS {
+		return errno
+	}
+	return nil
+}
+
+func setsockopt(fd, option int, value unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.IPPROTO_IPV6, uintptr(option), uintptr(value), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// Options of linux/in6.h to read the flow label of the packets received from the peer
+const (
+	ipv6FlowInfo        = 11
+	ipv6FlowLabelRemote = 8
+)
+
+func TestTunnelDialerFlowLabel(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer listener.Close()
+
+	// The accepted connections inherit the option, so the label of the SYN is kept
+	rawListener, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sockErr error
+	rawListener.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+
+	markings, err := parseIPv6Markings("22=af41", "22=0x12345", []string{"22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{markings: markings}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := config.tunnelDialer("22").Dial("tcp6", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	backend, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	defer backend.Close()
+
+	// The connection Go took over from the raw connect must work normally
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(backend, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	raw, err := backend.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req in6FlowLabelReq
+	raw.Control(func(fd uintptr) {
+		req.flags = ipv6FlowLabelRemote
+		size := uint32(unsafe.Sizeof(req))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_IPV6, ipv6FlowLabelMgr, uintptr(unsafe.Pointer(&req)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	label := binary.BigEndian.Uint32((*[4]byte)(unsafe.Pointer(&req.label))[:])
+	if label&0xfffff != 0x12345 {
+		t.Errorf("backend received flow label 0x%x, want 0x12345", label&0xfffff)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+const ipv6MarkingSupported = false
+
+// Markings are refused when the configuration is loaded
+func (marking *ipv6Marking) control(network, address string, conn syscall.RawConn) error {
+	return nil
+}
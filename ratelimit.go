@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Smallest burst of a rate limiter, so low limits still allow reasonably sized reads
+const minRateLimitBurst = 4 << 10
+
+// Throughput is measured over windows of this length
+const throughputWindow = time.Second
+
+// Token bucket that limits a direction of all connections of a tunnel together
+type rateLimiter struct {
+	// Bytes per second
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// Bytes transferred in the current window and the throughput of the last complete one
+	windowStart time.Time
+	windowBytes int64
+	throughput  float64
+}
+
+func newRateLimiter(bytesPerSecond float64) *rateLimiter {
+	// A tenth of a second worth of data keeps the traffic smooth
+	burst := max(bytesPerSecond/10, minRateLimitBurst)
+	now := time.Now()
+	return &rateLimiter{rate: bytesPerSecond, burst: burst, tokens: burst, last: now, windowStart: now}
+}
+
+// Takes n bytes from the bucket and blocks until they are paid for. The bucket may go into debt,
+// so concurrent connections queue up behind each other instead of all sleeping the same time.
+func (limiter *rateLimiter) wait(n int) {
+	limiter.mu.Lock()
+	now := time.Now()
+	limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate, limiter.burst)
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	debt := limiter.tokens
+	limiter.record(now, n)
+	limiter.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / limiter.rate * float64(time.Second)))
+	}
+}
+
+// Counts the bytes for the throughput, must be called with the lock held
+func (limiter *rateLimiter) record(now time.Time, n int) {
+	if elapsed := now.Sub(limiter.windowStart); elapsed >= throughputWindow {
+		limiter.throughput = float64(limiter.windowBytes) / elapsed.Seconds()
+		// The last window is worthless if nothing was transferred for a while
+		if elapsed >= 2*throughputWindow {
+			limiter.throughput = 0
+		}
+		limiter.windowStart = now
+		limiter.windowBytes = 0
+	}
+	limiter.windowBytes += int64(n)
+}
+
+// Returns the bytes per second of the last complete window
+func (limiter *rateLimiter) currentThroughput() float64 {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.record(time.Now(), 0)
+	return limiter.throughput
+}
+
+// Limits the reads of a connection
+type rateLimitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	// Large reads would run up a debt that blocks the other connections of the tunnel for long
+	if len(p) > int(c.limiter.burst) {
+		p = p[:int(c.limiter.burst)]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
+
+// Returns the wrapped connection
+func (c *rateLimitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// TunnelThroughput is the current throughput of a rate limited tunnel in bits per second
+type TunnelThroughput struct {
+	// From the clients to the target
+	Upload int64 `json:"upload_bps"`
+	// From the target to the clients
+	Download int64 `json:"download_bps"`
+}
+
+// Rate limiters of a tunnel, one per direction
+type tunnelRateLimit struct {
+	// As configured, e.g. 50Mbit
+	limit    string
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+// Parses per tunnel rate limits like 443=50Mbit;22=1MB keyed by source port
+func parseTunnelRateLimits(value string, srcPorts []string) (map[string]*tunnelRateLimit, error) {
+	limits := make(map[string]*tunnelRateLimit)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, limit, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("entry '%s' is missing the '=' between source port and rate", entry)
+		}
+		port, limit = strings.TrimSpace(port), strings.TrimSpace(limit)
+
+		if !slices.Contains(srcPorts, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if _, ok := limits[port]; ok {
+			return nil, fmt.Errorf("source port %s has more than one rate limit", port)
+		}
+
+		rate, err := parseRate(limit)
+		if err != nil {
+			return nil, err
+		}
+		limits[port] = &tunnelRateLimit{limit: limit, upload: newRateLimiter(rate), download: newRateLimiter(rate)}
+	}
+
+	return limits, nil
+}
+
+// Parses a rate in bits (kbit, Mbit, Gbit) or bytes (KB, MB, GB, KiB, MiB, GiB) per second and returns bytes per second.
+// A number without a unit is bytes per second.
+func parseRate(value string) (float64, error) {
+	number := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	factor := 1.0
+	for _, unit := range []struct {
+		suffix string
+		factor float64
+	}{
+		{"kbit", 1e3 / 8}, {"mbit", 1e6 / 8}, {"gbit", 1e9 / 8}, {"bit", 1.0 / 8},
+		{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+		{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"b", 1},
+	} {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, factor = trimmed, unit.factor
+			break
+		}
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("'%s' is not a positive rate like 50Mbit or 10MB", value)
+	}
+	return rate * factor, nil
+}
+
+// Wraps both sides of a tunnel connection if the tunnel has a rate limit
+func (config *Config) limitTunnel(ipv4Port string, src, dst net.Conn) (net.Conn, net.Conn) {
+	limit := config.tunnelSetting(ipv4Port).rateLimit
+	if limit == nil {
+		return src, dst
+	}
+	return &rateLimitedConn{Conn: src, limiter: limit.upload}, &rateLimitedConn{Conn: dst, limiter: limit.download}
+}
+
+// Returns the configured limit and current throughput of a tunnel, if it has a limit
+func (config *Config) tunnelThroughput(ipv4Port string) (string, *TunnelThroughput) {
+	limit := config.tunnelSetting(ipv4Port).rateLimit
+	if limit == nil {
+		return "", nil
+	}
+	return limit.limit, &TunnelThroughput{
+		Upload:   int64(limit.upload.currentThroughput() * 8),
+		Download: int64(limit.download.currentThroughput() * 8),
+	}
+}
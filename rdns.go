@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits how many reverse lookups run at the same time
+const maxConcurrentReverseLookups = 8
+
+// ClientInfo is a client of the tunnels including its reverse DNS name
+type ClientInfo struct {
+	Address  string    `json:"address"`
+	Hostname string    `json:"hostname,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+
+	resolvedAt time.Time
+	resolving  bool
+}
+
+// Bounded cache of reverse DNS names of client addresses. Lookups happen in the background
+// so they never delay a connection.
+type reverseDNSCache struct {
+	size     int
+	ttl      time.Duration
+	resolver *net.Resolver
+	sem      chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*ClientInfo
+}
+
+func newReverseDNSCache(size int, ttl time.Duration) *reverseDNSCache {
+	return &reverseDNSCache{
+		size:     size,
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+		sem:      make(chan struct{}, maxConcurrentReverseLookups),
+		entries:  make(map[string]*ClientInfo),
+	}
+}
+
+// Records that the address connected and returns its hostname if it is already known.
+// A lookup is started in the background if there is no fresh result yet.
+func (cache *reverseDNSCache) observe(addr string) string {
+	if cache == nil {
+		return ""
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := cache.entries[addr]
+	if !ok {
+		if len(cache.entries) >= cache.size {
+			cache.evictOldest()
+		}
+		entry = &ClientInfo{Address: addr}
+		cache.entries[addr] = entry
+	}
+	entry.LastSeen = now.UTC()
+
+	if !entry.resolving && now.Sub(entry.resolvedAt) > cache.ttl {
+		select {
+		case cache.sem <- struct{}{}:
+			entry.resolving = true
+			go cache.resolve(addr)
+		default: // Too many lookups in flight, try again on the next connection
+		}
+	}
+
+	return entry.Hostname
+}
+
+// Returns the cached hostname of the address
+func (cache *reverseDNSCache) hostname(addr string) string {
+	if cache == nil {
+		return ""
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if entry, ok := cache.entries[addr]; ok {
+		return entry.Hostname
+	}
+	return ""
+}
+
+func (cache *reverseDNSCache) resolve(addr string) {
+	defer func() { <-cache.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var hostname string
+	if names, err := cache.resolver.LookupAddr(ctx, addr); err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	// The entry might have been evicted in the meantime
+	if entry, ok := cache.entries[addr]; ok {
+		entry.Hostname = hostname
+		entry.resolvedAt = time.Now()
+		entry.resolving = false
+	}
+}
+
+// Removes the entry that wasn't seen for the longest time. Must be called with the lock held.
+func (cache *reverseDNSCache) evictOldest() {
+	var oldest *ClientInfo
+	for _, entry := range cache.entries {
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(cache.entries, oldest.Address)
+	}
+}
+
+// Returns all known clients, most recently seen first
+func (cache *reverseDNSCache) clients() []ClientInfo {
+	if cache == nil {
+		return nil
+	}
+
+	cache.mu.Lock()
+	clients := make([]ClientInfo, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		clients = append(clients, *entry)
+	}
+	cache.mu.Unlock()
+
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return clients
+}
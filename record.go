@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Directory in the data dir that holds the recorded webhook requests
+const webhookRecordingsDir = "webhook-recordings"
+
+// Stand-in for credentials that are never written to disk
+const redacted = "REDACTED"
+
+// Headers that carry credentials
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", signatureHeader}
+
+// Query and form parameters whose names contain one of these are redacted, routers often put their credentials there
+var redactedQueryParams = []string{"token", "pass", "secret", "key", "auth"}
+
+// The start of the response is enough to tell why an update was rejected
+const maxRecordedResponse = 1024
+
+// WebhookRecording is an update request as it was received, written to the data dir with WEBHOOK_RECORD
+type WebhookRecording struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	// Path and query, credentials in the query are redacted
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header"`
+	// Base64 encoded if the body isn't valid UTF-8, credentials in form bodies are redacted
+	Body       string `json:"body"`
+	BodyBase64 bool   `json:"body_base64,omitempty"`
+	Status     int    `json:"status"`
+	Response   string `json:"response,omitempty"`
+}
+
+// Writes every update request to its own file in the data dir and keeps the newest ones. Nil if disabled.
+type webhookRecorder struct {
+	dir string
+	max int
+
+	mu sync.Mutex
+}
+
+// Returns nil if recording is disabled
+func newWebhookRecorder(enabled bool, dir string, maxRecordings int) *webhookRecorder {
+	if !enabled {
+		return nil
+	}
+	return &webhookRecorder{dir: dir, max: maxRecordings}
+}
+
+// Records the requests that pass through the handler together with the response
+func (recorder *webhookRecorder) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if recorder == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// One byte more than the handler accepts, so it still rejects oversized bodies
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxUpdateBodySize+1))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		response := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(response, r)
+
+		recording := WebhookRecording{
+			RecordedAt: time.Now().UTC(),
+			RequestID:  w.Header().Get("X-Request-Id"),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			URI:        redactQuery(r.URL),
+			Header:     redactHeader(r.Header),
+			Status:     response.status,
+			Response:   strings.TrimSpace(response.body.String()),
+		}
+		body = redactBody(r.Header.Get("Content-Type"), body[:min(len(body), maxUpdateBodySize)])
+		if utf8.Valid(body) {
+			recording.Body = string(body)
+		} else {
+			recording.Body, recording.BodyBase64 = base64.StdEncoding.EncodeToString(body), true
+		}
+		if err := recorder.write(recording); err != nil {
+			loggerFromContext(r.Context()).Warn("Failed to record the webhook request", slog.String("dir", recorder.dir), slog.Any("error", err))
+		}
+	}
+}
+
+// Writes a recording and removes the oldest ones beyond the maximum
+func (recorder *webhookRecorder) write(recording WebhookRecording) error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if err := os.MkdirAll(recorder.dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(recorder.dir, recordingName(recording.RecordedAt)), append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(recorder.dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, entry.Name())
+		}
+	}
+	slices.Sort(files)
+	for len(files) > recorder.max {
+		os.Remove(filepath.Join(recorder.dir, files[0]))
+		files = files[1:]
+	}
+	return nil
+}
+
+// Names sort by time, a random suffix keeps requests of the same instant apart. The request ID comes
+// from the client and only goes into the recording, it could point anywhere as part of a path.
+func recordingName(recordedAt time.Time) string {
+	return recordedAt.Format("20060102T150405.000000000Z") + "-" + newRequestID() + ".json"
+}
+
+// Captures the status and the start of the response
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if remaining := maxRecordedResponse - w.body.Len(); remaining > 0 {
+		w.body.Write(p[:min(len(p), remaining)])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			header.Set(name, redacted)
+		}
+	}
+	return header
+}
+
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query := u.Query()
+	redactValues(query)
+	return u.Path + "?" + query.Encode()
+}
+
+// Redacts the credentials of form bodies, other bodies are kept as they are
+func redactBody(contentType string, body []byte) []byte {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/x-www-form-urlencoded" {
+		return body
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		// Parts of a malformed form could still be credentials
+		return []byte(redacted)
+	}
+	if !redactValues(form) {
+		return body
+	}
+	return []byte(form.Encode())
+}
+
+// Replaces the values of parameters that look like credentials, reports if there were any
+func redactValues(values url.Values) bool {
+	found := false
+	for name := range values {
+		lower := strings.ToLower(name)
+		for _, secret := range redactedQueryParams {
+			if strings.Contains(lower, secret) {
+				values.Set(name, redacted)
+				found = true
+				break
+			}
+		}
+	}
+	return found
+}
+
+// Handles the `replay <file or dir>...` command, it sends recorded requests to RELAY_URL again.
+// Redacted credentials are replaced with the configured ones.
+func runReplay(config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: four2six replay <recording or directory>...")
+	}
+	relayURL := os.Getenv("RELAY_URL")
+	if relayURL == "" {
+		return errors.New("RELAY_URL must be set to the instance the requests are replayed against")
+	}
+
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return err
+		}
+		slices.Sort(matches)
+		files = append(files, matches...)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	hmacSecret := os.Getenv("WEBHOOK_HMAC_SECRET")
+	for _, file := range files {
+		status, response, err := replayRecording(client, relayURL, config.WebhookToken, hmacSecret, file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		fmt.Printf("%s: %s %s\n", file, status, response)
+	}
+	return nil
+}
+
+// Sends a single recording and returns the status and response of the relay
+func replayRecording(client *http.Client, relayURL, token, hmacSecret, file string) (string, string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", err
+	}
+	var recording WebhookRecording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return "", "", fmt.Errorf("not a webhook recording: %v", err)
+	}
+
+	body := []byte(recording.Body)
+	if recording.BodyBase64 {
+		if body, err = base64.StdEncoding.DecodeString(recording.Body); err != nil {
+			return "", "", err
+		}
+	}
+
+	req, err := http.NewRequest(recording.Method, strings.TrimSuffix(relayURL, "/")+recording.URI, bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	for name, values := range recording.Header {
+		// Go sets these itself
+		if name == "Content-Length" || name == "Host" {
+			continue
+		}
+		req.Header[name] = values
+	}
+	if req.Header.Get("Authorization") == redacted {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if req.Header.Get(signatureHeader) == redacted {
+		req.Header.Del(signatureHeader)
+		signRequest(req, hmacSecret, body)
+	}
+	// The relay logs the replay with the ID of the original request
+	if recording.RequestID != "" {
+		req.Header.Set("X-Request-Id", recording.RequestID)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxRecordedResponse))
+	return resp.Status, strings.TrimSpace(string(response)), nil
+}
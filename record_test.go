@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactQuery(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"/update", "/update"},
+		{"/update?ip=2001:db8::1", "/update?ip=2001%3Adb8%3A%3A1"},
+		{"/update?user=me&token=abc", "/update?token=REDACTED&user=me"},
+		{"/update?Password=abc&api_key=x&AuthCode=y", "/update?AuthCode=REDACTED&Password=REDACTED&api_key=REDACTED"},
+		{"/update?secret=a&secret=b", "/update?secret=REDACTED"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactQuery(u); got != test.want {
+			t.Errorf("redactQuery(%q) = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+	header.Set("Cookie", "session=1")
+	header.Set(signatureHeader, "sha256=abc")
+	header.Set("Content-Type", "application/json")
+
+	redactedHeader := redactHeader(header)
+	for _, name := range []string{"Authorization", "Cookie", signatureHeader} {
+		if got := redactedHeader.Get(name); got != redacted {
+			t.Errorf("%s = %q, want it redacted", name, got)
+		}
+	}
+	if got := redactedHeader.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if _, ok := redactedHeader["Proxy-Authorization"]; ok {
+		t.Error("a missing header was added")
+	}
+	if header.Get("Authorization") != "Bearer token" {
+		t.Error("redacting changed the request")
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		contentType, body, want string
+	}{
+		{"application/x-www-form-urlencoded", "ip6addr=2001:db8::1", "ip6addr=2001:db8::1"},
+		{"application/x-www-form-urlencoded; charset=utf-8", "ip6addr=2001:db8::1&pass=hunter2", "ip6addr=2001%3Adb8%3A%3A1&pass=REDACTED"},
+		{"application/x-www-form-urlencoded", "token=%zz", redacted},
+		{"application/json", `{"token":"abc"}`, `{"token":"abc"}`},
+		{"", "pass=hunter2", "pass=hunter2"},
+	}
+	for _, test := range tests {
+		if got := string(redactBody(test.contentType, []byte(test.body))); got != test.want {
+			t.Errorf("redactBody(%q, %q) = %q, want %q", test.contentType, test.body, got, test.want)
+		}
+	}
+}
+
+func TestRecordingName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), webhookRecordingsDir)
+	recorder := newWebhookRecorder(true, dir, 10)
+	recordedAt := time.Date(2026, 10, 17, 1, 40, 12, 0, time.UTC)
+
+	// Client request IDs must not pick the path, nor keep two requests of the same instant from being recorded
+	for _, requestID := range []string{"/../../../x", "a/b", "/../../../x"} {
+		if err := recorder.write(WebhookRecording{RecordedAt: recordedAt, RequestID: requestID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d recordings, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "20261017T014012.000000000Z-") || strings.Contains(entry.Name(), "x") {
+			t.Errorf("recording is named %q", entry.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "x.json")); !os.IsNotExist(err) {
+		t.Errorf("the request ID escaped the recordings dir: %v", err)
+	}
+}
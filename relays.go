@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Names of relays end up in variable names and the data dir, so they are kept simple
+var relayNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Looks up a configuration variable, either straight from the environment or for a relay
+type configEnv func(name string) string
+
+// Returns the value of the variable or the default if it's not set
+func (env configEnv) parse(name, defaultValue string) string {
+	if value := env(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Returns the variables of a relay of RELAYS. RELAY_<NAME>_<VARIABLE> takes precedence over
+// <VARIABLE>, so settings all relays share only have to be set once.
+func relayEnv(name string) configEnv {
+	prefix := "RELAY_" + strings.ToUpper(name) + "_"
+	return func(variable string) string {
+		if value, ok := os.LookupEnv(prefix + variable); ok {
+			return value
+		}
+		return os.Getenv(variable)
+	}
+}
+
+// Builds the configuration of every relay in RELAYS, or of the single relay configured by the plain variables if it's not set
+func loadRelayConfigs(relays string) ([]*Config, error) {
+	if strings.TrimSpace(relays) == "" {
+		config, err := newConfigFromEnv("", os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		return []*Config{config}, nil
+	}
+
+	var configs []*Config
+	webhookAddrs := make(map[string]string)
+	for _, name := range strings.Split(relays, ",") {
+		name = strings.TrimSpace(name)
+		if !relayNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid RELAYS: '%s' is not a valid relay name, use lowercase letters, digits and underscores", name)
+		}
+		if _, err := findRelay(configs, name); err == nil {
+			return nil, fmt.Errorf("invalid RELAYS: relay %s is listed more than once", name)
+		}
+
+		config, err := newConfigFromEnv(name, relayEnv(name))
+		if err != nil {
+			return nil, fmt.Errorf("relay %s: %v", name, err)
+		}
+
+		// Every relay has its own webhook server, the default port only works for one of them
+		webhookAddr := joinListenAddr(config.WebhookListenAddr, config.WebhookListenPort)
+		if other, ok := webhookAddrs[webhookAddr]; ok {
+			return nil, fmt.Errorf("relays %s and %s both listen for webhooks on %s, set RELAY_%s_WEBHOOK_LISTEN_PORT", other, name, webhookAddr, strings.ToUpper(name))
+		}
+		webhookAddrs[webhookAddr] = name
+		if config.WebhookIPv6ListenAddr != "" {
+			webhookAddr := joinListenAddr(config.WebhookIPv6ListenAddr, config.WebhookIPv6ListenPort)
+			if other, ok := webhookAddrs[webhookAddr]; ok {
+				return nil, fmt.Errorf("relays %s and %s both listen for webhooks on %s, set RELAY_%s_WEBHOOK_IPV6_LISTEN_PORT", other, name, webhookAddr, strings.ToUpper(name))
+			}
+			webhookAddrs[webhookAddr] = name
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// Returns the logger of the relay, which names it if the process runs several
+func (config *Config) logger() *slog.Logger {
+	return relayLogger(config.Relay)
+}
+
+func relayLogger(relay string) *slog.Logger {
+	if relay == "" {
+		return slog.Default()
+	}
+	return slog.Default().With(slog.String("relay", relay))
+}
+
+// Names the relay in a header of every response, so monitoring behind a shared proxy can tell the relays apart
+func withRelayHeader(relay string, next http.Handler) http.Handler {
+	if relay == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Four2Six-Relay", relay)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the relay with the name, which may only be empty if the process runs a single relay
+func findRelay(configs []*Config, name string) (*Config, error) {
+	if name == "" {
+		if len(configs) == 1 {
+			return configs[0], nil
+		}
+		return nil, fmt.Errorf("RELAY_NAME must be set to one of the relays in RELAYS")
+	}
+
+	for _, config := range configs {
+		if config.Relay == name {
+			return config, nil
+		}
+	}
+	return nil, fmt.Errorf("relay %s is not listed in RELAYS", name)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// Upper bound of the wait between two dial attempts
+const maxDialRetryBackoff = 5 * time.Second
+
+// Failed dials ask the health checker for a check, but not more often than this
+const dialRecheckInterval = time.Second
+
+// Returned while the health checker found every target of a tunnel down
+var errCircuitOpen = errors.New("circuit breaker is open, all targets failed the last healthcheck")
+
+// Dials a tunnel and, if DIAL_RETRY_WINDOW is set, keeps retrying with exponential backoff
+// until the window is over. Bridges short outages like an ISP reconnect of the target.
+func (config *Config) dialTunnel(ctx context.Context, ipv4Port, ipv6Port string) (net.Conn, string, error) {
+	if config.DialRetryWindow == 0 {
+		return config.dialTargets(ctx, ipv4Port, ipv6Port)
+	}
+
+	deadline := time.Now().Add(config.DialRetryWindow)
+	backoff := config.DialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		conn, target, err := config.dialTargets(ctx, ipv4Port, ipv6Port)
+		if err == nil {
+			return conn, target, nil
+		}
+
+		// Let the health checker confirm the outage, which opens the circuit breaker for the next connections
+		config.health.recheckAfter(dialRecheckInterval)
+
+		// Jitter keeps the waiting clients from all dialing at once when the target comes back
+		wait := min(backoff/2+rand.N(backoff/2+1), time.Until(deadline))
+		if wait <= 0 {
+			return nil, "", fmt.Errorf("gave up after %d attempts in %s: %w", attempt, config.DialRetryWindow, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxDialRetryBackoff)
+	}
+}
+
+// Returns the targets of a tunnel in the order they should be dialed. With the circuit breaker
+// the targets that failed the last healthcheck are skipped instead of tried last.
+func (config *Config) dialableTargets(ipv4Port, ipv6Port string) ([]string, error) {
+	name := tunnelName(ipv4Port, ipv6Port)
+	targets := config.tunnelTargets(ipv4Port)
+	if !config.CircuitBreaker {
+		return config.health.orderTargets(name, targets), nil
+	}
+
+	targets = config.health.availableTargets(name, targets)
+	if len(targets) == 0 {
+		// The target may be back already, so don't wait for the regular interval to find out
+		config.health.recheckAfter(dialRecheckInterval)
+		return nil, errCircuitOpen
+	}
+	return targets, nil
+}
@@ -0,0 +1,4 @@
+package main
+
+// SO_REUSEPORT is missing from the syscall package on Linux
+const soReusePort = 0xf
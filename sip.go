@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media streams without packets for this long are closed
+const rtpIdleTimeout = time.Minute
+
+// Largest SIP header or body, anything larger isn't SIP
+const maxSIPMessagePart = 64 << 10
+
+// Makes calls to a PBX behind the relay work. The SDP bodies of SIP messages on SIP_PORTS are
+// rewritten so both sides send their RTP and RTCP to the relay, which forwards them between IPv4 and IPv6.
+type sipHelper struct {
+	config *Config
+	// Source ports of the SIP tunnels
+	ports []string
+	// IPv4 address announced to the clients, empty to detect it
+	mediaAddr string
+
+	mu sync.Mutex
+	// RTP ports of the pool, RTCP uses the port above each of them
+	rtpPorts []int
+	inUse    map[int]bool
+	next     int
+}
+
+// Parses SIP_PORTS, SIP_RTP_PORTS and SIP_MEDIA_ADDRESS, returns nil if no tunnel speaks SIP
+func newSIPHelper(config *Config, ports, rtpPorts, mediaAddr string) (*sipHelper, error) {
+	if strings.TrimSpace(ports) == "" {
+		return nil, nil
+	}
+
+	helper := &sipHelper{config: config, inUse: make(map[int]bool)}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if !slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if config.ftp.handles(port) {
+			return nil, fmt.Errorf("source port %s is also an FTP tunnel", port)
+		}
+		helper.ports = append(helper.ports, port)
+	}
+
+	if strings.TrimSpace(rtpPorts) == "" {
+		return nil, errors.New("SIP_RTP_PORTS must be set for SIP tunnels")
+	}
+	pool, err := parsePortList(rtpPorts)
+	if err != nil {
+		return nil, fmt.Errorf("SIP_RTP_PORTS: %v", err)
+	}
+	// RTP uses even ports and RTCP the odd one above
+	for _, port := range pool {
+		n, _ := strconv.Atoi(port)
+		if n%2 == 0 && slices.Contains(pool, strconv.Itoa(n+1)) {
+			helper.rtpPorts = append(helper.rtpPorts, n)
+		}
+	}
+	if len(helper.rtpPorts) == 0 {
+		return nil, errors.New("SIP_RTP_PORTS needs at least one even port followed by an odd one, e.g. 40000-40099")
+	}
+
+	if mediaAddr != "" {
+		addr, err := netip.ParseAddr(mediaAddr)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("SIP_MEDIA_ADDRESS '%s' is not an IPv4 address", mediaAddr)
+		}
+		helper.mediaAddr = addr.String()
+	}
+
+	return helper, nil
+}
+
+// Whether the tunnel speaks SIP
+func (helper *sipHelper) handles(ipv4Port string) bool {
+	return helper != nil && slices.Contains(helper.ports, ipv4Port)
+}
+
+// Reserves a free RTP port of the pool
+func (helper *sipHelper) reserve() (int, error) {
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+
+	for range helper.rtpPorts {
+		port := helper.rtpPorts[helper.next]
+		helper.next = (helper.next + 1) % len(helper.rtpPorts)
+		if !helper.inUse[port] {
+			helper.inUse[port] = true
+			return port, nil
+		}
+	}
+	return 0, errors.New("all RTP ports are in use")
+}
+
+func (helper *sipHelper) release(port int) {
+	helper.mu.Lock()
+	delete(helper.inUse, port)
+	helper.mu.Unlock()
+}
+
+// Returns how many RTP port pairs are in use
+func (helper *sipHelper) usage() portPoolUsage {
+	helper.mu.Lock()
+	defer helper.mu.Unlock()
+	return portPoolUsage{"SIP_RTP_PORTS", len(helper.inUse), len(helper.rtpPorts)}
+}
+
+// A SIP connection between a client and the PBX
+type sipSession struct {
+	helper   *sipHelper
+	logger   *slog.Logger
+	clientIP netip.Addr
+	src, dst net.Conn
+	// Addresses the media is announced at to the client and the PBX
+	relayIPv4, relayIPv6 netip.Addr
+	backendIP            netip.Addr
+
+	mu sync.Mutex
+	// Media streams keyed by Call-ID and the index of the m= line
+	streams map[string]*rtpStream
+}
+
+// Forwards a SIP connection, rewrites its SDP bodies and relays the media of its calls. Returns the bytes sent from src to dst and back.
+func (helper *sipHelper) forward(tunnel, ipv4Port, clientIP string, src, dst net.Conn) (int64, int64) {
+	defer src.Close()
+	defer dst.Close()
+
+	src, dst = helper.config.wrapTunnelConns(ipv4Port, src, dst)
+	session := &sipSession{
+		helper:  helper,
+		logger:  helper.config.logger().With(slog.String("tunnel", tunnel), slog.String("client", src.RemoteAddr().String())),
+		src:     src,
+		dst:     dst,
+		streams: make(map[string]*rtpStream),
+	}
+	defer session.closeStreams()
+
+	session.clientIP, _ = netip.ParseAddr(clientIP)
+	if local, ok := dst.LocalAddr().(*net.TCPAddr); ok {
+		session.relayIPv6 = local.AddrPort().Addr()
+	}
+	if remote, ok := dst.RemoteAddr().(*net.TCPAddr); ok {
+		session.backendIP = remote.AddrPort().Addr()
+	}
+	relayIPv4, ok := helper.config.advertisedIPv4(helper.mediaAddr, src)
+	if !ok {
+		session.logger.Error("The relay doesn't know its IPv4 address, set SIP_MEDIA_ADDRESS. Forwarding without media")
+	}
+	session.relayIPv4 = relayIPv4
+
+	downloaded := make(chan int64, 1)
+	go func() {
+		downloaded <- session.relay(dst, src, false)
+	}()
+	uploaded := session.relay(src, dst, true)
+
+	// Stop the other direction before waiting for its count
+	src.Close()
+	dst.Close()
+	return uploaded, <-downloaded
+}
+
+// Forwards the SIP messages of one direction until the connection is closed
+func (session *sipSession) relay(from, to net.Conn, fromClient bool) int64 {
+	reader := bufio.NewReaderSize(from, 4096)
+	var written int64
+	for {
+		header, body, err := readSIPMessage(reader)
+		if err != nil {
+			// Connections closed by the idle timeout end with a deadline error
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				session.logger.Warn("Closing SIP connection after an invalid message", slog.Any("error", err))
+			}
+			return written
+		}
+
+		header, body = session.rewrite(header, body, fromClient)
+		n, err := to.Write(append(header, body...))
+		written += int64(n)
+		if err != nil {
+			return written
+		}
+	}
+}
+
+// Reads a SIP message from a stream, keep-alive line breaks are returned as a header without body
+func readSIPMessage(reader *bufio.Reader) ([]byte, []byte, error) {
+	var header []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		header = append(header, line...)
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				err = errors.New("header line is too long")
+			}
+			return nil, nil, err
+		}
+		if len(header) > maxSIPMessagePart {
+			return nil, nil, errors.New("header is too large")
+		}
+		// An empty line ends the header, or is a keep-alive on its own
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	if len(bytes.TrimSpace(header)) == 0 {
+		return header, nil, nil
+	}
+
+	length := 0
+	if value := sipHeader(header, "Content-Length", "l"); value != "" {
+		var err error
+		length, err = strconv.Atoi(value)
+		if err != nil || length < 0 || length > maxSIPMessagePart {
+			return nil, nil, fmt.Errorf("invalid Content-Length '%s'", value)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, err
+	}
+	return header, body, nil
+}
+
+// Returns the value of a header by its name or compact form
+func sipHeader(header []byte, name, compact string) string {
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if found && (strings.EqualFold(key, name) || strings.EqualFold(key, compact)) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// Replaces the value of the Content-Length header
+func setSIPContentLength(header []byte, length int) []byte {
+	lines := strings.SplitAfter(string(header), "\n")
+	for i, line := range lines {
+		key, _, found := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if found && (strings.EqualFold(key, "Content-Length") || strings.EqualFold(key, "l")) {
+			lines[i] = key + ": " + strconv.Itoa(length) + "\r\n"
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// Points the media of an SDP body at the relay and releases the streams of ended calls
+func (session *sipSession) rewrite(header, body []byte, fromClient bool) ([]byte, []byte) {
+	callID := sipHeader(header, "Call-ID", "i")
+	if method, _, _ := strings.Cut(string(header), " "); method == "BYE" || method == "CANCEL" {
+		session.closeCall(callID)
+	}
+
+	contentType, _, _ := strings.Cut(sipHeader(header, "Content-Type", "c"), ";")
+	if len(body) == 0 || !strings.EqualFold(strings.TrimSpace(contentType), "application/sdp") || !session.relayIPv4.IsValid() || callID == "" {
+		return header, body
+	}
+
+	rewritten := session.rewriteSDP(callID, string(body), fromClient)
+	return setSIPContentLength(header, len(rewritten)), []byte(rewritten)
+}
+
+// Rewrites the connection addresses and media ports of an SDP body, or returns it unchanged if its media can't be relayed
+func (session *sipSession) rewriteSDP(callID, body string, fromClient bool) string {
+	lines := strings.SplitAfter(body, "\n")
+
+	// The session level address applies to media without their own
+	var sessionAddr netip.Addr
+	media := -1
+	mediaAddrs := map[int]netip.Addr{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			media++
+		}
+		if addr, ok := parseSDPConnection(line); ok {
+			if media < 0 {
+				sessionAddr = addr
+			} else {
+				mediaAddrs[media] = addr
+			}
+		}
+	}
+
+	announced := session.relayIPv6
+	if !fromClient {
+		announced = session.relayIPv4
+	}
+	family := "IP4"
+	if announced.Is6() && !announced.Is4In6() {
+		family = "IP6"
+	}
+
+	media = -1
+	for i, line := range lines {
+		ending := line[len(strings.TrimRight(line, "\r\n")):]
+		switch {
+		case strings.HasPrefix(line, "c="):
+			lines[i] = fmt.Sprintf("c=IN %s %s%s", family, announced.Unmap(), ending)
+
+		case strings.HasPrefix(line, "m="):
+			media++
+			fields := strings.Fields(line[2:])
+			if len(fields) < 2 {
+				continue
+			}
+			port, err := strconv.Atoi(fields[1])
+			if err != nil || port == 0 {
+				// Disabled streams stay disabled
+				continue
+			}
+			addr, ok := mediaAddrs[media]
+			if !ok {
+				addr = sessionAddr
+			}
+
+			stream, err := session.stream(fmt.Sprintf("%s/%d", callID, media))
+			if err != nil {
+				// A half rewritten body would send the media to the relay without anything forwarding it
+				session.logger.Error("Error relaying the media of a call, forwarding its SDP unchanged", slog.Any("error", err))
+				return body
+			}
+			stream.announce(fromClient, addr, port)
+			fields[1] = strconv.Itoa(stream.port)
+			lines[i] = "m=" + strings.Join(fields, " ") + ending
+
+		case strings.HasPrefix(line, "a=rtcp:") && media >= 0:
+			if stream := session.existingStream(fmt.Sprintf("%s/%d", callID, media)); stream != nil {
+				lines[i] = fmt.Sprintf("a=rtcp:%d%s", stream.port+1, ending)
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Parses a c=IN IP4 192.0.2.1 or c=IN IP6 2001:db8::1 line
+func parseSDPConnection(line string) (netip.Addr, bool) {
+	fields := strings.Fields(strings.TrimPrefix(line, "c="))
+	if !strings.HasPrefix(line, "c=") || len(fields) < 3 {
+		return netip.Addr{}, false
+	}
+	// Multicast addresses may have a TTL suffix
+	host, _, _ := strings.Cut(fields[2], "/")
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// Returns the media stream of a call, opening it if it's new
+func (session *sipSession) stream(key string) (*rtpStream, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if stream, ok := session.streams[key]; ok && !stream.isClosed() {
+		return stream, nil
+	}
+	stream, err := session.openStream()
+	if err != nil {
+		return nil, err
+	}
+	session.streams[key] = stream
+	return stream, nil
+}
+
+func (session *sipSession) existingStream(key string) *rtpStream {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.streams[key]
+}
+
+// Closes the media streams of a call
+func (session *sipSession) closeCall(callID string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	for key, stream := range session.streams {
+		if strings.HasPrefix(key, callID+"/") {
+			stream.close()
+			delete(session.streams, key)
+		}
+	}
+}
+
+func (session *sipSession) closeStreams() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	for key, stream := range session.streams {
+		stream.close()
+		delete(session.streams, key)
+	}
+}
+
+// Media of a call forwarded between a port pair on the client side and the same pair on the PBX side
+type rtpStream struct {
+	session *sipSession
+	port    int
+	// Index 0 is RTP, 1 is RTCP
+	ipv4, ipv6 [2]*net.UDPConn
+
+	mu sync.Mutex
+	// Where the media is sent, announced in the SDP and updated by the packets that arrive
+	client, backend [2]netip.AddrPort
+	lastPacket      time.Time
+	closed          bool
+}
+
+// Binds a port pair of the pool on both sides and starts forwarding
+func (session *sipSession) openStream() (*rtpStream, error) {
+	helper := session.helper
+	for range helper.rtpPorts {
+		port, err := helper.reserve()
+		if err != nil {
+			return nil, err
+		}
+
+		stream := &rtpStream{session: session, port: port, lastPacket: time.Now()}
+		if err := stream.bind(); err != nil {
+			stream.closeSockets()
+			helper.release(port)
+			continue
+		}
+
+		for i := range 2 {
+			go stream.forward(stream.ipv4[i], stream.ipv6[i], i, true)
+			go stream.forward(stream.ipv6[i], stream.ipv4[i], i, false)
+		}
+		session.logger.Debug("Relaying media", slog.Int("rtp_port", port))
+		return stream, nil
+	}
+	return nil, errors.New("no RTP port of the pool could be bound")
+}
+
+func (stream *rtpStream) bind() error {
+	ipv4Addr := "0.0.0.0"
+	if local, ok := stream.session.src.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() != nil {
+		ipv4Addr = local.IP.String()
+	}
+
+	var err error
+	for i := range 2 {
+		port := strconv.Itoa(stream.port + i)
+		if stream.ipv4[i], err = listenUDP("udp4", net.JoinHostPort(ipv4Addr, port)); err != nil {
+			return err
+		}
+		if stream.ipv6[i], err = listenUDP("udp", net.JoinHostPort(stream.session.relayIPv6.String(), port)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listenUDP(network, addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(network, udpAddr)
+}
+
+// Remembers where a side announced its media
+func (stream *rtpStream) announce(fromClient bool, addr netip.Addr, port int) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if fromClient {
+		// Clients behind NAT announce private addresses, their media is only sent once their first packet arrived
+		if addr.Unmap() != stream.session.clientIP.Unmap() {
+			return
+		}
+		stream.client = [2]netip.AddrPort{netip.AddrPortFrom(addr.Unmap(), uint16(port)), netip.AddrPortFrom(addr.Unmap(), uint16(port+1))}
+		return
+	}
+	stream.backend = [2]netip.AddrPort{netip.AddrPortFrom(addr, uint16(port)), netip.AddrPortFrom(addr, uint16(port+1))}
+}
+
+// Forwards the packets arriving on one side to the other. Only packets of the client of the SIP
+// connection and of the PBX are accepted, their source becomes the destination of the other direction.
+func (stream *rtpStream) forward(from, to *net.UDPConn, i int, fromClient bool) {
+	buf := make([]byte, 2048)
+	for {
+		from.SetReadDeadline(time.Now().Add(rtpIdleTimeout))
+		n, source, err := from.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			stream.mu.Lock()
+			idle := time.Since(stream.lastPacket) >= rtpIdleTimeout
+			stream.mu.Unlock()
+			if idle {
+				stream.close()
+				return
+			}
+			continue
+		}
+
+		stream.mu.Lock()
+		var destination netip.AddrPort
+		if fromClient {
+			if source.Addr().Unmap() != stream.session.clientIP.Unmap() {
+				stream.mu.Unlock()
+				continue
+			}
+			stream.client[i] = source
+			destination = stream.backend[i]
+		} else {
+			if source.Addr().Unmap() != stream.session.backendIP.Unmap() {
+				stream.mu.Unlock()
+				continue
+			}
+			stream.backend[i] = source
+			destination = stream.client[i]
+		}
+		stream.lastPacket = time.Now()
+		stream.mu.Unlock()
+
+		if destination.IsValid() {
+			to.WriteToUDPAddrPort(buf[:n], destination)
+		}
+	}
+}
+
+func (stream *rtpStream) isClosed() bool {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	return stream.closed
+}
+
+// Closes the sockets and returns the ports to the pool
+func (stream *rtpStream) close() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if stream.closed {
+		return
+	}
+	stream.closed = true
+	stream.closeSockets()
+	stream.session.helper.release(stream.port)
+}
+
+func (stream *rtpStream) closeSockets() {
+	for i := range 2 {
+		if stream.ipv4[i] != nil {
+			stream.ipv4[i].Close()
+		}
+		if stream.ipv6[i] != nil {
+			stream.ipv6[i].Close()
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a pool of RTP port pairs that were free on both sides a moment ago
+func freeRTPPorts(t *testing.T, pairs int) string {
+	t.Helper()
+	var ports []string
+	for port := 40000; port < 60000 && len(ports) < pairs; port += 2 {
+		var conns []*net.UDPConn
+		for i := range 2 {
+			// Like the streams, the IPv4 side binds udp4 so it doesn't take the port on IPv6 as well
+			if conn, err := listenUDP("udp4", net.JoinHostPort("0.0.0.0", strconv.Itoa(port+i))); err == nil {
+				conns = append(conns, conn)
+			}
+			if conn, err := listenUDP("udp", net.JoinHostPort("::1", strconv.Itoa(port+i))); err == nil {
+				conns = append(conns, conn)
+			}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if len(conns) == 4 {
+			ports = append(ports, strconv.Itoa(port)+"-"+strconv.Itoa(port+1))
+		}
+	}
+	if len(ports) < pairs {
+		t.Skip("no free RTP ports")
+	}
+	return strings.Join(ports, ",")
+}
+
+// Returns a session of a client at 203.0.113.7 and a PBX at ::1, the media is announced at 192.0.2.1 to the client
+func newTestSIPSession(t *testing.T, pairs int) *sipSession {
+	t.Helper()
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		conn.Close()
+	}
+	helper, err := newSIPHelper(&Config{IPv4Ports: []string{"5060"}}, "5060", freeRTPPorts(t, pairs), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst := net.Pipe()
+	t.Cleanup(func() {
+		src.Close()
+		dst.Close()
+	})
+	session := &sipSession{
+		helper:    helper,
+		logger:    helper.config.logger(),
+		clientIP:  netip.MustParseAddr("203.0.113.7"),
+		src:       src,
+		dst:       dst,
+		relayIPv4: netip.MustParseAddr("192.0.2.1"),
+		relayIPv6: netip.IPv6Loopback(),
+		backendIP: netip.IPv6Loopback(),
+		streams:   make(map[string]*rtpStream),
+	}
+	t.Cleanup(session.closeStreams)
+	return session
+}
+
+func TestReadSIPMessage(t *testing.T) {
+	tests := []struct {
+		name, message string
+		header, body  string
+		wantErr       bool
+	}{
+		{name: "keep-alive", message: "\r\n\r\n", header: "\r\n"},
+		{name: "no body", message: "OPTIONS sip:pbx SIP/2.0\r\nCall-ID: a\r\n\r\n", header: "OPTIONS sip:pbx SIP/2.0\r\nCall-ID: a\r\n\r\n"},
+		{name: "Content-Length", message: "INVITE sip:pbx SIP/2.0\r\nContent-Length: 3\r\n\r\nv=0next", header: "INVITE sip:pbx SIP/2.0\r\nContent-Length: 3\r\n\r\n", body: "v=0"},
+		{name: "compact Content-Length", message: "INVITE sip:pbx SIP/2.0\r\nl: 3\r\n\r\nv=0", header: "INVITE sip:pbx SIP/2.0\r\nl: 3\r\n\r\n", body: "v=0"},
+		{name: "negative Content-Length", message: "INVITE sip:pbx SIP/2.0\r\nContent-Length: -1\r\n\r\n", wantErr: true},
+		{name: "oversized Content-Length", message: "INVITE sip:pbx SIP/2.0\r\nContent-Length: 65537\r\n\r\n", wantErr: true},
+		{name: "invalid Content-Length", message: "INVITE sip:pbx SIP/2.0\r\nl: ten\r\n\r\n", wantErr: true},
+		{name: "truncated body", message: "INVITE sip:pbx SIP/2.0\r\nContent-Length: 10\r\n\r\nv=0", wantErr: true},
+		{name: "oversized header", message: "INVITE sip:pbx SIP/2.0\r\n" + strings.Repeat("X-Padding: "+strings.Repeat("a", 1000)+"\r\n", 70), wantErr: true},
+	}
+	for _, test := range tests {
+		header, body, err := readSIPMessage(bufio.NewReaderSize(strings.NewReader(test.message), 4096))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: read a message with a header of %d bytes", test.name, len(header))
+			}
+			continue
+		}
+		if err != nil || string(header) != test.header || string(body) != test.body {
+			t.Errorf("%s: got %q, %q, %v", test.name, header, body, err)
+		}
+	}
+}
+
+func TestSIPRewriteHeaders(t *testing.T) {
+	const body = "v=0\r\nc=IN IP6 ::1\r\nm=audio 4000 RTP/AVP 0\r\n"
+	tests := []struct {
+		name, header string
+		rewritten    bool
+		length       string
+	}{
+		{name: "long form", header: "INVITE sip:client SIP/2.0\r\nCall-ID: a\r\nContent-Type: application/sdp\r\nContent-Length: 43\r\n\r\n", rewritten: true, length: "Content-Length"},
+		{name: "compact form", header: "INVITE sip:client SIP/2.0\r\ni: b\r\nc: application/sdp\r\nl: 43\r\n\r\n", rewritten: true, length: "l"},
+		{name: "content type parameters", header: "INVITE sip:client SIP/2.0\r\ni: c\r\nc: Application/SDP; charset=utf-8\r\nl: 43\r\n\r\n", rewritten: true, length: "l"},
+		{name: "no Call-ID", header: "INVITE sip:client SIP/2.0\r\nc: application/sdp\r\nl: 43\r\n\r\n", length: "l"},
+		{name: "not SDP", header: "MESSAGE sip:client SIP/2.0\r\ni: d\r\nc: text/plain\r\nl: 43\r\n\r\n", length: "l"},
+	}
+	for _, test := range tests {
+		session := newTestSIPSession(t, 1)
+		header, rewritten := session.rewrite([]byte(test.header), []byte(body), false)
+		if test.rewritten == (string(rewritten) == body) {
+			t.Errorf("%s: body = %q", test.name, rewritten)
+		}
+		if got := sipHeader(header, "Content-Length", "l"); got != strconv.Itoa(len(rewritten)) {
+			t.Errorf("%s: Content-Length = %q for a body of %d bytes", test.name, got, len(rewritten))
+		}
+		if !strings.Contains(string(header), "\r\n"+test.length+": ") {
+			t.Errorf("%s: header %q doesn't keep the form of %s", test.name, header, test.length)
+		}
+	}
+}
+
+func TestSIPRewriteSDP(t *testing.T) {
+	session := newTestSIPSession(t, 2)
+	body := strings.Join([]string{
+		"v=0",
+		"o=pbx 1 1 IN IP6 2001:db8::1",
+		"c=IN IP6 2001:db8::1",
+		"m=audio 4000 RTP/AVP 0",
+		"a=rtcp:4001",
+		"m=video 5000 RTP/AVP 96",
+		"c=IN IP6 2001:db8::2",
+		"m=audio 0 RTP/AVP 0",
+		"",
+	}, "\r\n")
+
+	rewritten := strings.Split(session.rewriteSDP("call", body, false), "\r\n")
+	audio, video := session.existingStream("call/0"), session.existingStream("call/1")
+	if audio == nil || video == nil {
+		t.Fatalf("streams = %v", session.streams)
+	}
+	want := []string{
+		"v=0",
+		"o=pbx 1 1 IN IP6 2001:db8::1",
+		"c=IN IP4 192.0.2.1",
+		"m=audio " + strconv.Itoa(audio.port) + " RTP/AVP 0",
+		"a=rtcp:" + strconv.Itoa(audio.port+1),
+		"m=video " + strconv.Itoa(video.port) + " RTP/AVP 96",
+		"c=IN IP4 192.0.2.1",
+		// Disabled streams get no ports
+		"m=audio 0 RTP/AVP 0",
+		"",
+	}
+	if strings.Join(rewritten, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rewritten SDP:\n%s\nwant:\n%s", strings.Join(rewritten, "\n"), strings.Join(want, "\n"))
+	}
+	if len(session.streams) != 2 {
+		t.Errorf("%d streams, want 2", len(session.streams))
+	}
+
+	// The session level address applies to media without their own
+	wantBackend := map[*rtpStream]string{audio: "[2001:db8::1]:4000", video: "[2001:db8::2]:5000"}
+	for stream, want := range wantBackend {
+		if got := stream.backend[0].String(); got != want {
+			t.Errorf("stream %d sends RTP to %s, want %s", stream.port, got, want)
+		}
+	}
+}
+
+func TestSIPRewriteSDPClient(t *testing.T) {
+	session := newTestSIPSession(t, 2)
+	tests := []struct {
+		name, addr, client string
+	}{
+		{name: "public address", addr: "203.0.113.7", client: "203.0.113.7:4000"},
+		// Clients behind NAT are only sent media once their first packet arrived
+		{name: "private address", addr: "192.168.1.10", client: "invalid AddrPort"},
+	}
+	for i, test := range tests {
+		callID := "call" + strconv.Itoa(i)
+		rewritten := session.rewriteSDP(callID, "v=0\r\nc=IN IP4 "+test.addr+"\r\nm=audio 4000 RTP/AVP 0\r\n", true)
+		stream := session.existingStream(callID + "/0")
+		if stream == nil {
+			t.Fatalf("%s: no stream", test.name)
+		}
+		if want := "v=0\r\nc=IN IP6 ::1\r\nm=audio " + strconv.Itoa(stream.port) + " RTP/AVP 0\r\n"; rewritten != want {
+			t.Errorf("%s: rewritten SDP = %q, want %q", test.name, rewritten, want)
+		}
+		if got := stream.client[0].String(); got != test.client {
+			t.Errorf("%s: client = %s, want %s", test.name, got, test.client)
+		}
+	}
+}
+
+func TestSIPRewriteSDPPoolExhausted(t *testing.T) {
+	session := newTestSIPSession(t, 1)
+	body := "v=0\r\nc=IN IP6 2001:db8::1\r\nm=audio 4000 RTP/AVP 0\r\nm=video 5000 RTP/AVP 96\r\n"
+
+	// Only one stream gets a port, the media of the other would go nowhere
+	if rewritten := session.rewriteSDP("call", body, false); rewritten != body {
+		t.Errorf("rewritten SDP = %q, want it unchanged", rewritten)
+	}
+
+	// Ending the call frees the pool for the next one
+	session.closeCall("call")
+	if rewritten := session.rewriteSDP("next", "v=0\r\nc=IN IP6 2001:db8::1\r\nm=audio 4000 RTP/AVP 0\r\n", false); !strings.Contains(rewritten, "c=IN IP4 192.0.2.1") {
+		t.Errorf("rewritten SDP = %q after the call ended", rewritten)
+	}
+}
+
+func TestSIPConnectionIdleTimeout(t *testing.T) {
+	srcPort, destPort := freePort(t), startEchoBackend(t)
+	config := newTestConfig(t, map[string]string{"SRC_PORTS": srcPort, "DEST_PORTS": destPort, "SIP_PORTS": srcPort, "SIP_RTP_PORTS": freeRTPPorts(t, 1), "IDLE_TIMEOUT": "200ms"})
+	config.storeIPv6Address("::1")
+	config.tunnels.start()
+	t.Cleanup(config.tunnels.stop)
+
+	conn := dialTunnel(t, "127.0.0.1", srcPort)
+	expectEcho(t, conn, "OPTIONS sip:pbx SIP/2.0\r\nCall-ID: a\r\n\r\n")
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("idle SIP connection still open after %s: %v", time.Since(start), err)
+	}
+}
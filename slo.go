@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recent connections that are kept per tunnel to compute the latency
+const maxLatencySamples = 256
+
+// Fewer connections in the window never count as a breach, a single slow dial shouldn't shed anything
+const minLatencySamples = 5
+
+// TunnelLatency is the connection-open latency of a tunnel with a latency SLO
+type TunnelLatency struct {
+	SLO string `json:"slo"`
+	// 90th percentile of the connections in LATENCY_SLO_WINDOW, unset without enough connections
+	P90Milliseconds *int64 `json:"p90_ms"`
+	Degraded        bool   `json:"degraded"`
+	// Connections that were closed right after accepting them
+	Shed uint64 `json:"shed"`
+}
+
+// Tracks how long it takes from accepting a connection until the connection to the backend is open
+// and sheds new connections while the tunnel is slower than its SLO
+type latencySLO struct {
+	// As configured, e.g. 200ms
+	limit       string
+	slo         time.Duration
+	window      time.Duration
+	shedPercent int
+
+	mu       sync.Mutex
+	samples  []latencySample
+	degraded bool
+	shed     uint64
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// Parses per tunnel latency SLOs like 22=200ms;443=1s keyed by source port
+func parseTunnelLatencySLOs(value string, srcPorts []string, window time.Duration, shedPercent int) (map[string]*latencySLO, error) {
+	slos := make(map[string]*latencySLO)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, limit, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("entry '%s' is missing the '=' between source port and latency", entry)
+		}
+		port, limit = strings.TrimSpace(port), strings.TrimSpace(limit)
+
+		if !slices.Contains(srcPorts, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if _, ok := slos[port]; ok {
+			return nil, fmt.Errorf("source port %s has more than one latency SLO", port)
+		}
+
+		slo, err := time.ParseDuration(limit)
+		if err != nil || slo <= 0 {
+			return nil, fmt.Errorf("'%s' is not a positive duration like 200ms", limit)
+		}
+		slos[port] = &latencySLO{limit: limit, slo: slo, window: window, shedPercent: shedPercent}
+	}
+
+	return slos, nil
+}
+
+// Records how long a connection took to reach the backend. Failed dials count with the time they took.
+func (slo *latencySLO) record(logger *slog.Logger, latency time.Duration) {
+	if slo == nil {
+		return
+	}
+
+	slo.mu.Lock()
+	defer slo.mu.Unlock()
+
+	now := time.Now()
+	if len(slo.samples) >= maxLatencySamples {
+		slo.samples = slices.Delete(slo.samples, 0, 1)
+	}
+	slo.samples = append(slo.samples, latencySample{at: now, latency: latency})
+	slo.update(logger, now)
+}
+
+// Reports whether a new connection may be forwarded, false if it's shed
+func (slo *latencySLO) admit(logger *slog.Logger) bool {
+	if slo == nil {
+		return true
+	}
+
+	slo.mu.Lock()
+	defer slo.mu.Unlock()
+
+	// Old connections leave the window even while everything is shed, so shedding stops eventually
+	if !slo.update(logger, time.Now()) || rand.IntN(100) >= slo.shedPercent {
+		return true
+	}
+	slo.shed++
+	return false
+}
+
+// Returns the current latency of the tunnel
+func (slo *latencySLO) status() *TunnelLatency {
+	if slo == nil {
+		return nil
+	}
+
+	slo.mu.Lock()
+	defer slo.mu.Unlock()
+
+	status := &TunnelLatency{SLO: slo.limit, Degraded: slo.degraded, Shed: slo.shed}
+	if p90, ok := slo.percentile(time.Now()); ok {
+		ms := p90.Milliseconds()
+		status.P90Milliseconds = &ms
+	}
+	return status
+}
+
+// Drops the connections that left the window and logs when the tunnel starts or stops
+// exceeding its SLO. Must be called with the lock held.
+func (slo *latencySLO) update(logger *slog.Logger, now time.Time) bool {
+	p90, ok := slo.percentile(now)
+	degraded := ok && p90 > slo.slo
+	if degraded != slo.degraded {
+		slo.degraded = degraded
+		if degraded {
+			logger.Warn("Tunnel exceeds its latency SLO", slog.Duration("p90", p90), slog.String("slo", slo.limit), slog.Int("shed_percent", slo.shedPercent))
+		} else {
+			logger.Info("Tunnel meets its latency SLO again", slog.String("slo", slo.limit))
+		}
+	}
+	return degraded
+}
+
+// Returns the 90th percentile of the connections in the window, must be called with the lock held
+func (slo *latencySLO) percentile(now time.Time) (time.Duration, bool) {
+	start := 0
+	for start < len(slo.samples) && now.Sub(slo.samples[start].at) > slo.window {
+		start++
+	}
+	slo.samples = slo.samples[start:]
+	if len(slo.samples) < minLatencySamples {
+		return 0, false
+	}
+
+	latencies := make([]time.Duration, len(slo.samples))
+	for i, sample := range slo.samples {
+		latencies[i] = sample.latency
+	}
+	slices.Sort(latencies)
+	return latencies[(len(latencies)*9+9)/10-1], true
+}
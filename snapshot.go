@@ -0,0 +1,29 @@
+package main
+
+// Part of the configuration that changes at runtime. A snapshot is never modified after it was
+// stored, updates swap in a new one, so the accept paths read it without waiting for a lock.
+type configSnapshot struct {
+	IPv6Address string
+}
+
+// Returns the current snapshot, which stays valid after later updates
+func (config *Config) snapshot() *configSnapshot {
+	return config.current.Load()
+}
+
+// Returns the dynamic IPv6 address
+func (config *Config) ipv6Address() string {
+	return config.snapshot().IPv6Address
+}
+
+// Swaps in a snapshot with the address and returns the previous address
+func (config *Config) storeIPv6Address(ipv6Address string) string {
+	for {
+		previous := config.current.Load()
+		next := *previous
+		next.IPv6Address = ipv6Address
+		if config.current.CompareAndSwap(previous, &next) {
+			return previous.IPv6Address
+		}
+	}
+}
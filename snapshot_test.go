@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Changes the address while clients connect through the tunnel and /health and /status are served.
+// Meant to be run with -race, the tunnel keeps working because every address points to the backend.
+func TestSnapshotUnderLoad(t *testing.T) {
+	config, srcPort, name := startTestTunnel(t)
+	var err error
+	if config.history, err = loadAddressHistory(config.DataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Different spellings of the loopback address, so every update changes the snapshot
+	addresses := []string{"::1", "0::1", "0:0::1", "0:0:0::1"}
+	const updaters, updates, clients, connections = 4, 50, 4, 20
+
+	// /status must always show one of the addresses, never a torn or empty one
+	pollers := []struct {
+		handler http.Handler
+		check   func(body []byte) error
+	}{
+		{statusHandler(config), func(body []byte) error {
+			var status Status
+			if err := json.Unmarshal(body, &status); err != nil || !slices.Contains(addresses, status.IPv6Address) {
+				return fmt.Errorf("/status returned %q: %v", status.IPv6Address, err)
+			}
+			return nil
+		}},
+		{healthCheckHandler(config), nil},
+		{readinessHandler(config), nil},
+		{historyHandler(config), nil},
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, updaters+clients+len(pollers))
+
+	for i := range updaters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range updates {
+				if err := config.setIPv6Address(AddressUpdate{IPv6Address: addresses[(i+j)%len(addresses)], Source: fmt.Sprintf("updater %d", i)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range connections {
+				conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", srcPort), 5*time.Second)
+				if err != nil {
+					errs <- err
+					return
+				}
+				message := fmt.Sprintf("message %d", j)
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, len(message))
+				_, err = conn.Write([]byte(message))
+				if err == nil {
+					_, err = io.ReadFull(conn, buf)
+				}
+				conn.Close()
+				if err != nil || string(buf) != message {
+					errs <- fmt.Errorf("connection %d: got %q back: %v", j, buf, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// The health checks and the handlers run until the updates and connections are done
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				config.health.check()
+			}
+		}
+	}()
+	for _, poller := range pollers {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				recorder := httptest.NewRecorder()
+				poller.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+				if poller.check != nil {
+					if err := poller.check(recorder.Body.Bytes()); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	background.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	waitForStats(t, config.tunnels, name, 0, clients*connections)
+	if !slices.Contains(addresses, config.ipv6Address()) {
+		t.Errorf("the address ended up as %q", config.ipv6Address())
+	}
+}
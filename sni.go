@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLS records are at most 16 KiB plus the 5 byte header
+const maxTLSRecordSize = 5 + 16384
+
+// How long a client may take to send its ClientHello
+const clientHelloTimeout = 10 * time.Second
+
+// sniRoute maps a server name pattern to a target. Patterns may start with *. to match any subdomain.
+type sniRoute struct {
+	Pattern string
+	Target  string
+}
+
+// clientHelloInfo holds the fields of the ClientHello used for routing and statistics
+type clientHelloInfo struct {
+	ServerName string
+	ALPN       []string
+	// Highest version offered by the client
+	MaxVersion uint16
+}
+
+// serverHelloInfo holds the fields of the ServerHello used for statistics
+type serverHelloInfo struct {
+	Version uint16
+	// Only visible for TLS 1.2 and older, TLS 1.3 encrypts the ALPN answer
+	ALPN string
+}
+
+// Parses comma separated routes like app.example.com=[2001:db8::2]:443,*.example.org=home.example.net:8443
+func parseSNIRoutes(routes string) ([]sniRoute, error) {
+	var parsed []sniRoute
+	for _, route := range strings.Split(routes, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		pattern, target, found := strings.Cut(route, "=")
+		if !found {
+			return nil, fmt.Errorf("route '%s' is missing the '=' between server name and target", route)
+		}
+		if err := validateSNITarget(target); err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, sniRoute{Pattern: strings.ToLower(strings.TrimSpace(pattern)), Target: strings.TrimSpace(target)})
+	}
+
+	return parsed, nil
+}
+
+func validateSNITarget(target string) error {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(target))
+	if err != nil {
+		return fmt.Errorf("invalid target '%s': %v", target, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid target '%s': missing host", target)
+	}
+	_, err = parsePort(port)
+	return err
+}
+
+// Returns the target of the first route matching the server name. Exact matches win over wildcards.
+func matchSNIRoute(routes []sniRoute, serverName string) (string, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	for _, route := range routes {
+		if route.Pattern == serverName {
+			return route.Target, true
+		}
+	}
+	for _, route := range routes {
+		if suffix, ok := strings.CutPrefix(route.Pattern, "*"); ok && strings.HasSuffix(serverName, suffix) {
+			return route.Target, true
+		}
+	}
+	return "", false
+}
+
+// Reads the first TLS record of the connection and parses the ClientHello in it.
+// The raw bytes are returned so they can be replayed to the target.
+func readClientHello(conn net.Conn) ([]byte, *clientHelloInfo, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return header, nil, err
+	}
+	if header[0] != 22 { // Handshake record
+		return header, nil, errors.New("not a TLS handshake")
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if 5+length > maxTLSRecordSize {
+		return header, nil, errors.New("TLS record too large")
+	}
+
+	raw := make([]byte, 5+length)
+	copy(raw, header)
+	if _, err := io.ReadFull(conn, raw[5:]); err != nil {
+		return raw, nil, err
+	}
+
+	info, err := parseClientHello(raw[5:])
+	return raw, info, err
+}
+
+// Parses a ClientHello handshake message as described in RFC 8446 section 4.1.2
+func parseClientHello(msg []byte) (*clientHelloInfo, error) {
+	errMalformed := errors.New("malformed ClientHello")
+
+	if len(msg) < 4 || msg[0] != 1 { // ClientHello
+		return nil, errors.New("not a ClientHello")
+	}
+	msg = msg[4:]
+
+	// Skip the legacy version and random
+	if len(msg) < 34 {
+		return nil, errMalformed
+	}
+	info := &clientHelloInfo{MaxVersion: binary.BigEndian.Uint16(msg[0:2])}
+	msg = msg[34:]
+
+	// Skip the session id, cipher suites and compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		if len(msg) < lengthSize {
+			return nil, errMalformed
+		}
+		length := int(msg[0])
+		if lengthSize == 2 {
+			length = int(binary.BigEndian.Uint16(msg))
+		}
+		if len(msg) < lengthSize+length {
+			return nil, errMalformed
+		}
+		msg = msg[lengthSize+length:]
+	}
+
+	if len(msg) < 2 {
+		// No extensions at all
+		return info, nil
+	}
+	extensions := msg[2:]
+	if len(extensions) < int(binary.BigEndian.Uint16(msg)) {
+		return nil, errMalformed
+	}
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[0:2])
+		extLength := int(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+extLength {
+			return nil, errMalformed
+		}
+		data := extensions[4 : 4+extLength]
+		extensions = extensions[4+extLength:]
+
+		switch extType {
+		case 0: // server_name
+			// The list contains entries of type (1 byte), length (2 bytes) and name
+			if len(data) < 2 {
+				return nil, errMalformed
+			}
+			data = data[2:]
+			for len(data) >= 3 {
+				nameLength := int(binary.BigEndian.Uint16(data[1:3]))
+				if len(data) < 3+nameLength {
+					return nil, errMalformed
+				}
+				if data[0] == 0 { // host_name
+					info.ServerName = string(data[3 : 3+nameLength])
+					break
+				}
+				data = data[3+nameLength:]
+			}
+		case 16: // application_layer_protocol_negotiation
+			if len(data) < 2 {
+				return nil, errMalformed
+			}
+			info.ALPN = parseALPNList(data[2:])
+		case 43: // supported_versions
+			if len(data) < 1 {
+				return nil, errMalformed
+			}
+			versions := data[1:]
+			for len(versions) >= 2 {
+				version := binary.BigEndian.Uint16(versions)
+				// Ignore GREASE values (RFC 8701) which look like 0x?a?a
+				if version&0x0f0f != 0x0a0a && version > info.MaxVersion {
+					info.MaxVersion = version
+				}
+				versions = versions[2:]
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// Parses a list of protocol names, each prefixed with a 1 byte length
+func parseALPNList(data []byte) []string {
+	var protocols []string
+	for len(data) >= 1 {
+		length := int(data[0])
+		if len(data) < 1+length {
+			break
+		}
+		protocols = append(protocols, string(data[1:1+length]))
+		data = data[1+length:]
+	}
+	return protocols
+}
+
+// Parses a ServerHello handshake message as described in RFC 8446 section 4.1.3
+func parseServerHello(msg []byte) (*serverHelloInfo, error) {
+	errMalformed := errors.New("malformed ServerHello")
+
+	if len(msg) < 4 || msg[0] != 2 { // ServerHello
+		return nil, errors.New("not a ServerHello")
+	}
+	msg = msg[4:]
+
+	if len(msg) < 35 {
+		return nil, errMalformed
+	}
+	info := &serverHelloInfo{Version: binary.BigEndian.Uint16(msg[0:2])}
+
+	// Skip the legacy version, random, session id, cipher suite and compression method
+	sessionIDLength := int(msg[34])
+	if len(msg) < 35+sessionIDLength+3 {
+		return nil, errMalformed
+	}
+	msg = msg[35+sessionIDLength+3:]
+
+	if len(msg) < 2 {
+		return info, nil
+	}
+	extensions := msg[2:]
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[0:2])
+		extLength := int(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+extLength {
+			return nil, errMalformed
+		}
+		data := extensions[4 : 4+extLength]
+		extensions = extensions[4+extLength:]
+
+		switch extType {
+		case 16: // application_layer_protocol_negotiation
+			if len(data) >= 2 {
+				if protocols := parseALPNList(data[2:]); len(protocols) > 0 {
+					info.ALPN = protocols[0]
+				}
+			}
+		case 43: // supported_versions, contains the selected version
+			if len(data) >= 2 {
+				info.Version = binary.BigEndian.Uint16(data)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// Accepts TLS connections, routes them by their server name and splices them to the target without terminating TLS
+func runSNIListener(config *Config, listener net.Listener) {
+	name := "sni:" + config.SNIListenPort
+	logger := config.logger().With(slog.String("tunnel", name))
+
+	defer listener.Close()
+	logger.Info("Listening for TLS connections with SNI routing", slog.String("addr", listener.Addr().String()), slog.Int("routes", len(config.SNIRoutes)))
+
+	for {
+		srcConn, err := listener.Accept()
+		if err != nil {
+			logger.Error("Error accepting connection", slog.Any("error", err))
+			continue
+		}
+
+		go handleSNIConn(config, name, logger.With(slog.String("client", srcConn.RemoteAddr().String())), srcConn)
+	}
+}
+
+func handleSNIConn(config *Config, name string, logger *slog.Logger, srcConn net.Conn) {
+	srcConn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	raw, info, err := readClientHello(srcConn)
+	srcConn.SetReadDeadline(time.Time{})
+
+	config.protocolStats.recordConnection(name)
+
+	serverName := ""
+	if err != nil {
+		logger.Debug("Failed to parse ClientHello", slog.Any("error", err))
+	} else {
+		serverName = info.ServerName
+		config.protocolStats.recordClientHello(name, info)
+	}
+
+	target, ok := matchSNIRoute(config.SNIRoutes, serverName)
+	if !ok {
+		target = config.SNIDefaultTarget
+	}
+	if target == "" {
+		logger.Warn("No SNI route matches the server name", slog.String("server_name", serverName))
+		srcConn.Close()
+		return
+	}
+	logger = logger.With(slog.String("server_name", serverName), slog.String("target", target))
+
+	host, port, _ := net.SplitHostPort(target)
+	addr, err := config.resolveHost(context.Background(), host)
+	if err != nil {
+		logger.Error("Error resolving the SNI target", slog.Any("error", err))
+		srcConn.Close()
+		return
+	}
+
+	destConn, err := config.dialer().Dial("tcp6", net.JoinHostPort(addr.String(), port))
+	if err != nil {
+		logger.Error("Error dialing the SNI target", slog.Any("error", err))
+		srcConn.Close()
+		return
+	}
+
+	// Replay the ClientHello that was already consumed from the client
+	if _, err := destConn.Write(raw); err != nil {
+		logger.Error("Error forwarding the ClientHello", slog.Any("error", err))
+		srcConn.Close()
+		destConn.Close()
+		return
+	}
+
+	logger.Debug("Forwarding connection")
+	start := time.Now()
+	config.forward("", srcConn, config.protocolStats.sniffServer(name, destConn))
+	logger.Info("Connection closed", slog.Duration("duration", time.Since(start)))
+}
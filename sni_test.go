@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Prefixes the data with its length in size bytes
+func withLength(size int, data []byte) []byte {
+	prefix := make([]byte, size)
+	if size == 1 {
+		prefix[0] = byte(len(data))
+	} else {
+		binary.BigEndian.PutUint16(prefix, uint16(len(data)))
+	}
+	return append(prefix, data...)
+}
+
+// Builds a TLS extension of the given type
+func tlsExtension(extType uint16, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, extType), withLength(2, data)...)
+}
+
+// Builds a ClientHello handshake message with the given extensions
+func buildClientHello(extensions ...[]byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, tls.VersionTLS12)
+	body = append(body, make([]byte, 32)...)                  // Random
+	body = append(body, withLength(1, []byte{1, 2, 3})...)    // Session id
+	body = append(body, withLength(2, []byte{0x13, 0x01})...) // Cipher suites
+	body = append(body, withLength(1, []byte{0})...)          // Compression methods
+	body = append(body, withLength(2, bytes.Join(extensions, nil))...)
+	return append([]byte{1, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// Builds a server_name extension with a host_name entry per name
+func serverNameExtension(names ...string) []byte {
+	var list []byte
+	for _, name := range names {
+		list = append(list, 0)
+		list = append(list, withLength(2, []byte(name))...)
+	}
+	return tlsExtension(0, withLength(2, list))
+}
+
+// Builds an ALPN extension
+func alpnExtension(protocols ...string) []byte {
+	var list []byte
+	for _, protocol := range protocols {
+		list = append(list, withLength(1, []byte(protocol))...)
+	}
+	return tlsExtension(16, withLength(2, list))
+}
+
+// Builds a ServerHello handshake message with the given extensions
+func buildServerHello(extensions ...[]byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, tls.VersionTLS12)
+	body = append(body, make([]byte, 32)...)               // Random
+	body = append(body, withLength(1, []byte{1, 2, 3})...) // Session id
+	body = append(body, 0x13, 0x01, 0)                     // Cipher suite and compression method
+	body = append(body, withLength(2, bytes.Join(extensions, nil))...)
+	return append([]byte{2, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// Returns the first TLS record crypto/tls sends as a client
+func captureClientHello(t testing.TB, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	raw, _, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestReadClientHello(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{ServerName: "App.Example.com", NextProtos: []string{"h2", "http/1.1"}})
+	tooLarge := slices.Clone(raw[:5])
+	binary.BigEndian.PutUint16(tooLarge[3:], maxTLSRecordSize)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "crypto/tls"},
+		{name: "truncated header", data: raw[:3], wantErr: "EOF"},
+		{name: "truncated record", data: raw[:len(raw)-1], wantErr: "EOF"},
+		{name: "not a handshake", data: append([]byte{23}, raw[1:]...), wantErr: "not a TLS handshake"},
+		{name: "record too large", data: tooLarge, wantErr: "too large"},
+	}
+	for _, test := range tests {
+		data := test.data
+		if data == nil {
+			data = raw
+		}
+		client, server := net.Pipe()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		replay, info, err := readClientHello(server)
+		server.Close()
+
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: err = %v, want it to mention %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// The server name is routed as sent, matchSNIRoute folds the case
+		if info.ServerName != "App.Example.com" || !slices.Equal(info.ALPN, []string{"h2", "http/1.1"}) || info.MaxVersion != tls.VersionTLS13 {
+			t.Errorf("%s: info = %+v", test.name, info)
+		}
+		if !bytes.Equal(replay, raw) {
+			t.Errorf("%s: the replayed bytes differ from the ClientHello", test.name)
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	full := buildClientHello(serverNameExtension("app.example.com"), alpnExtension("h2"), tlsExtension(43, withLength(1, []byte{0x0a, 0x0a, 0x03, 0x04, 0x03, 0x03})))
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    clientHelloInfo
+		wantErr string
+	}{
+		{name: "complete", msg: full, want: clientHelloInfo{ServerName: "app.example.com", ALPN: []string{"h2"}, MaxVersion: tls.VersionTLS13}},
+		{name: "no extensions", msg: buildClientHello()[:len(buildClientHello())-2], want: clientHelloInfo{MaxVersion: tls.VersionTLS12}},
+		{name: "no server name", msg: buildClientHello(alpnExtension("h2")), want: clientHelloInfo{ALPN: []string{"h2"}, MaxVersion: tls.VersionTLS12}},
+		{name: "empty server name list", msg: buildClientHello(tlsExtension(0, withLength(2, nil))), want: clientHelloInfo{MaxVersion: tls.VersionTLS12}},
+		{name: "other name type", msg: buildClientHello(tlsExtension(0, withLength(2, append([]byte{1}, withLength(2, []byte("x"))...)))), want: clientHelloInfo{MaxVersion: tls.VersionTLS12}},
+		{name: "first host name wins", msg: buildClientHello(serverNameExtension("a.example.com", "b.example.com")), want: clientHelloInfo{ServerName: "a.example.com", MaxVersion: tls.VersionTLS12}},
+		{name: "GREASE only", msg: buildClientHello(tlsExtension(43, withLength(1, []byte{0xfa, 0xfa}))), want: clientHelloInfo{MaxVersion: tls.VersionTLS12}},
+		{name: "empty", wantErr: "not a ClientHello"},
+		{name: "ServerHello", msg: buildServerHello(), wantErr: "not a ClientHello"},
+		{name: "truncated random", msg: full[:20], wantErr: "malformed"},
+		{name: "truncated session id", msg: full[:4+34+2], wantErr: "malformed"},
+		{name: "truncated extensions", msg: full[:len(full)-1], wantErr: "malformed"},
+		{name: "truncated server name", msg: buildClientHello(tlsExtension(0, withLength(2, append([]byte{0}, withLength(2, []byte("app.example.com"))[:8]...)))), wantErr: "malformed"},
+		{name: "server name without list", msg: buildClientHello(tlsExtension(0, []byte{0})), wantErr: "malformed"},
+		{name: "extension longer than the message", msg: buildClientHello(append(binary.BigEndian.AppendUint16(nil, 0), 0xff, 0xff)), wantErr: "malformed"},
+	}
+	for _, test := range tests {
+		info, err := parseClientHello(test.msg)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: err = %v, want it to mention %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if info.ServerName != test.want.ServerName || !slices.Equal(info.ALPN, test.want.ALPN) || info.MaxVersion != test.want.MaxVersion {
+			t.Errorf("%s: info = %+v, want %+v", test.name, *info, test.want)
+		}
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	full := buildServerHello(alpnExtension("h2"), tlsExtension(43, []byte{0x03, 0x04}))
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    serverHelloInfo
+		wantErr string
+	}{
+		{name: "TLS 1.3", msg: full, want: serverHelloInfo{Version: tls.VersionTLS13, ALPN: "h2"}},
+		{name: "TLS 1.2", msg: buildServerHello(alpnExtension("http/1.1")), want: serverHelloInfo{Version: tls.VersionTLS12, ALPN: "http/1.1"}},
+		{name: "no extensions", msg: buildServerHello()[:len(buildServerHello())-2], want: serverHelloInfo{Version: tls.VersionTLS12}},
+		{name: "empty ALPN", msg: buildServerHello(tlsExtension(16, nil)), want: serverHelloInfo{Version: tls.VersionTLS12}},
+		{name: "ClientHello", msg: buildClientHello(), wantErr: "not a ServerHello"},
+		{name: "truncated random", msg: full[:30], wantErr: "malformed"},
+		{name: "truncated session id", msg: full[:4+35+1], wantErr: "malformed"},
+		{name: "truncated extensions", msg: full[:len(full)-1], wantErr: "malformed"},
+	}
+	for _, test := range tests {
+		info, err := parseServerHello(test.msg)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: err = %v, want it to mention %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if *info != test.want {
+			t.Errorf("%s: info = %+v, want %+v", test.name, *info, test.want)
+		}
+	}
+}
+
+func TestMatchSNIRoute(t *testing.T) {
+	routes, err := parseSNIRoutes("*.example.com=[2001:db8::1]:443, App.example.com=[2001:db8::2]:443,*.deep.example.com=[2001:db8::3]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName, want string
+	}{
+		// Exact matches win even if a wildcard comes first
+		{"app.example.com", "[2001:db8::2]:443"},
+		{"APP.example.com.", "[2001:db8::2]:443"},
+		{"cloud.example.com", "[2001:db8::1]:443"},
+		// Wildcards match any depth, the first one in the list wins
+		{"a.deep.example.com", "[2001:db8::1]:443"},
+		{"example.com", ""},
+		{"badexample.com", ""},
+		{"example.org", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, ok := matchSNIRoute(routes, test.serverName)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("matchSNIRoute(%q) = %q, %v, want %q", test.serverName, got, ok, test.want)
+		}
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	f.Add(captureClientHello(f, &tls.Config{ServerName: "app.example.com", NextProtos: []string{"h2"}})[5:])
+	f.Add(buildClientHello(serverNameExtension("a.example.com", "b.example.com"), alpnExtension("h2", "http/1.1"), tlsExtension(43, withLength(1, []byte{0x03, 0x04}))))
+	f.Add(buildClientHello())
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		info, err := parseClientHello(msg)
+		if err != nil {
+			return
+		}
+		// Everything that is parsed comes from the message
+		if len(info.ServerName) > len(msg) || !bytes.Contains(msg, []byte(info.ServerName)) {
+			t.Errorf("server name %q isn't part of the message", info.ServerName)
+		}
+		for _, protocol := range info.ALPN {
+			if !bytes.Contains(msg, []byte(protocol)) {
+				t.Errorf("protocol %q isn't part of the message", protocol)
+			}
+		}
+	})
+}
+
+func FuzzParseServerHello(f *testing.F) {
+	f.Add(buildServerHello(alpnExtension("h2"), tlsExtension(43, []byte{0x03, 0x04})))
+	f.Add(buildServerHello())
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		info, err := parseServerHello(msg)
+		if err != nil {
+			return
+		}
+		if !bytes.Contains(msg, []byte(info.ALPN)) {
+			t.Errorf("protocol %q isn't part of the message", info.ALPN)
+		}
+	})
+}
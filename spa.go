@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SPA packets that are older or newer than this are dropped, it also bounds how long nonces are remembered
+const spaMaxClockSkew = 30 * time.Second
+
+// Upper bound of authorized clients and remembered nonces, expired ones are dropped first
+const maxSPAEntries = 4096
+
+// Opens gated tunnels for the IP of a client that sent a valid single packet authorization (SPA)
+// to the UDP port. Other clients are reset right after accepting them. Nil if no tunnel is gated.
+type spaGate struct {
+	ports      []string
+	secret     []byte
+	ttl        time.Duration
+	listenAddr string
+	listenPort string
+
+	mu sync.Mutex
+	// Clients and when their authorization expires
+	allowed map[netip.Addr]time.Time
+	// Nonces of the valid packets within the clock skew, a captured packet can't be replayed
+	nonces map[string]time.Time
+}
+
+func newSPAGate(config *Config, ports, secret, listenAddr, listenPort, ttl string) (*spaGate, error) {
+	if strings.TrimSpace(ports) == "" {
+		return nil, nil
+	}
+
+	gate := &spaGate{
+		secret:     []byte(secret),
+		listenAddr: listenAddr,
+		listenPort: listenPort,
+		allowed:    make(map[netip.Addr]time.Time),
+		nonces:     make(map[string]time.Time),
+	}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if !slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		if strings.HasPrefix(config.tunnelListenAddr(port), "unix://") {
+			return nil, fmt.Errorf("tunnel %s listens on a unix socket, its clients have no IP to authorize", port)
+		}
+		gate.ports = append(gate.ports, port)
+	}
+
+	if secret == "" {
+		return nil, errors.New("SPA_SECRET must be set for gated tunnels")
+	}
+	if listenPort == "" {
+		return nil, errors.New("SPA_LISTEN_PORT must be set for gated tunnels")
+	}
+	if _, err := parsePort(listenPort); err != nil {
+		return nil, fmt.Errorf("SPA_LISTEN_PORT: %v", err)
+	}
+	var err error
+	if gate.ttl, err = time.ParseDuration(ttl); err != nil || gate.ttl <= 0 {
+		return nil, errors.New("SPA_TTL must be a positive duration")
+	}
+
+	return gate, nil
+}
+
+// Reports whether the tunnel is gated
+func (gate *spaGate) handles(ipv4Port string) bool {
+	return gate != nil && slices.Contains(gate.ports, ipv4Port)
+}
+
+// Reports whether a client may connect to the tunnel
+func (gate *spaGate) admits(ipv4Port, clientIP string) bool {
+	if !gate.handles(ipv4Port) {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return false
+	}
+
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	expires, ok := gate.allowed[addr.Unmap()]
+	return ok && time.Now().Before(expires)
+}
+
+// Receives SPA packets until the socket is closed
+func (gate *spaGate) run(logger *slog.Logger, conn net.PacketConn) error {
+	logger.Info("Listening for SPA packets", slog.String("addr", conn.LocalAddr().String()), slog.Any("ports", gate.ports))
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		client := udpAddr.AddrPort().Addr().Unmap()
+
+		// Invalid packets are only logged at debug level, the port is public
+		if err := gate.authorize(client, string(buf[:n]), time.Now()); err != nil {
+			logger.Debug("Dropping invalid SPA packet", slog.String("client", client.String()), slog.Any("error", err))
+			continue
+		}
+		logger.Info("Client authorized by SPA packet", slog.String("client", client.String()), slog.Duration("ttl", gate.ttl))
+	}
+}
+
+// Checks a packet like "<unix time> <nonce> <client ip> <hmac>" and authorizes the client that sent it.
+// The client IP is signed, so a captured packet can't be resent from another address before the original arrives.
+func (gate *spaGate) authorize(client netip.Addr, packet string, now time.Time) error {
+	fields := strings.Fields(packet)
+	if len(fields) != 4 {
+		return errors.New("malformed packet")
+	}
+	timestamp, nonce, signedIP, signature := fields[0], fields[1], fields[2], fields[3]
+
+	mac, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, spaSignature(gate.secret, timestamp, nonce, signedIP)) {
+		return errors.New("invalid signature")
+	}
+	if signed, err := netip.ParseAddr(signedIP); err != nil || signed.Unmap() != client {
+		return fmt.Errorf("packet is signed for %s but was sent from %s", signedIP, client)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-spaMaxClockSkew)) || sent.After(now.Add(spaMaxClockSkew)) {
+		return fmt.Errorf("timestamp %s is off by more than %s", sent.UTC().Format(time.RFC3339), spaMaxClockSkew)
+	}
+
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	for seen, at := range gate.nonces {
+		if now.Sub(at) > 2*spaMaxClockSkew {
+			delete(gate.nonces, seen)
+		}
+	}
+	if _, ok := gate.nonces[nonce]; ok {
+		return errors.New("replayed packet")
+	}
+	if len(gate.nonces) >= maxSPAEntries {
+		return errors.New("too many packets")
+	}
+	gate.nonces[nonce] = now
+
+	for addr, expires := range gate.allowed {
+		if now.After(expires) {
+			delete(gate.allowed, addr)
+		}
+	}
+	if _, ok := gate.allowed[client]; !ok && len(gate.allowed) >= maxSPAEntries {
+		return errors.New("too many authorized clients")
+	}
+	gate.allowed[client] = now.Add(gate.ttl)
+	return nil
+}
+
+func spaSignature(secret []byte, timestamp, nonce, clientIP string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + " " + nonce + " " + clientIP))
+	return mac.Sum(nil)
+}
+
+// Builds a fresh SPA packet for the client IP the relay will see
+func newSPAPacket(secret []byte, clientIP netip.Addr, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	encoded := hex.EncodeToString(nonce)
+	ip := clientIP.Unmap().String()
+	return fmt.Sprintf("%s %s %s %s", timestamp, encoded, ip, hex.EncodeToString(spaSignature(secret, timestamp, encoded, ip))), nil
+}
+
+// Handles the `knock <host:port> [client ip]` command, it opens the gated tunnels of a relay for this host.
+// The packet is signed for the address it's sent from unless another one is given, like the public address of a NAT.
+func runKnock(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: four2six knock <host:port> [client ip]")
+	}
+	secret := os.Getenv("SPA_SECRET")
+	if secret == "" {
+		return errors.New("SPA_SECRET must be set to knock")
+	}
+
+	conn, err := net.Dial("udp", args[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	clientIP := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	if len(args) == 2 {
+		if clientIP, err = netip.ParseAddr(args[1]); err != nil {
+			return fmt.Errorf("invalid client ip: %v", err)
+		}
+	} else if clientIP.IsPrivate() {
+		fmt.Fprintf(os.Stderr, "Signing for %s, pass the public address as second argument if the relay sees this host behind NAT\n", clientIP)
+	}
+
+	packet, err := newSPAPacket([]byte(secret), clientIP, time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(packet)); err != nil {
+		return err
+	}
+
+	// UDP has no reply, the packet is silently dropped if anything is wrong
+	fmt.Printf("SPA packet for %s sent to %s\n", clientIP.Unmap(), args[0])
+	return nil
+}
+
+// Closes a rejected connection with a reset instead of a FIN. The handshake already completed, so scanners still see an open port.
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
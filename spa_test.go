@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSPAGateAuthorize(t *testing.T) {
+	secret := []byte("secret")
+	client := netip.MustParseAddr("203.0.113.7")
+	now := time.Unix(1700000000, 0)
+
+	signed, err := newSPAPacket(secret, client, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := strings.Fields(signed)
+	forged[2] = "198.51.100.1"
+
+	tests := []struct {
+		name    string
+		from    netip.Addr
+		packet  string
+		wantErr string
+	}{
+		{name: "valid", from: client, packet: signed},
+		{name: "other sender", from: netip.MustParseAddr("198.51.100.1"), packet: signed, wantErr: "signed for 203.0.113.7"},
+		{name: "rewritten address", from: netip.MustParseAddr("198.51.100.1"), packet: strings.Join(forged, " "), wantErr: "invalid signature"},
+		{name: "old format", from: client, packet: strings.Join(append(strings.Fields(signed)[:2], strings.Fields(signed)[3]), " "), wantErr: "malformed"},
+		{name: "wrong secret", from: client, packet: mustSPAPacket(t, []byte("other"), client, now), wantErr: "invalid signature"},
+		{name: "too old", from: client, packet: mustSPAPacket(t, secret, client, now.Add(-time.Minute)), wantErr: "is off by"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gate := &spaGate{ports: []string{"22"}, secret: secret, ttl: time.Minute, allowed: make(map[netip.Addr]time.Time), nonces: make(map[string]time.Time)}
+			err := gate.authorize(test.from, test.packet, now)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("err = %v, want it to mention %q", err, test.wantErr)
+				}
+				if _, ok := gate.allowed[test.from]; ok {
+					t.Errorf("%s was authorized", test.from)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := gate.allowed[client]; !ok {
+				t.Errorf("%s was not authorized", client)
+			}
+			if err := gate.authorize(test.from, test.packet, now); err == nil || !strings.Contains(err.Error(), "replayed") {
+				t.Errorf("replay: err = %v", err)
+			}
+		})
+	}
+}
+
+func mustSPAPacket(t *testing.T, secret []byte, client netip.Addr, now time.Time) string {
+	t.Helper()
+	packet, err := newSPAPacket(secret, client, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
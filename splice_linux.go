@@ -0,0 +1,4 @@
+package main
+
+// TCP to TCP copies use splice(2) on Linux, the data never enters user space
+const spliceSupported = true
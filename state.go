@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds a single load or store of the state backend
+const stateTimeout = 10 * time.Second
+
+// How long to wait before watching again after the watch failed
+const stateWatchRetry = 5 * time.Second
+
+// How often the file backend looks for changes made by other instances
+const fileStatePollInterval = 5 * time.Second
+
+// Returned by State.Load if no address was stored yet
+var errStateEmpty = errors.New("no IPv6 address stored yet")
+
+// State persists the IPv6 address and shares it between instances
+type State interface {
+	// Returns the stored address or errStateEmpty
+	Load(ctx context.Context) (string, error)
+	Store(ctx context.Context, ipv6Address string) error
+	// Calls onChange with the stored address whenever it changed, until the context is done or the watch fails
+	Watch(ctx context.Context, onChange func(ipv6Address string)) error
+	// Returns the encoded active lease, empty if no instance wrote it yet
+	LoadLease(ctx context.Context) (string, error)
+	// Replaces the active lease if it's still the one that was loaded, reports whether it was replaced.
+	// Instances racing for the lease can't both win.
+	SwapLease(ctx context.Context, loaded, lease string) (bool, error)
+}
+
+// Creates the state backend selected by STATE_BACKEND
+func newState(backend, rawURL, key, token, filePath string) (State, error) {
+	if backend == "file" {
+		return &fileState{path: filePath, leasePath: filepath.Join(filepath.Dir(filePath), leaseFile)}, nil
+	}
+
+	if rawURL == "" {
+		return nil, fmt.Errorf("STATE_URL is required for the %s backend", backend)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STATE_URL: %v", err)
+	}
+
+	switch backend {
+	case "redis":
+		if u.Scheme != "redis" && u.Scheme != "rediss" {
+			return nil, fmt.Errorf("STATE_URL must start with redis:// or rediss:// for the redis backend")
+		}
+		return &redisState{url: u, key: key}, nil
+	case "etcd":
+		return newEtcdState(u, key, token)
+	case "consul":
+		return newConsulState(u, key, token)
+	default:
+		return nil, fmt.Errorf("unknown STATE_BACKEND '%s', expected one of: file, redis, etcd, consul", backend)
+	}
+}
+
+// Keeps the address in a text file in the data dir, and the active lease in a file next to it
+type fileState struct {
+	path      string
+	leasePath string
+
+	// Serializes the lease swaps of this process, files have no compare-and-swap across hosts
+	leaseMu sync.Mutex
+}
+
+func (state *fileState) Load(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errStateEmpty
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ipv6Address := strings.TrimSpace(string(data))
+	if ipv6Address == "" {
+		return "", errStateEmpty
+	}
+	return ipv6Address, nil
+}
+
+func (state *fileState) Store(ctx context.Context, ipv6Address string) error {
+	// Create the data dir if it's not existing to store the txt file
+	if err := os.MkdirAll(filepath.Dir(state.path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(state.path, []byte(ipv6Address), 0o644)
+}
+
+// Polls the file, it might be on a volume that other instances write to
+func (state *fileState) Watch(ctx context.Context, onChange func(ipv6Address string)) error {
+	ticker := time.NewTicker(fileStatePollInterval)
+	defer ticker.Stop()
+
+	last, _ := state.Load(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		current, err := state.Load(ctx)
+		if err != nil || current == last {
+			continue
+		}
+		last = current
+		onChange(current)
+	}
+}
+
+func (state *fileState) LoadLease(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(state.leasePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// Writes the lease with a rename, so other instances never see a partial file. Instances on other hosts
+// can still overwrite each other between the read and the rename, the lease notices that on its next check.
+func (state *fileState) SwapLease(ctx context.Context, loaded, lease string) (bool, error) {
+	state.leaseMu.Lock()
+	defer state.leaseMu.Unlock()
+
+	if current, err := state.LoadLease(ctx); err != nil || current != loaded {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.leasePath), os.ModePerm); err != nil {
+		return false, err
+	}
+	// Instances on other hosts may write their lease at the same time, every one gets its own temporary file
+	tmp, err := os.CreateTemp(filepath.Dir(state.leasePath), leaseFile+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	_, err = tmp.WriteString(lease)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), state.leasePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// Follows the addresses stored by other instances until the process is stopped
+func (config *Config) watchState() {
+	for {
+		err := config.state.Watch(context.Background(), config.applyIPv6Address)
+		config.logger().Warn("Watching the state backend failed, retrying", slog.Any("error", err), slog.Duration("retry_in", stateWatchRetry))
+		time.Sleep(stateWatchRetry)
+	}
+}
+
+// Takes over an address stored by another instance
+func (config *Config) applyIPv6Address(ipv6Address string) {
+	if previous := config.storeIPv6Address(ipv6Address); previous != ipv6Address {
+		config.logger().Info("IPv6 address updated by another instance", slog.String("ipv6_address", ipv6Address))
+		config.pins.retire(previous, ipv6Address)
+		config.notifications.record(Event{Type: EventAddressUpdated, IPv6Address: ipv6Address, Source: "state backend", Message: fmt.Sprintf("IPv6 address updated to %s by another instance", ipv6Address)})
+		config.health.recheck()
+	}
+}
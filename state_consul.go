@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// How long a blocking query of the Consul watch waits for a change
+const consulWatchWait = "5m"
+
+// Keeps the address in the Consul KV store and watches it with blocking queries
+type consulState struct {
+	endpoint string
+	// Key of the active lease
+	leaseEndpoint string
+	key           string
+	token         string
+	client        *http.Client
+}
+
+func newConsulState(u *url.URL, key, token string) (*consulState, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("STATE_URL must start with http:// or https:// for the consul backend")
+	}
+	endpoint := strings.TrimSuffix(u.String(), "/") + "/v1/kv/" + strings.TrimPrefix(key, "/")
+	return &consulState{
+		endpoint:      endpoint,
+		leaseEndpoint: endpoint + leaseKeySuffix,
+		key:           key,
+		token:         token,
+		client:        &http.Client{},
+	}, nil
+}
+
+func (state *consulState) request(ctx context.Context, endpoint, method, query string, body io.Reader) (*http.Response, error) {
+	target := endpoint
+	if query != "" {
+		target += "?" + query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if state.token != "" {
+		req.Header.Set("X-Consul-Token", state.token)
+	}
+	return state.client.Do(req)
+}
+
+// Reads the key, waiting for a change if an index is given. Returns the address and the index of the response.
+func (state *consulState) get(ctx context.Context, index uint64) (string, uint64, error) {
+	query := ""
+	if index > 0 {
+		query = url.Values{"index": {strconv.FormatUint(index, 10)}, "wait": {consulWatchWait}}.Encode()
+	}
+
+	resp, err := state.request(ctx, state.endpoint, http.MethodGet, query, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return "", newIndex, errStateEmpty
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", 0, fmt.Errorf("consul responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var entries []struct {
+		Value []byte `json:"Value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", 0, err
+	}
+	if len(entries) == 0 || len(entries[0].Value) == 0 {
+		return "", newIndex, errStateEmpty
+	}
+	return string(entries[0].Value), newIndex, nil
+}
+
+func (state *consulState) Load(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	ipv6Address, _, err := state.get(ctx, 0)
+	return ipv6Address, err
+}
+
+func (state *consulState) Store(ctx context.Context, ipv6Address string) error {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	resp, err := state.request(ctx, state.endpoint, http.MethodPut, "", strings.NewReader(ipv6Address))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("consul responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Runs blocking queries until the context is done, see https://developer.hashicorp.com/consul/api-docs/features/blocking
+func (state *consulState) Watch(ctx context.Context, onChange func(ipv6Address string)) error {
+	var index uint64
+	for {
+		ipv6Address, newIndex, err := state.get(ctx, index)
+		if err != nil && !errors.Is(err, errStateEmpty) {
+			return err
+		}
+		if newIndex != index && ipv6Address != "" {
+			onChange(ipv6Address)
+		}
+
+		// The index must only grow, start over if it went backwards
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = max(newIndex, 1)
+	}
+}
+
+// Reads the lease and the index it was last modified at, which is 0 if the key doesn't exist
+func (state *consulState) getLease(ctx context.Context) (string, uint64, error) {
+	resp, err := state.request(ctx, state.leaseEndpoint, http.MethodGet, "", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", 0, fmt.Errorf("consul responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var entries []struct {
+		Value       []byte `json:"Value"`
+		ModifyIndex uint64 `json:"ModifyIndex"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", 0, err
+	}
+	if len(entries) == 0 {
+		return "", 0, nil
+	}
+	return string(entries[0].Value), entries[0].ModifyIndex, nil
+}
+
+func (state *consulState) LoadLease(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	lease, _, err := state.getLease(ctx)
+	return lease, err
+}
+
+// Writes the lease with check-and-set on the index it was read at, cas=0 only creates a missing key
+func (state *consulState) SwapLease(ctx context.Context, loaded, lease string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	current, index, err := state.getLease(ctx)
+	if err != nil || current != loaded {
+		return false, err
+	}
+
+	resp, err := state.request(ctx, state.leaseEndpoint, http.MethodPut, "cas="+strconv.FormatUint(index, 10), strings.NewReader(lease))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("consul responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)) == "true", nil
+}
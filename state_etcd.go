@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Keeps the address in an etcd key using the JSON gateway of the v3 API
+type etcdState struct {
+	endpoint string
+	key      string
+	token    string
+	client   *http.Client
+}
+
+// Key-value pair of the v3 API, []byte fields are base64 encoded in JSON
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newEtcdState(u *url.URL, key, token string) (*etcdState, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("STATE_URL must start with http:// or https:// for the etcd backend")
+	}
+	return &etcdState{
+		endpoint: strings.TrimSuffix(u.String(), "/"),
+		key:      key,
+		token:    token,
+		client:   &http.Client{},
+	}, nil
+}
+
+// Posts a JSON request to the gateway and returns the response for the caller to read and close
+func (state *etcdState) post(ctx context.Context, path string, request any) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, state.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if state.token != "" {
+		req.Header.Set("Authorization", state.token)
+	}
+
+	resp, err := state.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func (state *etcdState) Load(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	resp, err := state.post(ctx, "/v3/kv/range", map[string]any{"key": []byte(state.key)})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Kvs) == 0 || len(result.Kvs[0].Value) == 0 {
+		return "", errStateEmpty
+	}
+	return string(result.Kvs[0].Value), nil
+}
+
+func (state *etcdState) Store(ctx context.Context, ipv6Address string) error {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	resp, err := state.post(ctx, "/v3/kv/put", etcdKeyValue{Key: []byte(state.key), Value: []byte(ipv6Address)})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Streams the watch events of the key. The key is read once after the watch was created,
+// so updates that happened while the watch was down aren't missed.
+func (state *etcdState) Watch(ctx context.Context, onChange func(ipv6Address string)) error {
+	resp, err := state.post(ctx, "/v3/watch", map[string]any{"create_request": map[string]any{"key": []byte(state.key)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Created bool `json:"created"`
+				Events  []struct {
+					Type string       `json:"type"`
+					Kv   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return fmt.Errorf("etcd watch failed: %s", message.Error.Message)
+		}
+
+		if message.Result.Created {
+			if ipv6Address, err := state.Load(ctx); err == nil {
+				onChange(ipv6Address)
+			}
+		}
+		for _, event := range message.Result.Events {
+			// Deleting the key keeps the current address
+			if event.Type != "DELETE" && len(event.Kv.Value) > 0 {
+				onChange(string(event.Kv.Value))
+			}
+		}
+	}
+}
+
+func (state *etcdState) LoadLease(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	resp, err := state.post(ctx, "/v3/kv/range", map[string]any{"key": []byte(state.key + leaseKeySuffix)})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Kvs) == 0 {
+		return "", nil
+	}
+	return string(result.Kvs[0].Value), nil
+}
+
+// Puts the lease in a transaction that compares the current value first, a missing key must not have been created
+func (state *etcdState) SwapLease(ctx context.Context, loaded, lease string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, stateTimeout)
+	defer cancel()
+
+	key := []byte(state.key + leaseKeySuffix)
+	compare := map[string]any{"key": key, "target": "VALUE", "result": "EQUAL", "value": []byte(loaded)}
+	if loaded == "" {
+		compare = map[string]any{"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": "0"}
+	}
+	resp, err := state.post(ctx, "/v3/kv/txn", map[string]any{
+		"compare": []any{compare},
+		"success": []any{map[string]any{"request_put": etcdKeyValue{Key: key, Value: []byte(lease)}}},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Succeeded, nil
+}
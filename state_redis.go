@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keeps the address in a Redis key and announces changes on a channel with the same name
+type redisState struct {
+	url *url.URL
+	key string
+}
+
+// A minimal RESP client, just enough for GET, SET, PUBLISH and SUBSCRIBE
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connects to the server of a redis:// or rediss:// URL and authenticates and selects the database if the URL says so
+func dialRedis(ctx context.Context, u *url.URL) (*redisConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: stateTimeout}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "rediss" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if username := u.User.Username(); username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		if _, err := c.do(ctx, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := c.do(ctx, "SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Sends a command and reads its reply
+func (c *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(stateTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) send(args ...string) error {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.conn, command.String())
+	return err
+}
+
+// Reads a reply. Bulk strings are returned as string (nil if missing), integers as int64 and arrays as []any.
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply from redis: %q", line)
+	}
+}
+
+func (state *redisState) Load(ctx context.Context) (string, error) {
+	c, err := dialRedis(ctx, state.url)
+	if err != nil {
+		return "", err
+	}
+	defer c.conn.Close()
+
+	reply, err := c.do(ctx, "GET", state.key)
+	if err != nil {
+		return "", err
+	}
+	ipv6Address, _ := reply.(string)
+	if ipv6Address == "" {
+		return "", errStateEmpty
+	}
+	return ipv6Address, nil
+}
+
+func (state *redisState) Store(ctx context.Context, ipv6Address string) error {
+	c, err := dialRedis(ctx, state.url)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	if _, err := c.do(ctx, "SET", state.key, ipv6Address); err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "PUBLISH", state.key, ipv6Address)
+	return err
+}
+
+// Subscribes to the channel. The key is read once after subscribing, so updates that
+// happened while the watch was down aren't missed.
+func (state *redisState) Watch(ctx context.Context, onChange func(ipv6Address string)) error {
+	c, err := dialRedis(ctx, state.url)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	if _, err := c.do(ctx, "SUBSCRIBE", state.key); err != nil {
+		return err
+	}
+	if ipv6Address, err := state.Load(ctx); err == nil {
+		onChange(ipv6Address)
+	}
+
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		message, ok := reply.([]any)
+		if !ok || len(message) != 3 || message[0] != "message" {
+			continue
+		}
+		if ipv6Address, ok := message[2].(string); ok && ipv6Address != "" {
+			onChange(ipv6Address)
+		}
+	}
+}
+
+// Replaces the lease only if it still has the loaded value, a missing key counts as empty
+const redisSwapLeaseScript = `if (redis.call('GET', KEYS[1]) or '') == ARGV[1] then redis.call('SET', KEYS[1], ARGV[2]) return 1 end return 0`
+
+func (state *redisState) LoadLease(ctx context.Context) (string, error) {
+	c, err := dialRedis(ctx, state.url)
+	if err != nil {
+		return "", err
+	}
+	defer c.conn.Close()
+
+	reply, err := c.do(ctx, "GET", state.key+leaseKeySuffix)
+	if err != nil {
+		return "", err
+	}
+	lease, _ := reply.(string)
+	return lease, nil
+}
+
+// Compares and sets the lease in a script, which Redis runs atomically
+func (state *redisState) SwapLease(ctx context.Context, loaded, lease string) (bool, error) {
+	c, err := dialRedis(ctx, state.url)
+	if err != nil {
+		return false, err
+	}
+	defer c.conn.Close()
+
+	reply, err := c.do(ctx, "EVAL", redisSwapLeaseScript, "1", state.key+leaseKeySuffix, loaded, lease)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
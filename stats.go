@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Limits the number of distinct values per statistic so scanners can't grow them forever
+const maxDistinctProtocolValues = 256
+
+// Name used for values that exceed maxDistinctProtocolValues
+const otherProtocolValue = "other"
+
+// TunnelProtocolStats aggregates what clients negotiate through a tunnel
+type TunnelProtocolStats struct {
+	Connections    uint64            `json:"connections"`
+	TLSConnections uint64            `json:"tls_connections"`
+	TLSVersions    map[string]uint64 `json:"tls_versions"`
+	ServerNames    map[string]uint64 `json:"server_names"`
+	ALPN           map[string]uint64 `json:"alpn"`
+}
+
+// Collects protocol statistics of all tunnels
+type protocolStats struct {
+	mu      sync.Mutex
+	tunnels map[string]*TunnelProtocolStats
+}
+
+func newProtocolStats() *protocolStats {
+	return &protocolStats{tunnels: make(map[string]*TunnelProtocolStats)}
+}
+
+// Returns the stats of the tunnel, must be called with the lock held
+func (stats *protocolStats) tunnel(name string) *TunnelProtocolStats {
+	tunnel, ok := stats.tunnels[name]
+	if !ok {
+		tunnel = &TunnelProtocolStats{
+			TLSVersions: make(map[string]uint64),
+			ServerNames: make(map[string]uint64),
+			ALPN:        make(map[string]uint64),
+		}
+		stats.tunnels[name] = tunnel
+	}
+	return tunnel
+}
+
+func incrementBounded(values map[string]uint64, value string) {
+	if _, ok := values[value]; !ok && len(values) >= maxDistinctProtocolValues {
+		value = otherProtocolValue
+	}
+	values[value]++
+}
+
+func (stats *protocolStats) recordConnection(tunnel string) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	stats.tunnel(tunnel).Connections++
+	stats.mu.Unlock()
+}
+
+func (stats *protocolStats) recordClientHello(tunnel string, info *clientHelloInfo) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	t := stats.tunnel(tunnel)
+	t.TLSConnections++
+	if info.ServerName != "" {
+		incrementBounded(t.ServerNames, info.ServerName)
+	}
+	for _, protocol := range info.ALPN {
+		incrementBounded(t.ALPN, protocol)
+	}
+}
+
+func (stats *protocolStats) recordServerHello(tunnel string, info *serverHelloInfo) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	incrementBounded(stats.tunnel(tunnel).TLSVersions, tls.VersionName(info.Version))
+}
+
+// Returns a deep copy of the stats
+func (stats *protocolStats) snapshot() map[string]TunnelProtocolStats {
+	result := make(map[string]TunnelProtocolStats)
+	if stats == nil {
+		return result
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	for name, tunnel := range stats.tunnels {
+		copied := *tunnel
+		copied.TLSVersions = copyCounts(tunnel.TLSVersions)
+		copied.ServerNames = copyCounts(tunnel.ServerNames)
+		copied.ALPN = copyCounts(tunnel.ALPN)
+		result[name] = copied
+	}
+	return result
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Passively looks at the first TLS record that passes through a connection without delaying it
+type sniffConn struct {
+	net.Conn
+	buf      []byte
+	done     bool
+	onRecord func(record []byte)
+}
+
+func newSniffConn(conn net.Conn, onRecord func(record []byte)) *sniffConn {
+	return &sniffConn{Conn: conn, onRecord: onRecord}
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		c.inspect()
+	}
+	return n, err
+}
+
+// Returns the wrapped connection
+func (c *sniffConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Calls onRecord once the first record is complete, gives up if it's not TLS
+func (c *sniffConn) inspect() {
+	if c.buf[0] != 22 { // Handshake record
+		c.finish()
+		return
+	}
+	if len(c.buf) < 5 {
+		return
+	}
+
+	length := 5 + int(binary.BigEndian.Uint16(c.buf[3:5]))
+	if length > maxTLSRecordSize {
+		c.finish()
+		return
+	}
+	if len(c.buf) >= length {
+		c.onRecord(c.buf[5:length])
+		c.finish()
+	}
+}
+
+func (c *sniffConn) finish() {
+	c.done = true
+	c.buf = nil
+}
+
+// Wraps both sides of a tunnel connection to record the TLS handshake details
+func (stats *protocolStats) sniff(tunnel string, src, dst net.Conn) (net.Conn, net.Conn) {
+	if stats == nil {
+		return src, dst
+	}
+
+	src = newSniffConn(src, func(record []byte) {
+		if info, err := parseClientHello(record); err == nil {
+			stats.recordClientHello(tunnel, info)
+		}
+	})
+	return src, stats.sniffServer(tunnel, dst)
+}
+
+// Wraps the server side only, used when the ClientHello was already parsed
+func (stats *protocolStats) sniffServer(tunnel string, dst net.Conn) net.Conn {
+	if stats == nil {
+		return dst
+	}
+
+	return newSniffConn(dst, func(record []byte) {
+		if info, err := parseServerHello(record); err == nil {
+			stats.recordServerHello(tunnel, info)
+		}
+	})
+}
+
+// Provides the protocol statistics of all tunnels
+func statsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false) // Keep the -> in tunnel names readable
+		encoder.Encode(config.protocolStats.snapshot())
+	}
+}
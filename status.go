@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Heartbeats older than this many agent intervals mark the agent as dead
+const heartbeatGraceIntervals = 3
+
+// HeartbeatRecord is the last heartbeat received from the agent
+type HeartbeatRecord struct {
+	Heartbeat
+	ReceivedAt time.Time `json:"received_at"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// AgentStatus is the agent part of the /status response
+type AgentStatus struct {
+	Alive         bool             `json:"alive"`
+	LastHeartbeat *HeartbeatRecord `json:"last_heartbeat"`
+}
+
+// TunnelOverview is a tunnel in the /status response
+type TunnelOverview struct {
+	Name       string   `json:"name"`
+	IPv4Port   string   `json:"ipv4_port"`
+	IPv6Port   string   `json:"ipv6_port"`
+	ListenAddr string   `json:"listen_addr"`
+	Targets    []string `json:"targets"`
+	// Unset until the first healthcheck finished
+	Alive             *bool      `json:"alive"`
+	Since             *time.Time `json:"since,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+	ActiveConnections int64      `json:"active_connections"`
+	TotalConnections  uint64     `json:"total_connections"`
+	// Only set for tunnels with a rate limit
+	RateLimit  string            `json:"rate_limit,omitempty"`
+	Throughput *TunnelThroughput `json:"throughput,omitempty"`
+	// Only set for tunnels with a latency SLO
+	Latency *TunnelLatency `json:"latency,omitempty"`
+}
+
+// Status is the response of the /status endpoint
+type Status struct {
+	Version       string           `json:"version"`
+	Relay         string           `json:"relay,omitempty"`
+	StartedAt     time.Time        `json:"started_at"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	IPv6Address   string           `json:"ipv6_address"`
+	PublicIPv4    string           `json:"public_ipv4,omitempty"`
+	TargetHost    string           `json:"target_host,omitempty"`
+	Healthy       bool             `json:"healthy"`
+	Tunnels       []TunnelOverview `json:"tunnels"`
+	Agent         AgentStatus      `json:"agent"`
+	Clients       []ClientInfo     `json:"clients,omitempty"`
+	Lease         *LeaseStatus     `json:"lease,omitempty"`
+	ReadOnly      bool             `json:"read_only,omitempty"`
+	// Why the home network seems to be behind carrier-grade NAT, from the last update
+	CGNAT string `json:"cgnat,omitempty"`
+}
+
+// Keeps track of the last heartbeat of the agent
+type heartbeatTracker struct {
+	mu   sync.RWMutex
+	last *HeartbeatRecord
+}
+
+func (tracker *heartbeatTracker) record(record *HeartbeatRecord) {
+	tracker.mu.Lock()
+	tracker.last = record
+	tracker.mu.Unlock()
+}
+
+func (tracker *heartbeatTracker) status(now time.Time) AgentStatus {
+	tracker.mu.RLock()
+	defer tracker.mu.RUnlock()
+
+	if tracker.last == nil {
+		return AgentStatus{}
+	}
+
+	interval := time.Duration(tracker.last.IntervalSeconds) * time.Second
+	return AgentStatus{
+		Alive:         now.Sub(tracker.last.ReceivedAt) <= heartbeatGraceIntervals*interval,
+		LastHeartbeat: tracker.last,
+	}
+}
+
+// Receives heartbeats from the home-side agent
+func heartbeatHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFromContext(r.Context())
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var heartbeat Heartbeat
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateBodySize)).Decode(&heartbeat)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logger.Warn("Rejected an oversized heartbeat", slog.Int64("limit", tooLarge.Limit))
+			http.Error(w, "Invalid heartbeat payload: the body is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			logger.Warn("Failed to decode heartbeat", slog.Any("error", err))
+			http.Error(w, "Invalid heartbeat payload", http.StatusBadRequest)
+			return
+		}
+
+		config.heartbeats.record(&HeartbeatRecord{
+			Heartbeat:  heartbeat,
+			ReceivedAt: time.Now().UTC(),
+			RemoteAddr: r.RemoteAddr,
+		})
+		logger.Debug("Received heartbeat", slog.String("hostname", heartbeat.Hostname), slog.Int("addresses", len(heartbeat.Addresses)))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Provides the runtime status of the relay
+func statusHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, healthy := config.health.snapshot()
+
+		status := Status{
+			Version:       version,
+			Relay:         config.Relay,
+			StartedAt:     config.startedAt.UTC(),
+			UptimeSeconds: int64(time.Since(config.startedAt).Seconds()),
+			IPv6Address:   config.ipv6Address(),
+			PublicIPv4:    config.publicIPv4.address(),
+			TargetHost:    config.TargetHost,
+			Healthy:       healthy,
+			Agent:         config.heartbeats.status(time.Now().UTC()),
+			Clients:       config.reverseDNS.clients(),
+			Lease:         config.lease.status(),
+			ReadOnly:      config.ReadOnly,
+		}
+		if updates := config.history.list(); len(updates) > 0 {
+			status.CGNAT = updates[0].CGNAT
+		}
+
+		for i, ipv4Port := range config.IPv4Ports {
+			tunnel := TunnelOverview{
+				Name:       tunnelName(ipv4Port, config.IPv6Ports[i]),
+				IPv4Port:   ipv4Port,
+				IPv6Port:   config.IPv6Ports[i],
+				ListenAddr: config.tunnelListenAddr(ipv4Port),
+				Targets:    config.tunnelTargets(ipv4Port),
+			}
+			if health, ok := config.health.tunnelHealth(ipv4Port); ok {
+				tunnel.Alive = &health.IPv6Alive
+				tunnel.Since = &health.Since
+				tunnel.LastError = health.LastError
+			}
+			tunnel.ActiveConnections, tunnel.TotalConnections = config.tunnels.stats(tunnel.Name)
+			tunnel.RateLimit, tunnel.Throughput = config.tunnelThroughput(ipv4Port)
+			tunnel.Latency = config.latencySLOs[ipv4Port].status()
+			status.Tunnels = append(status.Tunnels, tunnel)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(config.maskStatus(status))
+	}
+}
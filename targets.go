@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Parses per tunnel targets like 443=2001:db8::1,2001:db8::2;80=home.example.com keyed by source port
+func parseTunnelTargets(value string, srcPorts []string) (map[string][]string, error) {
+	targets := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, list, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("entry '%s' is missing the '=' between source port and targets", entry)
+		}
+		port = strings.TrimSpace(port)
+
+		if !slices.Contains(srcPorts, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+
+		parsed, err := parseTargetList(list)
+		if err != nil {
+			return nil, err
+		}
+		if len(parsed) == 0 {
+			return nil, fmt.Errorf("source port %s has no targets", port)
+		}
+		targets[port] = parsed
+	}
+
+	return targets, nil
+}
+
+// Parses a comma separated list of IPv6 addresses and hostnames
+func parseTargetList(list string) ([]string, error) {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		target = strings.Trim(strings.TrimSpace(target), "[]")
+		if target == "" {
+			continue
+		}
+		if strings.ContainsAny(target, "/ ") {
+			return nil, fmt.Errorf("invalid target '%s'", target)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Returns the dynamic target, which is either the configured hostname or the stored IPv6 address
+func (config *Config) primaryTarget() string {
+	if config.TargetHost != "" {
+		return config.TargetHost
+	}
+
+	return config.ipv6Address()
+}
+
+// Returns the ordered targets of a tunnel. Tunnels without their own targets use the
+// dynamic target followed by the global failover targets.
+func (config *Config) tunnelTargets(ipv4Port string) []string {
+	if targets, ok := config.TunnelTargets[ipv4Port]; ok {
+		return targets
+	}
+	return append([]string{config.primaryTarget()}, config.FailoverTargets...)
+}
+
+// Returns a dialer with the configured timeout and keep-alive interval.
+// Each target gets its own timeout, so a dead target doesn't stall the failover.
+func (config *Config) dialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAliveInterval}
+	if config.KeepAliveInterval == 0 {
+		dialer.KeepAlive = -1 // Zero would use the default of Go
+	}
+	return dialer
+}
+
+// Dials the targets of a tunnel in order, preferring the ones that passed the last health check.
+// Returns the connection and the target that was used.
+func (config *Config) dialTargets(ctx context.Context, ipv4Port, ipv6Port string) (net.Conn, string, error) {
+	targets, err := config.dialableTargets(ipv4Port, ipv6Port)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dialer := config.tunnelDialer(ipv4Port)
+	var errs []error
+	for _, target := range targets {
+		if config.HappyEyeballs {
+			conn, err := config.dialHappyEyeballs(ctx, dialer, target, ipv6Port)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return conn, target, nil
+		}
+
+		addr, err := config.resolveHost(ctx, target)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp6", net.JoinHostPort(addr.String(), ipv6Port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return conn, target, nil
+	}
+
+	return nil, "", errors.Join(errs...)
+}
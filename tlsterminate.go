@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients of terminating tunnels must finish their TLS handshake within this time
+const tlsHandshakeTimeout = 10 * time.Second
+
+// PROXY protocol v2 TLVs that describe the TLS session of the client. The subject and the fingerprint
+// of the client certificate have no type in the spec and use the custom range, they are only sent for
+// certificates signed by TUNNEL_TLS_CLIENT_CA.
+const (
+	pp2TypeAuthority         = 0x02
+	pp2TypeSSL               = 0x20
+	pp2SubtypeSSLVersion     = 0x21
+	pp2SubtypeSSLCN          = 0x22
+	pp2SubtypeSSLCipher      = 0x23
+	pp2SubtypeSSLSigAlg      = 0x24
+	pp2SubtypeSSLKeyAlg      = 0x25
+	pp2TypeClientSubject     = 0xe0
+	pp2TypeClientFingerprint = 0xe1
+)
+
+// Flags of the client field in the PP2_TYPE_SSL TLV
+const (
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// Terminates TLS on the tunnels of TUNNEL_TLS_PORTS and forwards the plain text, so the backend can learn the
+// client certificate from the PROXY protocol header. Nil if no tunnel terminates TLS.
+type tlsTerminator struct {
+	ports     []string
+	tlsConfig *tls.Config
+}
+
+func newTLSTerminator(config *Config, ports, certFile, keyFile, clientCAFile string) (*tlsTerminator, error) {
+	if strings.TrimSpace(ports) == "" {
+		return nil, nil
+	}
+
+	terminator := &tlsTerminator{}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if !slices.Contains(config.IPv4Ports, port) {
+			return nil, fmt.Errorf("source port %s is not configured", port)
+		}
+		// The certificate of the client would be lost otherwise
+		if config.proxyProtocols[port] != proxyProtocolV2 {
+			return nil, fmt.Errorf("tunnel %s terminates TLS, it must send the client certificate with TUNNEL_PROXY_PROTOCOL=%s=v2", port, port)
+		}
+		terminator.ports = append(terminator.ports, port)
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TUNNEL_TLS_CERT and TUNNEL_TLS_KEY must be set for terminating tunnels")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// Without a CA the certificates are passed on unverified and the backend has to check them
+	terminator.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12, ClientAuth: tls.RequestClientCert}
+	if clientCAFile != "" {
+		if terminator.tlsConfig.ClientCAs, err = loadClientCAs("TUNNEL_TLS_CLIENT_CA", clientCAFile); err != nil {
+			return nil, err
+		}
+		terminator.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return terminator, nil
+}
+
+// Reports if the tunnel terminates TLS
+func (terminator *tlsTerminator) handles(port string) bool {
+	return terminator != nil && slices.Contains(terminator.ports, port)
+}
+
+// Finishes the TLS handshake of a client, the returned connection carries the plain text
+func (terminator *tlsTerminator) handshake(conn net.Conn) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, terminator.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Describes the TLS session and the client certificate as PROXY protocol v2 TLVs
+func tlsProxyTLVs(state tls.ConnectionState) []byte {
+	var tlvs []byte
+	if state.ServerName != "" {
+		tlvs = appendProxyTLV(tlvs, pp2TypeAuthority, []byte(state.ServerName))
+	}
+
+	// The client field, then the verify field which is 0 only for a verified certificate, then the sub-TLVs
+	client, verify := byte(pp2ClientSSL), uint32(1)
+	var subTLVs []byte
+	subTLVs = appendProxyTLV(subTLVs, pp2SubtypeSSLVersion, []byte(strings.Replace(tls.VersionName(state.Version), "TLS ", "TLSv", 1)))
+	subTLVs = appendProxyTLV(subTLVs, pp2SubtypeSSLCipher, []byte(tls.CipherSuiteName(state.CipherSuite)))
+
+	var verified *x509.Certificate
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		client |= pp2ClientCertSess
+		if !state.DidResume {
+			client |= pp2ClientCertConn
+		}
+		if len(state.VerifiedChains) > 0 {
+			verify, verified = 0, cert
+		}
+		if cert.Subject.CommonName != "" {
+			subTLVs = appendProxyTLV(subTLVs, pp2SubtypeSSLCN, []byte(cert.Subject.CommonName))
+		}
+		subTLVs = appendProxyTLV(subTLVs, pp2SubtypeSSLSigAlg, []byte(cert.SignatureAlgorithm.String()))
+		subTLVs = appendProxyTLV(subTLVs, pp2SubtypeSSLKeyAlg, []byte(publicKeyAlgorithm(cert)))
+	}
+
+	ssl := binary.BigEndian.AppendUint32([]byte{client}, verify)
+	tlvs = appendProxyTLV(tlvs, pp2TypeSSL, append(ssl, subTLVs...))
+	// Backends that only look at the custom TLVs must not trust an identity anybody can make up
+	if verified != nil {
+		fingerprint := sha256.Sum256(verified.Raw)
+		tlvs = appendProxyTLV(tlvs, pp2TypeClientSubject, []byte(verified.Subject.String()))
+		tlvs = appendProxyTLV(tlvs, pp2TypeClientFingerprint, []byte(hex.EncodeToString(fingerprint[:])))
+	}
+	return tlvs
+}
+
+// Names the key of a certificate with its size like HAProxy does, e.g. RSA2048 or EC256
+func publicKeyAlgorithm(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA" + strconv.Itoa(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "EC" + strconv.Itoa(key.Curve.Params().BitSize)
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Issues a certificate signed by the parent, or a self-signed CA without a parent
+func issueCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	} else {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Writes the certificate and its key as PEM files, returns their paths
+func writeCertificate(t *testing.T, cert tls.Certificate, name string) (string, string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(t.TempDir(), name+".pem"), filepath.Join(t.TempDir(), name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Splits PROXY protocol v2 TLVs into their values keyed by type
+func parseProxyTLVs(t *testing.T, tlvs []byte) map[byte][]byte {
+	t.Helper()
+	values := make(map[byte][]byte)
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 || len(tlvs) < 3+int(binary.BigEndian.Uint16(tlvs[1:])) {
+			t.Fatalf("truncated TLV %x", tlvs)
+		}
+		size := 3 + int(binary.BigEndian.Uint16(tlvs[1:]))
+		values[tlvs[0]] = tlvs[3:size]
+		tlvs = tlvs[size:]
+	}
+	return values
+}
+
+func TestTLSTerminationForwardsClientCertificate(t *testing.T) {
+	ca := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Test CA"}}, nil)
+	server := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "relay"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, &ca)
+	client := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "laptop", Organization: []string{"Example"}}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, &ca)
+	caFile, _ := writeCertificate(t, ca, "ca")
+	certFile, keyFile := writeCertificate(t, server, "relay")
+
+	srcPort, destPort := freePort(t), startEchoBackend(t)
+	config := newTestConfig(t, map[string]string{
+		"SRC_PORTS":             srcPort,
+		"DEST_PORTS":            destPort,
+		"TUNNEL_PROXY_PROTOCOL": srcPort + "=v2",
+		"TUNNEL_TLS_PORTS":      srcPort,
+		"TUNNEL_TLS_CERT":       certFile,
+		"TUNNEL_TLS_KEY":        keyFile,
+		"TUNNEL_TLS_CLIENT_CA":  caFile,
+	})
+	config.storeIPv6Address("::1")
+	config.tunnels.start()
+	t.Cleanup(config.tunnels.stop)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	conn, err := tls.Dial("tcp4", net.JoinHostPort("127.0.0.1", srcPort), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The echo backend sends the PROXY header back in plain text, followed by the message
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(conn, fixed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(fixed, proxyV2Signature) || fixed[13] != 0x11 {
+		t.Fatalf("header starts with %x", fixed)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:])+5)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Fatal(err)
+	}
+	if message := string(rest[len(rest)-5:]); message != "hello" {
+		t.Errorf("message = %q, want hello", message)
+	}
+
+	// 12 bytes of IPv4 addresses and ports come before the TLVs
+	tlvs := parseProxyTLVs(t, rest[12:len(rest)-5])
+	ssl := tlvs[pp2TypeSSL]
+	if len(ssl) < 5 || ssl[0] != pp2ClientSSL|pp2ClientCertConn|pp2ClientCertSess || binary.BigEndian.Uint32(ssl[1:5]) != 0 {
+		t.Fatalf("PP2_TYPE_SSL = %x, want a verified certificate of this connection", ssl)
+	}
+	sub := parseProxyTLVs(t, ssl[5:])
+	if string(sub[pp2SubtypeSSLCN]) != "laptop" || string(sub[pp2SubtypeSSLVersion]) != "TLSv1.3" || string(sub[pp2SubtypeSSLKeyAlg]) != "EC256" {
+		t.Errorf("common name %q, version %q, key %q", sub[pp2SubtypeSSLCN], sub[pp2SubtypeSSLVersion], sub[pp2SubtypeSSLKeyAlg])
+	}
+	if subject := string(tlvs[pp2TypeClientSubject]); subject != "CN=laptop,O=Example" {
+		t.Errorf("subject = %q", subject)
+	}
+	fingerprint := sha256.Sum256(client.Leaf.Raw)
+	if got := string(tlvs[pp2TypeClientFingerprint]); got != hex.EncodeToString(fingerprint[:]) {
+		t.Errorf("fingerprint = %q", got)
+	}
+
+	// Clients without a certificate signed by the CA don't get through
+	anonymous, err := tls.Dial("tcp4", net.JoinHostPort("127.0.0.1", srcPort), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err == nil {
+		defer anonymous.Close()
+		anonymous.SetDeadline(time.Now().Add(5 * time.Second))
+		anonymous.Write([]byte("hello"))
+		_, err = anonymous.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Error("a client without a certificate was forwarded")
+	}
+}
+
+func TestNewTLSTerminator(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "relay"}}, nil), "relay")
+	tests := []struct {
+		name, ports, certFile string
+		proxyProtocol         string
+		wantErr               string
+	}{
+		{name: "disabled", certFile: certFile},
+		{name: "enabled", ports: "443", certFile: certFile, proxyProtocol: proxyProtocolV2},
+		{name: "unknown port", ports: "80", certFile: certFile, proxyProtocol: proxyProtocolV2, wantErr: "not configured"},
+		{name: "no certificate", ports: "443", proxyProtocol: proxyProtocolV2, wantErr: "TUNNEL_TLS_CERT"},
+		{name: "no PROXY protocol", ports: "443", certFile: certFile, wantErr: "TUNNEL_PROXY_PROTOCOL=443=v2"},
+		{name: "PROXY protocol v1", ports: "443", certFile: certFile, proxyProtocol: proxyProtocolV1, wantErr: "TUNNEL_PROXY_PROTOCOL=443=v2"},
+	}
+	for _, test := range tests {
+		config := &Config{IPv4Ports: []string{"443"}, proxyProtocols: map[string]string{}}
+		if test.proxyProtocol != "" {
+			config.proxyProtocols["443"] = test.proxyProtocol
+		}
+		terminator, err := newTLSTerminator(config, test.ports, test.certFile, keyFile, "")
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: err = %v, want it to mention %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if terminator.handles("443") != (test.ports != "") {
+			t.Errorf("%s: handles(443) = %v", test.name, terminator.handles("443"))
+		}
+	}
+}
+
+func TestTLSProxyTLVsUnverified(t *testing.T) {
+	cert := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "anybody"}}, nil)
+	tlvs := parseProxyTLVs(t, tlsProxyTLVs(tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: []*x509.Certificate{cert.Leaf}}))
+
+	// The backend can still see the unverified certificate, but never as a trusted identity
+	if ssl := tlvs[pp2TypeSSL]; len(ssl) < 5 || binary.BigEndian.Uint32(ssl[1:5]) == 0 {
+		t.Errorf("PP2_TYPE_SSL = %x, want a nonzero verify field", ssl)
+	}
+	for _, kind := range []byte{pp2TypeClientSubject, pp2TypeClientFingerprint} {
+		if value, ok := tlvs[kind]; ok {
+			t.Errorf("TLV %#x = %q was sent for an unverified certificate", kind, value)
+		}
+	}
+}
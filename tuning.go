@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// TuningCheck is a host setting or counter inspected by /debug/tuning
+type TuningCheck struct {
+	Name string `json:"name"`
+	// ok, warning or unknown if it couldn't be read
+	Status      string `json:"status"`
+	Value       string `json:"value"`
+	Recommended string `json:"recommended,omitempty"`
+	// What to change, only set for warnings
+	Recommendation string `json:"recommendation,omitempty"`
+}
+
+// TuningReport is the response of the /debug/tuning endpoint
+type TuningReport struct {
+	Platform    string        `json:"platform"`
+	Checks      []TuningCheck `json:"checks"`
+	EvaluatedAt time.Time     `json:"evaluated_at"`
+}
+
+// Open connections a relay should be able to hold without touching its limits
+const tuningExpectedConnections = 2048
+
+// Values of the checks
+const (
+	tuningMinOpenFiles      = 2 * tuningExpectedConnections
+	tuningMinSomaxconn      = 4096
+	tuningMinTCPBuffer      = 4 << 20
+	tuningMinLocalPorts     = 10000
+	tuningMaxRetransmitRate = 0.01
+)
+
+func tuningOK(name, value string) TuningCheck {
+	return TuningCheck{Name: name, Status: "ok", Value: value}
+}
+
+func tuningWarning(name, value, recommended, recommendation string) TuningCheck {
+	return TuningCheck{Name: name, Status: "warning", Value: value, Recommended: recommended, Recommendation: recommendation}
+}
+
+func tuningUnknown(name string, err error) TuningCheck {
+	return TuningCheck{Name: name, Status: "unknown", Value: err.Error()}
+}
+
+// Inspects the limits and kernel settings of the host and recommends changes, so operators can tell
+// whether their VPS is sized for the traffic without knowing every sysctl
+func tuningHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := TuningReport{Platform: runtime.GOOS, Checks: tuningChecks(), EvaluatedAt: time.Now().UTC()}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Runs the checks against /proc and the limits of the process
+func tuningChecks() []TuningCheck {
+	netstat, netstatErr := readProcCounters("/proc/net/netstat")
+	snmp, snmpErr := readProcCounters("/proc/net/snmp")
+
+	return []TuningCheck{
+		checkOpenFiles(),
+		checkSomaxconn(),
+		checkListenOverflows(netstat, netstatErr),
+		checkTCPBuffer("tcp_rmem", "receive"),
+		checkTCPBuffer("tcp_wmem", "send"),
+		checkLocalPortRange(),
+		checkRetransmits(snmp, snmpErr),
+	}
+}
+
+// Every connection through the relay needs two file descriptors
+func checkOpenFiles() TuningCheck {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return tuningUnknown("open_files", err)
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return tuningUnknown("open_files", err)
+	}
+
+	value := fmt.Sprintf("%d of %d in use", len(fds), limit.Cur)
+	recommended := strconv.Itoa(tuningMinOpenFiles)
+	switch {
+	case limit.Cur < tuningMinOpenFiles:
+		return tuningWarning("open_files", value, recommended, fmt.Sprintf("The relay can hold about %d connections before new ones fail with 'too many open files'. Raise the limit with LimitNOFILE=65536 in the systemd unit or --ulimit nofile=65536 with Docker", limit.Cur/2))
+	case uint64(len(fds))*5 > limit.Cur*4:
+		return tuningWarning("open_files", value, strconv.FormatUint(limit.Cur*2, 10), "More than 80% of the file descriptors are in use, raise LimitNOFILE or --ulimit nofile before connections start failing")
+	}
+	return tuningOK("open_files", value)
+}
+
+// The accept queue of every listener is capped by somaxconn
+func checkSomaxconn() TuningCheck {
+	value, err := readSysctlInt("net.core.somaxconn")
+	if err != nil {
+		return tuningUnknown("somaxconn", err)
+	}
+	if value < tuningMinSomaxconn {
+		return tuningWarning("somaxconn", strconv.Itoa(value), strconv.Itoa(tuningMinSomaxconn), fmt.Sprintf("Bursts of new connections are dropped once %d are waiting to be accepted. Run sysctl -w net.core.somaxconn=%d and persist it in /etc/sysctl.d", value, tuningMinSomaxconn))
+	}
+	return tuningOK("somaxconn", strconv.Itoa(value))
+}
+
+func checkListenOverflows(netstat map[string]int64, err error) TuningCheck {
+	if err != nil {
+		return tuningUnknown("listen_overflows", err)
+	}
+	overflows, ok := netstat["TcpExt.ListenOverflows"]
+	if !ok {
+		return tuningUnknown("listen_overflows", fmt.Errorf("ListenOverflows is missing from /proc/net/netstat"))
+	}
+	value := fmt.Sprintf("%d since boot", overflows)
+	if overflows > 0 {
+		return tuningWarning("listen_overflows", value, "0", "Accept queues overflowed and connections were dropped, raise net.core.somaxconn and check whether the host is short on CPU. The counter covers every process since boot, compare it over time")
+	}
+	return tuningOK("listen_overflows", value)
+}
+
+// Autotuning can't grow the TCP buffers past the maximum, which caps the throughput of every
+// connection at buffer size / round-trip time
+func checkTCPBuffer(name, direction string) TuningCheck {
+	raw, err := readSysctl("net.ipv4." + name)
+	if err != nil {
+		return tuningUnknown(name, err)
+	}
+	fields := strings.Fields(raw)
+	if len(fields) != 3 {
+		return tuningUnknown(name, fmt.Errorf("unexpected value '%s'", raw))
+	}
+	maximum, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return tuningUnknown(name, err)
+	}
+
+	if maximum < tuningMinTCPBuffer {
+		// Throughput of a single connection over a path with 100ms round-trip time
+		mbits := maximum * 8 * 10 / 1e6
+		return tuningWarning(name, raw, fmt.Sprintf("%s %s %d", fields[0], fields[1], 16<<20), fmt.Sprintf("The %s buffer limits a single connection to about %d Mbit/s at 100ms round-trip time. Run sysctl -w net.ipv4.%s='%s %s %d'", direction, mbits, name, fields[0], fields[1], 16<<20))
+	}
+	return tuningOK(name, raw)
+}
+
+// Every backend connection takes a local port
+func checkLocalPortRange() TuningCheck {
+	raw, err := readSysctl("net.ipv4.ip_local_port_range")
+	if err != nil {
+		return tuningUnknown("local_port_range", err)
+	}
+	var low, high int
+	if _, err := fmt.Sscan(raw, &low, &high); err != nil {
+		return tuningUnknown("local_port_range", err)
+	}
+	if high-low+1 < tuningMinLocalPorts {
+		return tuningWarning("local_port_range", raw, "1024 65535", fmt.Sprintf("Only %d local ports are available for the backend connections per target. Run sysctl -w net.ipv4.ip_local_port_range='1024 65535'", high-low+1))
+	}
+	return tuningOK("local_port_range", raw)
+}
+
+func checkRetransmits(snmp map[string]int64, err error) TuningCheck {
+	if err != nil {
+		return tuningUnknown("retransmits", err)
+	}
+	out, retrans := snmp["Tcp.OutSegs"], snmp["Tcp.RetransSegs"]
+	if out == 0 {
+		return tuningOK("retransmits", "no segments sent yet")
+	}
+
+	rate := float64(retrans) / float64(out)
+	value := fmt.Sprintf("%.2f%% of %d segments since boot", rate*100, out)
+	if rate > tuningMaxRetransmitRate {
+		return tuningWarning("retransmits", value, fmt.Sprintf("below %.0f%%", tuningMaxRetransmitRate*100), "Many segments are sent again, the uplink of the VPS or of your home network is lossy or saturated. Limit bulk tunnels with TUNNEL_RATE_LIMITS and compare the counter over time")
+	}
+	return tuningOK("retransmits", value)
+}
+
+// Reads a sysctl like net.core.somaxconn
+func readSysctl(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+func readSysctlInt(name string) (int, error) {
+	value, err := readSysctl(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Reads files like /proc/net/snmp, where a line of names is followed by a line of values,
+// into counters like Tcp.RetransSegs
+func readProcCounters(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	counters := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		values := strings.Fields(scanner.Text())
+		if len(names) != len(values) || len(names) == 0 {
+			continue
+		}
+		prefix := strings.TrimSuffix(names[0], ":")
+		for i := 1; i < len(names); i++ {
+			if value, err := strconv.ParseInt(values[i], 10, 64); err == nil {
+				counters[prefix+"."+names[i]] = value
+			}
+		}
+	}
+	return counters, scanner.Err()
+}
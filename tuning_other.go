@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// The checks read /proc, other platforms only get an explanation
+func tuningChecks() []TuningCheck {
+	return []TuningCheck{tuningUnknown("platform", errors.New("tuning checks are only available on Linux"))}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Owns the listeners and open connections of the tunnels of a relay
+type tunnelManager struct {
+	config *Config
+
+	mu sync.Mutex
+	// Open listeners keyed by source port
+	listeners map[string]net.Listener
+	// Open client connections and connection counts keyed by tunnel name
+	conns   map[string]map[net.Conn]struct{}
+	counts  map[string]*connectionCount
+	stopped bool
+}
+
+type connectionCount struct {
+	active int64
+	total  uint64
+}
+
+func newTunnelManager(config *Config) *tunnelManager {
+	return &tunnelManager{
+		config:    config,
+		listeners: make(map[string]net.Listener),
+		conns:     make(map[string]map[net.Conn]struct{}),
+		counts:    make(map[string]*connectionCount),
+	}
+}
+
+// Opens the listeners of all tunnels and exits if that's not possible. Lazy tunnels wait for their backend instead.
+func (manager *tunnelManager) start() {
+	config := manager.config
+	for i, port := range config.IPv4Ports {
+		name := tunnelName(port, config.IPv6Ports[i])
+
+		// Lazy tunnels bind once their backend is reachable, inherited sockets are bound already
+		if config.LazyListeners && !config.inherited.has(config.tunnelListenKey(port)) {
+			go manager.runLazy(name, port, config.IPv6Ports[i])
+			continue
+		}
+
+		manager.serve(config.mustListenTunnel(name, port), name, port, config.IPv6Ports[i])
+	}
+}
+
+// Closes all listeners and open connections, no tunnel can be opened afterwards
+func (manager *tunnelManager) stop() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.stopped = true
+	for port, listener := range manager.listeners {
+		listener.Close()
+		delete(manager.listeners, port)
+	}
+	for _, conns := range manager.conns {
+		for conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// Moves the listeners whose listen address changed, e.g. with the public IPv4 address, to the current one.
+// Their open connections keep running.
+func (manager *tunnelManager) reload() {
+	config := manager.config
+	for i, ipv4Port := range config.IPv4Ports {
+		listener, ok := manager.listener(ipv4Port)
+		if !ok {
+			continue
+		}
+
+		// Unix sockets and hostnames stay where they are
+		addr, err := netip.ParseAddr(config.tunnelListenAddr(ipv4Port))
+		bound, ok := listener.Addr().(*net.TCPAddr)
+		if err != nil || !ok || bound.AddrPort().Addr().Unmap() == addr.Unmap() {
+			continue
+		}
+
+		name := tunnelName(ipv4Port, config.IPv6Ports[i])
+		replacement, err := config.listen("tcp4", addr.String(), ipv4Port)
+		if err != nil {
+			config.logger().Error("Error moving the listener to its new address", slog.String("tunnel", name), slog.String("addr", addr.String()), slog.Any("error", err))
+			continue
+		}
+
+		manager.serve(replacement, name, ipv4Port, config.IPv6Ports[i])
+		listener.Close()
+	}
+}
+
+// Returns the open and total connections of the tunnel
+func (manager *tunnelManager) stats(tunnel string) (int64, uint64) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if count, ok := manager.counts[tunnel]; ok {
+		return count.active, count.total
+	}
+	return 0, 0
+}
+
+// Opens the listener of a tunnel and starts accepting its connections
+func (manager *tunnelManager) open(name, ipv4Port, ipv6Port string) error {
+	listener, err := manager.config.listenTunnel(ipv4Port)
+	if err != nil {
+		return err
+	}
+	manager.serve(listener, name, ipv4Port, ipv6Port)
+	return nil
+}
+
+// Returns the open listener of the tunnel
+func (manager *tunnelManager) listener(ipv4Port string) (net.Listener, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	listener, ok := manager.listeners[ipv4Port]
+	return listener, ok
+}
+
+// Closes the listener of the tunnel if it's open, its connections keep running
+func (manager *tunnelManager) close(ipv4Port string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if listener, ok := manager.listeners[ipv4Port]; ok {
+		listener.Close()
+		delete(manager.listeners, ipv4Port)
+	}
+}
+
+// Takes over the listener of a tunnel and accepts its connections in the background
+func (manager *tunnelManager) serve(listener net.Listener, name, ipv4Port, ipv6Port string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.stopped {
+		listener.Close()
+		return
+	}
+	manager.listeners[ipv4Port] = listener
+	go manager.accept(listener, name, ipv4Port, ipv6Port)
+}
+
+// Counts an open connection of the tunnel, the returned function must be called once it's closed.
+// Returns false if the manager was stopped and the connection must not be forwarded.
+func (manager *tunnelManager) track(tunnel string, conn net.Conn) (func(), bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.stopped {
+		return nil, false
+	}
+	count, ok := manager.counts[tunnel]
+	if !ok {
+		count = &connectionCount{}
+		manager.counts[tunnel] = count
+		manager.conns[tunnel] = make(map[net.Conn]struct{})
+	}
+	count.active++
+	count.total++
+	manager.conns[tunnel][conn] = struct{}{}
+
+	return func() {
+		manager.mu.Lock()
+		count.active--
+		delete(manager.conns[tunnel], conn)
+		manager.mu.Unlock()
+	}, true
+}
+
+// Accepts the connections of a tunnel and forwards them to its targets until the listener is closed
+func (manager *tunnelManager) accept(listener net.Listener, name, port, ipv6Port string) {
+	config := manager.config
+	logger := config.logger().With(slog.String("tunnel", name))
+
+	defer listener.Close()
+	addr := listener.Addr().String()
+	logger.Info("Listening for connections", slog.String("addr", addr))
+	config.notifications.record(Event{Type: EventTunnelOpened, Tunnel: name, ListenAddr: addr, Message: fmt.Sprintf("Tunnel %s is listening on %s", name, addr)})
+
+	for {
+		srcConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			config.notifications.record(Event{Type: EventTunnelClosed, Tunnel: name, ListenAddr: addr, Message: fmt.Sprintf("Tunnel %s stopped listening on %s", name, addr)})
+			return
+		}
+		if err != nil {
+			logger.Error("Error accepting connection", slog.Any("error", err))
+			continue
+		}
+
+		// Clients of unix sockets don't have an address
+		clientIP, _, _ := net.SplitHostPort(srcConn.RemoteAddr().String())
+		connLogger := logger.With(slog.String("client", srcConn.RemoteAddr().String()))
+		if clientIP != "" {
+			config.reverseDNS.observe(clientIP)
+		}
+
+		// Clients outside the tunnel's ACL are turned away before anything else
+		setting := config.tunnelSetting(port)
+		if !admitsClient(setting.allowedClients, setting.deniedClients, clientIP) {
+			connLogger.Debug("Rejecting connection outside the tunnel ACL")
+			resetConn(srcConn)
+			continue
+		}
+
+		// Clients of gated tunnels need a valid SPA packet first
+		if !config.spa.admits(port, clientIP) {
+			connLogger.Debug("Rejecting connection without SPA authorization")
+			resetConn(srcConn)
+			continue
+		}
+
+		// Failing fast beats letting every client wait for a backend that barely answers
+		slo := config.latencySLOs[port]
+		if !slo.admit(logger) {
+			connLogger.Debug("Shedding connection, the tunnel exceeds its latency SLO")
+			srcConn.Close()
+			continue
+		}
+		accepted := time.Now()
+
+		// Dial in the background, retries would hold up the other clients otherwise
+		go func() {
+			// Terminating tunnels forward the plain text, the client's handshake doesn't count toward the SLO
+			var tlvs []byte
+			if config.tls.handles(port) {
+				tlsConn, err := config.tls.handshake(srcConn)
+				if err != nil {
+					connLogger.Debug("Rejecting connection after a failed TLS handshake", slog.Any("error", err))
+					srcConn.Close()
+					return
+				}
+				srcConn, tlvs, accepted = tlsConn, tlsProxyTLVs(tlsConn.ConnectionState()), time.Now()
+			}
+
+			destConn, target, err := config.dialClient(context.Background(), name, port, ipv6Port, clientIP)
+			slo.record(logger, time.Since(accepted))
+			if err != nil {
+				connLogger.Error("Error dialing IPv6 target", slog.String("port", ipv6Port), slog.Any("error", err))
+				srcConn.Close()
+				return
+			}
+
+			closed, ok := manager.track(name, srcConn)
+			if !ok {
+				srcConn.Close()
+				destConn.Close()
+				return
+			}
+			defer closed()
+
+			// The backend learns the client and its certificate from the header, it only sees the relay otherwise
+			if setting.proxyProtocol != "" {
+				if _, err := destConn.Write(proxyHeader(setting.proxyProtocol, srcConn.RemoteAddr(), srcConn.LocalAddr(), tlvs)); err != nil {
+					connLogger.Error("Error sending the PROXY protocol header", slog.String("target", target), slog.Any("error", err))
+					srcConn.Close()
+					destConn.Close()
+					return
+				}
+			}
+
+			connLogger.Debug("Forwarding connection", slog.String("target", target), slog.String("port", ipv6Port))
+			config.protocolStats.recordConnection(name)
+			config.digest.recordConnection(name, clientIP)
+			start := time.Now()
+			var uploaded, downloaded int64
+			// FTP and SIP are plain text, they are never worth sniffing but have the limits of the tunnel like any other connection
+			switch {
+			case config.ftp.handles(port):
+				src, dst := config.limitTunnel(port, srcConn, destConn)
+				uploaded, downloaded = config.ftp.forward(name, port, clientIP, src, dst)
+			case config.sip.handles(port):
+				src, dst := config.limitTunnel(port, srcConn, destConn)
+				uploaded, downloaded = config.sip.forward(name, port, clientIP, src, dst)
+			default:
+				src, dst := config.protocolStats.sniff(name, srcConn, destConn)
+				src, dst = config.limitTunnel(port, src, dst)
+				uploaded, downloaded = config.forward(port, src, dst)
+			}
+			config.digest.recordTraffic(name, uploaded, downloaded)
+
+			attrs := []any{slog.Duration("duration", time.Since(start))}
+			if clientHost := config.reverseDNS.hostname(clientIP); clientHost != "" {
+				attrs = append(attrs, slog.String("client_host", clientHost))
+			}
+			connLogger.Info("Connection closed", attrs...)
+		}()
+	}
+}
+
+// Returns the key of an inherited socket for the tunnel, which is the port or the unix socket path
+func (config *Config) tunnelListenKey(ipv4Port string) string {
+	if path, ok := strings.CutPrefix(config.tunnelListenAddr(ipv4Port), "unix://"); ok {
+		return path
+	}
+	return ipv4Port
+}
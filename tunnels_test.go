@@ -0,0 +1,231 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Builds a relay configuration from the given environment with its state in a temporary data dir.
+// The tunnel manager, settings and health monitor are set up like serve does, nothing is started.
+func newTestConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	values := map[string]string{"WEBHOOK_TOKEN": "token", "SRC_LISTEN_ADDR": "127.0.0.1"}
+	maps.Copy(values, env)
+	config, err := newConfigFromEnv("", mapEnv(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.DataDir = t.TempDir()
+	config.FilePath = filepath.Join(config.DataDir, "ipv6_address.txt")
+	if config.state, err = newState("file", "", "", "", config.FilePath); err != nil {
+		t.Fatal(err)
+	}
+	config.settings = newTunnelSettings(config)
+	config.tunnels = newTunnelManager(config)
+	config.health = newHealthMonitor(config)
+	return config
+}
+
+// Returns a TCP port that was free a moment ago
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Starts a backend on the IPv6 loopback address that echoes everything back, returns its port
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Sends a message through the connection and checks that it comes back
+func expectEcho(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != message {
+		t.Fatalf("got %q back, want %q", buf, message)
+	}
+}
+
+// Waits until the tunnel has the expected connection counts
+func waitForStats(t *testing.T, manager *tunnelManager, tunnel string, active int64, total uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gotActive, gotTotal := manager.stats(tunnel)
+		if gotActive == active && gotTotal == total {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats(%s) = %d active, %d total, want %d and %d", tunnel, gotActive, gotTotal, active, total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Starts the tunnels of a relay that forwards a free port to an echo backend on ::1
+func startTestTunnel(t *testing.T) (*Config, string, string) {
+	t.Helper()
+	srcPort, destPort := freePort(t), startEchoBackend(t)
+	config := newTestConfig(t, map[string]string{"SRC_PORTS": srcPort, "DEST_PORTS": destPort})
+	config.storeIPv6Address("::1")
+	config.tunnels.start()
+	t.Cleanup(config.tunnels.stop)
+	return config, srcPort, tunnelName(srcPort, destPort)
+}
+
+func dialTunnel(t *testing.T, addr, port string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort(addr, port), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestTunnelManagerForwards(t *testing.T) {
+	config, srcPort, name := startTestTunnel(t)
+
+	first := dialTunnel(t, "127.0.0.1", srcPort)
+	expectEcho(t, first, "first")
+	second := dialTunnel(t, "127.0.0.1", srcPort)
+	expectEcho(t, second, "second")
+	waitForStats(t, config.tunnels, name, 2, 2)
+
+	first.Close()
+	waitForStats(t, config.tunnels, name, 1, 2)
+	second.Close()
+	waitForStats(t, config.tunnels, name, 0, 2)
+}
+
+func TestTunnelManagerStop(t *testing.T) {
+	config, srcPort, name := startTestTunnel(t)
+
+	conn := dialTunnel(t, "127.0.0.1", srcPort)
+	expectEcho(t, conn, "hello")
+	waitForStats(t, config.tunnels, name, 1, 1)
+
+	config.tunnels.stop()
+
+	// Open connections are closed and nothing listens anymore
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after stop = %v, want EOF", err)
+	}
+	if conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", srcPort), time.Second); err == nil {
+		conn.Close()
+		t.Error("the tunnel still accepts connections after stop")
+	}
+	waitForStats(t, config.tunnels, name, 0, 1)
+
+	// Listeners opened after stop, like lazy ones, are closed right away
+	if err := config.tunnels.open(name, srcPort, config.IPv6Ports[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.tunnels.listener(srcPort); ok {
+		t.Error("a listener was opened after stop")
+	}
+}
+
+func TestTunnelManagerReload(t *testing.T) {
+	config, srcPort, name := startTestTunnel(t)
+
+	conn := dialTunnel(t, "127.0.0.1", srcPort)
+	expectEcho(t, conn, "before")
+
+	// Unchanged listen addresses keep their listener
+	listener, _ := config.tunnels.listener(srcPort)
+	config.tunnels.reload()
+	if current, _ := config.tunnels.listener(srcPort); current != listener {
+		t.Fatal("reload replaced a listener whose address didn't change")
+	}
+
+	config.TunnelListenAddr = "127.0.0.2"
+	config.tunnels.reload()
+	current, ok := config.tunnels.listener(srcPort)
+	if !ok || current.Addr().String() != net.JoinHostPort("127.0.0.2", srcPort) {
+		t.Fatalf("listener after reload = %v", current)
+	}
+
+	// The listener moved, the open connection stays
+	moved := dialTunnel(t, "127.0.0.2", srcPort)
+	expectEcho(t, moved, "moved")
+	expectEcho(t, conn, "after")
+	waitForStats(t, config.tunnels, name, 2, 2)
+	if conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", srcPort), time.Second); err == nil {
+		conn.Close()
+		t.Error("the old address still accepts connections after reload")
+	}
+}
+
+func TestTunnelManagerTrack(t *testing.T) {
+	manager := newTunnelManager(&Config{})
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	closeFirst, ok := manager.track("web", first)
+	if !ok {
+		t.Fatal("track refused a connection")
+	}
+	closeSecond, _ := manager.track("web", second)
+	if active, total := manager.stats("web"); active != 2 || total != 2 {
+		t.Errorf("stats = %d active, %d total, want 2 and 2", active, total)
+	}
+	if active, total := manager.stats("ssh"); active != 0 || total != 0 {
+		t.Errorf("stats of an unused tunnel = %d active, %d total", active, total)
+	}
+
+	closeFirst()
+	if active, total := manager.stats("web"); active != 1 || total != 2 {
+		t.Errorf("stats = %d active, %d total, want 1 and 2", active, total)
+	}
+
+	// Stop closes the tracked connections and refuses new ones
+	manager.stop()
+	if _, err := second.Write([]byte("x")); err == nil {
+		t.Error("stop didn't close the tracked connection")
+	}
+	closeSecond()
+	if _, ok := manager.track("web", first); ok {
+		t.Error("track accepted a connection after stop")
+	}
+	if active, total := manager.stats("web"); active != 0 || total != 2 {
+		t.Errorf("stats = %d active, %d total, want 0 and 2", active, total)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the file in the data dir that holds the settings changed with PATCH /tunnels/{name}
+const tunnelSettingsFile = "tunnel_settings.json"
+
+// TunnelSettings are the settings of a tunnel that can be changed at runtime
+type TunnelSettings struct {
+	Tunnel       string `json:"tunnel"`
+	IdleTimeout  string `json:"idle_timeout"`
+	StallTimeout string `json:"stall_timeout"`
+	// Empty if the tunnel isn't limited
+	RateLimit string `json:"rate_limit"`
+	// Empty if the backend gets no PROXY protocol header
+	ProxyProtocol  string   `json:"proxy_protocol"`
+	AllowedClients []string `json:"allowed_clients"`
+	DeniedClients  []string `json:"denied_clients"`
+	// Settings that were changed at runtime instead of coming from the environment
+	Overridden []string `json:"overridden,omitempty"`
+}
+
+// Request body of PATCH /tunnels/{name} and the persisted overrides of a tunnel, fields that aren't set keep their value
+type tunnelOverride struct {
+	// Go duration, 0s disables the timeout
+	IdleTimeout  *string `json:"idle_timeout,omitempty"`
+	StallTimeout *string `json:"stall_timeout,omitempty"`
+	// Rate like 50Mbit, an empty string removes the limit
+	RateLimit *string `json:"rate_limit,omitempty"`
+	// v1 or v2, an empty string stops sending the header
+	ProxyProtocol *string `json:"proxy_protocol,omitempty"`
+	// Addresses and prefixes, an empty list removes the restriction
+	AllowedClients *[]string `json:"allowed_clients,omitempty"`
+	DeniedClients  *[]string `json:"denied_clients,omitempty"`
+}
+
+// Effective settings of a tunnel
+type tunnelSetting struct {
+	idleTimeout  time.Duration
+	stallTimeout time.Duration
+	rateLimit    *tunnelRateLimit
+	// Empty if no PROXY protocol header is sent
+	proxyProtocol  string
+	allowedClients []netip.Prefix
+	deniedClients  []netip.Prefix
+}
+
+// Runtime overrides of the tunnel settings, persisted in the data dir
+type tunnelSettings struct {
+	config *Config
+	path   string
+
+	mu sync.RWMutex
+	// Overrides and effective settings keyed by source port
+	overrides map[string]tunnelOverride
+	effective map[string]tunnelSetting
+}
+
+var errTunnelSettingsNotSaved = errors.New("failed to save the tunnel settings")
+
+func newTunnelSettings(config *Config) *tunnelSettings {
+	return &tunnelSettings{
+		config:    config,
+		path:      filepath.Join(config.DataDir, tunnelSettingsFile),
+		overrides: make(map[string]tunnelOverride),
+		effective: make(map[string]tunnelSetting),
+	}
+}
+
+// Loads the overrides from the data dir, a missing file means the environment applies unchanged.
+// Nothing is overridden if the file is invalid.
+func (settings *tunnelSettings) load() error {
+	data, err := os.ReadFile(settings.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var overrides map[string]tunnelOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return err
+	}
+	effective := make(map[string]tunnelSetting)
+	for ipv4Port, override := range overrides {
+		// Overrides of tunnels that were removed from the environment are kept in case they come back
+		if !slices.Contains(settings.config.IPv4Ports, ipv4Port) {
+			continue
+		}
+		setting, err := applyTunnelOverride(settings.config.envTunnelSetting(ipv4Port), override)
+		if err == nil {
+			err = settings.config.checkTunnelSetting(ipv4Port, setting)
+		}
+		if err != nil {
+			return fmt.Errorf("tunnel %s: %v", ipv4Port, err)
+		}
+		effective[ipv4Port] = setting
+	}
+
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	settings.overrides, settings.effective = overrides, effective
+	return nil
+}
+
+// Returns the settings of a tunnel as configured in the environment
+func (config *Config) envTunnelSetting(ipv4Port string) tunnelSetting {
+	return tunnelSetting{
+		idleTimeout:    config.IdleTimeout,
+		stallTimeout:   config.StallTimeout,
+		rateLimit:      config.rateLimits[ipv4Port],
+		proxyProtocol:  config.proxyProtocols[ipv4Port],
+		allowedClients: config.allowedClients[ipv4Port],
+		deniedClients:  config.deniedClients[ipv4Port],
+	}
+}
+
+// Applies the fields of an override to the settings
+func applyTunnelOverride(setting tunnelSetting, override tunnelOverride) (tunnelSetting, error) {
+	var err error
+	if override.IdleTimeout != nil {
+		if setting.idleTimeout, err = time.ParseDuration(*override.IdleTimeout); err != nil || setting.idleTimeout < 0 {
+			return tunnelSetting{}, fmt.Errorf("idle_timeout '%s' is not a duration like 5m, 0s disables it", *override.IdleTimeout)
+		}
+	}
+	if override.StallTimeout != nil {
+		if setting.stallTimeout, err = time.ParseDuration(*override.StallTimeout); err != nil || setting.stallTimeout < 0 {
+			return tunnelSetting{}, fmt.Errorf("stall_timeout '%s' is not a duration like 30s, 0s disables it", *override.StallTimeout)
+		}
+	}
+	if override.RateLimit != nil {
+		setting.rateLimit = nil
+		if *override.RateLimit != "" {
+			rate, err := parseRate(*override.RateLimit)
+			if err != nil {
+				return tunnelSetting{}, fmt.Errorf("rate_limit: %v", err)
+			}
+			setting.rateLimit = &tunnelRateLimit{limit: *override.RateLimit, upload: newRateLimiter(rate), download: newRateLimiter(rate)}
+		}
+	}
+	if override.ProxyProtocol != nil {
+		if setting.proxyProtocol, err = parseProxyProtocol(*override.ProxyProtocol); err != nil {
+			return tunnelSetting{}, fmt.Errorf("proxy_protocol: %v", err)
+		}
+	}
+	if override.AllowedClients != nil {
+		if setting.allowedClients, err = parseClientPrefixes(strings.Join(*override.AllowedClients, ",")); err != nil {
+			return tunnelSetting{}, fmt.Errorf("allowed_clients: %v", err)
+		}
+	}
+	if override.DeniedClients != nil {
+		if setting.deniedClients, err = parseClientPrefixes(strings.Join(*override.DeniedClients, ",")); err != nil {
+			return tunnelSetting{}, fmt.Errorf("denied_clients: %v", err)
+		}
+	}
+	return setting, nil
+}
+
+// Rejects settings that don't fit the rest of the tunnel's configuration
+func (config *Config) checkTunnelSetting(ipv4Port string, setting tunnelSetting) error {
+	// The client certificate of a terminating tunnel would be dropped without a v2 header
+	if config.tls.handles(ipv4Port) && setting.proxyProtocol != proxyProtocolV2 {
+		return fmt.Errorf("proxy_protocol: tunnel %s terminates TLS, it must send the client certificate with v2", ipv4Port)
+	}
+	return nil
+}
+
+// Returns the effective settings of a tunnel. Ports that aren't configured tunnels, like ephemeral tunnels, use the environment.
+func (config *Config) tunnelSetting(ipv4Port string) tunnelSetting {
+	if config.settings == nil {
+		return config.envTunnelSetting(ipv4Port)
+	}
+
+	config.settings.mu.RLock()
+	defer config.settings.mu.RUnlock()
+	return config.settings.lookup(ipv4Port)
+}
+
+// Returns the effective settings of a tunnel, must be called with the lock held
+func (settings *tunnelSettings) lookup(ipv4Port string) tunnelSetting {
+	if setting, ok := settings.effective[ipv4Port]; ok {
+		return setting
+	}
+	return settings.config.envTunnelSetting(ipv4Port)
+}
+
+// Changes the settings of a tunnel and saves them. New connections use them, open connections keep their settings.
+func (settings *tunnelSettings) update(ipv4Port string, patch tunnelOverride) error {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	override := settings.overrides[ipv4Port]
+	if patch.IdleTimeout != nil {
+		override.IdleTimeout = patch.IdleTimeout
+	}
+	if patch.StallTimeout != nil {
+		override.StallTimeout = patch.StallTimeout
+	}
+	if patch.RateLimit != nil {
+		override.RateLimit = patch.RateLimit
+	}
+	if patch.ProxyProtocol != nil {
+		override.ProxyProtocol = patch.ProxyProtocol
+	}
+	if patch.AllowedClients != nil {
+		override.AllowedClients = patch.AllowedClients
+	}
+	if patch.DeniedClients != nil {
+		override.DeniedClients = patch.DeniedClients
+	}
+
+	// An unchanged rate limit keeps its limiter, otherwise the PATCH would reset the buckets of the open connections
+	withoutRateLimit := patch
+	withoutRateLimit.RateLimit = nil
+	setting, err := applyTunnelOverride(settings.lookup(ipv4Port), withoutRateLimit)
+	if err != nil {
+		return err
+	}
+	if patch.RateLimit != nil && (setting.rateLimit == nil || setting.rateLimit.limit != *patch.RateLimit) {
+		if setting, err = applyTunnelOverride(setting, tunnelOverride{RateLimit: patch.RateLimit}); err != nil {
+			return err
+		}
+	}
+	if err := settings.config.checkTunnelSetting(ipv4Port, setting); err != nil {
+		return err
+	}
+
+	overrides := maps.Clone(settings.overrides)
+	if overrides == nil {
+		overrides = make(map[string]tunnelOverride)
+	}
+	overrides[ipv4Port] = override
+	if err := settings.save(overrides); err != nil {
+		return fmt.Errorf("%w: %v", errTunnelSettingsNotSaved, err)
+	}
+	settings.overrides = overrides
+	settings.effective[ipv4Port] = setting
+	return nil
+}
+
+// Writes the overrides to the data dir, must be called with the lock held
+func (settings *tunnelSettings) save(overrides map[string]tunnelOverride) error {
+	data, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(settings.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := settings.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, settings.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Returns the settings of a tunnel as shown by the API
+func (settings *tunnelSettings) describe(name, ipv4Port string) TunnelSettings {
+	setting := settings.config.tunnelSetting(ipv4Port)
+	described := TunnelSettings{
+		Tunnel:       name,
+		IdleTimeout:  setting.idleTimeout.String(),
+		StallTimeout: setting.stallTimeout.String(),
+	}
+	if setting.rateLimit != nil {
+		described.RateLimit = setting.rateLimit.limit
+	}
+	described.ProxyProtocol = setting.proxyProtocol
+	described.AllowedClients = formatClientPrefixes(setting.allowedClients)
+	described.DeniedClients = formatClientPrefixes(setting.deniedClients)
+
+	settings.mu.RLock()
+	defer settings.mu.RUnlock()
+	override := settings.overrides[ipv4Port]
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"idle_timeout", override.IdleTimeout != nil},
+		{"stall_timeout", override.StallTimeout != nil},
+		{"rate_limit", override.RateLimit != nil},
+		{"proxy_protocol", override.ProxyProtocol != nil},
+		{"allowed_clients", override.AllowedClients != nil},
+		{"denied_clients", override.DeniedClients != nil},
+	} {
+		if field.set {
+			described.Overridden = append(described.Overridden, field.name)
+		}
+	}
+	return described
+}
+
+// Shows and changes the settings of a tunnel, which is addressed by its name or source port
+func tunnelSettingsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFromContext(r.Context())
+
+		var ipv4Port, name string
+		for i, port := range config.IPv4Ports {
+			if tunnel := tunnelName(port, config.IPv6Ports[i]); r.PathValue("name") == tunnel || r.PathValue("name") == port {
+				ipv4Port, name = port, tunnel
+			}
+		}
+		if ipv4Port == "" {
+			http.Error(w, "Unknown tunnel", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPatch:
+			if config.ReadOnly {
+				logger.Warn("Refused tunnel settings change in read-only mode", slog.String("tunnel", name))
+				http.Error(w, "This instance is read-only, tunnels can't be changed", http.StatusForbidden)
+				return
+			}
+
+			var patch tunnelOverride
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10))
+			// A typo must not look like a successful change
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&patch); err != nil {
+				http.Error(w, fmt.Sprintf(`Invalid request: expected a JSON body like {"idle_timeout": "5m", "rate_limit": "50Mbit", "proxy_protocol": "v2", "allowed_clients": ["203.0.113.0/24"]}: %v.`, err), http.StatusBadRequest)
+				return
+			}
+
+			err := config.settings.update(ipv4Port, patch)
+			if errors.Is(err, errTunnelSettingsNotSaved) {
+				logger.Error("Error saving the tunnel settings", slog.String("tunnel", name), slog.Any("error", err))
+				http.Error(w, "Failed to save the tunnel settings", http.StatusInternalServerError)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid request: %v.", err), http.StatusBadRequest)
+				return
+			}
+			settings := config.settings.describe(name, ipv4Port)
+			logger.Info("Changed the tunnel settings", slog.String("tunnel", name), slog.String("idle_timeout", settings.IdleTimeout), slog.String("stall_timeout", settings.StallTimeout), slog.String("rate_limit", settings.RateLimit), slog.String("proxy_protocol", settings.ProxyProtocol), slog.Any("allowed_clients", settings.AllowedClients), slog.Any("denied_clients", settings.DeniedClients))
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(config.settings.describe(name, ipv4Port))
+	}
+}
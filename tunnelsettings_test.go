@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a request to the tunnel settings endpoint and returns the status and the settings it answered with
+func patchTunnel(t *testing.T, config *Config, port, body string) (int, TunnelSettings) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/tunnels/{name}", tunnelSettingsHandler(config))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPatch, "/tunnels/"+port, strings.NewReader(body)))
+
+	var settings TunnelSettings
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code, settings
+}
+
+func TestTunnelSettingsKeepTLSHeader(t *testing.T) {
+	srcPort := freePort(t)
+	config := newTestConfig(t, map[string]string{"SRC_PORTS": srcPort, "DEST_PORTS": "443", "TUNNEL_PROXY_PROTOCOL": srcPort + "=v2"})
+	config.tls = &tlsTerminator{ports: []string{srcPort}}
+
+	for _, body := range []string{`{"proxy_protocol": ""}`, `{"proxy_protocol": "v1"}`} {
+		if code, _ := patchTunnel(t, config, srcPort, body); code != http.StatusBadRequest {
+			t.Errorf("PATCH %s = %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+	if code, settings := patchTunnel(t, config, srcPort, `{"proxy_protocol": "v2", "idle_timeout": "1m"}`); code != http.StatusOK || settings.ProxyProtocol != "v2" {
+		t.Errorf("PATCH = %d, %+v", code, settings)
+	}
+}
+
+func TestTunnelSettingsProxyProtocolAndACL(t *testing.T) {
+	config, srcPort, _ := startTestTunnel(t)
+
+	code, settings := patchTunnel(t, config, srcPort, `{"proxy_protocol": "v1"}`)
+	if code != http.StatusOK || settings.ProxyProtocol != "v1" || !slices.Contains(settings.Overridden, "proxy_protocol") {
+		t.Fatalf("PATCH = %d, %+v", code, settings)
+	}
+
+	// The echo backend sends the header back, so the client sees what the backend got
+	conn := dialTunnel(t, "127.0.0.1", srcPort)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := conn.LocalAddr().(*net.TCPAddr)
+	if want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %s\r\n", client.Port, srcPort); header != want {
+		t.Errorf("backend got header %q, want %q", header, want)
+	}
+
+	code, settings = patchTunnel(t, config, srcPort, `{"allowed_clients": ["198.51.100.0/24", "127.0.0.1"], "denied_clients": ["127.0.0.0/8"]}`)
+	if code != http.StatusOK || !slices.Equal(settings.AllowedClients, []string{"198.51.100.0/24", "127.0.0.1"}) || !slices.Equal(settings.DeniedClients, []string{"127.0.0.0/8"}) {
+		t.Fatalf("PATCH = %d, %+v", code, settings)
+	}
+
+	// Denied clients are reset before anything is forwarded
+	refused := dialTunnel(t, "127.0.0.1", srcPort)
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := refused.Read(make([]byte, 64)); err == nil {
+		t.Errorf("a denied client read %d bytes", n)
+	}
+
+	// Invalid values change nothing
+	for _, body := range []string{`{"proxy_protocol": "v3"}`, `{"allowed_clients": ["example.com"]}`, `{"acl": []}`} {
+		if code, _ := patchTunnel(t, config, srcPort, body); code != http.StatusBadRequest {
+			t.Errorf("PATCH %s = %d, want 400", body, code)
+		}
+	}
+
+	// An empty string and an empty list remove the settings again
+	code, settings = patchTunnel(t, config, srcPort, `{"proxy_protocol": "", "denied_clients": []}`)
+	if code != http.StatusOK || settings.ProxyProtocol != "" || len(settings.DeniedClients) != 0 || len(settings.AllowedClients) != 2 {
+		t.Fatalf("PATCH = %d, %+v", code, settings)
+	}
+	expectEcho(t, dialTunnel(t, "127.0.0.1", srcPort), "allowed again")
+
+	// The overrides survive a restart
+	reloaded := newTunnelSettings(config)
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if setting := reloaded.lookup(srcPort); !slices.Equal(formatClientPrefixes(setting.allowedClients), settings.AllowedClients) || setting.proxyProtocol != "" || reloaded.overrides[srcPort].DeniedClients == nil {
+		t.Errorf("settings after a restart = %+v, overrides %+v", setting, reloaded.overrides[srcPort])
+	}
+}
+
+func TestTunnelSettingsApplyToFTP(t *testing.T) {
+	backendPort, _ := startFTPBackend(t)
+	config, srcPort := startFTPTunnel(t, backendPort, nil)
+	if code, _ := patchTunnel(t, config, srcPort, `{"idle_timeout": "200ms"}`); code != http.StatusOK {
+		t.Fatalf("PATCH = %d", code)
+	}
+
+	_, reader := dialFTP(t, srcPort)
+	start := time.Now()
+	if _, err := reader.ReadString('\n'); err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("idle control connection still open after %s: %v", time.Since(start), err)
+	}
+}